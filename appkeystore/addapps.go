@@ -0,0 +1,145 @@
+package appkeystore
+
+import (
+	"github.com/aefalcon/github-keystore-protobuf/go/appkeypb"
+	"github.com/aefalcon/go-github-keystore/kslog"
+	"github.com/aefalcon/go-github-keystore/messagestore"
+)
+
+// AddAppsRequest requests several apps be added to the data store at once
+type AddAppsRequest struct {
+	Apps    []*appkeypb.AddAppRequest
+	Partial bool // Add the apps which can be added even if others are rejected
+}
+
+// AddAppsResponse reports the outcome of an AddApps request.  Added lists the
+// apps added in request order, and Errors has the error of each app which was
+// not added.
+type AddAppsResponse struct {
+	Added  []uint64
+	Errors map[uint64]error
+}
+
+// AddApps adds several apps to the data store, as AddApp does each, updating
+// the application index once after all apps are written.  Every app is
+// validated before anything is written.  Unless req.Partial is set, the
+// request is aborted if any app is rejected or fails to be written: the index
+// is left unchanged and an *AppsRejected error is returned alongside the
+// response.  Documents of apps written before an abort are not indexed, and
+// may be cleaned up with RemoveApp.  With req.Partial the index references
+// every app which was written and failures are only reported in the response.
+func (s *AppKeyService) AddApps(req *AddAppsRequest, logger kslog.KsLogger) (*AddAppsResponse, error) {
+	defer s.lockWrites()()
+	resp := AddAppsResponse{
+		Added:  make([]uint64, 0, len(req.Apps)),
+		Errors: make(map[uint64]error),
+	}
+	index, _, err := s.Store.GetAppIndex()
+	if err != nil {
+		return nil, err
+	}
+	apps := make([]*appkeypb.App, 0, len(req.Apps))
+	appReqs := make([]*appkeypb.AddAppRequest, 0, len(req.Apps))
+	requested := make(map[uint64]int, len(req.Apps))
+	for _, appReq := range req.Apps {
+		requested[appReq.App]++
+	}
+	for _, appReq := range req.Apps {
+		if requested[appReq.App] > 1 {
+			// Neither request of a repeated app is added, since they may differ
+			logger.Logf("App %d requested more than once", appReq.App)
+			resp.Errors[appReq.App] = AppExists(appReq.App)
+			continue
+		}
+		app, err := s.validateNewApp(index, appReq, logger)
+		if err != nil {
+			resp.Errors[appReq.App] = err
+			continue
+		}
+		apps = append(apps, app)
+		appReqs = append(appReqs, appReq)
+	}
+	if len(resp.Errors) > 0 && !req.Partial {
+		logger.Logf("Aborting adding apps: %d of %d rejected", len(resp.Errors), len(req.Apps))
+		return &resp, &AppsRejected{resp.Errors}
+	}
+	for i, app := range apps {
+		err = s.writeApp(app, appReqs[i].Keys, logger)
+		if err != nil {
+			logger.Logf("Failed to write app %d: %s", app.Id, err)
+			resp.Errors[app.Id] = err
+			continue
+		}
+		resp.Added = append(resp.Added, app.Id)
+	}
+	if len(resp.Errors) > 0 && !req.Partial {
+		logger.Logf("Aborting adding apps: %d of %d failed", len(resp.Errors), len(req.Apps))
+		resp.Added = resp.Added[:0]
+		return &resp, &AppsRejected{resp.Errors}
+	}
+	if len(resp.Added) == 0 {
+		return &resp, nil
+	}
+	if index.AppRefs == nil {
+		index.AppRefs = make(map[uint64]*appkeypb.AppIndexEntry)
+	}
+	for _, app := range resp.Added {
+		index.AppRefs[app] = &appkeypb.AppIndexEntry{
+			Id: app,
+		}
+	}
+	_, err = s.Store.PutAppIndex(index)
+	if err != nil {
+		logger.Logf("Failed to put application index: %s", err)
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// validateNewApp checks an app of an AddApps request may be added, getting
+// the document describing it
+func (s *AppKeyService) validateNewApp(index *appkeypb.AppIndex, req *appkeypb.AddAppRequest, logger kslog.KsLogger) (*appkeypb.App, error) {
+	err := s.checkApp(req.App, logger)
+	if err != nil {
+		return nil, err
+	}
+	_, _, err = s.Store.GetApp(req.App)
+	if err == nil {
+		logger.Logf("App %d already exists", req.App)
+		return nil, AppExists(req.App)
+	} else if !messagestore.IsNotFound(err) {
+		logger.Logf("Failed to check for existing app %d: %s", req.App, err)
+		return nil, err
+	}
+	if _, found := index.AppRefs[req.App]; found {
+		logger.Logf("App %d already exists", req.App)
+		return nil, AppExists(req.App)
+	}
+	app := appkeypb.App{
+		Id: req.App,
+	}
+	if len(req.Keys) > 0 {
+		err = s.addKeysToApp(&app, req.Keys)
+		if err != nil {
+			logger.Logf("Rejecting keys of app %d: %s", req.App, err)
+			return nil, err
+		}
+		if err = s.checkKeyCount(req.App, len(app.Keys)); err != nil {
+			logger.Logf("Rejecting keys of app %d: %s", req.App, err)
+			return nil, err
+		}
+	}
+	return &app, nil
+}
+
+// writeApp puts the keys and document of a validated app
+func (s *AppKeyService) writeApp(app *appkeypb.App, keys []*appkeypb.AppKey, logger kslog.KsLogger) error {
+	if len(keys) > 0 {
+		err := storeKeys(s.Store, app.Id, keys, s.keyWorkers(), logger)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := s.Store.PutApp(app)
+	return tolerateHistory(err, logger)
+}
@@ -4,12 +4,12 @@ package appkeystore
 
 import (
 	"crypto"
-	"crypto/rsa"
-	"crypto/sha256"
-	"encoding/base64"
-	"encoding/json"
+	"crypto/rand"
 	"fmt"
+	"io"
+	"sort"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/aefalcon/github-keystore-protobuf/go/appkeypb"
@@ -17,12 +17,53 @@ import (
 	"github.com/aefalcon/go-github-keystore/keyutils"
 	"github.com/aefalcon/go-github-keystore/kslog"
 	"github.com/aefalcon/go-github-keystore/messagestore"
+	"github.com/aefalcon/go-github-keystore/metrics"
 	"github.com/aefalcon/go-github-keystore/timeutils"
-	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
 	structpb "github.com/golang/protobuf/ptypes/struct"
-	"github.com/jtacoma/uritemplates"
 )
 
+// DEFAULT_JWT_TYPE is the `typ` header of signed JWTs unless configured
+// otherwise
+const DEFAULT_JWT_TYPE = "JWT"
+
+// GITHUB_MAX_JWT_LIFETIME is the furthest in the future github accepts the
+// `exp` claim of an app JWT
+const GITHUB_MAX_JWT_LIFETIME = 10 * time.Minute
+
+// DEFAULT_JWT_LIFETIME is the lifetime of a filled in `exp` claim unless
+// configured otherwise, leaving a margin below GITHUB_MAX_JWT_LIFETIME for
+// clock drift
+const DEFAULT_JWT_LIFETIME = 9 * time.Minute
+
+// ClaimsValidation is the strictness with which SignJwt validates claims
+type ClaimsValidation int
+
+const (
+	// CLAIMS_STRICT requires `iss` to name the app, `exp` to be in the future
+	// but no later than the maximum JWT lifetime, a sane `nbf` and numeric `iat`
+	CLAIMS_STRICT ClaimsValidation = iota
+	// CLAIMS_UNCHECKED signs claims as given
+	CLAIMS_UNCHECKED
+)
+
+// MAX_APP_UPDATE_ATTEMPTS is the number of times an update of an application
+// is attempted when it conflicts with another writer
+const MAX_APP_UPDATE_ATTEMPTS = 5
+
+// KID_CLAIM is the claim identifying the fingerprint of the key that signed
+// a JWT
+const KID_CLAIM = "com.mobettersoftware.auth-kid"
+
+// DEFAULT_LIFETIME_METADATA is the user metadata of an app document
+// recording the lifetime of `exp` claims filled in for the app, as given to
+// AddAppWithOptions, in time.Duration format
+const DEFAULT_LIFETIME_METADATA = "default-lifetime"
+
+// DEFAULT_KEY_WORKERS is the number of keys AddApp validates and writes
+// concurrently unless configured otherwise
+const DEFAULT_KEY_WORKERS = 4
+
 // StoreBackend is the interface that must be implemented by a storage
 // system to be used by AppKeyStore.
 type StoreBackend interface {
@@ -32,8 +73,10 @@ type StoreBackend interface {
 
 // AppKeyStore manages a list of applications and their keys
 type AppKeyStore struct {
-	StoreBackend                // Storage system
-	Links        appkeypb.Links // Definitions of paths in the store
+	StoreBackend                  // Storage system
+	Links        appkeypb.Links   // Definitions of paths in the store
+	History      bool             // Keep a copy of every version of app documents put, listed by GetAppHistory
+	Clock        func() time.Time // Current time of history copies; defaults to time.Now
 }
 
 // NewAppKeyStore allocates a new AppKeyStore.  Generally nil should be
@@ -49,24 +92,61 @@ func NewAppKeyStore(backend StoreBackend, links *appkeypb.Links) *AppKeyStore {
 }
 
 // InitDb initializes an empty database.  This must be called before
-// database use.
+// database use.  It is idempotent: an existing application index is left
+// untouched, and application documents are never written, so it is safe to
+// call against a populated database, such as on every start of a service.
 func (s *AppKeyStore) InitDb(logger kslog.KsLogger) error {
+	_, _, err := s.GetAppIndex()
+	if err == nil {
+		logger.Debug("Application index already exists")
+		return nil
+	} else if !messagestore.IsNotFound(err) {
+		logger.Errorf("Failed to get application index: %s", err)
+		return err
+	}
+	name, err := s.appIndexName()
+	if err != nil {
+		return err
+	}
 	var index appkeypb.AppIndex
-	_, err := s.PutAppIndex(&index)
+	// Create the index only if it still does not exist, so an index created
+	// concurrently, perhaps with apps already added, is not replaced
+	_, err = messagestore.PutMessageIfMatch(s.StoreBackend, name, &index, nil)
+	if _, ok := err.(messagestore.ConditionalUnsupported); ok {
+		_, err = s.PutAppIndex(&index)
+	} else if messagestore.IsConflict(err) {
+		logger.Debug("Application index was created concurrently")
+		return nil
+	}
 	if err != nil {
 		logger.Error("Failed to put application index")
 	}
 	return err
 }
 
+// Healthy checks that the store is reachable and has been initialized.  A
+// *messagestore.StoreUnreachable or DbNotInitialized error describes why not.
+func (s *AppKeyStore) Healthy(logger kslog.KsLogger) error {
+	err := messagestore.Ping(s.StoreBackend, logger)
+	if err != nil {
+		return err
+	}
+	_, _, err = s.GetAppIndex()
+	if messagestore.IsNotFound(err) {
+		name, _ := s.appIndexName()
+		logger.Errorf("Application index %s does not exist", name)
+		return DbNotInitialized(name)
+	} else if err != nil {
+		logger.Errorf("Failed to get application index: %s", err)
+		return err
+	}
+	return nil
+}
+
 // appIndexName gets the name of the applicatoin index within the
 // storage system
 func (s *AppKeyStore) appIndexName() (string, error) {
-	uritmpl, err := uritemplates.Parse(s.Links.AppIndex)
-	if err != nil {
-		return "", err
-	}
-	return uritmpl.Expand(map[string]interface{}{})
+	return messagestore.ExpandName(s.Links.AppIndex, map[string]interface{}{})
 }
 
 // GetAppIndex fetches the applicatoin index from storage
@@ -101,14 +181,11 @@ func (s *AppKeyStore) DeleteAppIndex() (*messagestore.CacheMeta, error) {
 // appName gets the name of the document describing an application within the
 // storage system
 func (s *AppKeyStore) appName(appId uint64) (string, error) {
-	uritmpl, err := uritemplates.Parse(s.Links.App)
-	if err != nil {
-		return "", err
-	}
-	return uritmpl.Expand(map[string]interface{}{"AppId": appId})
+	return messagestore.ExpandName(s.Links.App, map[string]interface{}{"AppId": appId})
 }
 
-// GetApp fetches the document describing an application from storage
+// GetApp fetches the document describing an application from storage.  A
+// document of the LegacyApp layout is read as an app with its one key.
 func (s *AppKeyStore) GetApp(appId uint64) (*appkeypb.App, *messagestore.CacheMeta, error) {
 	name, err := s.appName(appId)
 	if err != nil {
@@ -116,16 +193,82 @@ func (s *AppKeyStore) GetApp(appId uint64) (*appkeypb.App, *messagestore.CacheMe
 	}
 	var app appkeypb.App
 	meta, err := s.GetMessage(name, &app)
+	if err == nil && len(app.Keys) == 0 {
+		s.upgradeLegacyApp(name, &app)
+	}
 	return &app, meta, err
 }
 
-// PutApp creates or replaces the document describing an application in storage
+// PutApp creates or replaces the document describing an application in
+// storage.  With History, a copy of the document is also kept; if it cannot
+// be, the document is still put and a *HistoryNotRecorded error is returned
+// with its metadata.
 func (s *AppKeyStore) PutApp(app *appkeypb.App) (*messagestore.CacheMeta, error) {
 	name, err := s.appName(app.Id)
 	if err != nil {
 		return nil, err
 	}
-	return s.PutMessage(name, app)
+	meta, err := s.PutMessage(name, app)
+	if err != nil {
+		return nil, err
+	}
+	return meta, s.recordAppHistory(app)
+}
+
+// PutAppWithMetadata puts the document describing an application like
+// PutApp, along with user metadata.  If the backend is not a
+// messagestore.MetadataMessageStore, or metadata is empty, the document is put
+// without it.
+func (s *AppKeyStore) PutAppWithMetadata(app *appkeypb.App, metadata map[string]string) (*messagestore.CacheMeta, error) {
+	metaStore, ok := s.StoreBackend.(messagestore.MetadataMessageStore)
+	if !ok || len(metadata) == 0 {
+		return s.PutApp(app)
+	}
+	name, err := s.appName(app.Id)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := metaStore.PutMessageWithMetadata(name, app, metadata)
+	if err != nil {
+		return nil, err
+	}
+	return meta, s.recordAppHistory(app)
+}
+
+// PutAppIfMatch replaces the document describing an application only if the
+// stored document is the version described by meta.  It fails with
+// messagestore.ConditionalUnsupported if the backend cannot put conditionally.
+// History is kept as by PutApp.
+func (s *AppKeyStore) PutAppIfMatch(app *appkeypb.App, meta *messagestore.CacheMeta) (*messagestore.CacheMeta, error) {
+	name, err := s.appName(app.Id)
+	if err != nil {
+		return nil, err
+	}
+	putMeta, err := messagestore.PutMessageIfMatch(s.StoreBackend, name, app, meta)
+	if err != nil {
+		return nil, err
+	}
+	return putMeta, s.recordAppHistory(app)
+}
+
+// PutAppIfMatchWithMetadata replaces the document describing an application
+// along with user metadata, such as that of lifetimeMetadata, only if the
+// stored document is the version described by meta.  It fails with
+// messagestore.ConditionalUnsupported if the backend cannot put conditionally
+// with metadata.  Without metadata, the app is put as by PutAppIfMatch.
+func (s *AppKeyStore) PutAppIfMatchWithMetadata(app *appkeypb.App, meta *messagestore.CacheMeta, metadata map[string]string) (*messagestore.CacheMeta, error) {
+	if len(metadata) == 0 {
+		return s.PutAppIfMatch(app, meta)
+	}
+	name, err := s.appName(app.Id)
+	if err != nil {
+		return nil, err
+	}
+	putMeta, err := messagestore.PutMessageIfMatchWithMetadata(s.StoreBackend, name, app, meta, metadata)
+	if err != nil {
+		return nil, err
+	}
+	return putMeta, s.recordAppHistory(app)
 }
 
 // DeleteApp removes the document describing an application from storage
@@ -140,11 +283,7 @@ func (s *AppKeyStore) DeleteApp(appId uint64) (*messagestore.CacheMeta, error) {
 // keyName gets the name of an RSA key for a certain application within the
 // storage system
 func (s *AppKeyStore) keyName(appId uint64, fingerprint string) (string, error) {
-	uritmpl, err := uritemplates.Parse(s.Links.Key)
-	if err != nil {
-		return "", err
-	}
-	return uritmpl.Expand(map[string]interface{}{"AppId": appId, "Fingerprint": fingerprint})
+	return messagestore.ExpandName(s.Links.Key, map[string]interface{}{"AppId": appId, "Fingerprint": fingerprint})
 }
 
 // GetKey loads the key for a specified app given the key's finger print.
@@ -153,16 +292,32 @@ func (s *AppKeyStore) GetKey(appId uint64, fingerprint string) ([]byte, *message
 	if err != nil {
 		return nil, nil, err
 	}
-	return s.GetBlob(name)
+	return messagestore.GetSealedBlob(s.StoreBackend, name)
+}
+
+// GetKeys loads several keys of an app at once.  If some keys fail, the error
+// is a *messagestore.BatchError.
+func (s *AppKeyStore) GetKeys(appId uint64, fingerprints []string) ([][]byte, error) {
+	names := make([]string, len(fingerprints))
+	for i, fingerprint := range fingerprints {
+		var err error
+		names[i], err = s.keyName(appId, fingerprint)
+		if err != nil {
+			return nil, err
+		}
+	}
+	keys, _, err := messagestore.GetSealedBlobs(s.StoreBackend, names)
+	return keys, err
 }
 
-// PutKey stores a key for an app using a specified fingerprint.
+// PutKey stores a key for an app using a specified fingerprint.  The key is
+// encrypted if the backend is a messagestore.SealingBlobStore with a Cipher.
 func (s *AppKeyStore) PutKey(app uint64, fingerprint string, key []byte) (*messagestore.CacheMeta, error) {
 	name, err := s.keyName(app, fingerprint)
 	if err != nil {
 		return nil, err
 	}
-	return s.PutBlob(name, key)
+	return messagestore.PutSealedBlob(s.StoreBackend, name, key)
 }
 
 // DeleteKey removes the key specified by fingerprint from an app
@@ -174,14 +329,19 @@ func (s *AppKeyStore) DeleteKey(appId uint64, fingerprint string) (*messagestore
 	return s.DeleteBlob(name)
 }
 
+// DeleteKeyExisted deletes a key from the store, reporting whether it existed
+func (s *AppKeyStore) DeleteKeyExisted(appId uint64, fingerprint string) (bool, error) {
+	name, err := s.keyName(appId, fingerprint)
+	if err != nil {
+		return false, err
+	}
+	return messagestore.DeleteBlob(s.StoreBackend, name)
+}
+
 // kyeMetaName gets the name used to reference an RSA key metadata for
 // a particular RSA key and application
 func (s *AppKeyStore) keyMetaName(appId uint64, fingerprint string) (string, error) {
-	uritmpl, err := uritemplates.Parse(s.Links.KeyMeta)
-	if err != nil {
-		return "", err
-	}
-	return uritmpl.Expand(map[string]interface{}{"AppId": appId, "Fingerprint": fingerprint})
+	return messagestore.ExpandName(s.Links.KeyMeta, map[string]interface{}{"AppId": appId, "Fingerprint": fingerprint})
 }
 
 // GetKeyMeta fetches key metadata for an applications key, identified by fingerprint
@@ -213,10 +373,50 @@ func (s *AppKeyStore) DeleteKeyMeta(appId uint64, fingerprint string) (*messages
 	return s.DeleteBlob(name)
 }
 
+// DeleteKeyMetaExisted deletes key metadata from the store, reporting whether
+// it existed
+func (s *AppKeyStore) DeleteKeyMetaExisted(appId uint64, fingerprint string) (bool, error) {
+	name, err := s.keyMetaName(appId, fingerprint)
+	if err != nil {
+		return false, err
+	}
+	return messagestore.DeleteBlob(s.StoreBackend, name)
+}
+
 // AppKeyService performs high level functions on data stored in an
-// AppKeyStore
+// AppKeyStore.  It is safe for concurrent use once configured, provided its
+// store is: reads such as SignJwt and GetApp run concurrently, while changes
+// such as AddApp and RemoveApp are serialized, so changes made through one
+// service never overwrite each other's updates of the application index.
+// Services sharing a store from other processes are not serialized.
 type AppKeyService struct {
-	Store *AppKeyStore
+	Store             *AppKeyStore
+	Fingerprint       keyutils.FingerprintFunc   // Derives fingerprints of added keys; defaults to keyutils.SignerFingerprint
+	JwtType           string                     // `typ` header of signed JWTs; defaults to DEFAULT_JWT_TYPE
+	Claims            ClaimsValidation           // Validation of claims to sign; defaults to CLAIMS_STRICT
+	MaxLifetime       time.Duration              // Furthest in the future `exp` may be; defaults to GITHUB_MAX_JWT_LIFETIME
+	Metrics           metrics.Metrics            // Receives counts and latencies of AddApp and SignJwt, if set
+	KeyCacheSize      int                        // Parsed keys cached for signing; defaults to DEFAULT_KEY_CACHE_SIZE, or none if negative
+	KMS               keyutils.KMSAPI            // Signs with keys stored as KMS key references; required to use them
+	Secrets           keyutils.SecretsManagerAPI // Resolves keys stored as Secrets Manager references; required to use them
+	SecretCacheTTL    time.Duration              // How long resolved secret keys are cached; defaults to DEFAULT_SECRET_CACHE_TTL, or not cached if negative
+	RateLimiter       *SigningLimiter            // Limits the rate each app signs JWTs, if set
+	AppPolicy         keyservice.AppPolicy       // Decides which apps may be added and sign JWTs, if set
+	KeyWorkers        int                        // Keys AddApp validates and writes concurrently; defaults to DEFAULT_KEY_WORKERS
+	DefaultClaims     bool                       // Fill in `iat`, `exp` and `iss` when absent from claims to sign
+	DefaultLifetime   time.Duration              // Lifetime of a filled in `exp`; defaults to DEFAULT_JWT_LIFETIME, capped at MaxLifetime and GITHUB_MAX_JWT_LIFETIME
+	RotationOverlap   time.Duration              // How long a deprecated key may still sign when named; defaults to DEFAULT_ROTATION_OVERLAP, or never if negative
+	LenientKeys       bool                       // Sign with any usable key when the named key does not exist or is deprecated beyond the RotationOverlap
+	AllowedAlgorithms []string                   // Algorithms SignJwt accepts; DEFAULT_ALLOWED_ALGORITHMS if empty
+	Clock             func() time.Time           // Current time of signed and verified claims, such as a timeutils.Clock's Now; defaults to time.Now
+	Rand              io.Reader                  // Randomness given to signers, such as HSM-backed crypto.Signers; defaults to crypto/rand.Reader
+	AppLockTTL        time.Duration              // Lock an app across processes while changing its keys, expiring after this long, if set
+	AppLockWait       time.Duration              // How long to wait for an app locked by another process; fail immediately if 0
+	MaxKeysPerApp     int                        // Keys an app may have; unlimited if 0
+	PruneDeprecated   bool                       // Make room for keys AddKey adds beyond MaxKeysPerApp by removing the keys deprecated longest ago
+	keys              keyCache
+	secrets           secretCache
+	writes            sync.Mutex
 }
 
 // NewAppKeyService allocates a new app key store.  The arguments are passed
@@ -227,63 +427,228 @@ func NewAppKeyService(backend StoreBackend, links *appkeypb.Links) *AppKeyServic
 	}
 }
 
+// NewInMemory allocates an AppKeyService with an initialized in-memory store
+// and default configuration, for local development and examples.  Nothing
+// stored in it is durable; all apps and keys are lost with the service.
+func NewInMemory() (*AppKeyService, error) {
+	service := NewAppKeyService(messagestore.NewMemMessageStore(), nil)
+	if err := service.Store.InitDb(kslog.DefaultLogger{}); err != nil {
+		return nil, err
+	}
+	return service, nil
+}
+
+// Healthy checks that the service's store is reachable and initialized, for
+// use at startup and by health checks
+func (s *AppKeyService) Healthy(logger kslog.KsLogger) error {
+	return s.Store.Healthy(logger)
+}
+
 // Guarantee AppKeyService implements needed interfaces
 var _ keyservice.ManagerService = &AppKeyService{}
 var _ keyservice.SigningService = &AppKeyService{}
 
-// addKeysToApp adds a list of keys to an appkeypb.AppKey key index
-func addKeysToApp(app *appkeypb.App, keys []*appkeypb.AppKey) error {
-	app.Keys = make(map[string]*appkeypb.AppKeyIndexEntry, len(keys))
-	for _, key := range keys {
-		rsaKey, err := keyutils.ParsePrivateKey(key.Key)
-		if err != nil {
-			return err
+// fingerprintFunc gets the function used to derive fingerprints of keys
+func (s *AppKeyService) fingerprintFunc() keyutils.FingerprintFunc {
+	if s.Fingerprint == nil {
+		return keyutils.SignerFingerprint
+	}
+	return s.Fingerprint
+}
+
+// checkKeyFingerprint parses the key at index of a request and derives its
+// fingerprint.  If the key's metadata states a fingerprint it must match,
+// otherwise the derived one is set.  Keys referencing a secret are resolved
+// first.  An *InvalidKey error is returned if the key cannot be parsed, other
+// than for lack of a KMS client.
+func (s *AppKeyService) checkKeyFingerprint(index int, key *appkeypb.AppKey) error {
+	resolved, err := s.resolveKey(key.Key)
+	if err != nil {
+		return err
+	}
+	signer, err := keyutils.ParseSigner(resolved, s.KMS)
+	if _, noClient := err.(keyutils.NoKMSClient); noClient {
+		return err
+	} else if err != nil {
+		invalid := InvalidKey{
+			Index: index,
+			Cause: err,
 		}
-		fingerprint, err := keyutils.KeyFingerprint(rsaKey)
-		if err != nil {
-			return err
+		if key.Meta != nil {
+			invalid.Fingerprint = key.Meta.Fingerprint
 		}
-		if key.Meta.Fingerprint != fingerprint {
-			return &FingerprintMismatch{
-				Given:   key.Meta.Fingerprint,
-				Derived: fingerprint,
+		return &invalid
+	}
+	fingerprint, err := s.fingerprintFunc()(signer)
+	if err != nil {
+		return err
+	}
+	if key.Meta == nil {
+		key.Meta = &appkeypb.AppKeyMeta{}
+	}
+	if key.Meta.Fingerprint == "" {
+		key.Meta.Fingerprint = fingerprint
+	} else if key.Meta.Fingerprint != fingerprint {
+		return &FingerprintMismatch{
+			Given:   key.Meta.Fingerprint,
+			Derived: fingerprint,
+		}
+	}
+	return nil
+}
+
+func (s *AppKeyService) keyWorkers() int {
+	if s.KeyWorkers <= 0 {
+		return DEFAULT_KEY_WORKERS
+	}
+	return s.KeyWorkers
+}
+
+// forEachKey calls f with the index of each of n keys, with at most workers
+// calls in progress at once.  The error of each call is returned by index.
+func forEachKey(n int, workers int, f func(i int) error) []error {
+	errs := make([]error, n)
+	if workers > n {
+		workers = n
+	}
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				errs[i] = f(i)
 			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+	return errs
+}
+
+// addKeysToApp adds a list of keys to an appkeypb.AppKey key index.  Each key
+// must parse, and the fingerprint its metadata states must match the one
+// derived from the key.  Keys are checked concurrently by up to KeyWorkers
+// goroutines, so the Fingerprint function must be safe for concurrent use.
+// If a single key is invalid its error is returned, while several invalid
+// keys are reported together by an *InvalidKeys error.
+func (s *AppKeyService) addKeysToApp(app *appkeypb.App, keys []*appkeypb.AppKey) error {
+	errs := forEachKey(len(keys), s.keyWorkers(), func(i int) error {
+		return s.checkKeyFingerprint(i, keys[i])
+	})
+	invalid := make([]error, 0)
+	for _, err := range errs {
+		if err != nil {
+			invalid = append(invalid, err)
 		}
-		app.Keys[fingerprint] = &appkeypb.AppKeyIndexEntry{
+	}
+	if len(invalid) == 1 {
+		return invalid[0]
+	} else if len(invalid) > 1 {
+		return &InvalidKeys{invalid}
+	}
+	app.Keys = make(map[string]*appkeypb.AppKeyIndexEntry, len(keys))
+	for _, key := range keys {
+		app.Keys[key.Meta.Fingerprint] = &appkeypb.AppKeyIndexEntry{
 			Meta: key.Meta,
 		}
 	}
 	return nil
 }
 
-// storeKeys puts keys for an app in the key store
-func (s *AppKeyService) storeKeys(app uint64, keys []*appkeypb.AppKey, logger kslog.KsLogger) error {
-	for _, key := range keys {
-		_, err := s.Store.PutKey(app, key.Meta.Fingerprint, key.Key)
+// storeKeys puts keys for an app in the key store, writing up to workers
+// keys concurrently.  The error of the first key which failed is returned.
+func storeKeys(store *AppKeyStore, app uint64, keys []*appkeypb.AppKey, workers int, logger kslog.KsLogger) error {
+	errs := forEachKey(len(keys), workers, func(i int) error {
+		key := keys[i]
+		_, err := store.PutKey(app, key.Meta.Fingerprint, key.Key)
 		if err != nil {
 			logger.Logf("Failed to put key in store: %s", err)
 			return err
 		}
-		_, err = s.Store.PutKeyMeta(key.Meta)
+		// Metadata is put under the app even if the request's metadata names
+		// no app, so it is found and removed along with the key
+		meta := proto.Clone(key.Meta).(*appkeypb.AppKeyMeta)
+		meta.App = app
+		_, err = store.PutKeyMeta(meta)
 		if err != nil {
 			logger.Logf("Failed to put key metadata in store: %s", err)
 			return err
 		}
+		return nil
+	})
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-// AddApp adds an app to the data store, including it in the application index
+// AddAppOptions modifies how AddAppWithOptions adds an app
+type AddAppOptions struct {
+	Overwrite       bool          // Replace an existing app and its keys instead of failing
+	DryRun          bool          // Log the documents which would be written or deleted without changing the store
+	DefaultLifetime time.Duration // Lifetime of `exp` claims filled in for the app, overriding the service's DefaultLifetime, if set
+}
+
+// AddApp adds an app to the data store, including it in the application
+// index.  An AppExists error is returned if the app already exists, and a
+// *TooManyKeys error if it has more than MaxKeysPerApp keys.  The index is
+// put only once the keys and app document are written; if any write fails,
+// the documents already written for the app are removed as well as possible
+// before the error is returned, so adding the app may be retried.
 func (s *AppKeyService) AddApp(req *appkeypb.AddAppRequest, logger kslog.KsLogger) (*appkeypb.AddAppResponse, error) {
-	if req.App == 0 {
-		logger.Errorf("Attempted to add app %d", req.App)
-		return nil, UnallowedAppId(req.App)
+	return s.AddAppWithOptions(req, AddAppOptions{}, logger)
+}
+
+// AddAppWithOptions adds an app to the data store like AddApp.  With
+// opts.Overwrite an existing app is replaced, removing keys not in req.  With
+// opts.DryRun the store is left unchanged and each document which would be
+// written or deleted is logged instead.  With opts.DefaultLifetime, the
+// lifetime is recorded in the user metadata of the app document, so a
+// LifetimeUnsupported error is returned, before anything is written, if the
+// backend is not a messagestore.MetadataMessageStore.
+func (s *AppKeyService) AddAppWithOptions(req *appkeypb.AddAppRequest, opts AddAppOptions, logger kslog.KsLogger) (*appkeypb.AddAppResponse, error) {
+	defer s.lockWrites()()
+	start := time.Now()
+	resp, err := s.addApp(req, opts, logger)
+	metrics.Record(s.Metrics, metrics.METRIC_ADD_APP, start, err)
+	return resp, err
+}
+
+func (s *AppKeyService) addApp(req *appkeypb.AddAppRequest, opts AddAppOptions, logger kslog.KsLogger) (*appkeypb.AddAppResponse, error) {
+	err := s.checkApp(req.App, logger)
+	if err != nil {
+		return nil, err
 	}
-	index, _, err := s.Store.GetAppIndex()
+	if opts.DefaultLifetime > 0 {
+		if _, ok := s.Store.StoreBackend.(messagestore.MetadataMessageStore); !ok {
+			logger.Logf("Rejecting default lifetime of app %d: backend %T cannot record metadata", req.App, s.Store.StoreBackend)
+			return nil, LifetimeUnsupported(fmt.Sprintf("%T", s.Store.StoreBackend))
+		}
+	}
+	store := s.Store
+	if opts.DryRun {
+		store = store.dryRun(logger)
+	}
+	index, _, err := store.GetAppIndex()
 	if err != nil {
 		return nil, err
 	}
-	if _, found := index.AppRefs[req.App]; found {
+	existing, existingMeta, err := store.GetApp(req.App)
+	if messagestore.IsNotFound(err) {
+		existing = nil
+	} else if err != nil {
+		logger.Logf("Failed to check for existing app %d: %s", req.App, err)
+		return nil, err
+	}
+	if _, found := index.AppRefs[req.App]; (found || existing != nil) && !opts.Overwrite {
+		logger.Logf("App %d already exists", req.App)
 		return nil, AppExists(req.App)
 	}
 	if index.AppRefs == nil {
@@ -296,79 +661,176 @@ func (s *AppKeyService) AddApp(req *appkeypb.AddAppRequest, logger kslog.KsLogge
 		Id: req.App,
 	}
 	if len(req.Keys) > 0 {
-		err = addKeysToApp(&app, req.Keys)
+		err = s.addKeysToApp(&app, req.Keys)
 		if err != nil {
+			logger.Logf("Rejecting keys of app %d: %s", req.App, err)
+			return nil, err
+		}
+		if err = s.checkKeyCount(req.App, len(app.Keys)); err != nil {
+			logger.Logf("Rejecting keys of app %d: %s", req.App, err)
 			return nil, err
 		}
-		err = s.storeKeys(req.App, req.Keys, logger)
+		err = storeKeys(store, req.App, req.Keys, s.keyWorkers(), logger)
 		if err != nil {
+			abandonApp(store, &app, existing, existingMeta, false, logger)
 			return nil, err
 		}
 	}
-	_, err = s.Store.PutApp(&app)
-	if err != nil {
+	_, err = store.PutAppWithMetadata(&app, lifetimeMetadata(opts.DefaultLifetime))
+	if err = tolerateHistory(err, logger); err != nil {
+		abandonApp(store, &app, existing, existingMeta, false, logger)
 		return nil, err
 	}
-	_, err = s.Store.PutAppIndex(index)
+	_, err = store.PutAppIndex(index)
 	if err != nil {
+		abandonApp(store, &app, existing, existingMeta, true, logger)
 		return nil, err
 	}
+	if existing != nil {
+		staleKeys := make(map[string]*appkeypb.AppKeyIndexEntry)
+		for fingerprint, keyEntry := range existing.Keys {
+			if _, kept := app.Keys[fingerprint]; !kept {
+				staleKeys[fingerprint] = keyEntry
+			}
+		}
+		if _, ok := removeKeys(store, req.App, staleKeys, logger); !ok {
+			logger.Logf("Failed to remove some replaced keys of app %d", req.App)
+		}
+	}
 	return &appkeypb.AddAppResponse{}, nil
 }
 
-// removeKeys removes keys in an applications key index from the store
-func (s *AppKeyService) removeKeys(app uint64, keyIdx map[string]*appkeypb.AppKeyIndexEntry, logger kslog.KsLogger) bool {
+// abandonApp removes, as well as it can, the documents written by an addApp
+// which failed before the app index was put, so a retry starts clean.  Keys
+// of an existing app are left in place, since they may still be referenced
+// by it.  An existing app document which was replaced is put back, with the
+// metadata of existingMeta, before the new keys are removed; if it cannot
+// be, the new keys are kept, since the replacing document references them.
+func abandonApp(store *AppKeyStore, app *appkeypb.App, existing *appkeypb.App, existingMeta *messagestore.CacheMeta, appWritten bool, logger kslog.KsLogger) {
+	written := make(map[string]*appkeypb.AppKeyIndexEntry, len(app.Keys))
+	for fingerprint, keyEntry := range app.Keys {
+		if existing != nil {
+			if _, found := existing.Keys[fingerprint]; found {
+				continue
+			}
+		}
+		written[fingerprint] = keyEntry
+	}
+	if appWritten && existing == nil {
+		if _, err := store.DeleteApp(app.Id); err != nil {
+			logger.Logf("Failed to remove app %d document after failing to add it: %s", app.Id, err)
+		}
+	} else if appWritten {
+		_, err := store.PutAppWithMetadata(existing, appMetadata(existingMeta))
+		if err = tolerateHistory(err, logger); err != nil {
+			logger.Logf("Failed to restore app %d document after failing to replace it, keeping its new keys: %s", app.Id, err)
+			return
+		}
+	}
+	if removed, ok := removeKeys(store, app.Id, written, logger); !ok {
+		logger.Logf("Failed to remove some keys of app %d after failing to add it", app.Id)
+	} else {
+		logger.Logf("Removed %d key documents of app %d after failing to add it", removed, app.Id)
+	}
+}
+
+// removeKeys removes keys in an applications key index from the store.  Key
+// documents which are already missing are skipped.  The number of documents
+// removed is returned along with whether all documents could be removed.
+func removeKeys(store *AppKeyStore, app uint64, keyIdx map[string]*appkeypb.AppKeyIndexEntry, logger kslog.KsLogger) (int, bool) {
 	removeKeysOk := true
+	removed := 0
 	for _, key := range keyIdx {
-		_, err := s.Store.DeleteKeyMeta(app, key.Meta.Fingerprint)
+		existed, err := store.DeleteKeyMetaExisted(app, key.Meta.Fingerprint)
 		if err != nil {
 			logger.Logf("Failed to remove key %s metadata", key.Meta.Fingerprint)
 			removeKeysOk = false
+		} else if !existed {
+			logger.Logf("Key %s metadata already removed", key.Meta.Fingerprint)
 		} else {
 			logger.Logf("Deleted key %s metadata", key.Meta.Fingerprint)
+			removed++
 		}
-		_, err = s.Store.DeleteKey(app, key.Meta.Fingerprint)
+		existed, err = store.DeleteKeyExisted(app, key.Meta.Fingerprint)
 		if err != nil {
 			logger.Logf("Failed to remove key %s", key.Meta.Fingerprint)
 			removeKeysOk = false
+		} else if !existed {
+			logger.Logf("Key %s already removed", key.Meta.Fingerprint)
 		} else {
 			logger.Logf("Deleted key %s", key.Meta.Fingerprint)
+			removed++
 		}
 	}
-	return removeKeysOk
+	return removed, removeKeysOk
 }
 
 // RemoveApp removes an application from the store, removing all its keys and
-// its reference in the application index
+// its reference in the application index.  Documents that are already missing
+// are skipped so a partially created application may be removed.
 func (s *AppKeyService) RemoveApp(req *appkeypb.RemoveAppRequest, logger kslog.KsLogger) (*appkeypb.RemoveAppResponse, error) {
+	result, err := s.RemoveAppWithOptions(req, RemoveAppOptions{}, logger)
+	if err != nil {
+		return nil, err
+	}
+	return result.Response, nil
+}
+
+// RemoveAppOptions modifies how RemoveAppWithOptions removes an app
+type RemoveAppOptions struct {
+	DryRun bool // Log the documents which would be written or deleted without changing the store
+}
+
+// RemoveAppResult reports the outcome of RemoveAppWithOptions.  The
+// RemoveAppResponse message has no fields, so the number of documents removed
+// is reported alongside it.
+type RemoveAppResult struct {
+	Response            *appkeypb.RemoveAppResponse
+	RemovedKeyDocuments int // Key and key metadata documents deleted, not counting those already missing
+}
+
+// RemoveAppWithOptions removes an application like RemoveApp, also reporting
+// how many key documents were removed.  With opts.DryRun the store is left
+// unchanged and each document which would be deleted is logged and counted
+// instead.
+func (s *AppKeyService) RemoveAppWithOptions(req *appkeypb.RemoveAppRequest, opts RemoveAppOptions, logger kslog.KsLogger) (*RemoveAppResult, error) {
+	defer s.lockWrites()()
 	if req.App == 0 {
-		logger.Errorf("Attempted to add app %d", req.App)
+		logger.Errorf("Attempted to remove app %d", req.App)
 		return nil, UnallowedAppId(req.App)
 	}
-	index, _, err := s.Store.GetAppIndex()
+	store := s.Store
+	if opts.DryRun {
+		store = store.dryRun(logger)
+	}
+	index, _, err := store.GetAppIndex()
 	if err != nil {
 		logger.Errorf("failed to get app index: %s", err)
 		return nil, err
 	}
-	if _, found := index.AppRefs[req.App]; !found {
+	_, indexed := index.AppRefs[req.App]
+	if !indexed {
 		logger.Errorf("Application %d not in index", req.App)
 	} else {
 		delete(index.AppRefs, req.App)
-		_, err = s.Store.PutAppIndex(index)
+		_, err = store.PutAppIndex(index)
 		if err != nil {
 			logger.Error("Failed to put updated application index")
 			return nil, err
 		}
 		logger.Logf("Application %d removed from index", req.App)
 	}
-	app, _, err := s.Store.GetApp(req.App)
-	if err != nil {
+	app, _, err := store.GetApp(req.App)
+	if indexed && messagestore.IsNotFound(err) {
+		logger.Logf("Application %d has no document to remove", req.App)
+		return &RemoveAppResult{Response: &appkeypb.RemoveAppResponse{}}, nil
+	} else if err != nil {
 		logger.Errorf("Failed to get app %d: %s", req.App, err)
 		return nil, err
 	} else {
 		logger.Logf("Fetched app from store for %d", req.App)
 	}
-	_, err = s.Store.DeleteApp(req.App)
+	_, err = store.DeleteApp(req.App)
 	if err != nil {
 		logger.Logf("Failed to remove app from store for %d: %s", req.App, err)
 		return nil, err
@@ -376,25 +838,71 @@ func (s *AppKeyService) RemoveApp(req *appkeypb.RemoveAppRequest, logger kslog.K
 	logger.Logf("Deleted application %d", req.App)
 	if len(app.Keys) == 0 {
 		logger.Logf("no keys to delete")
-		return &appkeypb.RemoveAppResponse{}, nil
+		return &RemoveAppResult{Response: &appkeypb.RemoveAppResponse{}}, nil
 	}
-	if !s.removeKeys(req.App, app.Keys, logger) {
+	removed, ok := removeKeys(store, req.App, app.Keys, logger)
+	logger.Logf("Removed %d key documents for application %d", removed, req.App)
+	if !ok {
 		return nil, fmt.Errorf("Failed to remove keys")
 	} else {
 		logger.Logf("Deleted all keys")
 	}
-	return &appkeypb.RemoveAppResponse{}, nil
+	return &RemoveAppResult{
+		Response:            &appkeypb.RemoveAppResponse{},
+		RemovedKeyDocuments: removed,
+	}, nil
 }
 
 // GetApp loads an application description from the store.  This includes an
-// index of keys for the application.
+// index of keys for the application with their metadata but not the keys
+// themselves.  A NoSuchApp error is returned for unknown applications.  If
+// the application index does not reference the application, or its entry
+// names another application id than the document, the application is
+// returned along with an *IndexDrift error.  Index entries hold only the
+// application id, so key counts cannot drift and are not compared.
 func (s *AppKeyService) GetApp(req *appkeypb.GetAppRequest, logger kslog.KsLogger) (*appkeypb.App, error) {
 	app, _, err := s.Store.GetApp(req.App)
-	if err != nil {
+	if messagestore.IsNotFound(err) {
+		logger.Logf("App %d does not exist", req.App)
+		return nil, NoSuchApp(req.App)
+	} else if err != nil {
 		logger.Logf("Failed to get app %d: %s", req.App, err)
 		return nil, err
 	}
-	return app, err
+	index, _, err := s.Store.GetAppIndex()
+	if err != nil {
+		logger.Logf("Failed to get application index to check app %d: %s", req.App, err)
+		return app, nil
+	}
+	entry, found := index.AppRefs[req.App]
+	if !found || entry.GetId() != app.Id {
+		drift := &IndexDrift{
+			App:       req.App,
+			IndexedId: entry.GetId(),
+		}
+		logger.Logf("Application index drift: %s", drift)
+		return app, drift
+	}
+	return app, nil
+}
+
+// ListKeys gets the metadata of an application's keys sorted by fingerprint.
+// The keys themselves are not loaded.
+func (s *AppKeyService) ListKeys(app uint64, logger kslog.KsLogger) ([]*appkeypb.AppKeyMeta, error) {
+	appDoc, err := s.GetApp(&appkeypb.GetAppRequest{App: app}, logger)
+	if _, drift := err.(*IndexDrift); err != nil && !drift {
+		return nil, err
+	}
+	fingerprints := make([]string, 0, len(appDoc.Keys))
+	for fingerprint := range appDoc.Keys {
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	sort.Strings(fingerprints)
+	metas := make([]*appkeypb.AppKeyMeta, len(fingerprints))
+	for i, fingerprint := range fingerprints {
+		metas[i] = appDoc.Keys[fingerprint].Meta
+	}
+	return metas, nil
 }
 
 // ListApps loads the application index for the data store
@@ -407,103 +915,388 @@ func (s *AppKeyService) ListApps(req *appkeypb.ListAppsRequest, logger kslog.KsL
 	return index, err
 }
 
-// AddKey adds a key to the data store and updates an application to reference it.
+// ListAppsPageRequest requests a page of application ids
+type ListAppsPageRequest struct {
+	PageSize          int    // Maximum number of apps to return; all if 0
+	ContinuationToken string // Token from a previous response; empty for the first page
+}
+
+// ListAppsPageResponse is a page of application ids in ascending order
+type ListAppsPageResponse struct {
+	Apps              []uint64 // Application ids
+	ContinuationToken string   // Token for the next page; empty after the last page
+}
+
+// ListAppsPage loads a page of application ids from the application index
+func (s *AppKeyService) ListAppsPage(req *ListAppsPageRequest, logger kslog.KsLogger) (*ListAppsPageResponse, error) {
+	var after uint64
+	if req.ContinuationToken != "" {
+		var err error
+		after, err = strconv.ParseUint(req.ContinuationToken, 10, 64)
+		if err != nil {
+			logger.Logf("Invalid continuation token %s: %s", req.ContinuationToken, err)
+			return nil, InvalidContinuationToken(req.ContinuationToken)
+		}
+	}
+	index, _, err := s.Store.GetAppIndex()
+	if err != nil {
+		logger.Logf("Failed to get application index: %s", err)
+		return nil, err
+	}
+	apps := make([]uint64, 0, len(index.AppRefs))
+	for appId := range index.AppRefs {
+		if appId > after {
+			apps = append(apps, appId)
+		}
+	}
+	sort.Slice(apps, func(i, j int) bool { return apps[i] < apps[j] })
+	resp := ListAppsPageResponse{
+		Apps: apps,
+	}
+	if req.PageSize > 0 && len(apps) > req.PageSize {
+		resp.Apps = apps[:req.PageSize]
+		resp.ContinuationToken = strconv.FormatUint(resp.Apps[req.PageSize-1], 10)
+	}
+	return &resp, nil
+}
+
+// updateApp reads an application, applies modify to it and stores the
+// result.  If the backend can put conditionally and the application is
+// changed by another writer in between, it is read and modified again, up to
+// MAX_APP_UPDATE_ATTEMPTS times.  A NoSuchApp error is returned if the
+// application does not exist.
+func (s *AppKeyService) updateApp(appId uint64, modify func(app *appkeypb.App) error, logger kslog.KsLogger) error {
+	for attempt := 1; ; attempt++ {
+		app, meta, err := s.Store.GetApp(appId)
+		if messagestore.IsNotFound(err) {
+			logger.Logf("App %d does not exist", appId)
+			return NoSuchApp(appId)
+		} else if err != nil {
+			logger.Logf("Failed to get app %d: %s", appId, err)
+			return err
+		}
+		if err = modify(app); err != nil {
+			return err
+		}
+		metadata := appMetadata(meta)
+		_, err = s.Store.PutAppIfMatchWithMetadata(app, meta, metadata)
+		if _, ok := err.(messagestore.ConditionalUnsupported); ok {
+			_, err = s.Store.PutAppWithMetadata(app, metadata)
+		}
+		err = tolerateHistory(err, logger)
+		if messagestore.IsConflict(err) && attempt < MAX_APP_UPDATE_ATTEMPTS {
+			logger.Logf("App %d was changed concurrently; retrying update", appId)
+			continue
+		}
+		if err != nil {
+			logger.Errorf("Failed to update application in store: %s", err)
+		}
+		return err
+	}
+}
+
+// AddKey adds keys to an existing application.  Fingerprints the request
+// omits are derived from the keys.  A NoSuchApp error is returned if the
+// application does not exist and a *KeyExists error if it already has a key.
+// A *TooManyKeys error is returned if the application would have more than
+// MaxKeysPerApp keys, unless PruneDeprecated makes room by removing keys
+// deprecated longest ago.
 func (s *AppKeyService) AddKey(req *appkeypb.AddKeyRequest, logger kslog.KsLogger) (*appkeypb.AddKeyResponse, error) {
+	defer s.lockWrites()()
+	unlock, err := s.lockApp(req.App, logger)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 	if len(req.Keys) == 0 {
 		logger.Logf("No keys to add")
 		return &appkeypb.AddKeyResponse{}, nil
 	}
-	app, _, err := s.Store.GetApp(req.App)
+	keysStored := false
+	var pruned map[string]*appkeypb.AppKeyIndexEntry
+	deprecatedAt := make(map[string]time.Time)
+	if s.PruneDeprecated && s.MaxKeysPerApp > 0 {
+		// Read once rather than on every conflicting update of the app
+		if current, _, err := s.Store.GetApp(req.App); err == nil {
+			deprecatedAt = s.keysDeprecatedAt(current)
+		}
+	}
+	err = s.updateApp(req.App, func(app *appkeypb.App) error {
+		logger.Logf("Adding %d keys", len(req.Keys))
+		if len(app.Keys) == 0 {
+			app.Keys = make(map[string]*appkeypb.AppKeyIndexEntry)
+		}
+		for i, key := range req.Keys {
+			err := s.checkKeyFingerprint(i, key)
+			if err != nil {
+				logger.Logf("Failed to check fingerprint of key %s: %s", RedactAppKey(key), err)
+				return err
+			}
+			if _, found := app.Keys[key.Meta.Fingerprint]; found {
+				logger.Logf("App %d already has key %s", req.App, key.Meta.Fingerprint)
+				return &KeyExists{
+					App:         req.App,
+					Fingerprint: key.Meta.Fingerprint,
+				}
+			}
+			key.Meta.App = req.App
+			app.Keys[key.Meta.Fingerprint] = &appkeypb.AppKeyIndexEntry{
+				Meta: key.Meta,
+			}
+		}
+		pruned = nil
+		if s.PruneDeprecated {
+			pruned = s.pruneDeprecatedKeys(app, deprecatedAt, logger)
+		}
+		if err := s.checkKeyCount(req.App, len(app.Keys)); err != nil {
+			logger.Logf("Rejecting keys of app %d: %s", req.App, err)
+			return err
+		}
+		if keysStored {
+			return nil
+		}
+		keysStored = true
+		return storeKeys(s.Store, req.App, req.Keys, s.keyWorkers(), logger)
+	}, logger)
 	if err != nil {
-		logger.Logf("Failed to get app %d: %s", req.App, err)
 		return nil, err
 	}
-	logger.Logf("Adding %d keys", len(req.Keys))
-	if len(app.Keys) == 0 {
-		app.Keys = make(map[string]*appkeypb.AppKeyIndexEntry)
+	if _, ok := removeKeys(s.Store, req.App, pruned, logger); !ok {
+		logger.Logf("Failed to remove some pruned keys of app %d", req.App)
 	}
-	keysToAdd := make([]*appkeypb.AppKey, 0, len(req.Keys))
-	for _, key := range req.Keys {
-		if _, found := app.Keys[key.Meta.Fingerprint]; found {
-			logger.Logf("App %d already has key %s", req.App, key.Meta.Fingerprint)
+	return &appkeypb.AddKeyResponse{}, nil
+}
+
+// checkKeyCount ensures an app with a number of keys is within the
+// MaxKeysPerApp, returning a *TooManyKeys error if not
+func (s *AppKeyService) checkKeyCount(app uint64, keys int) error {
+	if s.MaxKeysPerApp <= 0 || keys <= s.MaxKeysPerApp {
+		return nil
+	}
+	return &TooManyKeys{
+		App:  app,
+		Keys: keys,
+		Max:  s.MaxKeysPerApp,
+	}
+}
+
+// pruneDeprecatedKeys removes the disabled keys of an app from its key index,
+// those deprecated longest ago first, until it is within the MaxKeysPerApp.
+// Keys disabled without DeprecateKey recording when are removed before any
+// others.  When keys were deprecated is taken from deprecatedAt, as from
+// keysDeprecatedAt, and read into it for keys it lacks.  The removed index
+// entries are returned so their documents may be deleted once the app is put.
+func (s *AppKeyService) pruneDeprecatedKeys(app *appkeypb.App, deprecatedAt map[string]time.Time, logger kslog.KsLogger) map[string]*appkeypb.AppKeyIndexEntry {
+	if s.MaxKeysPerApp <= 0 || len(app.Keys) <= s.MaxKeysPerApp {
+		return nil
+	}
+	deprecated := make([]string, 0)
+	for fingerprint, keyEntry := range app.Keys {
+		if !keyEntry.Meta.Disabled {
 			continue
 		}
-		key.Meta.App = req.App
-		app.Keys[key.Meta.Fingerprint] = &appkeypb.AppKeyIndexEntry{
-			Meta: key.Meta,
+		deprecated = append(deprecated, fingerprint)
+		if _, found := deprecatedAt[fingerprint]; !found {
+			deprecatedAt[fingerprint] = s.keyDeprecatedAt(app.Id, fingerprint)
 		}
-		keysToAdd = append(keysToAdd, key)
 	}
-	err = s.storeKeys(req.App, keysToAdd, logger)
-	if err == nil {
+	sort.Slice(deprecated, func(i, j int) bool {
+		a, b := deprecatedAt[deprecated[i]], deprecatedAt[deprecated[j]]
+		if !a.Equal(b) {
+			return a.Before(b)
+		}
+		return deprecated[i] < deprecated[j]
+	})
+	pruned := make(map[string]*appkeypb.AppKeyIndexEntry)
+	for _, fingerprint := range deprecated {
+		if len(app.Keys) <= s.MaxKeysPerApp {
+			break
+		}
+		logger.Logf("Pruning key %s of app %d deprecated at %s", fingerprint, app.Id, deprecatedAt[fingerprint])
+		pruned[fingerprint] = app.Keys[fingerprint]
+		delete(app.Keys, fingerprint)
+	}
+	return pruned
+}
+
+// RemoveKeyOptions modifies how RemoveKeyWithOptions removes keys
+type RemoveKeyOptions struct {
+	Force bool // Remove keys even if the app is left without an enabled key, or without keys
+}
+
+// RemoveKey removes keys from the data store and their references from an
+// application.  A *NoSuchKey error is returned if the application does not
+// have a key, and a LastKey error if no enabled key, or no key at all, would
+// remain.
+func (s *AppKeyService) RemoveKey(req *appkeypb.RemoveKeyRequest, logger kslog.KsLogger) (*appkeypb.RemoveKeyResponse, error) {
+	return s.RemoveKeyWithOptions(req, RemoveKeyOptions{}, logger)
+}
+
+// RemoveKeyWithOptions removes keys like RemoveKey.  With opts.Force the
+// last enabled keys, or every key, of an application may be removed.
+func (s *AppKeyService) RemoveKeyWithOptions(req *appkeypb.RemoveKeyRequest, opts RemoveKeyOptions, logger kslog.KsLogger) (*appkeypb.RemoveKeyResponse, error) {
+	defer s.lockWrites()()
+	unlock, err := s.lockApp(req.App, logger)
+	if err != nil {
 		return nil, err
 	}
-	_, err = s.Store.PutApp(app)
+	defer unlock()
+	var removeIdx map[string]*appkeypb.AppKeyIndexEntry
+	err = s.updateApp(req.App, func(app *appkeypb.App) error {
+		removeIdx = make(map[string]*appkeypb.AppKeyIndexEntry, len(req.Fingerprints))
+		for _, fingerprint := range req.Fingerprints {
+			keyEntry, found := app.Keys[fingerprint]
+			if !found {
+				logger.Logf("App %d does not have key %s", req.App, fingerprint)
+				return &NoSuchKey{
+					App:         req.App,
+					Fingerprint: fingerprint,
+				}
+			}
+			removeIdx[fingerprint] = keyEntry
+		}
+		enabledLeft, enabledBefore := 0, 0
+		for fingerprint, keyEntry := range app.Keys {
+			if keyEntry.Meta.Disabled {
+				continue
+			}
+			enabledBefore++
+			if _, removing := removeIdx[fingerprint]; !removing {
+				enabledLeft++
+			}
+		}
+		if enabledLeft == 0 && enabledBefore > 0 && !opts.Force {
+			logger.Logf("Refusing to remove the last enabled key of app %d", req.App)
+			return LastKey(req.App)
+		}
+		if len(removeIdx) == len(app.Keys) && !opts.Force {
+			logger.Logf("Refusing to remove every key of app %d", req.App)
+			return LastKey(req.App)
+		}
+		for fingerprint := range removeIdx {
+			delete(app.Keys, fingerprint)
+		}
+		return nil
+	}, logger)
 	if err != nil {
-		logger.Logf("Failed to update application in store: %s", err)
 		return nil, err
 	}
-	return &appkeypb.AddKeyResponse{}, nil
+	if _, ok := removeKeys(s.Store, req.App, removeIdx, logger); !ok {
+		logger.Logf("Failed to remove some key documents of app %d", req.App)
+	}
+	return &appkeypb.RemoveKeyResponse{}, nil
 }
 
-// RemoveKey removes a key from the data store and its reference to an application.
-func (s *AppKeyService) RemoveKey(req *appkeypb.RemoveKeyRequest, logger kslog.KsLogger) (*appkeypb.RemoveKeyResponse, error) {
-	for _, fingerprint := range req.Fingerprints {
-		_, err := s.Store.DeleteKey(req.App, fingerprint)
-		if err != nil {
-			logger.Logf("Failed delete key %s: %s", fingerprint, err)
-		}
-		_, err = s.Store.DeleteKeyMeta(req.App, fingerprint)
-		if err != nil {
-			logger.Logf("Failed delete key %s metadata: %s", fingerprint, err)
+// loadSigner gets and parses a key of an application, using the key cache
+// while the application document is the version described by appMeta
+func (s *AppKeyService) loadSigner(app *appkeypb.App, appMeta *messagestore.CacheMeta, fingerprint string, logger kslog.KsLogger) (crypto.Signer, error) {
+	cacheSize := s.KeyCacheSize
+	if cacheSize == 0 {
+		cacheSize = DEFAULT_KEY_CACHE_SIZE
+	}
+	id := keyCacheId{app.Id, fingerprint}
+	if cacheSize > 0 {
+		if signer := s.keys.get(id, appMeta); signer != nil {
+			return signer, nil
 		}
 	}
-	app, _, err := s.Store.GetApp(req.App)
+	key, _, err := s.Store.GetKey(app.Id, fingerprint)
 	if err != nil {
-		logger.Logf("Failed to get app %d: %s", req.App, err)
+		logger.Logf("Failed to get key %s for app %d: %s", fingerprint, app.Id, err)
 		return nil, err
 	}
-	for _, fingerprint := range req.Fingerprints {
-		if _, found := app.Keys[fingerprint]; !found {
-			logger.Errorf("App %d does not have  key %s", req.App, fingerprint)
+	key, err = s.resolveKey(key)
+	if err != nil {
+		logger.Logf("Failed to resolve private key %s: %s", fingerprint, err)
+		return nil, err
+	}
+	signer, err := parseSigningKey(key, s.KMS)
+	if err != nil {
+		logger.Logf("Failed to parse private key %s: %s", fingerprint, err)
+		return nil, err
+	}
+	s.keys.put(id, appMeta, signer, cacheSize)
+	return signer, nil
+}
+
+// keyFromApp gets the key of an application with a certain fingerprint.  If
+// the app has no such key, a *NoSuchKey error is returned.  A disabled key is
+// deprecated, and is only got within the RotationOverlap after it was
+// deprecated by DeprecateKey; otherwise a *KeyDeprecated error is returned.
+func (s *AppKeyService) keyFromApp(app *appkeypb.App, appMeta *messagestore.CacheMeta, fingerprint string, alg jwsAlgorithm, logger kslog.KsLogger) (crypto.Signer, error) {
+	keyEntry, found := app.Keys[fingerprint]
+	if !found {
+		logger.Logf("App %d has no key %s", app.Id, fingerprint)
+		return nil, &NoSuchKey{
+			App:         app.Id,
+			Fingerprint: fingerprint,
 		}
-		delete(app.Keys, fingerprint)
 	}
-	_, err = s.Store.PutApp(app)
+	if keyEntry.Meta.Disabled {
+		if err := s.checkDeprecatedKey(app.Id, fingerprint, logger); err != nil {
+			return nil, err
+		}
+	}
+	signer, err := s.loadSigner(app, appMeta, fingerprint, logger)
 	if err != nil {
-		logger.Errorf("Failed to update application in store: %s", err)
+		return nil, err
 	}
-	return &appkeypb.RemoveKeyResponse{}, nil
+	err = alg.checkKey(signer)
+	if err != nil {
+		return nil, err
+	}
+	return signer, nil
 }
 
 // anyKeyFromApp fetches a valid key for a specified app.  This is useful
 // when a key operation needs to be performed and any valid key
-// may be used.
-func (s *AppKeyService) anyKeyFromApp(app *appkeypb.App, logger kslog.KsLogger) (*rsa.PrivateKey, string, error) {
-	var key []byte
-	var fingerprint string
+// may be used.  Enabled keys are tried in fingerprint order, the first
+// being the primary key.  Keys which cannot be loaded or parsed, or which cannot
+// be used with the signature algorithm, are skipped, with a warning when
+// another key is used in place of a primary key which cannot be loaded, since
+// its document is then likely corrupt.  If no key is usable
+// because of the algorithm, a *KeyAlgorithmMismatch error is returned,
+// otherwise a *PrimaryKeyUnusable error is returned.
+func (s *AppKeyService) anyKeyFromApp(app *appkeypb.App, appMeta *messagestore.CacheMeta, alg jwsAlgorithm, logger kslog.KsLogger) (crypto.Signer, string, error) {
+	fingerprints := make([]string, 0, len(app.Keys))
 	for _, keyEntry := range app.Keys {
 		if keyEntry.Meta.Disabled {
 			continue
 		}
-		var err error
-		key, _, err = s.Store.GetKey(app.Id, keyEntry.Meta.Fingerprint)
-		if err != nil {
-			logger.Logf("Failed to get key %s for app %d", keyEntry.Meta.Fingerprint, app.Id)
-		}
-		fingerprint = keyEntry.Meta.Fingerprint
-		break
+		fingerprints = append(fingerprints, keyEntry.Meta.Fingerprint)
 	}
-	if key == nil {
+	if len(fingerprints) == 0 {
 		logger.Logf("Did not find a key for app %d", app.Id)
 		return nil, "", NoKeyForApp(app.Id)
 	}
-	rsaKey, err := keyutils.ParsePrivateKey(key)
-	if err != nil {
-		logger.Logf("Failed to parse private key %s: %s", fingerprint, err)
-		return nil, "", err
+	sort.Strings(fingerprints)
+	var primaryErr, mismatchErr error
+	for i, fingerprint := range fingerprints {
+		signer, err := s.loadSigner(app, appMeta, fingerprint, logger)
+		if err == nil {
+			err = alg.checkKey(signer)
+			if err == nil {
+				if primaryErr != nil {
+					kslog.Warnf(logger, "Primary key %s of app %d cannot be loaded, using key %s: %s", fingerprints[0], app.Id, fingerprint, primaryErr)
+				}
+				return signer, fingerprint, nil
+			}
+			logger.Logf("Key %s cannot be used: %s", fingerprint, err)
+			mismatchErr = err
+			continue
+		}
+		if i == 0 {
+			primaryErr = err
+		}
+	}
+	if mismatchErr != nil {
+		return nil, "", mismatchErr
+	}
+	return nil, "", &PrimaryKeyUnusable{
+		App:         app.Id,
+		Fingerprint: fingerprints[0],
+		Cause:       primaryErr,
 	}
-	return rsaKey, fingerprint, nil
 }
 
 // validateIssClaim checks that the `iss` (issuer) claim of a JWT is a string
@@ -520,13 +1313,16 @@ func validateIssClaim(app uint64, iss string) error {
 }
 
 // validateExpNbfClaims checks the `exp` (expires) and `nbf` (not before)
-// claims of a JWT.  `exp` must be in the future and `nbf` must be after
-// `exp`.  `nbf` must also be either in the feature or within a reasonable
-// margin of now in the past (5 seconds ago).
-func validateExpNbfClaims(exp, nbf, now time.Time) error {
+// claims of a JWT.  `exp` must be in the future but no more than maxLifetime
+// from now and `nbf` must be after `exp`.  `nbf` must also be either in the
+// feature or within a reasonable margin of now in the past (5 seconds ago).
+func validateExpNbfClaims(exp, nbf, now time.Time, maxLifetime time.Duration) error {
 	if !exp.After(now) {
 		return InvalidClaims("`exp` indicates claims are already expired")
 	}
+	if exp.Sub(now) > maxLifetime {
+		return InvalidClaims(fmt.Sprintf("`exp` is more than %s in the future", maxLifetime))
+	}
 	if !nbf.IsZero() {
 		if !exp.After(nbf) {
 			return InvalidClaims("`exp` must be greater than `nbf`")
@@ -569,19 +1365,115 @@ func pbValToTime(v *structpb.Value) (time.Time, bool) {
 	return timeutils.FloatToTime(numTime), true
 }
 
+// lifetimeMetadata gets the user metadata of an app document recording its
+// default JWT lifetime, or nil if it has none
+func lifetimeMetadata(lifetime time.Duration) map[string]string {
+	if lifetime <= 0 {
+		return nil
+	}
+	return map[string]string{
+		DEFAULT_LIFETIME_METADATA: lifetime.String(),
+	}
+}
+
+// appMetadata gets the user metadata of an app document to keep when it is
+// replaced, or nil if there is none
+func appMetadata(meta *messagestore.CacheMeta) map[string]string {
+	if meta == nil {
+		return nil
+	}
+	lifetime, found := meta.Metadata[DEFAULT_LIFETIME_METADATA]
+	if !found {
+		return nil
+	}
+	return map[string]string{
+		DEFAULT_LIFETIME_METADATA: lifetime,
+	}
+}
+
+// appLifetime gets the default JWT lifetime recorded for an app by AddApp, or
+// 0 if it has none
+func (s *AppKeyService) appLifetime(app uint64, meta *messagestore.CacheMeta, logger kslog.KsLogger) time.Duration {
+	metadata := appMetadata(meta)
+	if metadata == nil {
+		return 0
+	}
+	lifetime, err := time.ParseDuration(metadata[DEFAULT_LIFETIME_METADATA])
+	if err != nil || lifetime <= 0 {
+		logger.Logf("Ignoring invalid default lifetime of app %d: %q", app, metadata[DEFAULT_LIFETIME_METADATA])
+		return 0
+	}
+	return lifetime
+}
+
+// fillDefaultClaims gets a copy of a request with its `iat`, `exp` and `iss`
+// claims which are absent set to now, now plus the lifetime and the app
+// respectively, leaving the caller's request unchanged so it may be reused.
+// A zero lifetime is the DefaultLifetime.  Claims given by the caller are
+// never replaced, so a mismatched `iss` is still rejected by validation.
+func (s *AppKeyService) fillDefaultClaims(req *appkeypb.SignJwtRequest, now time.Time, lifetime, maxLifetime time.Duration) *appkeypb.SignJwtRequest {
+	if lifetime == 0 {
+		lifetime = s.DefaultLifetime
+	}
+	if lifetime == 0 {
+		lifetime = DEFAULT_JWT_LIFETIME
+	}
+	if lifetime > maxLifetime {
+		lifetime = maxLifetime
+	}
+	if lifetime > GITHUB_MAX_JWT_LIFETIME {
+		lifetime = GITHUB_MAX_JWT_LIFETIME
+	}
+	defaults := map[string]*structpb.Value{
+		"iat": &structpb.Value{
+			Kind: &structpb.Value_NumberValue{
+				NumberValue: float64(now.Unix()),
+			},
+		},
+		"exp": &structpb.Value{
+			Kind: &structpb.Value_NumberValue{
+				NumberValue: float64(now.Add(lifetime).Unix()),
+			},
+		},
+		"iss": &structpb.Value{
+			Kind: &structpb.Value_StringValue{
+				StringValue: strconv.FormatUint(req.App, 10),
+			},
+		},
+	}
+	filled := proto.Clone(req).(*appkeypb.SignJwtRequest)
+	if filled.Claims == nil {
+		filled.Claims = &structpb.Struct{}
+	}
+	if filled.Claims.Fields == nil {
+		filled.Claims.Fields = make(map[string]*structpb.Value, len(defaults))
+	}
+	for name, value := range defaults {
+		if _, found := filled.Claims.Fields[name]; !found {
+			filled.Claims.Fields[name] = value
+		}
+	}
+	return filled
+}
+
 // validateClaims checks the claims in a `appkeypb.SignJwtRequest` to make sure
 // all values are sane and secure
-func validateClaims(req *appkeypb.SignJwtRequest, now time.Time) error {
+func validateClaims(req *appkeypb.SignJwtRequest, now time.Time, maxLifetime time.Duration) error {
 	issVal := req.Claims.Fields["iss"]
 	if issVal == nil {
 		return InvalidClaims("Missing claim `iss`")
 	}
-	iss, ok := pbValToStr(issVal)
-	if !ok {
-		return InvalidClaims("`iss` must be string")
-	}
-	if err := validateIssClaim(req.App, iss); err == nil {
-		return err
+	if iss, ok := pbValToStr(issVal); ok {
+		if err := validateIssClaim(req.App, iss); err != nil {
+			return err
+		}
+	} else if iss, ok := pbValToNum(issVal); ok {
+		// JSON clients may give the app id as a number rather than a string
+		if iss != float64(req.App) {
+			return InvalidClaims(fmt.Sprintf("Application Id in request (%d) does not match claim `iss` (%v)", req.App, iss))
+		}
+	} else {
+		return InvalidClaims("`iss` must be string or numeric")
 	}
 	expVal := req.Claims.Fields["exp"]
 	if expVal == nil {
@@ -599,83 +1491,227 @@ func validateClaims(req *appkeypb.SignJwtRequest, now time.Time) error {
 			return InvalidClaims("`nbf` must be numeric")
 		}
 	}
-	if err := validateExpNbfClaims(exp, nbf, now); err != nil {
+	if err := validateExpNbfClaims(exp, nbf, now, maxLifetime); err != nil {
 		return err
 	}
-	iatVal := req.Claims.Fields["iat"]
-	if iatVal != nil {
-		return InvalidClaims("Do not include `iat` in claims")
+	if iatVal := req.Claims.Fields["iat"]; iatVal != nil {
+		if _, ok := pbValToNum(iatVal); !ok {
+			return InvalidClaims("`iat` must be numeric")
+		}
 	}
 	return nil
 }
 
-// SignJwt loads a key for a specified app and signs the provided claims
+// SignJwt loads a key for a specified app and signs the provided claims.  If
+// the claims include KID_CLAIM, the key with that fingerprint signs, otherwise
+// the first usable key signs.  A named key which does not exist is a
+// *NoSuchKey error, and one deprecated beyond the RotationOverlap is a
+// *KeyDeprecated error, unless LenientKeys chooses another key instead.
+// Filled in claims are of the time of the Clock, and the header and claims
+// are encoded with sorted fields, so with a fixed Clock and a deterministic
+// algorithm such as RS256 the same request always gives the same JWT.
 func (s *AppKeyService) SignJwt(req *appkeypb.SignJwtRequest, logger kslog.KsLogger) (*appkeypb.SignJwtResponse, error) {
-	if req.Algorithm != "RS256" {
-		return nil, UnsupportedSignatureAlgo(req.Algorithm)
+	return s.SignJwtWithOptions(req, SignJwtOptions{}, logger)
+}
+
+// SignJwtOptions modifies how SignJwtWithOptions signs a JWT
+type SignJwtOptions struct {
+	Headers map[string]interface{} // Fields of the JOSE header; `alg` is always that signed with, `typ` defaults to the JwtType and `kid` to the key fingerprint
+}
+
+// SignJwtWithOptions signs claims like SignJwt.  With opts.Headers, the
+// fields are added to the JOSE header of the JWT.
+func (s *AppKeyService) SignJwtWithOptions(req *appkeypb.SignJwtRequest, opts SignJwtOptions, logger kslog.KsLogger) (*appkeypb.SignJwtResponse, error) {
+	start := time.Now()
+	resp, err := s.signJwt(req, opts, nil, logger)
+	metrics.Record(s.Metrics, metrics.METRIC_SIGN_JWT, start, err)
+	return resp, err
+}
+
+// lockWrites serializes changes of the store made through the service,
+// returning the function releasing the lock
+func (s *AppKeyService) lockWrites() func() {
+	s.writes.Lock()
+	return s.writes.Unlock
+}
+
+// APP_LOCK_SUFFIX is appended to the name of an app document to name the
+// document locking it across processes
+const APP_LOCK_SUFFIX = ".lock"
+
+// lockApp takes the lock of an app shared with other processes if the
+// AppLockTTL is set, returning the function releasing it
+func (s *AppKeyService) lockApp(app uint64, logger kslog.KsLogger) (func(), error) {
+	if s.AppLockTTL <= 0 {
+		return func() {}, nil
 	}
-	now := time.Now().UTC()
-	err := validateClaims(req, now)
+	name, err := s.Store.appName(app)
 	if err != nil {
-		logger.Errorf("Claims are invalid: %s", err)
 		return nil, err
 	}
-	app, _, err := s.Store.GetApp(req.App)
+	opts := messagestore.LockOptions{
+		Wait:  s.AppLockWait,
+		Clock: s.Clock,
+	}
+	lock, err := messagestore.AcquireLockWithOptions(s.Store.StoreBackend, name+APP_LOCK_SUFFIX, s.AppLockTTL, opts)
+	if err != nil {
+		logger.Errorf("Failed to lock app %d: %s", app, err)
+		return nil, err
+	}
+	return func() {
+		if err := messagestore.ReleaseLock(s.Store.StoreBackend, lock); err != nil {
+			kslog.Warnf(logger, "Failed to release lock of app %d: %s", app, err)
+		}
+	}, nil
+}
+
+// now gets the current time from the service's clock
+func (s *AppKeyService) now() time.Time {
+	if s.Clock == nil {
+		return time.Now()
+	}
+	return s.Clock()
+}
+
+// random gets the source of randomness of signatures
+func (s *AppKeyService) random() io.Reader {
+	if s.Rand == nil {
+		return rand.Reader
+	}
+	return s.Rand
+}
+
+// checkApp ensures an app id is not 0 and is allowed by the AppPolicy
+func (s *AppKeyService) checkApp(app uint64, logger kslog.KsLogger) error {
+	if app == 0 {
+		logger.Errorf("Attempted to use app %d", app)
+		return UnallowedAppId(app)
+	}
+	if s.AppPolicy == nil {
+		return nil
+	}
+	err := s.AppPolicy.Allowed(app)
 	if err != nil {
+		logger.Errorf("App policy rejected app %d: %s", app, err)
+	}
+	return err
+}
+
+// signJwt signs the claims of a request, describing the signature in diag
+// if it is not nil
+func (s *AppKeyService) signJwt(req *appkeypb.SignJwtRequest, opts SignJwtOptions, diag *SignJwtDiagnostics, logger kslog.KsLogger) (*appkeypb.SignJwtResponse, error) {
+	if err := s.checkApp(req.App, logger); err != nil {
+		return nil, err
+	}
+	if s.RateLimiter != nil {
+		if allowed, wait := s.RateLimiter.Allow(req.App); !allowed {
+			logger.Errorf("App %d is rate limited for %s", req.App, wait)
+			return nil, &RateLimited{
+				App:        req.App,
+				RetryAfter: wait,
+			}
+		}
+	}
+	alg, err := lookupJwsAlgorithm(req.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if !s.algorithmAllowed(alg.Name) {
+		logger.Errorf("App %d requested disallowed algorithm %s", req.App, alg.Name)
+		return nil, AlgorithmNotAllowed(alg.Name)
+	}
+	if req.Claims == nil {
+		req.Claims = &structpb.Struct{}
+	}
+	if req.Claims.Fields == nil {
+		req.Claims.Fields = make(map[string]*structpb.Value)
+	}
+	now := s.now().UTC()
+	maxLifetime := s.MaxLifetime
+	if maxLifetime == 0 {
+		maxLifetime = GITHUB_MAX_JWT_LIFETIME
+	}
+	app, appMeta, err := s.Store.GetApp(req.App)
+	if messagestore.IsNotFound(err) {
+		logger.Errorf("App %d does not exist", req.App)
+		return nil, NoSuchApp(req.App)
+	} else if err != nil {
 		logger.Errorf("Failed to get application from store: %s", err)
 		return nil, err
 	}
-	rsaKey, fingerprint, err := s.anyKeyFromApp(app, logger)
+	if s.DefaultClaims {
+		req = s.fillDefaultClaims(req, now, s.appLifetime(req.App, appMeta, logger), maxLifetime)
+	}
+	if s.Claims != CLAIMS_UNCHECKED {
+		err = validateClaims(req, now, maxLifetime)
+		if err != nil {
+			logger.Errorf("Claims are invalid: %s", err)
+			return nil, err
+		}
+	}
+	var signer crypto.Signer
+	var fingerprint string
+	kidVal, named := req.Claims.Fields[KID_CLAIM]
+	if named {
+		fingerprint, named = pbValToStr(kidVal)
+	}
+	if named {
+		signer, err = s.keyFromApp(app, appMeta, fingerprint, alg, logger)
+		if s.LenientKeys && isUnusableNamedKey(err) {
+			logger.Logf("Signing with another key of app %d than %s: %s", req.App, fingerprint, err)
+			signer, fingerprint, err = s.anyKeyFromApp(app, appMeta, alg, logger)
+		}
+	} else {
+		signer, fingerprint, err = s.anyKeyFromApp(app, appMeta, alg, logger)
+	}
 	if err != nil {
 		logger.Errorf("Failed to get key for app %d: %s", req.App, err)
 		return nil, err
 	}
-	req.Claims.Fields["iat"] = &structpb.Value{
-		Kind: &structpb.Value_NumberValue{
-			NumberValue: float64(int64(timeutils.TimeToFloat(now))),
-		},
+	if _, found := req.Claims.Fields["iat"]; !found {
+		req.Claims.Fields["iat"] = &structpb.Value{
+			Kind: &structpb.Value_NumberValue{
+				NumberValue: float64(int64(timeutils.TimeToFloat(now))),
+			},
+		}
 	}
-	req.Claims.Fields["com.mobettersoftware.auth-kid"] = &structpb.Value{
+	req.Claims.Fields[KID_CLAIM] = &structpb.Value{
 		Kind: &structpb.Value_StringValue{
 			StringValue: fingerprint,
 		},
 	}
-	jsonMarshaler := jsonpb.Marshaler{
-		Indent: "",
+	jwtType := s.JwtType
+	if jwtType == "" {
+		jwtType = DEFAULT_JWT_TYPE
 	}
-	claims, err := jsonMarshaler.MarshalToString(req.Claims)
-	if err != nil {
-		logger.Errorf("Failed to marshal claims: %s", err)
-		return nil, err
+	headerFields := map[string]interface{}{
+		"typ": jwtType,
+		"kid": fingerprint,
 	}
-	claims64 := make([]byte, base64.RawURLEncoding.EncodedLen(len(claims)))
-	base64.RawURLEncoding.Encode(claims64, []byte(claims))
-	header, err := json.Marshal(map[string]interface{}{
-		"typ": "JWT",
-		"alg": req.Algorithm,
-	})
-	if err != nil {
+	for name, value := range opts.Headers {
+		headerFields[name] = value
+	}
+	headerFields["alg"] = req.Algorithm
+	encoder := getJwtEncoder()
+	defer encoder.release()
+	if err = encoder.appendHeader(headerFields); err != nil {
 		logger.Errorf("Failed to marshal header: %s", err)
+		return nil, err
+	}
+	if err = encoder.appendClaims(req.Claims); err != nil {
+		logger.Errorf("Failed to marshal claims: %s", err)
+		return nil, err
 	}
-	header64 := make([]byte, base64.RawURLEncoding.EncodedLen(len(header)))
-	base64.RawURLEncoding.Encode(header64, []byte(header))
-	secureData := make([]byte, len(claims64)+len(header64)+1)
-	copy(secureData, header64)
-	secureData[len(header64)] = '.'
-	copy(secureData[len(header64)+1:], claims64)
-	// sign with RSASSA-PKCS1-V1_5-SIGN using SHA-256
-	digest := sha256.Sum256(secureData)
-	sig, err := rsa.SignPKCS1v15(nil, rsaKey, crypto.SHA256, digest[:])
+	sig, err := alg.sign(s.random(), signer, encoder.input)
 	if err != nil {
 		logger.Logf("Failed to sign claims data: %s", err)
 		return nil, err
 	}
-	token := make([]byte, len(secureData)+1+base64.RawURLEncoding.EncodedLen(len(sig)))
-	copy(token, secureData)
-	token[len(secureData)] = '.'
-	base64.RawURLEncoding.Encode(token[len(secureData)+1:], sig[:])
+	if diag != nil {
+		diag.describe(fingerprint, alg.Name, encoder.input)
+	}
 	resp := appkeypb.SignJwtResponse{
-		Jwt: string(token),
+		Jwt: encoder.token(sig),
 	}
 	return &resp, nil
 }
@@ -0,0 +1,246 @@
+package appkeystore
+
+import (
+	"sort"
+
+	"github.com/aefalcon/github-keystore-protobuf/go/appkeypb"
+	"github.com/aefalcon/go-github-keystore/kslog"
+	"github.com/aefalcon/go-github-keystore/messagestore"
+	"github.com/golang/protobuf/proto"
+)
+
+// KeyRef identifies a key of an app
+type KeyRef struct {
+	App         uint64
+	Fingerprint string
+}
+
+// AuditReport describes the inconsistencies between the application index
+// and the documents of a store found by Audit
+type AuditReport struct {
+	Orphans        []string // Names of app and key documents referenced by no indexed app, in lexical order
+	DanglingApps   []uint64 // Apps of the index without an app document, in ascending order
+	DanglingKeys   []KeyRef // Keys of indexed apps missing their key document, by app and fingerprint
+	MissingKeyMeta []KeyRef // Keys of indexed apps with a key document but no metadata document, by app and fingerprint
+	Repaired       bool     // The inconsistencies were repaired
+}
+
+// Consistent determines if the audit found no inconsistencies
+func (r *AuditReport) Consistent() bool {
+	return len(r.Orphans) == 0 && len(r.DanglingApps) == 0 && len(r.DanglingKeys) == 0 && len(r.MissingKeyMeta) == 0
+}
+
+// sortKeyRefs sorts keys by app and fingerprint
+func sortKeyRefs(refs []KeyRef) {
+	sort.Slice(refs, func(i, j int) bool {
+		a, b := refs[i], refs[j]
+		return a.App < b.App || (a.App == b.App && a.Fingerprint < b.Fingerprint)
+	})
+}
+
+// AuditOptions modifies how AuditWithOptions audits the store
+type AuditOptions struct {
+	Repair bool // Delete orphans, prune dangling references from the index and app documents and recreate missing key metadata
+}
+
+// Audit cross-references the application index and the app documents it
+// references against the documents listed in the store, reporting documents
+// left behind by failed AddApp and RemoveApp runs and references to missing
+// documents.  The store must be listable.  The store is not changed.
+func (s *AppKeyService) Audit(logger kslog.KsLogger) (*AuditReport, error) {
+	return s.AuditWithOptions(AuditOptions{}, logger)
+}
+
+// AuditWithOptions audits the store like Audit.  With opts.Repair, dangling
+// apps are removed from the index, dangling keys are removed from their app
+// documents along with what remains of them, missing key metadata documents
+// are recreated from the app documents and orphans are deleted.  Each app is
+// repaired under its lock.  Repairs which fail are reported in a
+// *messagestore.MultiError by document name alongside the report.
+func (s *AppKeyService) AuditWithOptions(opts AuditOptions, logger kslog.KsLogger) (*AuditReport, error) {
+	if opts.Repair {
+		defer s.lockWrites()()
+	}
+	names, err := messagestore.ListMessages(s.Store.StoreBackend, "")
+	if err != nil {
+		logger.Errorf("Failed to list documents to audit: %s", err)
+		return nil, err
+	}
+	listed := make(map[string]bool, len(names))
+	for _, name := range names {
+		listed[name] = true
+	}
+	index, _, err := s.Store.GetAppIndex()
+	if err != nil {
+		logger.Errorf("Failed to get app index to audit: %s", err)
+		return nil, err
+	}
+	var report AuditReport
+	referenced := make(map[string]bool)
+	danglingKeys := make(map[uint64][]string)
+	missingMeta := make(map[uint64][]string)
+	for appId := range index.AppRefs {
+		appName, err := s.Store.appName(appId)
+		if err != nil {
+			return nil, err
+		}
+		if !listed[appName] {
+			report.DanglingApps = append(report.DanglingApps, appId)
+			continue
+		}
+		referenced[appName] = true
+		app, _, err := s.Store.GetApp(appId)
+		if err != nil {
+			logger.Errorf("Failed to get app %d to audit: %s", appId, err)
+			return nil, err
+		}
+		for fingerprint := range app.Keys {
+			keyName, err := s.Store.keyName(appId, fingerprint)
+			if err != nil {
+				return nil, err
+			}
+			metaName, err := s.Store.keyMetaName(appId, fingerprint)
+			if err != nil {
+				return nil, err
+			}
+			ref := KeyRef{
+				App:         appId,
+				Fingerprint: fingerprint,
+			}
+			if !listed[keyName] {
+				danglingKeys[appId] = append(danglingKeys[appId], fingerprint)
+				report.DanglingKeys = append(report.DanglingKeys, ref)
+			} else if !listed[metaName] {
+				// The key itself is intact, so only its metadata is restored
+				missingMeta[appId] = append(missingMeta[appId], fingerprint)
+				report.MissingKeyMeta = append(report.MissingKeyMeta, ref)
+			}
+			// What remains of a dangling key is reported with it rather than as an orphan
+			referenced[keyName] = true
+			referenced[metaName] = true
+		}
+	}
+	for _, name := range names {
+		switch s.Store.DocumentType(name) {
+		case DOCTYPE_APP, DOCTYPE_KEY, DOCTYPE_KEY_META:
+			if !referenced[name] {
+				report.Orphans = append(report.Orphans, name)
+			}
+		}
+	}
+	sort.Strings(report.Orphans)
+	sort.Slice(report.DanglingApps, func(i, j int) bool { return report.DanglingApps[i] < report.DanglingApps[j] })
+	sortKeyRefs(report.DanglingKeys)
+	sortKeyRefs(report.MissingKeyMeta)
+	logger.Logf("Audit found %d orphans, %d dangling apps, %d dangling keys and %d keys missing metadata", len(report.Orphans), len(report.DanglingApps), len(report.DanglingKeys), len(report.MissingKeyMeta))
+	if !opts.Repair || report.Consistent() {
+		return &report, nil
+	}
+	err = s.repair(&report, index, danglingKeys, missingMeta, logger)
+	report.Repaired = err == nil
+	return &report, err
+}
+
+// repair removes the inconsistencies of a report, continuing past failures
+func (s *AppKeyService) repair(report *AuditReport, index *appkeypb.AppIndex, danglingKeys, missingMeta map[uint64][]string, logger kslog.KsLogger) error {
+	var failures messagestore.MultiError
+	if len(report.DanglingApps) != 0 {
+		for _, appId := range report.DanglingApps {
+			delete(index.AppRefs, appId)
+		}
+		indexName, _ := s.Store.appIndexName()
+		_, err := s.Store.PutAppIndex(index)
+		failures.Add(indexName, err)
+		if err == nil {
+			logger.Logf("Pruned %d dangling apps from the index", len(report.DanglingApps))
+		}
+	}
+	for appId, fingerprints := range danglingKeys {
+		s.repairAppUnderLock(appId, &failures, logger, func(appName string) {
+			s.pruneDanglingKeys(appId, appName, fingerprints, &failures, logger)
+		})
+	}
+	for appId, fingerprints := range missingMeta {
+		s.repairAppUnderLock(appId, &failures, logger, func(appName string) {
+			s.restoreKeyMeta(appId, appName, fingerprints, &failures, logger)
+		})
+	}
+	for _, name := range report.Orphans {
+		_, err := messagestore.DeleteBlob(s.Store.StoreBackend, name)
+		failures.Add(name, err)
+	}
+	if failures.Len() != 0 {
+		logger.Errorf("Failed to repair %d documents: %s", failures.Len(), &failures)
+		return &failures
+	}
+	logger.Logf("Deleted %d orphans", len(report.Orphans))
+	return nil
+}
+
+// repairAppUnderLock runs a repair of an app while holding its lock, adding
+// a failure to lock it to failures under the app document's name
+func (s *AppKeyService) repairAppUnderLock(appId uint64, failures *messagestore.MultiError, logger kslog.KsLogger, repair func(appName string)) {
+	appName, _ := s.Store.appName(appId)
+	unlock, err := s.lockApp(appId, logger)
+	if err != nil {
+		failures.Add(appName, err)
+		return
+	}
+	defer unlock()
+	repair(appName)
+}
+
+// pruneDanglingKeys removes keys from an app document, then deletes what
+// remains of their documents
+func (s *AppKeyService) pruneDanglingKeys(appId uint64, appName string, fingerprints []string, failures *messagestore.MultiError, logger kslog.KsLogger) {
+	app, _, err := s.Store.GetApp(appId)
+	if err != nil {
+		failures.Add(appName, err)
+		return
+	}
+	for _, fingerprint := range fingerprints {
+		delete(app.Keys, fingerprint)
+	}
+	if _, err = s.Store.PutApp(app); tolerateHistory(err, logger) != nil {
+		failures.Add(appName, err)
+		return
+	}
+	logger.Logf("Pruned %d dangling keys of app %d", len(fingerprints), appId)
+	for _, fingerprint := range fingerprints {
+		keyName, _ := s.Store.keyName(appId, fingerprint)
+		_, err := s.Store.DeleteKeyExisted(appId, fingerprint)
+		failures.Add(keyName, err)
+		metaName, _ := s.Store.keyMetaName(appId, fingerprint)
+		_, err = s.Store.DeleteKeyMetaExisted(appId, fingerprint)
+		failures.Add(metaName, err)
+	}
+}
+
+// restoreKeyMeta puts the metadata documents of keys from their entries in
+// the app document
+func (s *AppKeyService) restoreKeyMeta(appId uint64, appName string, fingerprints []string, failures *messagestore.MultiError, logger kslog.KsLogger) {
+	app, _, err := s.Store.GetApp(appId)
+	if err != nil {
+		failures.Add(appName, err)
+		return
+	}
+	for _, fingerprint := range fingerprints {
+		entry, found := app.Keys[fingerprint]
+		if !found {
+			// Removed since the audit, along with its documents
+			continue
+		}
+		meta := &appkeypb.AppKeyMeta{}
+		if entry.Meta != nil {
+			meta = proto.Clone(entry.Meta).(*appkeypb.AppKeyMeta)
+		}
+		meta.App = appId
+		meta.Fingerprint = fingerprint
+		metaName, _ := s.Store.keyMetaName(appId, fingerprint)
+		_, err := s.Store.PutKeyMeta(meta)
+		failures.Add(metaName, err)
+		if err == nil {
+			logger.Logf("Restored metadata of app %d key %s", appId, fingerprint)
+		}
+	}
+}
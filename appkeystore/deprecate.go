@@ -0,0 +1,141 @@
+package appkeystore
+
+import (
+	"time"
+
+	"github.com/aefalcon/github-keystore-protobuf/go/appkeypb"
+	"github.com/aefalcon/go-github-keystore/kslog"
+	"github.com/aefalcon/go-github-keystore/messagestore"
+)
+
+// DEFAULT_ROTATION_OVERLAP is how long a deprecated key may still sign JWTs
+// naming it unless configured otherwise, giving callers a day to move to its
+// replacement
+const DEFAULT_ROTATION_OVERLAP = 24 * time.Hour
+
+// DEPRECATED_AT_METADATA is the user metadata of a key metadata document
+// recording when DeprecateKey deprecated the key, in RFC 3339 format
+const DEPRECATED_AT_METADATA = "deprecated-at"
+
+// DeprecateKey disables a key of an application being rotated out, recording
+// when.  It is no longer chosen to sign, but may still sign JWTs naming it
+// by KID_CLAIM for the RotationOverlap.  The time is kept as user metadata,
+// so if the backend is not a messagestore.MetadataMessageStore the key is
+// rejected immediately.  A *NoSuchKey error is returned if the application
+// does not have the key, and a LastKey error if no enabled key would remain.
+func (s *AppKeyService) DeprecateKey(app uint64, fingerprint string, logger kslog.KsLogger) error {
+	defer s.lockWrites()()
+	unlock, err := s.lockApp(app, logger)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	keyMeta := appkeypb.AppKeyMeta{
+		App:         app,
+		Fingerprint: fingerprint,
+		Disabled:    true,
+	}
+	alreadyDeprecated := false
+	err = s.updateApp(app, func(appMsg *appkeypb.App) error {
+		keyEntry, found := appMsg.Keys[fingerprint]
+		if !found {
+			logger.Logf("App %d does not have key %s", app, fingerprint)
+			return &NoSuchKey{
+				App:         app,
+				Fingerprint: fingerprint,
+			}
+		}
+		if keyEntry.Meta.Disabled {
+			alreadyDeprecated = true
+			return nil
+		}
+		enabledLeft := 0
+		for other, otherEntry := range appMsg.Keys {
+			if other != fingerprint && !otherEntry.Meta.Disabled {
+				enabledLeft++
+			}
+		}
+		if enabledLeft == 0 {
+			logger.Logf("Refusing to deprecate the last enabled key of app %d", app)
+			return LastKey(app)
+		}
+		keyEntry.Meta.Disabled = true
+		return nil
+	}, logger)
+	if err != nil || alreadyDeprecated {
+		return err
+	}
+	name, err := s.Store.keyMetaName(app, fingerprint)
+	if err != nil {
+		return err
+	}
+	metadata := map[string]string{
+		DEPRECATED_AT_METADATA: s.now().UTC().Format(time.RFC3339Nano),
+	}
+	if metaStore, ok := s.Store.StoreBackend.(messagestore.MetadataMessageStore); ok {
+		_, err = metaStore.PutMessageWithMetadata(name, &keyMeta, metadata)
+	} else {
+		logger.Logf("Store cannot record when key %s was deprecated", fingerprint)
+		_, err = s.Store.PutMessage(name, &keyMeta)
+	}
+	if err != nil {
+		logger.Errorf("Failed to record deprecation of key %s: %s", fingerprint, err)
+	}
+	return err
+}
+
+// keyDeprecatedAt gets when DeprecateKey deprecated a key, or the zero time
+// if it is unknown
+func (s *AppKeyService) keyDeprecatedAt(app uint64, fingerprint string) time.Time {
+	_, cacheMeta, err := s.Store.GetKeyMeta(app, fingerprint)
+	if err != nil || cacheMeta == nil {
+		return time.Time{}
+	}
+	deprecatedAt, err := time.Parse(time.RFC3339Nano, cacheMeta.Metadata[DEPRECATED_AT_METADATA])
+	if err != nil {
+		return time.Time{}
+	}
+	return deprecatedAt
+}
+
+// keysDeprecatedAt gets when each disabled key of an app was deprecated, as by
+// keyDeprecatedAt
+func (s *AppKeyService) keysDeprecatedAt(app *appkeypb.App) map[string]time.Time {
+	deprecatedAt := make(map[string]time.Time)
+	for fingerprint, keyEntry := range app.Keys {
+		if keyEntry.Meta.Disabled {
+			deprecatedAt[fingerprint] = s.keyDeprecatedAt(app.Id, fingerprint)
+		}
+	}
+	return deprecatedAt
+}
+
+// checkDeprecatedKey ensures a deprecated key is still within the
+// RotationOverlap, returning a *KeyDeprecated error if not
+func (s *AppKeyService) checkDeprecatedKey(app uint64, fingerprint string, logger kslog.KsLogger) error {
+	overlap := s.RotationOverlap
+	if overlap == 0 {
+		overlap = DEFAULT_ROTATION_OVERLAP
+	}
+	deprecatedAt := s.keyDeprecatedAt(app, fingerprint)
+	if overlap > 0 && !deprecatedAt.IsZero() && s.now().Sub(deprecatedAt) < overlap {
+		logger.Logf("Signing with key %s of app %d deprecated at %s", fingerprint, app, deprecatedAt)
+		return nil
+	}
+	logger.Logf("Key %s of app %d is deprecated", fingerprint, app)
+	return &KeyDeprecated{
+		App:          app,
+		Fingerprint:  fingerprint,
+		DeprecatedAt: deprecatedAt,
+	}
+}
+
+// isUnusableNamedKey determines if an error getting a named key is because
+// it does not exist or is deprecated, so LenientKeys may choose another
+func isUnusableNamedKey(err error) bool {
+	switch err.(type) {
+	case *NoSuchKey, *KeyDeprecated:
+		return true
+	}
+	return false
+}
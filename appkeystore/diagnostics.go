@@ -0,0 +1,42 @@
+package appkeystore
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"time"
+
+	"github.com/aefalcon/github-keystore-protobuf/go/appkeypb"
+	"github.com/aefalcon/go-github-keystore/kslog"
+	"github.com/aefalcon/go-github-keystore/metrics"
+)
+
+// SignJwtDiagnostics describes how a JWT was signed, so a signature failing
+// verification downstream may be traced to its key and input.  It never holds
+// key material; the fingerprint is the public `kid` of the JWT.
+type SignJwtDiagnostics struct {
+	Fingerprint string `json:"fingerprint"` // Fingerprint of the key which signed
+	Algorithm   string `json:"algorithm"`   // JWS algorithm of the signature
+	InputHash   string `json:"inputHash"`   // Unpadded base64url SHA-256 of the signed header and claims
+}
+
+// describe fills in the diagnostics of a signature of input
+func (d *SignJwtDiagnostics) describe(fingerprint, algorithm string, input []byte) {
+	digest := sha256.Sum256(input)
+	d.Fingerprint = fingerprint
+	d.Algorithm = algorithm
+	d.InputHash = base64.RawURLEncoding.EncodeToString(digest[:])
+}
+
+// SignJwtWithDiagnostics signs claims like SignJwt, also describing the
+// signature for diagnosing JWTs rejected downstream.  The input hash is of
+// the first two parts of the JWT, as a verifier computes it.
+func (s *AppKeyService) SignJwtWithDiagnostics(req *appkeypb.SignJwtRequest, logger kslog.KsLogger) (*appkeypb.SignJwtResponse, *SignJwtDiagnostics, error) {
+	start := time.Now()
+	var diag SignJwtDiagnostics
+	resp, err := s.signJwt(req, SignJwtOptions{}, &diag, logger)
+	metrics.Record(s.Metrics, metrics.METRIC_SIGN_JWT, start, err)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, &diag, nil
+}
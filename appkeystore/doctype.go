@@ -0,0 +1,41 @@
+package appkeystore
+
+import (
+	"strings"
+
+	"github.com/aefalcon/go-github-keystore/messagestore"
+)
+
+// Document types of the documents of an AppKeyStore, as given by DocumentType
+const (
+	DOCTYPE_APP_INDEX   = "appindex"
+	DOCTYPE_APP         = "app"
+	DOCTYPE_KEY         = "key"
+	DOCTYPE_KEY_META    = "keymeta"
+	DOCTYPE_APP_HISTORY = "apphistory"
+)
+
+// DocumentType gets the type of the document of a name under the store's
+// links, or an empty string if the name is not of a document of the store.
+// It may be passed to s3store.DocTypeTagger to tag objects by type.
+func (s *AppKeyStore) DocumentType(name string) string {
+	name = strings.TrimPrefix(name, "/")
+	cases := []struct {
+		Template string
+		DocType  string
+	}{
+		{s.Links.AppIndex, DOCTYPE_APP_INDEX},
+		{s.Links.App, DOCTYPE_APP},
+		{s.Links.Key, DOCTYPE_KEY},
+		{s.Links.KeyMeta, DOCTYPE_KEY_META},
+	}
+	for _, c := range cases {
+		if messagestore.MatchName(strings.TrimPrefix(c.Template, "/"), name) {
+			return c.DocType
+		}
+	}
+	if strings.HasPrefix(name, HISTORY_PREFIX) {
+		return DOCTYPE_APP_HISTORY
+	}
+	return ""
+}
@@ -0,0 +1,47 @@
+package appkeystore
+
+import (
+	"github.com/aefalcon/go-github-keystore/kslog"
+	"github.com/aefalcon/go-github-keystore/messagestore"
+	"github.com/golang/protobuf/proto"
+)
+
+// dryRunBackend is a StoreBackend which reads from a backend but only logs
+// the documents it would write or delete
+type dryRunBackend struct {
+	StoreBackend
+	logger kslog.KsLogger
+}
+
+func (b *dryRunBackend) PutBlob(name string, content []byte) (*messagestore.CacheMeta, error) {
+	b.logger.Logf("Dry run: would put %s", name)
+	return &messagestore.CacheMeta{}, nil
+}
+
+func (b *dryRunBackend) DeleteBlob(name string) (*messagestore.CacheMeta, error) {
+	b.logger.Logf("Dry run: would delete %s", name)
+	return nil, nil
+}
+
+func (b *dryRunBackend) PutMessage(name string, pb proto.Message) (*messagestore.CacheMeta, error) {
+	b.logger.Logf("Dry run: would put %s", name)
+	return &messagestore.CacheMeta{}, nil
+}
+
+func (b *dryRunBackend) DeleteMessage(name string) (*messagestore.CacheMeta, error) {
+	b.logger.Logf("Dry run: would delete %s", name)
+	return nil, nil
+}
+
+// dryRun gets a copy of the store which reads from the same backend but
+// logs writes and deletes to logger instead of performing them
+func (s *AppKeyStore) dryRun(logger kslog.KsLogger) *AppKeyStore {
+	return &AppKeyStore{
+		StoreBackend: &dryRunBackend{
+			StoreBackend: s.StoreBackend,
+			logger:       logger,
+		},
+		Links:   s.Links,
+		History: s.History,
+	}
+}
@@ -0,0 +1,89 @@
+package appkeystore
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"sync"
+
+	"github.com/golang/protobuf/jsonpb"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+)
+
+// MAX_POOLED_JWT_BUFFER is the largest buffer of a jwtEncoder kept for
+// reuse, so a rare large JWT does not pin its memory
+const MAX_POOLED_JWT_BUFFER = 64 * 1024
+
+// claimsMarshaler encodes the claims of JWTs
+var claimsMarshaler = jsonpb.Marshaler{}
+
+// jwtEncoder holds the buffers a JWT is encoded in while it is signed, which
+// are pooled so each signature need not allocate its own
+type jwtEncoder struct {
+	json  bytes.Buffer // JSON of the header or claims being encoded
+	input []byte       // Signing input of the encoded header and claims
+}
+
+var jwtEncoders = sync.Pool{
+	New: func() interface{} { return &jwtEncoder{} },
+}
+
+// getJwtEncoder gets an empty encoder from the pool
+func getJwtEncoder() *jwtEncoder {
+	e := jwtEncoders.Get().(*jwtEncoder)
+	e.json.Reset()
+	e.input = e.input[:0]
+	return e
+}
+
+// release returns the encoder to the pool unless its buffers grew too large
+func (e *jwtEncoder) release() {
+	if e.json.Cap() > MAX_POOLED_JWT_BUFFER || cap(e.input) > MAX_POOLED_JWT_BUFFER {
+		return
+	}
+	jwtEncoders.Put(e)
+}
+
+// appendBase64 appends the unpadded base64url encoding of src to the signing
+// input
+func (e *jwtEncoder) appendBase64(src []byte) {
+	n := len(e.input)
+	size := base64.RawURLEncoding.EncodedLen(len(src))
+	if cap(e.input)-n < size {
+		grown := make([]byte, n, 2*cap(e.input)+size)
+		copy(grown, e.input)
+		e.input = grown
+	}
+	e.input = e.input[:n+size]
+	base64.RawURLEncoding.Encode(e.input[n:], src)
+}
+
+// appendHeader encodes the JOSE header as the first part of the signing
+// input, as json.Marshal would encode it
+func (e *jwtEncoder) appendHeader(fields map[string]interface{}) error {
+	e.json.Reset()
+	if err := json.NewEncoder(&e.json).Encode(fields); err != nil {
+		return err
+	}
+	e.appendBase64(bytes.TrimSuffix(e.json.Bytes(), []byte{'\n'}))
+	return nil
+}
+
+// appendClaims encodes the claims as the part of the signing input after
+// the header
+func (e *jwtEncoder) appendClaims(claims *structpb.Struct) error {
+	e.json.Reset()
+	if err := claimsMarshaler.Marshal(&e.json, claims); err != nil {
+		return err
+	}
+	e.input = append(e.input, '.')
+	e.appendBase64(e.json.Bytes())
+	return nil
+}
+
+// token gets the JWT of the signing input and its signature
+func (e *jwtEncoder) token(sig []byte) string {
+	e.input = append(e.input, '.')
+	e.appendBase64(sig)
+	return string(e.input)
+}
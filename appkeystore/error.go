@@ -1,9 +1,53 @@
 package appkeystore
 
 import (
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aefalcon/go-github-keystore/keyservice"
+)
+
+// Machine-readable codes of errors, for callers such as lambda functions
+// which must report failures to clients without Go types
+const (
+	CODE_APP_NOT_FOUND   = "AppNotFound"
+	CODE_KEY_NOT_FOUND   = "KeyNotFound"
+	CODE_KEY_DEPRECATED  = "KeyDeprecated"
+	CODE_APP_EXISTS      = "AppExists"
+	CODE_APP_NOT_ALLOWED = "AppNotAllowed"
+	CODE_INVALID_KEY     = "InvalidKey"
+	CODE_INVALID_REQUEST = "InvalidRequest"
+	CODE_RATE_LIMITED    = "RateLimited"
+	CODE_INTERNAL        = "Internal"
 )
 
+// CodedError is an error with a machine-readable code
+type CodedError interface {
+	error
+	ErrorCode() string
+}
+
+// ErrorCode gets the code of an error, or of the first CodedError it wraps.
+// Rejections of an AppPolicy are CODE_APP_NOT_ALLOWED, other errors which do
+// not wrap a CodedError are CODE_INTERNAL, and nil errors have no code.
+func ErrorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+	var coded CodedError
+	if errors.As(err, &coded) {
+		return coded.ErrorCode()
+	}
+	var notAllowed *keyservice.AppNotAllowed
+	if errors.As(err, &notAllowed) {
+		return CODE_APP_NOT_ALLOWED
+	}
+	return CODE_INTERNAL
+}
+
 // AppExists is an error indicating an application with a
 // given ID already exists.  It may be converted to uin64 to
 // retreive the application ID.
@@ -13,6 +57,23 @@ func (e AppExists) Error() string {
 	return fmt.Sprintf("app %d already exists", uint64(e))
 }
 
+func (e AppExists) ErrorCode() string {
+	return CODE_APP_EXISTS
+}
+
+// NoSuchApp is an error indicating an application with a given ID
+// does not exist.  It may be converted to uint64 to get the
+// application ID.
+type NoSuchApp uint64
+
+func (e NoSuchApp) Error() string {
+	return fmt.Sprintf("app %d does not exist", uint64(e))
+}
+
+func (e NoSuchApp) ErrorCode() string {
+	return CODE_APP_NOT_FOUND
+}
+
 // UnallowedAppId is an error indicating that a given app ID may
 // not be used.  It may be converted to uint64 to get the
 // application ID.
@@ -22,6 +83,10 @@ func (e UnallowedAppId) Error() string {
 	return fmt.Sprintf("app id %d is not allowed", uint64(e))
 }
 
+func (e UnallowedAppId) ErrorCode() string {
+	return CODE_INVALID_REQUEST
+}
+
 // UnsupportedSignatureAlgo is an error indicating that a specified
 // signature algorithm is not supported.  It may be converted to
 // string to get the identifier of the unsupported algorithm.
@@ -31,6 +96,23 @@ func (e UnsupportedSignatureAlgo) Error() string {
 	return fmt.Sprintf("unsupported algorithm %s", string(e))
 }
 
+func (e UnsupportedSignatureAlgo) ErrorCode() string {
+	return CODE_INVALID_REQUEST
+}
+
+// AlgorithmNotAllowed is an error indicating that a supported signature
+// algorithm is outside the AllowedAlgorithms of the service.  It may be
+// converted to string to get the identifier of the algorithm.
+type AlgorithmNotAllowed string
+
+func (e AlgorithmNotAllowed) Error() string {
+	return fmt.Sprintf("algorithm %s is not allowed", string(e))
+}
+
+func (e AlgorithmNotAllowed) ErrorCode() string {
+	return CODE_INVALID_REQUEST
+}
+
 // NoKeyForApp is an error indicating that a certain application
 // has no available key.  It may be converted to uint64 to get
 // the application ID.
@@ -40,6 +122,10 @@ func (e NoKeyForApp) Error() string {
 	return fmt.Sprintf("No key for app %d", uint64(e))
 }
 
+func (e NoKeyForApp) ErrorCode() string {
+	return CODE_KEY_NOT_FOUND
+}
+
 // InvalidClaims is in error indicating that given claims are not
 // acceptable.
 type InvalidClaims string
@@ -48,6 +134,10 @@ func (e InvalidClaims) Error() string {
 	return string(e)
 }
 
+func (e InvalidClaims) ErrorCode() string {
+	return CODE_INVALID_REQUEST
+}
+
 // FingerprintMismatch is an error indicating that a key fingerprint does
 // not match the key.
 type FingerprintMismatch struct {
@@ -58,3 +148,277 @@ type FingerprintMismatch struct {
 func (e *FingerprintMismatch) Error() string {
 	return fmt.Sprintf("derived fingerprint %s for key with stated fingerprint %s", e.Derived, e.Given)
 }
+
+func (e *FingerprintMismatch) ErrorCode() string {
+	return CODE_INVALID_KEY
+}
+
+// IndexDrift is a non-fatal error indicating that the application index
+// does not reference the document describing an application, or that its
+// entry names another application.  It is returned alongside the
+// authoritative application document.
+type IndexDrift struct {
+	App       uint64 // The application ID
+	IndexedId uint64 // Application ID of the index entry; 0 if the app is not referenced
+}
+
+func (e *IndexDrift) Error() string {
+	if e.IndexedId == 0 {
+		return fmt.Sprintf("app %d exists but is not referenced by the application index", e.App)
+	}
+	return fmt.Sprintf("app %d is indexed as app %d", e.App, e.IndexedId)
+}
+
+// PrimaryKeyUnusable is an error indicating that none of an application's
+// keys could be used, including its primary key.
+type PrimaryKeyUnusable struct {
+	App         uint64 // The application ID
+	Fingerprint string // Fingerprint of the primary key
+	Cause       error  // Why the primary key could not be used
+}
+
+func (e *PrimaryKeyUnusable) Error() string {
+	return fmt.Sprintf("no usable key for app %d; primary key %s: %s", e.App, e.Fingerprint, e.Cause)
+}
+
+// InvalidContinuationToken is an error indicating that a continuation token
+// was not issued by a previous listing.  It may be converted to string to get
+// the token.
+type InvalidContinuationToken string
+
+func (e InvalidContinuationToken) Error() string {
+	return fmt.Sprintf("invalid continuation token %s", string(e))
+}
+
+// InvalidJwt is an error indicating a JWT is malformed
+type InvalidJwt string
+
+func (e InvalidJwt) Error() string {
+	return "invalid JWT: " + string(e)
+}
+
+// JwtSignatureInvalid is an error indicating a JWT was not signed by any
+// key of an application.  It may be converted to uint64 to get the
+// application ID.
+type JwtSignatureInvalid uint64
+
+func (e JwtSignatureInvalid) Error() string {
+	return fmt.Sprintf("JWT signature does not verify with any key of app %d", uint64(e))
+}
+
+// JwtExpired is an error indicating a JWT's `exp` claim has passed
+type JwtExpired struct {
+	Expiration time.Time
+}
+
+func (e *JwtExpired) Error() string {
+	return fmt.Sprintf("JWT expired at %s", e.Expiration)
+}
+
+// JwtNotYetValid is an error indicating a JWT's `nbf` claim has not passed
+type JwtNotYetValid struct {
+	NotBefore time.Time
+}
+
+func (e *JwtNotYetValid) Error() string {
+	return fmt.Sprintf("JWT is not valid before %s", e.NotBefore)
+}
+
+// KeyAlgorithmMismatch is an error indicating that a signature algorithm
+// cannot be used with a type of key.
+type KeyAlgorithmMismatch struct {
+	Algorithm string // The signature algorithm
+	KeyType   string // Description of the key's type
+}
+
+func (e *KeyAlgorithmMismatch) Error() string {
+	return fmt.Sprintf("algorithm %s cannot be used with %s key", e.Algorithm, e.KeyType)
+}
+
+// UnknownIssuer is an error indicating the `iss` claim of a JWT does not name
+// a known application.  It may be converted to uint64 to get the issuer.
+type UnknownIssuer uint64
+
+func (e UnknownIssuer) Error() string {
+	return fmt.Sprintf("issuer %d is not a known app", uint64(e))
+}
+
+// NoSuchKey is an error indicating an application has no enabled key with a
+// certain fingerprint
+type NoSuchKey struct {
+	App         uint64
+	Fingerprint string
+}
+
+func (e *NoSuchKey) Error() string {
+	return fmt.Sprintf("app %d has no key %s", e.App, e.Fingerprint)
+}
+
+func (e *NoSuchKey) ErrorCode() string {
+	return CODE_KEY_NOT_FOUND
+}
+
+// KeyExists is an error indicating an application already has a key with a
+// certain fingerprint
+type KeyExists struct {
+	App         uint64
+	Fingerprint string
+}
+
+func (e *KeyExists) Error() string {
+	return fmt.Sprintf("app %d already has key %s", e.App, e.Fingerprint)
+}
+
+// LastKey is an error indicating removing keys would leave an application
+// without an enabled key, or without any key.  It may be converted to
+// uint64 to get the application ID.
+type LastKey uint64
+
+func (e LastKey) Error() string {
+	return fmt.Sprintf("refusing to remove the last enabled key of app %d", uint64(e))
+}
+
+// TooManyKeys is an error indicating adding keys would give an application
+// more than the MaxKeysPerApp of the service
+type TooManyKeys struct {
+	App  uint64 // The application ID
+	Keys int    // Keys the application would have
+	Max  int    // The most keys it may have
+}
+
+func (e *TooManyKeys) Error() string {
+	return fmt.Sprintf("app %d would have %d keys, more than the maximum of %d", e.App, e.Keys, e.Max)
+}
+
+func (e *TooManyKeys) ErrorCode() string {
+	return CODE_INVALID_REQUEST
+}
+
+// InvalidKey is an error indicating a submitted key could not be parsed
+type InvalidKey struct {
+	Index       int    // Position of the key in the request
+	Fingerprint string // The stated fingerprint of the key, if any
+	Cause       error  // Why the key could not be parsed
+}
+
+func (e *InvalidKey) Error() string {
+	if e.Fingerprint != "" {
+		return fmt.Sprintf("key %d with fingerprint %s is invalid: %s", e.Index, e.Fingerprint, e.Cause)
+	}
+	return fmt.Sprintf("key %d is invalid: %s", e.Index, e.Cause)
+}
+
+func (e *InvalidKey) ErrorCode() string {
+	return CODE_INVALID_KEY
+}
+
+// InvalidKeys is an error indicating several submitted keys were rejected.
+// Errors holds the error of each rejected key in request order.
+type InvalidKeys struct {
+	Errors []error
+}
+
+func (e *InvalidKeys) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d keys are invalid: %s", len(e.Errors), strings.Join(msgs, "; "))
+}
+
+func (e *InvalidKeys) ErrorCode() string {
+	return CODE_INVALID_KEY
+}
+
+// DbNotInitialized is an error indicating the store has no application
+// index because InitDb was never called.  It may be converted to string to
+// get the name of the missing index.
+type DbNotInitialized string
+
+func (e DbNotInitialized) Error() string {
+	return fmt.Sprintf("database is not initialized; application index %s does not exist", string(e))
+}
+
+// RateLimited is an error indicating an app has exceeded its signing rate
+type RateLimited struct {
+	App        uint64        // The application ID
+	RetryAfter time.Duration // Time until the app may sign again
+}
+
+func (e *RateLimited) Error() string {
+	return fmt.Sprintf("app %d exceeded its signing rate; retry after %s", e.App, e.RetryAfter)
+}
+
+func (e *RateLimited) ErrorCode() string {
+	return CODE_RATE_LIMITED
+}
+
+// AppsRejected is an error indicating an AddApps request was aborted because
+// some of its apps could not be added.  Errors holds the error of each
+// rejected app by app ID.
+type AppsRejected struct {
+	Errors map[uint64]error
+}
+
+func (e *AppsRejected) Error() string {
+	apps := make([]uint64, 0, len(e.Errors))
+	for app := range e.Errors {
+		apps = append(apps, app)
+	}
+	sort.Slice(apps, func(i, j int) bool { return apps[i] < apps[j] })
+	msgs := make([]string, len(apps))
+	for i, app := range apps {
+		msgs[i] = fmt.Sprintf("app %d: %s", app, e.Errors[app])
+	}
+	return fmt.Sprintf("%d apps were rejected: %s", len(apps), strings.Join(msgs, "; "))
+}
+
+func (e *AppsRejected) ErrorCode() string {
+	return CODE_INVALID_REQUEST
+}
+
+// HistoryNotRecorded is a non-fatal error indicating the document describing
+// an application was put but its copy could not be added to the app history.
+// It is returned alongside the metadata of the put document.
+type HistoryNotRecorded struct {
+	App   uint64 // The application ID
+	Cause error
+}
+
+func (e *HistoryNotRecorded) Error() string {
+	return fmt.Sprintf("app %d was put but its history was not recorded: %s", e.App, e.Cause)
+}
+
+// KeyDeprecated is an error indicating a named key of an application is
+// deprecated and the rotation overlap during which it may still sign has
+// passed.  DeprecatedAt is zero if the time it was deprecated is unknown, as
+// for keys disabled by other means than DeprecateKey.
+type KeyDeprecated struct {
+	App          uint64    // The application ID
+	Fingerprint  string    // Fingerprint of the deprecated key
+	DeprecatedAt time.Time // When the key was deprecated
+}
+
+func (e *KeyDeprecated) Error() string {
+	if e.DeprecatedAt.IsZero() {
+		return fmt.Sprintf("key %s of app %d is deprecated", e.Fingerprint, e.App)
+	}
+	return fmt.Sprintf("key %s of app %d was deprecated at %s", e.Fingerprint, e.App, e.DeprecatedAt.Format(time.RFC3339))
+}
+
+func (e *KeyDeprecated) ErrorCode() string {
+	return CODE_KEY_DEPRECATED
+}
+
+// LifetimeUnsupported is an error indicating a default lifetime was given
+// for an application whose backend, of the named type, cannot record the
+// user metadata it is kept in
+type LifetimeUnsupported string
+
+func (e LifetimeUnsupported) Error() string {
+	return fmt.Sprintf("store %s cannot record the default lifetime of an app", string(e))
+}
+
+func (e LifetimeUnsupported) ErrorCode() string {
+	return CODE_INVALID_REQUEST
+}
@@ -0,0 +1,51 @@
+package appkeystore
+
+import (
+	"github.com/aefalcon/go-github-keystore/kslog"
+	"github.com/aefalcon/go-github-keystore/messagestore"
+)
+
+// AUDIT_KEY_EXPORT is the audit field value of log messages of ExportAppKey
+const AUDIT_KEY_EXPORT = "key_export"
+
+// ExportAppKey gets the private key of an application as stored, such as
+// PEM, for emergency export of keys from the store.  Keys referencing KMS or
+// Secrets Manager are returned as the stored reference.  Disabled keys may be
+// exported.  Every call logs a warning for auditing, with the fields of
+// logger, so callers should give context such as the operator and reason
+// with kslog.WithFields.  A NoSuchApp error is returned for an unknown app
+// and a *NoSuchKey error for an unknown fingerprint.
+func (s *AppKeyService) ExportAppKey(app uint64, fingerprint string, logger kslog.KsLogger) ([]byte, error) {
+	kslog.LogFields(logger, kslog.LEVEL_WARN, "Exporting private key", kslog.Fields{
+		"audit":       AUDIT_KEY_EXPORT,
+		"app":         app,
+		"fingerprint": fingerprint,
+	})
+	appMsg, _, err := s.Store.GetApp(app)
+	if messagestore.IsNotFound(err) {
+		logger.Logf("App %d does not exist", app)
+		return nil, NoSuchApp(app)
+	} else if err != nil {
+		logger.Errorf("Failed to get app %d: %s", app, err)
+		return nil, err
+	}
+	if _, found := appMsg.Keys[fingerprint]; !found {
+		logger.Logf("App %d does not have key %s", app, fingerprint)
+		return nil, &NoSuchKey{
+			App:         app,
+			Fingerprint: fingerprint,
+		}
+	}
+	key, _, err := s.Store.GetKey(app, fingerprint)
+	if messagestore.IsNotFound(err) {
+		logger.Errorf("Key %s of app %d is indexed but missing", fingerprint, app)
+		return nil, &NoSuchKey{
+			App:         app,
+			Fingerprint: fingerprint,
+		}
+	} else if err != nil {
+		logger.Errorf("Failed to get key %s of app %d: %s", fingerprint, app, err)
+		return nil, err
+	}
+	return key, nil
+}
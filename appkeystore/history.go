@@ -0,0 +1,124 @@
+package appkeystore
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aefalcon/github-keystore-protobuf/go/appkeypb"
+	"github.com/aefalcon/go-github-keystore/kslog"
+	"github.com/aefalcon/go-github-keystore/messagestore"
+)
+
+// HISTORY_PREFIX begins the names of the copies an AppKeyStore with History
+// keeps of app documents.  Each copy is named by the app document name and
+// the time it was put, such as "history/apps/1/app/01700000000000000000".
+const HISTORY_PREFIX = "history/"
+
+// MAX_HISTORY_ATTEMPTS is the number of names tried for a history copy when
+// copies are put at the same instant
+const MAX_HISTORY_ATTEMPTS = 8
+
+// AppKeyDocVersion is a version of the document describing an application
+// kept in the app history
+type AppKeyDocVersion struct {
+	Time time.Time               // When the version was put
+	Name string                  // Name of the history copy
+	App  *appkeypb.App           // The document as it was put
+	Meta *messagestore.CacheMeta // Cache metadata of the history copy
+}
+
+// historyPrefix gets the prefix of the names of history copies of an app
+func (s *AppKeyStore) historyPrefix(appId uint64) (string, error) {
+	name, err := s.appName(appId)
+	if err != nil {
+		return "", err
+	}
+	return HISTORY_PREFIX + strings.TrimPrefix(name, "/") + "/", nil
+}
+
+// now gets the current time from the store's clock
+func (s *AppKeyStore) now() time.Time {
+	if s.Clock == nil {
+		return time.Now()
+	}
+	return s.Clock()
+}
+
+// recordAppHistory puts a copy of an app document in the app history, if
+// History is enabled.  Copies are put only if no other has the same name
+// when the backend can put conditionally, so an existing version is never
+// overwritten.
+func (s *AppKeyStore) recordAppHistory(app *appkeypb.App) error {
+	if !s.History {
+		return nil
+	}
+	prefix, err := s.historyPrefix(app.Id)
+	if err != nil {
+		return &HistoryNotRecorded{App: app.Id, Cause: err}
+	}
+	stamp := s.now().UnixNano()
+	for attempt := 1; ; attempt++ {
+		name := fmt.Sprintf("%s%020d", prefix, stamp)
+		_, err = messagestore.PutMessageIfMatch(s.StoreBackend, name, app, nil)
+		if _, ok := err.(messagestore.ConditionalUnsupported); ok {
+			_, err = s.PutMessage(name, app)
+		}
+		if !messagestore.IsConflict(err) || attempt == MAX_HISTORY_ATTEMPTS {
+			break
+		}
+		stamp++
+	}
+	if err != nil {
+		return &HistoryNotRecorded{App: app.Id, Cause: err}
+	}
+	return nil
+}
+
+// GetAppHistory gets the versions of the document describing an application
+// kept by an AppKeyStore with History, oldest first.  History is kept after
+// the application is removed.  The backend must be a
+// messagestore.ListableMessageStore.
+func (s *AppKeyStore) GetAppHistory(appId uint64) ([]AppKeyDocVersion, error) {
+	prefix, err := s.historyPrefix(appId)
+	if err != nil {
+		return nil, err
+	}
+	names, err := messagestore.ListMessages(s.StoreBackend, prefix)
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]AppKeyDocVersion, 0, len(names))
+	for _, name := range names {
+		stamp, err := strconv.ParseInt(strings.TrimPrefix(name, prefix), 10, 64)
+		if err != nil {
+			// Not a history copy
+			continue
+		}
+		var app appkeypb.App
+		meta, err := s.GetMessage(name, &app)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, AppKeyDocVersion{
+			Time: time.Unix(0, stamp).UTC(),
+			Name: name,
+			App:  &app,
+			Meta: meta,
+		})
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Time.Before(versions[j].Time) })
+	return versions, nil
+}
+
+// tolerateHistory logs a *HistoryNotRecorded error of a put app document and
+// drops it, since the document itself was put
+func tolerateHistory(err error, logger kslog.KsLogger) error {
+	if historyErr, ok := err.(*HistoryNotRecorded); ok {
+		logger.Errorf("Failed to record history: %s", historyErr)
+		return nil
+	}
+	return err
+}
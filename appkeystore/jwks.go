@@ -0,0 +1,131 @@
+package appkeystore
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/aefalcon/go-github-keystore/kslog"
+)
+
+// PublicKey is the public part of an application key
+type PublicKey struct {
+	Fingerprint string           // Fingerprint of the key
+	Key         crypto.PublicKey // An *rsa.PublicKey or *ecdsa.PublicKey
+}
+
+// GetPublicKeys derives the public keys of an application's enabled keys,
+// ordered by fingerprint
+func (s *AppKeyService) GetPublicKeys(app uint64, logger kslog.KsLogger) ([]PublicKey, error) {
+	appDoc, _, err := s.Store.GetApp(app)
+	if err != nil {
+		logger.Logf("Failed to get app %d: %s", app, err)
+		return nil, err
+	}
+	fingerprints := make([]string, 0, len(appDoc.Keys))
+	for fingerprint, keyEntry := range appDoc.Keys {
+		if keyEntry.Meta.Disabled {
+			continue
+		}
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	sort.Strings(fingerprints)
+	keys, err := s.Store.GetKeys(app, fingerprints)
+	if err != nil {
+		logger.Logf("Failed to get keys for app %d: %s", app, err)
+		return nil, err
+	}
+	publicKeys := make([]PublicKey, 0, len(fingerprints))
+	for i, fingerprint := range fingerprints {
+		signer, err := s.parseSigner(keys[i])
+		if err != nil {
+			logger.Logf("Failed to parse private key %s: %s", fingerprint, err)
+			return nil, err
+		}
+		publicKeys = append(publicKeys, PublicKey{
+			Fingerprint: fingerprint,
+			Key:         signer.Public(),
+		})
+	}
+	return publicKeys, nil
+}
+
+// Jwk is a JSON Web Key describing a public key
+type Jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// Jwks is a JSON Web Key Set
+type Jwks struct {
+	Keys []Jwk `json:"keys"`
+}
+
+// b64Uint encodes an unsigned integer as base64url of its big-endian bytes,
+// zero padded to size bytes
+func b64Uint(n *big.Int, size int) string {
+	b := n.Bytes()
+	if len(b) < size {
+		b = append(make([]byte, size-len(b)), b...)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// NewJwk describes a public key as a JWK with `kid` set to its fingerprint
+func NewJwk(key PublicKey) (*Jwk, error) {
+	switch tk := key.Key.(type) {
+	case *rsa.PublicKey:
+		return &Jwk{
+			Kty: "RSA",
+			Kid: key.Fingerprint,
+			Use: "sig",
+			N:   b64Uint(tk.N, 0),
+			E:   b64Uint(big.NewInt(int64(tk.E)), 0),
+		}, nil
+	case *ecdsa.PublicKey:
+		size := (tk.Curve.Params().BitSize + 7) / 8
+		jwk := Jwk{
+			Kty: "EC",
+			Kid: key.Fingerprint,
+			Use: "sig",
+			Crv: tk.Curve.Params().Name,
+			X:   b64Uint(tk.X, size),
+			Y:   b64Uint(tk.Y, size),
+		}
+		for name, alg := range jwsAlgorithms {
+			if alg.Curve == tk.Curve {
+				jwk.Alg = name
+			}
+		}
+		return &jwk, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", key.Key)
+	}
+}
+
+// MarshalJwks serializes public keys as a JWKS JSON document
+func MarshalJwks(keys []PublicKey) ([]byte, error) {
+	jwks := Jwks{
+		Keys: make([]Jwk, 0, len(keys)),
+	}
+	for _, key := range keys {
+		jwk, err := NewJwk(key)
+		if err != nil {
+			return nil, err
+		}
+		jwks.Keys = append(jwks.Keys, *jwk)
+	}
+	return json.Marshal(&jwks)
+}
@@ -0,0 +1,101 @@
+package appkeystore
+
+import (
+	"container/list"
+	"crypto"
+	"sync"
+
+	"github.com/aefalcon/go-github-keystore/keyutils"
+	"github.com/aefalcon/go-github-keystore/messagestore"
+)
+
+// DEFAULT_KEY_CACHE_SIZE is the number of parsed keys an AppKeyService caches
+// unless configured otherwise
+const DEFAULT_KEY_CACHE_SIZE = 64
+
+// parseSigningKey parses keys loaded for signing
+var parseSigningKey = keyutils.ParseSigner
+
+// keyCacheId identifies a key of an application
+type keyCacheId struct {
+	App         uint64
+	Fingerprint string
+}
+
+// keyCacheEntry is a parsed key and the version of the application document
+// it was loaded with
+type keyCacheEntry struct {
+	Id         keyCacheId
+	AppVersion *messagestore.CacheMeta
+	Signer     crypto.Signer
+}
+
+// keyCache is an LRU cache of parsed private keys.  A key is only used while
+// the document of its application is unchanged, so keys removed or disabled
+// since they were cached are not used.
+type keyCache struct {
+	mu      sync.Mutex
+	entries map[keyCacheId]*list.Element
+	lru     *list.List
+}
+
+// sameAppVersion reports whether two cache metadata describe the same version
+// of an application document
+func sameAppVersion(a, b *messagestore.CacheMeta) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	if a.ETag != "" || b.ETag != "" {
+		return a.ETag == b.ETag
+	}
+	return !a.LastModified.IsZero() && a.LastModified.Equal(b.LastModified)
+}
+
+// get gets a cached key loaded with the application version appMeta
+func (c *keyCache) get(id keyCacheId, appMeta *messagestore.CacheMeta) crypto.Signer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, found := c.entries[id]
+	if !found {
+		return nil
+	}
+	entry := elem.Value.(*keyCacheEntry)
+	if !sameAppVersion(entry.AppVersion, appMeta) {
+		c.lru.Remove(elem)
+		delete(c.entries, id)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return entry.Signer
+}
+
+// put caches a key, evicting the least recently used keys beyond maxEntries.
+// Keys loaded with an application version that cannot be compared are not
+// cached.
+func (c *keyCache) put(id keyCacheId, appMeta *messagestore.CacheMeta, signer crypto.Signer, maxEntries int) {
+	if maxEntries <= 0 || !sameAppVersion(appMeta, appMeta) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[keyCacheId]*list.Element)
+		c.lru = list.New()
+	}
+	entry := &keyCacheEntry{
+		Id:         id,
+		AppVersion: appMeta,
+		Signer:     signer,
+	}
+	if elem, found := c.entries[id]; found {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+	} else {
+		c.entries[id] = c.lru.PushFront(entry)
+	}
+	for c.lru.Len() > maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*keyCacheEntry).Id)
+	}
+}
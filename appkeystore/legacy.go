@@ -0,0 +1,40 @@
+package appkeystore
+
+import (
+	"github.com/aefalcon/github-keystore-protobuf/go/appkeypb"
+	"github.com/golang/protobuf/proto"
+)
+
+// LegacyApp is the layout of app documents written before apps could have
+// several keys, naming their only key directly.  It is declared here rather
+// than generated, since the keystore's protobuf packages only describe the
+// current layout; its fields are encoded as those of the protobuf message
+//
+//	message LegacyApp {
+//	    uint64 id = 1;
+//	    AppKeyIndexEntry key = 3;
+//	}
+type LegacyApp struct {
+	Id  uint64                     `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	Key *appkeypb.AppKeyIndexEntry `protobuf:"bytes,3,opt,name=key,proto3" json:"key,omitempty"`
+}
+
+func (m *LegacyApp) Reset()         { *m = LegacyApp{} }
+func (m *LegacyApp) String() string { return proto.CompactTextString(m) }
+func (*LegacyApp) ProtoMessage()    {}
+
+// upgradeLegacyApp fills in the keys of an app document without any from its
+// legacy single key, if the document is of the legacy layout.  The document
+// is not rewritten; the next put of the app stores the current layout.
+func (s *AppKeyStore) upgradeLegacyApp(name string, app *appkeypb.App) {
+	var legacy LegacyApp
+	if _, err := s.GetMessage(name, &legacy); err != nil {
+		return
+	}
+	if legacy.Key == nil || legacy.Key.Meta == nil || legacy.Key.Meta.Fingerprint == "" {
+		return
+	}
+	app.Keys = map[string]*appkeypb.AppKeyIndexEntry{
+		legacy.Key.Meta.Fingerprint: legacy.Key,
+	}
+}
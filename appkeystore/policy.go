@@ -0,0 +1,25 @@
+package appkeystore
+
+import (
+	"github.com/aefalcon/go-github-keystore/keyservice"
+	"github.com/aefalcon/go-github-keystore/messagestore"
+)
+
+// KnownApps is a keyservice.AppPolicy accepting only applications which have
+// a document in a store.  It lets services acting for applications, such as
+// tokenstore.InstallTokenService, reject ids that were never added with a
+// NoSuchApp error rather than minting tokens for them.  It must not be the
+// AppPolicy of the AppKeyService adding applications to the store.
+type KnownApps struct {
+	Store *AppKeyStore
+}
+
+var _ keyservice.AppPolicy = KnownApps{}
+
+func (p KnownApps) Allowed(app uint64) error {
+	_, _, err := p.Store.GetApp(app)
+	if messagestore.IsNotFound(err) {
+		return NoSuchApp(app)
+	}
+	return err
+}
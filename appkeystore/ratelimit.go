@@ -0,0 +1,66 @@
+package appkeystore
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// SigningLimiter limits the rate at which each app may sign JWTs with a token
+// bucket per app.  Buckets begin full.  It is safe for concurrent use.
+type SigningLimiter struct {
+	Rate    float64          // Signatures per second each app may sustain
+	Burst   int              // Signatures an idle app may make at once; at least 1
+	Clock   func() time.Time // Current time for refilling buckets, such as a timeutils.Clock's Now; defaults to time.Now
+	mu      sync.Mutex
+	buckets map[uint64]*tokenBucket
+}
+
+// tokenBucket is the state of an app's bucket
+type tokenBucket struct {
+	Tokens float64
+	Last   time.Time
+}
+
+func (l *SigningLimiter) now() time.Time {
+	if l.Clock == nil {
+		return time.Now()
+	}
+	return l.Clock()
+}
+
+// Allow takes a token from the bucket of an app if one is available.  If not,
+// the time until one will be is returned.
+func (l *SigningLimiter) Allow(app uint64) (bool, time.Duration) {
+	burst := float64(l.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = make(map[uint64]*tokenBucket)
+	}
+	bucket, found := l.buckets[app]
+	if !found {
+		bucket = &tokenBucket{
+			Tokens: burst,
+			Last:   now,
+		}
+		l.buckets[app] = bucket
+	}
+	if elapsed := now.Sub(bucket.Last); elapsed > 0 {
+		bucket.Tokens = math.Min(burst, bucket.Tokens+elapsed.Seconds()*l.Rate)
+		bucket.Last = now
+	}
+	if bucket.Tokens >= 1 {
+		bucket.Tokens--
+		return true, 0
+	}
+	if l.Rate <= 0 {
+		return false, time.Duration(math.MaxInt64)
+	}
+	wait := time.Duration((1 - bucket.Tokens) / l.Rate * float64(time.Second))
+	return false, wait
+}
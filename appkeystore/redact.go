@@ -0,0 +1,36 @@
+package appkeystore
+
+import (
+	"fmt"
+
+	"github.com/aefalcon/github-keystore-protobuf/go/appkeypb"
+)
+
+// RedactedAppKey formats an app key without its key material, so it may be
+// logged.  Only the metadata and length of the key are printed.
+type RedactedAppKey struct {
+	Key *appkeypb.AppKey
+}
+
+// RedactAppKey wraps an app key to be formatted without its key material,
+// such as in log calls with %v or %s
+func RedactAppKey(key *appkeypb.AppKey) RedactedAppKey {
+	return RedactedAppKey{Key: key}
+}
+
+func (k RedactedAppKey) String() string {
+	if k.Key == nil {
+		return "AppKey{}"
+	}
+	meta := k.Key.Meta
+	if meta == nil {
+		meta = &appkeypb.AppKeyMeta{}
+	}
+	return fmt.Sprintf("AppKey{App:%d Fingerprint:%s Disabled:%t Key:<%d bytes redacted>}", meta.App, meta.Fingerprint, meta.Disabled, len(k.Key.Key))
+}
+
+// GoString formats the key for %#v like String, so no verb prints the key
+// material
+func (k RedactedAppKey) GoString() string {
+	return k.String()
+}
@@ -0,0 +1,91 @@
+package appkeystore
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aefalcon/go-github-keystore/keyutils"
+)
+
+// DEFAULT_SECRET_CACHE_TTL is how long an AppKeyService caches keys resolved
+// from Secrets Manager unless configured otherwise
+const DEFAULT_SECRET_CACHE_TTL = 5 * time.Minute
+
+// secretCacheEntry is a key resolved from a secret and when it expires
+type secretCacheEntry struct {
+	Key     []byte
+	Expires time.Time
+}
+
+// secretCache holds keys resolved from Secrets Manager by secret id for a
+// short time, so signing and verifying does not fetch the secret every time
+type secretCache struct {
+	mu      sync.Mutex
+	entries map[string]secretCacheEntry
+}
+
+// get gets a cached key which has not expired at now
+func (c *secretCache) get(secretId string, now time.Time) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, found := c.entries[secretId]
+	if !found {
+		return nil
+	}
+	if !now.Before(entry.Expires) {
+		delete(c.entries, secretId)
+		return nil
+	}
+	return entry.Key
+}
+
+// put caches a key until expires
+func (c *secretCache) put(secretId string, key []byte, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]secretCacheEntry)
+	}
+	c.entries[secretId] = secretCacheEntry{
+		Key:     key,
+		Expires: expires,
+	}
+}
+
+// resolveKey gets the key referenced by a stored key from Secrets Manager,
+// using the secret cache for up to the SecretCacheTTL.  Keys which are not
+// secret references are returned unchanged.
+func (s *AppKeyService) resolveKey(key []byte) ([]byte, error) {
+	secretId, ok := keyutils.SecretKeyId(key)
+	if !ok {
+		return key, nil
+	}
+	ttl := s.SecretCacheTTL
+	if ttl == 0 {
+		ttl = DEFAULT_SECRET_CACHE_TTL
+	}
+	now := s.now()
+	if ttl > 0 {
+		if resolved := s.secrets.get(secretId, now); resolved != nil {
+			return resolved, nil
+		}
+	}
+	resolved, err := keyutils.GetSecretKey(s.Secrets, secretId)
+	if err != nil {
+		return nil, err
+	}
+	if ttl > 0 {
+		s.secrets.put(secretId, resolved, now.Add(ttl))
+	}
+	return resolved, nil
+}
+
+// parseSigner resolves a stored key and parses it for signing with
+// keyutils.ParseSigner
+func (s *AppKeyService) parseSigner(key []byte) (keyutils.Signer, error) {
+	resolved, err := s.resolveKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return keyutils.ParseSigner(resolved, s.KMS)
+}
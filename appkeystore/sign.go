@@ -0,0 +1,202 @@
+package appkeystore
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// jwsAlgorithm describes how a JWS algorithm signs and verifies data
+type jwsAlgorithm struct {
+	Name  string
+	Hash  crypto.Hash
+	Curve elliptic.Curve // Curve of ECDSA algorithms; nil for RSA algorithms
+	PSS   bool           // RSA algorithm signs with RSASSA-PSS rather than PKCS #1 v1.5
+}
+
+// jwsAlgorithms are the supported JWS signature algorithms
+var jwsAlgorithms = map[string]jwsAlgorithm{
+	"RS256": {Name: "RS256", Hash: crypto.SHA256},
+	"RS384": {Name: "RS384", Hash: crypto.SHA384},
+	"RS512": {Name: "RS512", Hash: crypto.SHA512},
+	"PS256": {Name: "PS256", Hash: crypto.SHA256, PSS: true},
+	"PS384": {Name: "PS384", Hash: crypto.SHA384, PSS: true},
+	"PS512": {Name: "PS512", Hash: crypto.SHA512, PSS: true},
+	"ES256": {Name: "ES256", Hash: crypto.SHA256, Curve: elliptic.P256()},
+	"ES384": {Name: "ES384", Hash: crypto.SHA384, Curve: elliptic.P384()},
+}
+
+// lookupJwsAlgorithm finds a supported JWS algorithm by name
+func lookupJwsAlgorithm(name string) (jwsAlgorithm, error) {
+	alg, found := jwsAlgorithms[name]
+	if !found {
+		return jwsAlgorithm{}, UnsupportedSignatureAlgo(name)
+	}
+	return alg, nil
+}
+
+// keyType describes a key for error messages
+func keyType(key interface{}) string {
+	switch tk := key.(type) {
+	case *rsa.PrivateKey, *rsa.PublicKey:
+		return "RSA"
+	case *ecdsa.PrivateKey:
+		return fmt.Sprintf("EC %s", tk.Curve.Params().Name)
+	case *ecdsa.PublicKey:
+		return fmt.Sprintf("EC %s", tk.Curve.Params().Name)
+	case crypto.Signer:
+		return keyType(tk.Public())
+	default:
+		return fmt.Sprintf("%T", key)
+	}
+}
+
+// DEFAULT_ALLOWED_ALGORITHMS are the algorithms SignJwt accepts unless the
+// AllowedAlgorithms are configured; GitHub only accepts JWTs signed with RSA
+var DEFAULT_ALLOWED_ALGORITHMS = []string{"RS256", "RS384", "RS512"}
+
+// algorithmAllowed determines if SignJwt accepts an algorithm under the
+// AllowedAlgorithms
+func (s *AppKeyService) algorithmAllowed(name string) bool {
+	allowedAlgorithms := s.AllowedAlgorithms
+	if len(allowedAlgorithms) == 0 {
+		allowedAlgorithms = DEFAULT_ALLOWED_ALGORITHMS
+	}
+	for _, allowed := range allowedAlgorithms {
+		if allowed == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkKey ensures a private or public key may be used with the algorithm
+func (a jwsAlgorithm) checkKey(key interface{}) error {
+	ok := false
+	switch tk := key.(type) {
+	case *rsa.PrivateKey, *rsa.PublicKey:
+		ok = a.Curve == nil
+	case *ecdsa.PrivateKey:
+		ok = a.Curve != nil && tk.Curve == a.Curve
+	case *ecdsa.PublicKey:
+		ok = a.Curve != nil && tk.Curve == a.Curve
+	case crypto.Signer:
+		return a.checkKey(tk.Public())
+	}
+	if !ok {
+		return &KeyAlgorithmMismatch{
+			Algorithm: a.Name,
+			KeyType:   keyType(key),
+		}
+	}
+	return nil
+}
+
+// digest hashes data with the algorithm's hash function
+func (a jwsAlgorithm) digest(data []byte) []byte {
+	h := a.Hash.New()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// pssOptions gets the options of RSASSA-PSS signatures of the algorithm,
+// which JWS requires to have a salt the size of the hash
+func (a jwsAlgorithm) pssOptions() *rsa.PSSOptions {
+	return &rsa.PSSOptions{
+		SaltLength: rsa.PSSSaltLengthEqualsHash,
+		Hash:       a.Hash,
+	}
+}
+
+// signerOpts gets the options given to the Sign method of signers
+func (a jwsAlgorithm) signerOpts() crypto.SignerOpts {
+	if a.PSS {
+		return a.pssOptions()
+	}
+	return a.Hash
+}
+
+// curveOctets is the size in bytes of each of R and S in a JWS ECDSA signature
+func (a jwsAlgorithm) curveOctets() int {
+	return (a.Curve.Params().BitSize + 7) / 8
+}
+
+// sign signs data with a private key.  Keys other than *rsa.PrivateKey and
+// *ecdsa.PrivateKey, such as a *keyutils.KMSSigner, sign with their Sign
+// method.  ECDSA signatures are encoded as R||S as required by JWS rather
+// than ASN.1 DER.  Randomness, if the algorithm or signer uses any, is read
+// from random.
+func (a jwsAlgorithm) sign(random io.Reader, key crypto.Signer, data []byte) ([]byte, error) {
+	if err := a.checkKey(key); err != nil {
+		return nil, err
+	}
+	digest := a.digest(data)
+	switch tk := key.(type) {
+	case *rsa.PrivateKey:
+		if a.PSS {
+			return rsa.SignPSS(random, tk, a.Hash, digest, a.pssOptions())
+		}
+		return rsa.SignPKCS1v15(nil, tk, a.Hash, digest)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(random, tk, digest)
+		if err != nil {
+			return nil, err
+		}
+		return a.encodeEcdsa(r, s), nil
+	}
+	sig, err := key.Sign(random, digest, a.signerOpts())
+	if err != nil || a.Curve == nil {
+		return sig, err
+	}
+	var ecdsaSig struct {
+		R, S *big.Int
+	}
+	if _, err := asn1.Unmarshal(sig, &ecdsaSig); err != nil {
+		return nil, fmt.Errorf("failed to decode ECDSA signature: %s", err)
+	}
+	return a.encodeEcdsa(ecdsaSig.R, ecdsaSig.S), nil
+}
+
+// encodeEcdsa encodes an ECDSA signature as R||S
+func (a jwsAlgorithm) encodeEcdsa(r, s *big.Int) []byte {
+	size := a.curveOctets()
+	sig := make([]byte, 2*size)
+	rBytes, sBytes := r.Bytes(), s.Bytes()
+	copy(sig[size-len(rBytes):size], rBytes)
+	copy(sig[2*size-len(sBytes):], sBytes)
+	return sig
+}
+
+// verify checks a signature of data was made by the private key of a public key
+func (a jwsAlgorithm) verify(key crypto.PublicKey, data, sig []byte) error {
+	if err := a.checkKey(key); err != nil {
+		return err
+	}
+	digest := a.digest(data)
+	switch tk := key.(type) {
+	case *rsa.PublicKey:
+		if a.PSS {
+			return rsa.VerifyPSS(tk, a.Hash, digest, sig, a.pssOptions())
+		}
+		return rsa.VerifyPKCS1v15(tk, a.Hash, digest, sig)
+	case *ecdsa.PublicKey:
+		size := a.curveOctets()
+		if len(sig) != 2*size {
+			return fmt.Errorf("ECDSA signature has %d bytes instead of %d", len(sig), 2*size)
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(tk, digest, r, s) {
+			return fmt.Errorf("ECDSA signature does not verify")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key type %T", key)
+}
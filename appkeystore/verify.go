@@ -0,0 +1,228 @@
+package appkeystore
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aefalcon/github-keystore-protobuf/go/appkeypb"
+	"github.com/aefalcon/go-github-keystore/kslog"
+	"github.com/aefalcon/go-github-keystore/timeutils"
+	"github.com/golang/protobuf/jsonpb"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+)
+
+// parsedJwt holds the decoded parts of a compact JWT
+type parsedJwt struct {
+	Header     map[string]interface{}
+	Claims     map[string]interface{}
+	ClaimsJson []byte // The decoded claims before parsing
+	SecureData []byte // The signed portion of the token
+	Signature  []byte
+}
+
+// parseJwt decodes a compact JWT without verifying it
+func parseJwt(token string) (*parsedJwt, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, InvalidJwt("token must have 3 parts")
+	}
+	var jwt parsedJwt
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, InvalidJwt("header is not base64url encoded")
+	}
+	err = json.Unmarshal(header, &jwt.Header)
+	if err != nil {
+		return nil, InvalidJwt("header is not a JSON object")
+	}
+	claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, InvalidJwt("claims are not base64url encoded")
+	}
+	err = json.Unmarshal(claims, &jwt.Claims)
+	if err != nil {
+		return nil, InvalidJwt("claims are not a JSON object")
+	}
+	jwt.ClaimsJson = claims
+	jwt.Signature, err = base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, InvalidJwt("signature is not base64url encoded")
+	}
+	jwt.SecureData = []byte(token[:len(parts[0])+1+len(parts[1])])
+	return &jwt, nil
+}
+
+// verifySignature checks the signature of a JWT against a public key
+func (jwt *parsedJwt) verifySignature(key crypto.PublicKey) error {
+	algName, _ := jwt.Header["alg"].(string)
+	alg, err := lookupJwsAlgorithm(algName)
+	if err != nil {
+		return err
+	}
+	return alg.verify(key, jwt.SecureData, jwt.Signature)
+}
+
+// verifyTimeClaims checks the `exp` and `nbf` claims of a JWT against now
+func (jwt *parsedJwt) verifyTimeClaims(now time.Time) error {
+	expNum, ok := jwt.Claims["exp"].(float64)
+	if !ok {
+		return InvalidJwt("`exp` must be numeric")
+	}
+	exp := timeutils.FloatToTime(expNum)
+	if !now.Before(exp) {
+		return &JwtExpired{Expiration: exp}
+	}
+	if nbfVal, found := jwt.Claims["nbf"]; found {
+		nbfNum, ok := nbfVal.(float64)
+		if !ok {
+			return InvalidJwt("`nbf` must be numeric")
+		}
+		nbf := timeutils.FloatToTime(nbfNum)
+		if now.Before(nbf) {
+			return &JwtNotYetValid{NotBefore: nbf}
+		}
+	}
+	return nil
+}
+
+// candidateFingerprints lists the fingerprints of keys that may have signed
+// a JWT.  If the JWT names a key of the app, only that key is a candidate.
+func candidateFingerprints(app *appkeypb.App, jwt *parsedJwt) []string {
+	if kid, ok := jwt.Claims[KID_CLAIM].(string); ok {
+		if _, found := app.Keys[kid]; found {
+			return []string{kid}
+		}
+	}
+	fingerprints := make([]string, 0, len(app.Keys))
+	for fingerprint := range app.Keys {
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	sort.Strings(fingerprints)
+	return fingerprints
+}
+
+// verifyJwtForApp verifies the signature and time claims of a JWT against the
+// keys of an application.  The fingerprint of the verifying key is returned.
+func (s *AppKeyService) verifyJwtForApp(app *appkeypb.App, jwt *parsedJwt, logger kslog.KsLogger) (string, error) {
+	for _, fingerprint := range candidateFingerprints(app, jwt) {
+		keyBytes, _, err := s.Store.GetKey(app.Id, fingerprint)
+		if err != nil {
+			logger.Logf("Failed to get key %s for app %d: %s", fingerprint, app.Id, err)
+			continue
+		}
+		signer, err := s.parseSigner(keyBytes)
+		if err != nil {
+			logger.Logf("Failed to parse private key %s: %s", fingerprint, err)
+			continue
+		}
+		err = jwt.verifySignature(signer.Public())
+		if _, ok := err.(UnsupportedSignatureAlgo); ok {
+			return "", err
+		} else if err != nil {
+			continue
+		}
+		err = jwt.verifyTimeClaims(s.now().UTC())
+		if err != nil {
+			return "", err
+		}
+		return fingerprint, nil
+	}
+	return "", JwtSignatureInvalid(app.Id)
+}
+
+// VerifyAppJwt verifies a JWT was signed by a key of an application and that
+// its `exp` and `nbf` claims are currently satisfied.  If the JWT names the
+// signing key, only that key is tried, otherwise all the app's keys are tried.
+func (s *AppKeyService) VerifyAppJwt(app uint64, token string, logger kslog.KsLogger) error {
+	_, err := s.VerifyJwt(app, token, logger)
+	return err
+}
+
+// VerifyJwt verifies a JWT as VerifyAppJwt does and gets its claims.  A
+// JwtSignatureInvalid error is returned if no key of the app signed the JWT,
+// and a *JwtExpired error if it was signed but has expired.
+func (s *AppKeyService) VerifyJwt(app uint64, token string, logger kslog.KsLogger) (*structpb.Struct, error) {
+	jwt, err := parseJwt(token)
+	if err != nil {
+		logger.Logf("Failed to parse JWT: %s", err)
+		return nil, err
+	}
+	appDoc, _, err := s.Store.GetApp(app)
+	if err != nil {
+		logger.Logf("Failed to get app %d: %s", app, err)
+		return nil, err
+	}
+	_, err = s.verifyJwtForApp(appDoc, jwt, logger)
+	if err != nil {
+		logger.Logf("JWT did not verify for app %d: %s", app, err)
+		return nil, err
+	}
+	var claims structpb.Struct
+	err = jsonpb.Unmarshal(bytes.NewReader(jwt.ClaimsJson), &claims)
+	if err != nil {
+		logger.Logf("Failed to convert claims of JWT: %s", err)
+		return nil, InvalidJwt("claims cannot be converted to a struct")
+	}
+	return &claims, nil
+}
+
+// issuerApp gets the application id named by the `iss` claim of a JWT
+func (jwt *parsedJwt) issuerApp() (uint64, error) {
+	switch iss := jwt.Claims["iss"].(type) {
+	case string:
+		app, err := strconv.ParseUint(iss, 10, 64)
+		if err != nil {
+			return 0, InvalidJwt("`iss` is not an application id")
+		}
+		return app, nil
+	case float64:
+		if iss < 1 || iss != float64(uint64(iss)) {
+			return 0, InvalidJwt("`iss` is not an application id")
+		}
+		return uint64(iss), nil
+	default:
+		return 0, InvalidJwt("`iss` must be an application id")
+	}
+}
+
+// VerifyIssuerJwt verifies a JWT was signed by a key of the application named
+// by its `iss` claim, as VerifyAppJwt does.  The application must be in the
+// application index.  The application id is returned on success.
+func (s *AppKeyService) VerifyIssuerJwt(token string, logger kslog.KsLogger) (uint64, error) {
+	jwt, err := parseJwt(token)
+	if err != nil {
+		logger.Logf("Failed to parse JWT: %s", err)
+		return 0, err
+	}
+	app, err := jwt.issuerApp()
+	if err != nil {
+		logger.Logf("Failed to read issuer of JWT: %s", err)
+		return 0, err
+	}
+	index, _, err := s.Store.GetAppIndex()
+	if err != nil {
+		logger.Logf("Failed to get app index: %s", err)
+		return 0, err
+	}
+	if _, found := index.AppRefs[app]; !found {
+		logger.Logf("JWT issuer %d is not a known app", app)
+		return 0, UnknownIssuer(app)
+	}
+	appDoc, _, err := s.Store.GetApp(app)
+	if err != nil {
+		logger.Logf("Failed to get app %d: %s", app, err)
+		return 0, err
+	}
+	_, err = s.verifyJwtForApp(appDoc, jwt, logger)
+	if err != nil {
+		logger.Logf("JWT did not verify for app %d: %s", app, err)
+		return 0, err
+	}
+	return app, nil
+}
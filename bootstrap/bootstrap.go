@@ -0,0 +1,181 @@
+// Construct the keystore's services from a single configuration
+package bootstrap
+
+import (
+	"fmt"
+
+	"github.com/aefalcon/github-keystore-protobuf/go/appkeypb"
+	"github.com/aefalcon/github-keystore-protobuf/go/locationpb"
+	"github.com/aefalcon/github-keystore-protobuf/go/tokenpb"
+	"github.com/aefalcon/go-github-keystore/appkeystore"
+	"github.com/aefalcon/go-github-keystore/keyservice"
+	"github.com/aefalcon/go-github-keystore/kslog"
+	"github.com/aefalcon/go-github-keystore/messagestore"
+	"github.com/aefalcon/go-github-keystore/s3store"
+	"github.com/aefalcon/go-github-keystore/s3storev2"
+	"github.com/aefalcon/go-github-keystore/storeloc"
+	"github.com/aefalcon/go-github-keystore/tokenstore"
+)
+
+// MissingConfig is an error indicating a required field of a Config is not
+// set.  It may be converted to string to get the field.
+type MissingConfig string
+
+func (e MissingConfig) Error() string {
+	return fmt.Sprintf("config field %s is required", string(e))
+}
+
+// InvalidConfig is an error indicating a field of a Config is set to an
+// unusable value
+type InvalidConfig struct {
+	Field string
+	Cause error
+}
+
+func (e *InvalidConfig) Error() string {
+	return fmt.Sprintf("config field %s is invalid: %s", e.Field, e.Cause)
+}
+
+// Config describes the stores and providers of a Service
+type Config struct {
+	Location             *locationpb.Location            // Backend of app keys, as for storeloc.NewFromLocation; required
+	TokenLocation        *locationpb.Location            // Backend of cached tokens; the backend of Location if nil
+	Encoding             string                          // Encoding of put messages, as for messagestore.ParseEncoding; ENCODING_PROTO if empty
+	AppLinks             *appkeypb.Links                 // Links of app key documents; defaults to appkeypb.DefaultLinks
+	TokenLinks           *tokenpb.Links                  // Links of token documents; loaded from the token store if nil
+	InitDb               bool                            // Initialize the app key and token stores if they are empty
+	SigningService       keyservice.SigningService       // Signs app JWTs of install token requests; the service's AppKeyService if nil
+	InstallTokenProvider tokenstore.InstallTokenProvider // Provides install tokens; defaults to tokenstore.V3InstallTokenProvider
+	TagObjects           bool                            // Tag objects of S3 stores by document type and expiry, which needs s3:PutObjectTagging
+}
+
+// Service holds the services of a keystore, sharing their stores
+type Service struct {
+	AppKeys        *appkeystore.AppKeyService
+	Tokens         *tokenstore.InstallTokenService
+	appBlobStore   messagestore.BlobStore
+	tokenBlobStore messagestore.BlobStore
+}
+
+// validate checks the fields of a config, giving every problem found in a
+// *messagestore.MultiError by field
+func (cfg *Config) validate() error {
+	var errs messagestore.MultiError
+	if cfg.Location == nil || cfg.Location.Location == nil {
+		errs.Add("Location", MissingConfig("Location"))
+	}
+	if cfg.TokenLocation != nil && cfg.TokenLocation.Location == nil {
+		errs.Add("TokenLocation", MissingConfig("TokenLocation"))
+	}
+	if _, err := messagestore.ParseEncoding(cfg.Encoding); err != nil {
+		errs.Add("Encoding", &InvalidConfig{
+			Field: "Encoding",
+			Cause: err,
+		})
+	}
+	if cfg.TokenLinks != nil {
+		if err := tokenstore.NewTokenMessageStore(nil, cfg.TokenLinks).ValidateLinks(); err != nil {
+			errs.Add("TokenLinks", &InvalidConfig{
+				Field: "TokenLinks",
+				Cause: err,
+			})
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
+// NewService constructs the services of a keystore from cfg.  The config is
+// validated before any store is created, failing with a
+// *messagestore.MultiError of a MissingConfig or *InvalidConfig for each
+// field at fault.  With cfg.TagObjects, objects of S3 stores are tagged by
+// document type.
+func NewService(cfg Config, logger kslog.KsLogger) (*Service, error) {
+	if err := cfg.validate(); err != nil {
+		logger.Errorf("Invalid keystore config: %s", err)
+		return nil, err
+	}
+	encoding, _ := messagestore.ParseEncoding(cfg.Encoding)
+	appBlobStore, err := storeloc.NewFromLocation(cfg.Location, logger)
+	if err != nil {
+		return nil, err
+	}
+	tokenBlobStore := appBlobStore
+	if cfg.TokenLocation != nil {
+		tokenBlobStore, err = storeloc.NewFromLocation(cfg.TokenLocation, logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+	keyService := appkeystore.NewAppKeyService(&messagestore.BlobMessageStore{
+		BlobStore: appBlobStore,
+		Encoding:  encoding,
+	}, cfg.AppLinks)
+	tokenMessageStore := &messagestore.BlobMessageStore{
+		BlobStore: tokenBlobStore,
+		Encoding:  encoding,
+	}
+	var tokenStore *tokenstore.TokenMessageStore
+	if cfg.TokenLinks != nil {
+		tokenStore = tokenstore.NewTokenMessageStore(tokenMessageStore, cfg.TokenLinks)
+	} else if tokenStore, err = tokenstore.LoadTokenMessageStore(tokenMessageStore); err != nil {
+		logger.Errorf("Failed to load token store links: %s", err)
+		return nil, err
+	}
+	if cfg.InitDb {
+		if err = keyService.Store.InitDb(logger); err != nil {
+			return nil, err
+		}
+		if err = tokenStore.InitDb(logger); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.TagObjects {
+		tagObjects(appBlobStore, keyService.Store.DocumentType, tokenStore.DocumentType)
+		if tokenBlobStore != appBlobStore {
+			tagObjects(tokenBlobStore, tokenStore.DocumentType)
+		}
+	}
+	signingService := cfg.SigningService
+	if signingService == nil {
+		signingService = keyService
+	}
+	provider := cfg.InstallTokenProvider
+	if provider == nil {
+		provider = tokenstore.V3InstallTokenProvider
+	}
+	return &Service{
+		AppKeys: keyService,
+		Tokens: &tokenstore.InstallTokenService{
+			TokenMessageStore:    tokenStore,
+			SigningService:       signingService,
+			InstallTokenProvider: provider,
+		},
+		appBlobStore:   appBlobStore,
+		tokenBlobStore: tokenBlobStore,
+	}, nil
+}
+
+// tagObjects tags the objects of an S3 store, using either version of the
+// AWS SDK, by the document types of the stores held in it, and by their
+// expiry
+func tagObjects(store messagestore.BlobStore, docTypes ...func(name string) string) {
+	switch s3Store := store.(type) {
+	case *s3store.S3BlobStore:
+		s3Store.Tagger = s3store.DocTypeTagger(docTypes...)
+		s3Store.TagExpires = true
+	case *s3storev2.S3BlobStore:
+		s3Store.Tagger = s3store.DocTypeTagger(docTypes...)
+		s3Store.TagExpires = true
+	}
+}
+
+// Close closes the stores of the services, flushing their pending writes
+func (s *Service) Close() error {
+	err := messagestore.CloseBlobStore(s.appBlobStore)
+	if s.tokenBlobStore != s.appBlobStore {
+		if tokenErr := messagestore.CloseBlobStore(s.tokenBlobStore); err == nil {
+			err = tokenErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,137 @@
+package bootstrap
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aefalcon/github-keystore-protobuf/go/appkeypb"
+	"github.com/aefalcon/github-keystore-protobuf/go/locationpb"
+	"github.com/aefalcon/github-keystore-protobuf/go/tokenpb"
+	"github.com/aefalcon/go-github-keystore/keyutils"
+	"github.com/aefalcon/go-github-keystore/kslog"
+	"github.com/aefalcon/go-github-keystore/messagestore"
+	"github.com/aefalcon/go-github-keystore/s3store"
+	"github.com/aefalcon/go-github-keystore/s3storev2"
+	"github.com/aefalcon/go-github-keystore/storeloc"
+)
+
+func memLocation() *locationpb.Location {
+	return &locationpb.Location{
+		Location: &locationpb.Location_Url{
+			Url: storeloc.MEM_SCHEME + ":",
+		},
+	}
+}
+
+func TestNewService(t *testing.T) {
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	const appId = 1
+	const installId = 2
+	var receivedAppToken string
+	service, err := NewService(Config{
+		Location: memLocation(),
+		InitDb:   true,
+		InstallTokenProvider: func(install uint64, appToken string) (string, time.Time, error) {
+			receivedAppToken = appToken
+			return "install-token", time.Now().Add(time.Hour), nil
+		},
+	}, &logger)
+	if err != nil {
+		t.Fatalf("Failed to create service: %s", err)
+	}
+	defer service.Close()
+	keyBytes, err := ioutil.ReadFile(filepath.Join("..", "appkeystore", "testdata", "priv1.pem"))
+	if err != nil {
+		t.Fatalf("Failed to read key: %s", err)
+	}
+	signer, err := keyutils.ParseSigningKey(keyBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse key: %s", err)
+	}
+	fingerprint, err := keyutils.SignerFingerprint(signer)
+	if err != nil {
+		t.Fatalf("Failed to fingerprint key: %s", err)
+	}
+	addReq := appkeypb.AddAppRequest{
+		App: appId,
+		Keys: []*appkeypb.AppKey{
+			&appkeypb.AppKey{
+				Key: keyBytes,
+				Meta: &appkeypb.AppKeyMeta{
+					Fingerprint: fingerprint,
+				},
+			},
+		},
+	}
+	if _, err = service.AppKeys.AddApp(&addReq, &logger); err != nil {
+		t.Fatalf("Failed to add app: %s", err)
+	}
+	resp, err := service.Tokens.GetInstallToken(&tokenpb.GetInstallTokenRequest{App: appId, Install: installId}, &logger)
+	if err != nil {
+		t.Fatalf("Failed to get install token: %s", err)
+	}
+	if resp.Token.Token != "install-token" {
+		t.Errorf("Got install token %s", resp.Token.Token)
+	}
+	if err = service.AppKeys.VerifyAppJwt(appId, receivedAppToken, &logger); err != nil {
+		t.Errorf("Provider was given app token which does not verify: %s", err)
+	}
+	if _, _, err = service.Tokens.TokenMessageStore.GetInstallToken(appId, installId); err != nil {
+		t.Errorf("Install token was not cached: %s", err)
+	}
+}
+
+func TestTagObjects(t *testing.T) {
+	docType := func(name string) string { return "app" }
+	v1Store := s3store.S3BlobStore{}
+	tagObjects(&v1Store, docType)
+	if v1Store.Tagger == nil || v1Store.Tagger("apps/1")[s3store.DOCTYPE_TAG] != "app" || !v1Store.TagExpires {
+		t.Errorf("Store of version 1 of the SDK was not tagged")
+	}
+	v2Store := s3storev2.S3BlobStore{}
+	tagObjects(&v2Store, docType)
+	if v2Store.Tagger == nil || v2Store.Tagger("apps/1")[s3store.DOCTYPE_TAG] != "app" || !v2Store.TagExpires {
+		t.Errorf("Store of version 2 of the SDK was not tagged")
+	}
+	tagObjects(messagestore.NewMemBlobStore(), docType)
+}
+
+func TestNewServiceInvalidConfig(t *testing.T) {
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	_, err := NewService(Config{
+		Encoding: "xml",
+		TokenLinks: &tokenpb.Links{
+			AppTokens:     "tokens/{AppId}/app",
+			InstallTokens: "tokens/{AppId}",
+		},
+	}, &logger)
+	errs, ok := err.(*messagestore.MultiError)
+	if !ok {
+		t.Fatalf("Expected *messagestore.MultiError but got %v", err)
+	}
+	fields := make(map[string]error)
+	errs.Each(func(field string, err error) {
+		fields[field] = err
+	})
+	if len(fields) != 3 {
+		t.Errorf("Expected errors of 3 fields but got %v", err)
+	}
+	if missing, ok := fields["Location"].(MissingConfig); !ok || string(missing) != "Location" {
+		t.Errorf("Expected MissingConfig(Location) but got %v", fields["Location"])
+	}
+	for _, field := range []string{"Encoding", "TokenLinks"} {
+		if invalid, ok := fields[field].(*InvalidConfig); !ok || invalid.Field != field {
+			t.Errorf("Expected InvalidConfig of %s but got %v", field, fields[field])
+		}
+	}
+	_, err = NewService(Config{Location: &locationpb.Location{}, TokenLocation: &locationpb.Location{}}, &logger)
+	if errs, ok := err.(*messagestore.MultiError); !ok || errs.Len() != 2 {
+		t.Errorf("Expected MissingConfig of Location and TokenLocation but got %v", err)
+	}
+}
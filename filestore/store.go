@@ -0,0 +1,259 @@
+package filestore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aefalcon/go-github-keystore/messagestore"
+)
+
+// FileBlobStore stores blobs as files in a directory tree.  Blob names are
+// slash separated paths relative to Root.  Blobs are written to temporary
+// files renamed into place, so a crash never leaves a partially written blob.
+// Without Fsync, a put or delete which returned may still be lost by a crash
+// of the host.
+type FileBlobStore struct {
+	Root  string
+	Fsync bool // Sync files and directories to disk before puts and deletes return
+}
+
+var _ messagestore.BlobStore = &FileBlobStore{}
+var _ messagestore.ListableBlobStore = &FileBlobStore{}
+var _ messagestore.StatBlobStore = &FileBlobStore{}
+var _ messagestore.ExistenceDeleteBlobStore = &FileBlobStore{}
+var _ messagestore.CapableStore = &FileBlobStore{}
+
+func NewFileBlobStore(root string) *FileBlobStore {
+	return &FileBlobStore{
+		Root: root,
+	}
+}
+
+func NewFileMessageStore(root string) *messagestore.BlobMessageStore {
+	return &messagestore.BlobMessageStore{
+		BlobStore: NewFileBlobStore(root),
+	}
+}
+
+// DocPath gets the path of the file holding a blob.  Names cannot refer to
+// files outside of Root.
+func (s *FileBlobStore) DocPath(name string) string {
+	return filepath.Join(s.Root, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+// fileCacheMeta creates cache metadata from a file's modification time and size
+func fileCacheMeta(info os.FileInfo) *messagestore.CacheMeta {
+	return &messagestore.CacheMeta{
+		ETag:         fmt.Sprintf("\"%x-%x\"", info.ModTime().UnixNano(), info.Size()),
+		LastModified: info.ModTime(),
+	}
+}
+
+func (s *FileBlobStore) GetBlob(name string) ([]byte, *messagestore.CacheMeta, error) {
+	file, err := os.Open(s.DocPath(name))
+	if os.IsNotExist(err) {
+		return nil, nil, messagestore.NoSuchResource(name)
+	} else if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		wrapErr := messagestore.ReadResourceError{
+			Name:  name,
+			Cause: err,
+		}
+		return nil, nil, &wrapErr
+	}
+	return content, fileCacheMeta(info), nil
+}
+
+// StatBlob gets the cache metadata of a blob without reading it
+func (s *FileBlobStore) StatBlob(name string) (*messagestore.CacheMeta, error) {
+	info, err := os.Stat(s.DocPath(name))
+	if os.IsNotExist(err) {
+		return nil, messagestore.NoSuchResource(name)
+	} else if err != nil {
+		return nil, err
+	}
+	return fileCacheMeta(info), nil
+}
+
+// PutBlob writes a blob to a temporary file which then replaces the blob's
+// file, creating intermediate directories as needed.  With Fsync, the file is
+// synced before it is renamed, then its directory and any created directories
+// are synced.
+func (s *FileBlobStore) PutBlob(name string, content []byte) (*messagestore.CacheMeta, error) {
+	docPath := s.DocPath(name)
+	info, err := s.writeFile(docPath, content)
+	if err != nil {
+		wrapErr := messagestore.PutResourceError{
+			Name:  name,
+			Cause: err,
+		}
+		return nil, &wrapErr
+	}
+	return fileCacheMeta(info), nil
+}
+
+// syncDir syncs a directory, so the entries renamed into or removed from it
+// are durable
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// missingAncestor gets the outermost directory of dir which does not exist,
+// or "" if dir exists
+func missingAncestor(dir string) string {
+	missing := ""
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return missing
+		}
+		missing = dir
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return missing
+		}
+		dir = parent
+	}
+}
+
+func (s *FileBlobStore) writeFile(docPath string, content []byte) (os.FileInfo, error) {
+	dir := filepath.Dir(docPath)
+	var created string
+	if s.Fsync {
+		created = missingAncestor(dir)
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	tmpFile, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	tmpName := tmpFile.Name()
+	_, err = tmpFile.Write(content)
+	if err == nil && s.Fsync {
+		err = tmpFile.Sync()
+	}
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, docPath)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return nil, err
+	}
+	if s.Fsync {
+		if err = s.syncDirs(dir, created); err != nil {
+			return nil, err
+		}
+	}
+	return os.Stat(docPath)
+}
+
+// syncDirs syncs dir and, if directories from created down to dir were
+// created, each of their parents, so the new directories are durable
+func (s *FileBlobStore) syncDirs(dir, created string) error {
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+	if created == "" {
+		return nil
+	}
+	for parent := filepath.Dir(dir); ; parent = filepath.Dir(parent) {
+		if err := syncDir(parent); err != nil {
+			return err
+		}
+		if parent == filepath.Dir(created) || parent == filepath.Dir(parent) {
+			return nil
+		}
+	}
+}
+
+func (s *FileBlobStore) DeleteBlob(name string) (*messagestore.CacheMeta, error) {
+	docPath := s.DocPath(name)
+	err := os.Remove(docPath)
+	if os.IsNotExist(err) {
+		return nil, messagestore.NoSuchResource(name)
+	}
+	if err == nil && s.Fsync {
+		err = syncDir(filepath.Dir(docPath))
+	}
+	if err != nil {
+		wrapErr := messagestore.DeleteResourceError{
+			Name:  name,
+			Cause: err,
+		}
+		return nil, &wrapErr
+	}
+	return nil, nil
+}
+
+// DeleteBlobExisted deletes a blob, reporting whether it existed
+func (s *FileBlobStore) DeleteBlobExisted(name string) (bool, error) {
+	_, err := s.DeleteBlob(name)
+	if messagestore.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ListBlobs lists the names of blobs beginning with prefix
+func (s *FileBlobStore) ListBlobs(prefix string) ([]string, error) {
+	names := make([]string, 0)
+	err := filepath.Walk(s.Root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".tmp-") {
+			return nil
+		}
+		relPath, err := filepath.Rel(s.Root, filePath)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(relPath)
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return names, nil
+	} else if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Capabilities reports that the store lists and stats blobs, but keeps no
+// metadata and cannot put conditionally or stream
+func (s *FileBlobStore) Capabilities() messagestore.Caps {
+	return messagestore.Caps{
+		List: true,
+		Stat: true,
+	}
+}
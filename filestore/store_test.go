@@ -0,0 +1,186 @@
+package filestore
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aefalcon/github-keystore-protobuf/go/appkeypb"
+	"github.com/aefalcon/go-github-keystore/appkeystore"
+	"github.com/aefalcon/go-github-keystore/keyutils"
+	"github.com/aefalcon/go-github-keystore/kslog"
+	"github.com/aefalcon/go-github-keystore/messagestore"
+	"github.com/aefalcon/go-github-keystore/timeutils"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+)
+
+func setUpDirTest(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "filestore")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %s", err)
+	}
+	return dir
+}
+
+func tearDownDirTest(t *testing.T, dir string) {
+	err := os.RemoveAll(dir)
+	if err != nil {
+		t.Logf("Failed to remove directory: %s", err)
+	}
+}
+
+func TestFileBlobStore(t *testing.T) {
+	dir := setUpDirTest(t)
+	defer tearDownDirTest(t, dir)
+	store := NewFileBlobStore(dir)
+	const name = "apps/1/app"
+	_, _, err := store.GetBlob(name)
+	if !messagestore.IsNotFound(err) {
+		t.Fatalf("Expected not found but got %v", err)
+	}
+	content := []byte("content")
+	putMeta, err := store.PutBlob(name, content)
+	if err != nil {
+		t.Fatalf("Failed to put blob: %s", err)
+	}
+	contentBack, getMeta, err := store.GetBlob(name)
+	if err != nil {
+		t.Fatalf("Failed to get blob: %s", err)
+	}
+	if string(contentBack) != string(content) {
+		t.Fatalf("Expected content %s but got %s", content, contentBack)
+	}
+	if getMeta.ETag == "" || getMeta.ETag != putMeta.ETag {
+		t.Fatalf("Expected ETag %s but got %s", putMeta.ETag, getMeta.ETag)
+	}
+	if getMeta.LastModified.IsZero() {
+		t.Fatalf("LastModified is not set")
+	}
+	if !strings.HasPrefix(store.DocPath("../../outside"), dir) {
+		t.Fatalf("Path %s is outside of %s", store.DocPath("../../outside"), dir)
+	}
+	_, err = store.DeleteBlob(name)
+	if err != nil {
+		t.Fatalf("Failed to delete blob: %s", err)
+	}
+	_, err = store.DeleteBlob(name)
+	if !messagestore.IsNotFound(err) {
+		t.Fatalf("Expected not found but got %v", err)
+	}
+}
+
+func TestFileBlobStoreFsync(t *testing.T) {
+	dir := setUpDirTest(t)
+	defer tearDownDirTest(t, dir)
+	store := NewFileBlobStore(dir)
+	store.Fsync = true
+	const name = "apps/1/keys/abc"
+	content := bytes.Repeat([]byte("content"), 1000)
+	if _, err := store.PutBlob(name, content); err != nil {
+		t.Fatalf("Failed to put blob: %s", err)
+	}
+	contentBack, err := ioutil.ReadFile(filepath.Join(dir, "apps", "1", "keys", "abc"))
+	if err != nil {
+		t.Fatalf("Failed to read blob file: %s", err)
+	}
+	if !bytes.Equal(contentBack, content) {
+		t.Fatalf("Blob file has %d bytes instead of %d", len(contentBack), len(content))
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "apps", "1", "keys"))
+	if err != nil {
+		t.Fatalf("Failed to read blob directory: %s", err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "abc" {
+		t.Fatalf("Blob directory has %d entries, such as temporary files", len(entries))
+	}
+	if _, err = store.DeleteBlob(name); err != nil {
+		t.Fatalf("Failed to delete blob: %s", err)
+	}
+	if _, _, err = store.GetBlob(name); !messagestore.IsNotFound(err) {
+		t.Fatalf("Expected not found but got %v", err)
+	}
+}
+
+func TestSignJwt(t *testing.T) {
+	dir := setUpDirTest(t)
+	defer tearDownDirTest(t, dir)
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	keyService := appkeystore.NewAppKeyService(NewFileMessageStore(dir), nil)
+	err := keyService.Store.InitDb(&logger)
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %s", err)
+	}
+	keyFileName := filepath.Join("testdata", "priv1.pem")
+	keyBytes, err := ioutil.ReadFile(keyFileName)
+	if err != nil {
+		t.Fatalf("Failed to read file %s: %s", keyFileName, err)
+	}
+	rsaKey, err := keyutils.ParsePrivateKey(keyBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse key from file %s: %s", keyFileName, err)
+	}
+	fingerprint, err := keyutils.KeyFingerprint(rsaKey)
+	if err != nil {
+		t.Fatalf("Failed to derive fingerprint of key from file %s: %s", keyFileName, err)
+	}
+	const appId = 1
+	addReq := appkeypb.AddAppRequest{
+		App: appId,
+		Keys: []*appkeypb.AppKey{
+			&appkeypb.AppKey{
+				Key: keyBytes,
+				Meta: &appkeypb.AppKeyMeta{
+					Fingerprint: fingerprint,
+				},
+			},
+		},
+	}
+	_, err = keyService.AddApp(&addReq, &logger)
+	if err != nil {
+		t.Fatalf("Failed to add app %d: %s", appId, err)
+	}
+	now := time.Now().UTC()
+	signReq := appkeypb.SignJwtRequest{
+		App:       appId,
+		Algorithm: "RS256",
+		Claims: &structpb.Struct{
+			Fields: map[string]*structpb.Value{
+				"iss": &structpb.Value{
+					Kind: &structpb.Value_StringValue{
+						StringValue: fmt.Sprintf("%d", appId),
+					},
+				},
+				"exp": &structpb.Value{
+					Kind: &structpb.Value_NumberValue{
+						NumberValue: float64(int64(timeutils.TimeToFloat(now.Add(time.Minute * 5)))),
+					},
+				},
+			},
+		},
+	}
+	jwtResp, err := keyService.SignJwt(&signReq, &logger)
+	if err != nil {
+		t.Fatalf("Failed to sign JWT: %s", err)
+	}
+	secureData64 := jwtResp.Jwt[:strings.LastIndex(jwtResp.Jwt, ".")]
+	sig, err := base64.RawURLEncoding.DecodeString(jwtResp.Jwt[len(secureData64)+1:])
+	if err != nil {
+		t.Fatalf("Failed to decode signature: %s", err)
+	}
+	digest := sha256.Sum256([]byte(secureData64))
+	err = rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, digest[:], sig)
+	if err != nil {
+		t.Fatalf("Failed to verify signature: %s", err)
+	}
+}
@@ -3,9 +3,12 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
+	"time"
 	"unicode"
 	"unicode/utf8"
 
@@ -16,11 +19,17 @@ import (
 	"github.com/aefalcon/go-github-keystore/kslog"
 	"github.com/aefalcon/go-github-keystore/messagestore"
 	"github.com/aefalcon/go-github-keystore/s3store"
+	"github.com/aefalcon/go-github-keystore/s3storev2"
+	"github.com/aefalcon/go-github-keystore/storeloc"
+	"github.com/aefalcon/go-github-keystore/timeutils"
 	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	structpb "github.com/golang/protobuf/ptypes/struct"
 )
 
 const (
 	FLAG_CONFIG       = "config"
+	FLAG_LOCATION     = "location"
 	FLAG_INDEX_URL    = "index-url"
 	FLAG_INDEX_BUCKET = "index-bucket"
 	FLAG_INDEX_KEY    = "index-key"
@@ -28,6 +37,8 @@ const (
 	FLAG_APP          = "app"
 	FLAG_KEY_FILE     = "key-file"
 	FLAG_KEY          = "key"
+	FLAG_FORCE        = "force"
+	FLAG_TAG_OBJECTS  = "tag-objects"
 
 	CMD_INIT_CONFIG = "init-config"
 	CMD_INIT_DB     = "init-db"
@@ -37,10 +48,22 @@ const (
 	CMD_LIST_KEYS   = "list-keys"
 	CMD_REM_KEY     = "remove-key"
 	CMD_REM_APP     = "remove-app"
+	CMD_SIGN        = "sign"
 )
 
+// SIGN_LIFETIME is the lifetime of JWTs signed by the sign sub-command
+const SIGN_LIFETIME = 9 * time.Minute
+
+// newBlobStore creates the store of a location.  It may be replaced to run
+// commands against another backend.
+var newBlobStore = storeloc.NewFromLocation
+
+// output receives the structured output of commands
+var output io.Writer = os.Stdout
+
 type flagValues struct {
 	ConfigPath  string
+	Location    string
 	IndexUrl    string
 	IndexBucket string
 	IndexKey    string
@@ -48,6 +71,8 @@ type flagValues struct {
 	App         uint64
 	KeyFile     string
 	Key         string
+	Force       bool
+	TagObjects  bool
 }
 
 func (v flagValues) RequireUint64(flag string, value uint64) error {
@@ -94,11 +119,14 @@ func (v *flagValues) Require(flags ...string) error {
 	return nil
 }
 
-func MakeKeyService(config *appkeypb.AppKeyManagerConfig, links *appkeypb.Links) (*appkeystore.AppKeyService, error) {
+// MakeKeyService creates the key service of a configuration.  With
+// tagObjects, objects put in an S3 database are tagged by document type,
+// which needs s3:PutObjectTagging.
+func MakeKeyService(config *appkeypb.AppKeyManagerConfig, links *appkeypb.Links, tagObjects bool, logger kslog.KsLogger) (*appkeystore.AppKeyService, error) {
 	if links == nil {
 		links = &appkeypb.DefaultLinks
 	}
-	blobStore, err := s3store.NewS3BlobStore(config.DbLoc)
+	blobStore, err := newBlobStore(config.DbLoc, logger)
 	if err != nil {
 		return nil, err
 	}
@@ -106,10 +134,30 @@ func MakeKeyService(config *appkeypb.AppKeyManagerConfig, links *appkeypb.Links)
 		BlobStore: blobStore,
 	}
 	service := appkeystore.NewAppKeyService(&messageStore, links)
+	if tagObjects {
+		switch s3Store := blobStore.(type) {
+		case *s3store.S3BlobStore:
+			s3Store.Tagger = s3store.DocTypeTagger(service.Store.DocumentType)
+		case *s3storev2.S3BlobStore:
+			s3Store.Tagger = s3store.DocTypeTagger(service.Store.DocumentType)
+		}
+	}
 	return service, nil
 }
 
+// GetConfig gets the configuration of the configuration file, unless the
+// location flag names the database instead
 func GetConfig(flags *flagValues, logger kslog.KsLogger) (*appkeypb.AppKeyManagerConfig, error) {
+	if flags.Location != "" {
+		config := appkeypb.AppKeyManagerConfig{
+			DbLoc: &locationpb.Location{
+				Location: &locationpb.Location_Url{
+					Url: flags.Location,
+				},
+			},
+		}
+		return &config, nil
+	}
 	configPath, err := expandPath(flags.ConfigPath)
 	if err != nil {
 		logger.Logf("Unable to expand path %s: %s", flags.ConfigPath, err)
@@ -173,27 +221,76 @@ func (v *flagValues) ValidateDecimal(flag, text string) error {
 	return nil
 }
 
-type CmdFunc func(flagValues *flagValues, logger kslog.KsLogger)
+type CmdFunc func(flagValues *flagValues, logger kslog.KsLogger) error
 
-func cmdInitDb(flagValues *flagValues, logger kslog.KsLogger) {
+// openKeyService creates the key service of the configured database
+func openKeyService(flagValues *flagValues, logger kslog.KsLogger) (*appkeystore.AppKeyService, error) {
 	config, err := GetConfig(flagValues, logger)
 	if err != nil {
 		logger.Errorf("Failed to get configuration: %s", err)
-		os.Exit(1)
+		return nil, err
 	}
-	service, err := MakeKeyService(config, nil)
+	service, err := MakeKeyService(config, nil, flagValues.TagObjects, logger)
 	if err != nil {
 		logger.Errorf("Failed to make store: %s", err)
-		os.Exit(1)
+		return nil, err
+	}
+	return service, nil
+}
+
+// writeMessage writes a message to the output as a line of JSON
+func writeMessage(pb proto.Message) error {
+	marshaler := jsonpb.Marshaler{}
+	err := marshaler.Marshal(output, pb)
+	if err != nil {
+		return err
+	}
+	_, err = output.Write([]byte("\n"))
+	return err
+}
+
+// readKeyFile reads the PEM private key of an application from a file
+func readKeyFile(app uint64, fileName string, logger kslog.KsLogger) (*appkeypb.AppKey, error) {
+	keyBytes, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		logger.Errorf("Failed to read key file %s: %s", fileName, err)
+		return nil, err
+	}
+	key, err := keyutils.ParseSigningKey(keyBytes)
+	if err != nil {
+		logger.Errorf("Failed to parse private key %s: %s", fileName, err)
+		return nil, err
+	}
+	fingerprint, err := keyutils.SignerFingerprint(key)
+	if err != nil {
+		logger.Errorf("Failed to calculate key fingerprint: %s", err)
+		return nil, err
+	}
+	logger.Logf("Key has fingerprint %s", fingerprint)
+	appKey := appkeypb.AppKey{
+		Meta: &appkeypb.AppKeyMeta{
+			App:         app,
+			Fingerprint: fingerprint,
+		},
+		Key: keyBytes,
+	}
+	return &appKey, nil
+}
+
+func cmdInitDb(flagValues *flagValues, logger kslog.KsLogger) error {
+	service, err := openKeyService(flagValues, logger)
+	if err != nil {
+		return err
 	}
 	err = service.Store.InitDb(logger)
 	if err != nil {
 		logger.Errorf("Failed to initialize new database: %s", err)
-		os.Exit(1)
+		return err
 	}
+	return nil
 }
 
-func cmdInitConfig(flagValues *flagValues, logger kslog.KsLogger) {
+func cmdInitConfig(flagValues *flagValues, logger kslog.KsLogger) error {
 	config := appkeypb.AppKeyManagerConfig{
 		DbLoc: &locationpb.Location{},
 	}
@@ -213,214 +310,194 @@ func cmdInitConfig(flagValues *flagValues, logger kslog.KsLogger) {
 	configPath, err := expandPath(flagValues.ConfigPath)
 	if err != nil {
 		logger.Errorf("Unable to expand path %s: %s", flagValues.ConfigPath, err)
-		os.Exit(1)
+		return err
 	}
 	configDir := filepath.Dir(configPath)
 	err = os.MkdirAll(configDir, 0750)
 	if err != nil {
 		logger.Errorf("Unable to create directory %s: %s", configDir, err)
-		os.Exit(1)
+		return err
 	}
 	configFile, err := os.Create(configPath)
-	defer configFile.Close()
 	if err != nil {
 		logger.Errorf("Unable to create configuration file %s: %s", configPath, err)
-		os.Exit(1)
+		return err
 	}
+	defer configFile.Close()
 	marshaler := jsonpb.Marshaler{
 		Indent: "   ",
 	}
 	err = marshaler.Marshal(configFile, &config)
 	if err != nil {
 		logger.Errorf("Unable to marshal configuration: %s", err)
-		os.Exit(1)
+		return err
 	}
 	_, err = configFile.Write([]byte("\n"))
 	if err != nil {
 		logger.Errorf("Unable to write to configuration file: %s", err)
-		os.Exit(1)
+		return err
 	}
+	return nil
 }
 
-func cmdListApps(flagValues *flagValues, logger kslog.KsLogger) {
-	config, err := GetConfig(flagValues, logger)
+func cmdListApps(flagValues *flagValues, logger kslog.KsLogger) error {
+	service, err := openKeyService(flagValues, logger)
 	if err != nil {
-		logger.Errorf("Failed to get configuration: %s", err)
-		os.Exit(1)
-	}
-	service, err := MakeKeyService(config, nil)
-	if err != nil {
-		logger.Errorf("Failed to make store: %s", err)
-		os.Exit(1)
+		return err
 	}
 	req := appkeypb.ListAppsRequest{}
 	index, err := service.ListApps(&req, logger)
 	if err != nil {
 		logger.Errorf("Failed go get app index: %s", err)
-		os.Exit(1)
-	}
-	if err != nil {
-		logger.Errorf("Failed to put application index")
-		os.Exit(1)
+		return err
 	}
 	if len(index.AppRefs) == 0 {
 		logger.Logf("No apps")
-	} else {
-		for appId := range index.AppRefs {
-			logger.Logf("app %d", appId)
-		}
 	}
+	return writeMessage(index)
 }
 
-func cmdAddApp(flagValues *flagValues, logger kslog.KsLogger) {
-	config, err := GetConfig(flagValues, logger)
-	if err != nil {
-		logger.Errorf("Failed to get configuration: %s", err)
-		os.Exit(1)
-	}
-	service, err := MakeKeyService(config, nil)
+func cmdAddApp(flagValues *flagValues, logger kslog.KsLogger) error {
+	service, err := openKeyService(flagValues, logger)
 	if err != nil {
-		logger.Errorf("Failed to make store: %s", err)
-		os.Exit(1)
+		return err
 	}
 	req := appkeypb.AddAppRequest{
 		App: flagValues.App,
 	}
-	_, err = service.AddApp(&req, logger)
+	if flagValues.KeyFile != "" {
+		key, err := readKeyFile(flagValues.App, flagValues.KeyFile, logger)
+		if err != nil {
+			return err
+		}
+		req.Keys = []*appkeypb.AppKey{key}
+	}
+	resp, err := service.AddApp(&req, logger)
 	if err != nil {
 		logger.Errorf("Failed to create application %d: %s", flagValues.App, err)
-		os.Exit(1)
+		return err
 	}
+	return writeMessage(resp)
 }
 
-func cmdAddKey(flagValues *flagValues, logger kslog.KsLogger) {
-	config, err := GetConfig(flagValues, logger)
+func cmdAddKey(flagValues *flagValues, logger kslog.KsLogger) error {
+	service, err := openKeyService(flagValues, logger)
 	if err != nil {
-		logger.Errorf("Failed to get configuration: %s", err)
-		os.Exit(1)
-	}
-	service, err := MakeKeyService(config, nil)
-	if err != nil {
-		logger.Errorf("Failed to make store: %s", err)
-		os.Exit(1)
-	}
-	keyFile, err := os.Open(flagValues.KeyFile)
-	if err != nil {
-		logger.Errorf("Failed to open key file %s", flagValues.KeyFile)
-		os.Exit(1)
+		return err
 	}
-	keyBytes, err := ioutil.ReadAll(keyFile)
+	key, err := readKeyFile(flagValues.App, flagValues.KeyFile, logger)
 	if err != nil {
-		logger.Errorf("Failed to read key file %s: %s", flagValues.KeyFile, err)
-		os.Exit(1)
+		return err
 	}
-	key, err := keyutils.ParsePrivateKey(keyBytes)
-	if err != nil {
-		logger.Errorf("Failed to parse private key %s: %s", flagValues.KeyFile, err)
-		os.Exit(1)
-	}
-	fingerprint, err := keyutils.KeyFingerprint(key)
-	if err != nil {
-		logger.Errorf("Failed to calculate key fingerprint: %s", err)
-		os.Exit(1)
-	}
-	logger.Logf("Key has fingerprint %s", fingerprint)
 	req := appkeypb.AddKeyRequest{
-		App: flagValues.App,
-		Keys: []*appkeypb.AppKey{
-			&appkeypb.AppKey{
-				Meta: &appkeypb.AppKeyMeta{
-					App:         flagValues.App,
-					Fingerprint: fingerprint,
-				},
-				Key: keyBytes,
-			},
-		},
+		App:  flagValues.App,
+		Keys: []*appkeypb.AppKey{key},
 	}
-	_, err = service.AddKey(&req, logger)
+	resp, err := service.AddKey(&req, logger)
 	if err != nil {
 		logger.Errorf("Failed to add key: %s", err)
-		os.Exit(1)
+		return err
 	}
+	return writeMessage(resp)
 }
 
-func cmdListKeys(flagValues *flagValues, logger kslog.KsLogger) {
-	config, err := GetConfig(flagValues, logger)
-	if err != nil {
-		logger.Errorf("Failed to get configuration: %s", err)
-		os.Exit(1)
-	}
-	service, err := MakeKeyService(config, nil)
+func cmdListKeys(flagValues *flagValues, logger kslog.KsLogger) error {
+	service, err := openKeyService(flagValues, logger)
 	if err != nil {
-		logger.Errorf("Failed to make store: %s", err)
-		os.Exit(1)
-	}
-	req := appkeypb.GetAppRequest{
-		App: flagValues.App,
+		return err
 	}
-	app, err := service.GetApp(&req, logger)
+	metas, err := service.ListKeys(flagValues.App, logger)
 	if err != nil {
-		logger.Errorf("Failed to get app %d: %s", flagValues.App, err)
-		os.Exit(1)
+		logger.Errorf("Failed to list keys of app %d: %s", flagValues.App, err)
+		return err
 	}
-	if len(app.Keys) == 0 {
+	if len(metas) == 0 {
 		logger.Logf("App has no keys")
-		return
 	}
-	for _, key := range app.Keys {
-		logger.Logf("key %s", key.Meta.Fingerprint)
+	for _, meta := range metas {
+		err = writeMessage(meta)
+		if err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func cmdRemoveKey(flagValues *flagValues, logger kslog.KsLogger) {
-	config, err := GetConfig(flagValues, logger)
+func cmdRemoveKey(flagValues *flagValues, logger kslog.KsLogger) error {
+	service, err := openKeyService(flagValues, logger)
 	if err != nil {
-		logger.Errorf("Failed to get configuration: %s", err)
-		os.Exit(1)
-	}
-	service, err := MakeKeyService(config, nil)
-	if err != nil {
-		logger.Errorf("Failed to make store: %s", err)
-		os.Exit(1)
+		return err
 	}
 	req := appkeypb.RemoveKeyRequest{
 		App:          flagValues.App,
 		Fingerprints: []string{flagValues.Key},
 	}
-	_, err = service.RemoveKey(&req, logger)
+	opts := appkeystore.RemoveKeyOptions{
+		Force: flagValues.Force,
+	}
+	resp, err := service.RemoveKeyWithOptions(&req, opts, logger)
 	if err != nil {
 		logger.Errorf("Failed to remove key: %s", err)
-		os.Exit(1)
+		return err
 	}
+	return writeMessage(resp)
 }
 
-func cmdRemoveApp(flagValues *flagValues, logger kslog.KsLogger) {
-	config, err := GetConfig(flagValues, logger)
+func cmdRemoveApp(flagValues *flagValues, logger kslog.KsLogger) error {
+	service, err := openKeyService(flagValues, logger)
 	if err != nil {
-		logger.Errorf("Failed to get configuration: %s", err)
-		os.Exit(1)
-	}
-	service, err := MakeKeyService(config, nil)
-	if err != nil {
-		logger.Errorf("Failed to make store: %s", err)
-		os.Exit(1)
+		return err
 	}
 	req := appkeypb.RemoveAppRequest{
 		App: flagValues.App,
 	}
-	_, err = service.RemoveApp(&req, logger)
+	result, err := service.RemoveAppWithOptions(&req, appkeystore.RemoveAppOptions{}, logger)
 	if err != nil {
-		logger.Errorf("Failed to remove application %d", flagValues.App)
-		os.Exit(1)
+		logger.Errorf("Failed to remove application %d: %s", flagValues.App, err)
+		return err
 	}
-	logger.Logf("Applicatoin %d removed", flagValues.App)
+	logger.Logf("Application %d removed with %d key documents", flagValues.App, result.RemovedKeyDocuments)
+	return writeMessage(result.Response)
+}
+
+// cmdSign signs a JWT for an application as GitHub expects, for testing keys
+func cmdSign(flagValues *flagValues, logger kslog.KsLogger) error {
+	service, err := openKeyService(flagValues, logger)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	req := appkeypb.SignJwtRequest{
+		App:       flagValues.App,
+		Algorithm: "RS256",
+		Claims: &structpb.Struct{
+			Fields: map[string]*structpb.Value{
+				"iss": &structpb.Value{
+					Kind: &structpb.Value_StringValue{
+						StringValue: strconv.FormatUint(flagValues.App, 10),
+					},
+				},
+				"exp": &structpb.Value{
+					Kind: &structpb.Value_NumberValue{
+						NumberValue: float64(int64(timeutils.TimeToFloat(now.Add(SIGN_LIFETIME)))),
+					},
+				},
+			},
+		},
+	}
+	resp, err := service.SignJwt(&req, logger)
+	if err != nil {
+		logger.Errorf("Failed to sign JWT for application %d: %s", flagValues.App, err)
+		return err
+	}
+	return writeMessage(resp)
 }
 
 type CmdSpec struct {
 	Flags         *flag.FlagSet
 	RequiredFlags []string
 	CheckFlags    CheckFlagsFunc
-	CmdFunc       func(flagValues *flagValues, logger kslog.KsLogger)
+	CmdFunc       CmdFunc
 }
 
 func SetupFlags(flags *flagValues) map[string]CmdSpec {
@@ -435,6 +512,8 @@ func SetupFlags(flags *flagValues) map[string]CmdSpec {
 		}
 	}
 	flag.StringVar(&flags.ConfigPath, FLAG_CONFIG, USER_CONFIG_PATH, "Configuration file path")
+	flag.StringVar(&flags.Location, FLAG_LOCATION, "", "Database URL such as s3://bucket/prefix, instead of the configuration file")
+	flag.BoolVar(&flags.TagObjects, FLAG_TAG_OBJECTS, false, "Tag put S3 objects by document type, which needs s3:PutObjectTagging")
 	initDbFlags := flag.NewFlagSet(CMD_INIT_DB, flag.ExitOnError)
 	cmdSpecs[CMD_INIT_DB] = CmdSpec{
 		Flags:         initDbFlags,
@@ -460,6 +539,7 @@ func SetupFlags(flags *flagValues) map[string]CmdSpec {
 	}
 	addAppFlags := flag.NewFlagSet(CMD_ADD_APP, flag.ExitOnError)
 	addAppFlags.Uint64Var(&flags.App, FLAG_APP, 0, "Application ID")
+	addAppFlags.StringVar(&flags.KeyFile, FLAG_KEY_FILE, "", "Key file name, if the app is added with a key")
 	cmdSpecs[CMD_ADD_APP] = CmdSpec{
 		Flags:         addAppFlags,
 		RequiredFlags: []string{FLAG_CONFIG, FLAG_APP},
@@ -483,6 +563,7 @@ func SetupFlags(flags *flagValues) map[string]CmdSpec {
 	removeKeyFlags := flag.NewFlagSet(CMD_REM_KEY, flag.ExitOnError)
 	removeKeyFlags.Uint64Var(&flags.App, FLAG_APP, 0, "Application ID")
 	removeKeyFlags.StringVar(&flags.Key, FLAG_KEY, "", "Key fingerprint")
+	removeKeyFlags.BoolVar(&flags.Force, FLAG_FORCE, false, "Remove the app's last enabled key")
 	cmdSpecs[CMD_REM_KEY] = CmdSpec{
 		Flags:         removeKeyFlags,
 		RequiredFlags: []string{FLAG_CONFIG, FLAG_APP, FLAG_KEY},
@@ -496,6 +577,13 @@ func SetupFlags(flags *flagValues) map[string]CmdSpec {
 		RequiredFlags: []string{FLAG_CONFIG, FLAG_APP},
 		CmdFunc:       cmdRemoveApp,
 	}
+	signFlags := flag.NewFlagSet(CMD_SIGN, flag.ExitOnError)
+	signFlags.Uint64Var(&flags.App, FLAG_APP, 0, "Application ID")
+	cmdSpecs[CMD_SIGN] = CmdSpec{
+		Flags:         signFlags,
+		RequiredFlags: []string{FLAG_CONFIG, FLAG_APP},
+		CmdFunc:       cmdSign,
+	}
 	return cmdSpecs
 }
 
@@ -509,7 +597,12 @@ func main() {
 		flag.Usage()
 		os.Exit(2)
 	}
-	cmdSpec := cmdSpecs[subArgs[0]]
+	cmdSpec, found := cmdSpecs[subArgs[0]]
+	if !found {
+		fmt.Fprintf(os.Stderr, "Unknown subcommand %s\n", subArgs[0])
+		flag.Usage()
+		os.Exit(2)
+	}
 	err := cmdSpec.Flags.Parse(subArgs[1:])
 	if err == nil {
 		err = flagValues.Require(cmdSpec.RequiredFlags...)
@@ -523,6 +616,12 @@ func main() {
 		os.Exit(2)
 	}
 	logger := kslog.DefaultLogger{}
-	logger.Logf("Using configuration file %s", flagValues.ConfigPath)
-	cmdSpec.CmdFunc(&flagValues, logger)
+	if flagValues.Location != "" {
+		logger.Logf("Using database %s", flagValues.Location)
+	} else {
+		logger.Logf("Using configuration file %s", flagValues.ConfigPath)
+	}
+	if cmdSpec.CmdFunc(&flagValues, logger) != nil {
+		os.Exit(1)
+	}
 }
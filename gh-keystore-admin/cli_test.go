@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/aefalcon/github-keystore-protobuf/go/appkeypb"
+	"github.com/aefalcon/github-keystore-protobuf/go/locationpb"
+	"github.com/aefalcon/go-github-keystore/kslog"
+	"github.com/aefalcon/go-github-keystore/messagestore"
+	"github.com/golang/protobuf/jsonpb"
+)
+
+// useMemStore runs commands against a store in memory, capturing their output
+func useMemStore(t *testing.T) *bytes.Buffer {
+	store := messagestore.NewMemBlobStore()
+	var buf bytes.Buffer
+	origNewBlobStore, origOutput := newBlobStore, output
+	newBlobStore = func(loc *locationpb.Location, logger kslog.KsLogger) (messagestore.BlobStore, error) {
+		return store, nil
+	}
+	output = &buf
+	t.Cleanup(func() {
+		newBlobStore, output = origNewBlobStore, origOutput
+	})
+	return &buf
+}
+
+func TestAddAndListApps(t *testing.T) {
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	buf := useMemStore(t)
+	flags := flagValues{
+		Location: "mem://test",
+	}
+	if err := cmdInitDb(&flags, &logger); err != nil {
+		t.Fatalf("Failed to initialize database: %s", err)
+	}
+	for _, app := range []uint64{1, 2} {
+		flags.App = app
+		flags.KeyFile = filepath.Join("testdata", "priv1.pem")
+		if err := cmdAddApp(&flags, &logger); err != nil {
+			t.Fatalf("Failed to add app %d: %s", app, err)
+		}
+	}
+	if err := cmdAddApp(&flags, &logger); err == nil {
+		t.Fatalf("Added app %d twice", flags.App)
+	}
+	flags.KeyFile = filepath.Join("testdata", "missing.pem")
+	flags.App = 3
+	if err := cmdAddApp(&flags, &logger); err == nil {
+		t.Fatalf("Added app with missing key file")
+	}
+	buf.Reset()
+	if err := cmdListApps(&flags, &logger); err != nil {
+		t.Fatalf("Failed to list apps: %s", err)
+	}
+	var index appkeypb.AppIndex
+	if err := jsonpb.Unmarshal(buf, &index); err != nil {
+		t.Fatalf("Listed apps as invalid JSON: %s", err)
+	}
+	if len(index.AppRefs) != 2 || index.AppRefs[1] == nil || index.AppRefs[2] == nil {
+		t.Fatalf("Listed apps %v", index.AppRefs)
+	}
+	flags.App = 1
+	buf.Reset()
+	if err := cmdSign(&flags, &logger); err != nil {
+		t.Fatalf("Failed to sign JWT: %s", err)
+	}
+	var signResp appkeypb.SignJwtResponse
+	if err := jsonpb.Unmarshal(buf, &signResp); err != nil || signResp.Jwt == "" {
+		t.Fatalf("Signed %v, %v", signResp.Jwt, err)
+	}
+	buf.Reset()
+	if err := cmdListKeys(&flags, &logger); err != nil {
+		t.Fatalf("Failed to list keys: %s", err)
+	}
+	scanner := bufio.NewScanner(buf)
+	keys := 0
+	for ; scanner.Scan(); keys++ {
+		var meta appkeypb.AppKeyMeta
+		if err := jsonpb.UnmarshalString(scanner.Text(), &meta); err != nil || meta.Fingerprint == "" {
+			t.Fatalf("Listed key %s: %v", scanner.Text(), err)
+		}
+	}
+	if keys != 1 {
+		t.Fatalf("Listed %d keys instead of 1", keys)
+	}
+}
@@ -0,0 +1,52 @@
+package keyservice
+
+import (
+	"fmt"
+)
+
+// AppPolicy decides which application ids a service accepts.  Allowed returns
+// an error describing why an id is not accepted.  Services reject app id 0
+// whether or not they have a policy.
+type AppPolicy interface {
+	Allowed(app uint64) error
+}
+
+// AppNotAllowed is an error indicating an AppPolicy rejected an application id
+type AppNotAllowed struct {
+	App    uint64
+	Reason string
+}
+
+func (e *AppNotAllowed) Error() string {
+	return fmt.Sprintf("app %d is not allowed: %s", e.App, e.Reason)
+}
+
+// AllowList is an AppPolicy accepting only the application ids it holds
+type AllowList map[uint64]bool
+
+var _ AppPolicy = AllowList{}
+
+func (l AllowList) Allowed(app uint64) error {
+	if !l[app] {
+		return &AppNotAllowed{
+			App:    app,
+			Reason: "not in the allow list",
+		}
+	}
+	return nil
+}
+
+// DenyList is an AppPolicy accepting every application id it does not hold
+type DenyList map[uint64]bool
+
+var _ AppPolicy = DenyList{}
+
+func (l DenyList) Allowed(app uint64) error {
+	if l[app] {
+		return &AppNotAllowed{
+			App:    app,
+			Reason: "in the deny list",
+		}
+	}
+	return nil
+}
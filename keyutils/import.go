@@ -0,0 +1,38 @@
+package keyutils
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+
+	"github.com/aefalcon/github-keystore-protobuf/go/appkeypb"
+)
+
+// ImportGitHubAppKey reads a private key as downloaded from the settings of a
+// GitHub app, giving an app key holding it in PKCS#1 PEM form with its
+// SignerFingerprint.  The app of the key meta is left for the caller to set.
+func ImportGitHubAppKey(r io.Reader) (*appkeypb.AppKey, error) {
+	keyBytes, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, err := ParsePrivateKey(keyBytes)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint, err := SignerFingerprint(rsaKey)
+	if err != nil {
+		return nil, err
+	}
+	block := pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(rsaKey),
+	}
+	return &appkeypb.AppKey{
+		Meta: &appkeypb.AppKeyMeta{
+			Fingerprint: fingerprint,
+		},
+		Key: pem.EncodeToMemory(&block),
+	}, nil
+}
@@ -2,12 +2,18 @@ package keyutils
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/pem"
 	"fmt"
-	"os/exec"
+	"math/big"
 	"strings"
 	"unicode/utf8"
 )
@@ -21,38 +27,288 @@ func (e *UnparseableKey) Error() string {
 	return e.Message
 }
 
+// NeedsPassphrase is returned when parsing an encrypted key without a passphrase
+type NeedsPassphrase struct{}
+
+func (e *NeedsPassphrase) Error() string {
+	return "private key is encrypted and needs a passphrase"
+}
+
+// WrongPassphrase is returned when an encrypted key can not be decrypted with
+// the given passphrase
+type WrongPassphrase struct{}
+
+func (e *WrongPassphrase) Error() string {
+	return "passphrase of encrypted private key is incorrect"
+}
+
+// UnsupportedKeyType is returned for key data that is not an RSA or EC private
+// key
+type UnsupportedKeyType string
+
+func (e UnsupportedKeyType) Error() string {
+	return fmt.Sprintf("unsupported private key type %s", string(e))
+}
+
+// ParsePrivateKey parses an unencrypted PEM or DER encoded RSA private key
 func ParsePrivateKey(key []byte) (*rsa.PrivateKey, error) {
-	block, _ := pem.Decode(key)
-	if block != nil && block.Type != "RSA PRIVATE KEY" {
-		err := &UnparseableKey{
-			Key:     key,
-			Message: fmt.Sprintf("PEM data of type %s is not an RSA PRIVATE KEY", block.Type),
+	signer, err := ParseSigningKey(key)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := signer.(*rsa.PrivateKey)
+	if !ok {
+		return nil, UnsupportedKeyType(fmt.Sprintf("%T", signer))
+	}
+	return rsaKey, nil
+}
+
+// ParseSigningKey parses an unencrypted PEM or DER encoded RSA or EC private key.
+func ParseSigningKey(key []byte) (crypto.Signer, error) {
+	return ParsePrivateKeyWithPassphrase(key, nil)
+}
+
+// ParsePrivateKeyWithPassphrase parses a PEM or DER encoded RSA or EC private
+// key in PKCS#1, SEC 1 or PKCS#8 form.  PEM blocks encrypted with a DEK-Info
+// header are decrypted with passphrase.  PEM data may have CRLF line endings,
+// surrounding whitespace and several blocks, of which the first private key
+// block is parsed.
+func ParsePrivateKeyWithPassphrase(key, passphrase []byte) (crypto.Signer, error) {
+	block := privateKeyPemBlock(key)
+	if block == nil {
+		if bytes.Contains(key, []byte(PEM_BEGIN)) {
+			return nil, &UnparseableKey{
+				Key:     key,
+				Message: "PEM data has no valid blocks",
+			}
+		}
+		return parseDerPrivateKey(key)
+	}
+	der := block.Bytes
+	if x509.IsEncryptedPEMBlock(block) {
+		if len(passphrase) == 0 {
+			return nil, &NeedsPassphrase{}
 		}
+		var err error
+		der, err = x509.DecryptPEMBlock(block, passphrase)
+		if err == x509.IncorrectPasswordError {
+			return nil, &WrongPassphrase{}
+		} else if err != nil {
+			return nil, err
+		}
+		signer, err := parsePemPrivateKey(block.Type, der)
+		if _, unsupported := err.(UnsupportedKeyType); err != nil && !unsupported {
+			// padding checks miss some incorrect passphrases
+			return nil, &WrongPassphrase{}
+		}
+		return signer, err
+	}
+	return parsePemPrivateKey(block.Type, der)
+}
+
+// PEM_BEGIN begins each block of PEM data
+const PEM_BEGIN = "-----BEGIN "
+
+// privateKeyPemBlock decodes the first PEM block of key whose type is a
+// private key, or failing that its first block.  It is nil if key has no PEM
+// blocks.
+func privateKeyPemBlock(key []byte) *pem.Block {
+	rest := bytes.TrimSpace(bytes.Replace(key, []byte("\r\n"), []byte("\n"), -1))
+	var first *pem.Block
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return first
+		}
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			return block
+		}
+		if first == nil {
+			first = block
+		}
+	}
+}
+
+// parsePemPrivateKey parses the DER content of a PEM block of the given type
+func parsePemPrivateKey(blockType string, der []byte) (crypto.Signer, error) {
+	switch blockType {
+	case "RSA PRIVATE KEY":
+		return parseRsaPrivateKey(der)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(der)
+	case "PRIVATE KEY":
+		return parsePkcs8PrivateKey(der)
+	default:
+		return nil, UnsupportedKeyType(blockType)
+	}
+}
+
+// parseDerPrivateKey parses a DER encoded key of unknown form
+func parseDerPrivateKey(der []byte) (crypto.Signer, error) {
+	if signer, err := parseRsaPrivateKey(der); err == nil {
+		return signer, nil
+	}
+	if signer, err := x509.ParseECPrivateKey(der); err == nil {
+		return signer, nil
+	}
+	if signer, err := parsePkcs8PrivateKey(der); err == nil {
+		return signer, nil
+	} else if _, unsupported := err.(UnsupportedKeyType); unsupported {
 		return nil, err
-	} else if block != nil {
-		key = block.Bytes
 	}
-	rsaKey, err := x509.ParsePKCS1PrivateKey(key)
+	return nil, &UnparseableKey{
+		Key:     der,
+		Message: "DER data is not an RSA or EC private key",
+	}
+}
+
+func parseRsaPrivateKey(der []byte) (crypto.Signer, error) {
+	rsaKey, err := x509.ParsePKCS1PrivateKey(der)
 	if err != nil {
 		return nil, err
 	}
 	return rsaKey, rsaKey.Validate()
 }
 
+func parsePkcs8PrivateKey(der []byte) (crypto.Signer, error) {
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	switch tk := parsed.(type) {
+	case *rsa.PrivateKey:
+		return tk, tk.Validate()
+	case *ecdsa.PrivateKey:
+		return tk, nil
+	default:
+		return nil, UnsupportedKeyType(fmt.Sprintf("%T", parsed))
+	}
+}
+
+// formatFingerprint formats a digest as colon separated, zero padded hex octets
+func formatFingerprint(digest []byte) string {
+	pairs := make([]string, len(digest))
+	for i := 0; i < len(pairs); i++ {
+		pairs[i] = fmt.Sprintf("%02x", digest[i])
+	}
+	return strings.Join(pairs, ":")
+}
+
+// FingerprintAlgo is a scheme for deriving the fingerprint of a key
+type FingerprintAlgo int
+
+const (
+	// FINGERPRINT_SHA1 is the SHA-1 hash of the PKIX public key formatted as
+	// colon separated hex octets, as accepted by ValidateFingerprintSha1
+	FINGERPRINT_SHA1 FingerprintAlgo = iota
+	// FINGERPRINT_SHA256 is the SHA-256 hash of the PKIX public key formatted
+	// as padded base64 prefixed with `SHA256:`, as github displays it
+	FINGERPRINT_SHA256
+)
+
+// UnsupportedFingerprintAlgo is an error when deriving a fingerprint with an
+// unknown FingerprintAlgo
+type UnsupportedFingerprintAlgo FingerprintAlgo
+
+func (e UnsupportedFingerprintAlgo) Error() string {
+	return fmt.Sprintf("unsupported fingerprint algorithm %d", int(e))
+}
+
+// KeyFingerprint derives the FINGERPRINT_SHA1 fingerprint of an RSA private
+// key.  It is kept for existing callers; see KeyFingerprintWithAlgo and
+// SignerFingerprint.
 func KeyFingerprint(private *rsa.PrivateKey) (string, error) {
-	privateDer := x509.MarshalPKCS1PrivateKey(private)
-	cmd := exec.Command("openssl", "rsa", "-inform", "der", "-outform", "der", "-pubout")
-	cmd.Stdin = bytes.NewReader(privateDer)
-	publicBytes, err := cmd.Output()
+	return SignerFingerprint(private)
+}
+
+// KeyFingerprintWithAlgo derives the fingerprint of a private key using algo
+func KeyFingerprintWithAlgo(private crypto.Signer, algo FingerprintAlgo) (string, error) {
+	publicBytes, err := x509.MarshalPKIXPublicKey(private.Public())
 	if err != nil {
 		return "", err
 	}
-	fpBytes := sha1.Sum(publicBytes)
-	pairs := make([]string, len(fpBytes))
-	for i := 0; i < len(pairs); i++ {
-		pairs[i] = fmt.Sprintf("%x", fpBytes[i])
+	switch algo {
+	case FINGERPRINT_SHA1:
+		fpBytes := sha1.Sum(publicBytes)
+		return formatFingerprint(fpBytes[:]), nil
+	case FINGERPRINT_SHA256:
+		fpBytes := sha256.Sum256(publicBytes)
+		return "SHA256:" + base64.StdEncoding.EncodeToString(fpBytes[:]), nil
+	default:
+		return "", UnsupportedFingerprintAlgo(algo)
+	}
+}
+
+// SignerFingerprint derives the FINGERPRINT_SHA1 fingerprint of a private key,
+// the default fingerprint of keys in the store.
+func SignerFingerprint(private crypto.Signer) (string, error) {
+	return KeyFingerprintWithAlgo(private, FINGERPRINT_SHA1)
+}
+
+// FingerprintFunc derives the fingerprint of a private key
+type FingerprintFunc func(private crypto.Signer) (string, error)
+
+var _ FingerprintFunc = SignerFingerprint
+
+// GithubFingerprint derives the FINGERPRINT_SHA256 fingerprint github displays
+// for app keys.
+func GithubFingerprint(private crypto.Signer) (string, error) {
+	return KeyFingerprintWithAlgo(private, FINGERPRINT_SHA256)
+}
+
+// OpenSshFingerprint derives the fingerprint displayed by `ssh-keygen -l`, the
+// unpadded base64 SHA-256 hash of the SSH public key prefixed with `SHA256:`.
+func OpenSshFingerprint(private crypto.Signer) (string, error) {
+	publicBytes, err := sshPublicKey(private.Public())
+	if err != nil {
+		return "", err
+	}
+	fpBytes := sha256.Sum256(publicBytes)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(fpBytes[:]), nil
+}
+
+// sshString encodes bytes as an SSH wire format string
+func sshString(b []byte) []byte {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(b)))
+	return append(length[:], b...)
+}
+
+// sshMpint encodes a non-negative integer as an SSH wire format mpint
+func sshMpint(n *big.Int) []byte {
+	b := n.Bytes()
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return sshString(b)
+}
+
+// sshPublicKey encodes a public key in the SSH wire format
+func sshPublicKey(public crypto.PublicKey) ([]byte, error) {
+	switch tk := public.(type) {
+	case *rsa.PublicKey:
+		encoded := sshString([]byte("ssh-rsa"))
+		encoded = append(encoded, sshMpint(big.NewInt(int64(tk.E)))...)
+		return append(encoded, sshMpint(tk.N)...), nil
+	case *ecdsa.PublicKey:
+		var curve string
+		switch tk.Curve {
+		case elliptic.P256():
+			curve = "nistp256"
+		case elliptic.P384():
+			curve = "nistp384"
+		case elliptic.P521():
+			curve = "nistp521"
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", tk.Curve.Params().Name)
+		}
+		encoded := sshString([]byte("ecdsa-sha2-" + curve))
+		encoded = append(encoded, sshString([]byte(curve))...)
+		return append(encoded, sshString(elliptic.Marshal(tk.Curve, tk.X, tk.Y))...), nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", public)
 	}
-	return strings.Join(pairs, ":"), nil
 }
 
 type InvalidRune struct {
@@ -0,0 +1,153 @@
+package keyutils
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+// KMS_KEY_PREFIX begins a stored key which references a key held in AWS KMS
+// rather than containing a private key.  It is followed by the key id or ARN,
+// for example "kms:arn:aws:kms:us-east-1:111122223333:key/1234abcd-...".
+const KMS_KEY_PREFIX = "kms:"
+
+// Signer is a private key able to sign.  Keys parsed from PEM are
+// *rsa.PrivateKey or *ecdsa.PrivateKey, while a *KMSSigner signs with a key
+// that never leaves KMS.
+type Signer = crypto.Signer
+
+// KMSAPI is the part of the AWS KMS client used to sign, satisfied by
+// *kms.KMS
+type KMSAPI interface {
+	Sign(input *kms.SignInput) (*kms.SignOutput, error)
+	GetPublicKey(input *kms.GetPublicKeyInput) (*kms.GetPublicKeyOutput, error)
+}
+
+// NoKMSClient is an error indicating a key references a KMS key but no KMS
+// client is available to sign with it
+type NoKMSClient string
+
+func (e NoKMSClient) Error() string {
+	return fmt.Sprintf("key references KMS key %s but no KMS client is configured", string(e))
+}
+
+// UnsupportedKMSHash is an error indicating KMS cannot sign digests of a hash
+type UnsupportedKMSHash struct {
+	KeyType string
+	Hash    crypto.Hash
+}
+
+func (e *UnsupportedKMSHash) Error() string {
+	return fmt.Sprintf("KMS cannot sign %s digests with %s keys", e.Hash, e.KeyType)
+}
+
+// KMSKeyId gets the KMS key id referenced by a stored key, if it is a KMS
+// reference
+func KMSKeyId(key []byte) (string, bool) {
+	key = bytes.TrimSpace(key)
+	if !bytes.HasPrefix(key, []byte(KMS_KEY_PREFIX)) {
+		return "", false
+	}
+	return string(key[len(KMS_KEY_PREFIX):]), true
+}
+
+// ParseSigner parses a stored key for signing.  Keys referencing KMS give a
+// *KMSSigner using client, while others are parsed as by ParseSigningKey.
+func ParseSigner(key []byte, client KMSAPI) (Signer, error) {
+	keyId, ok := KMSKeyId(key)
+	if !ok {
+		return ParseSigningKey(key)
+	}
+	if client == nil {
+		return nil, NoKMSClient(keyId)
+	}
+	return NewKMSSigner(client, keyId)
+}
+
+// KMSSigner signs digests with an asymmetric RSA or ECDSA key held in KMS.
+// As with the keys of crypto/ecdsa, ECDSA signatures are ASN.1 DER encoded.
+type KMSSigner struct {
+	Client KMSAPI
+	KeyId  string
+	public crypto.PublicKey
+}
+
+var _ Signer = &KMSSigner{}
+
+// NewKMSSigner allocates a KMSSigner, fetching the public key from KMS
+func NewKMSSigner(client KMSAPI, keyId string) (*KMSSigner, error) {
+	output, err := client.GetPublicKey(&kms.GetPublicKeyInput{
+		KeyId: aws.String(keyId),
+	})
+	if err != nil {
+		return nil, err
+	}
+	public, err := x509.ParsePKIXPublicKey(output.PublicKey)
+	if err != nil {
+		return nil, &UnparseableKey{
+			Message: fmt.Sprintf("Failed to parse public key of KMS key %s: %s", keyId, err),
+		}
+	}
+	switch public.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return nil, UnsupportedKeyType(fmt.Sprintf("%T", public))
+	}
+	return &KMSSigner{
+		Client: client,
+		KeyId:  keyId,
+		public: public,
+	}, nil
+}
+
+func (s *KMSSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+// kmsSigningAlgorithms are the KMS signing algorithms of RSA PKCS #1 v1.5 and
+// ECDSA signatures by hash
+var kmsSigningAlgorithms = map[string]map[crypto.Hash]string{
+	"RSA": {
+		crypto.SHA256: kms.SigningAlgorithmSpecRsassaPkcs1V15Sha256,
+		crypto.SHA384: kms.SigningAlgorithmSpecRsassaPkcs1V15Sha384,
+		crypto.SHA512: kms.SigningAlgorithmSpecRsassaPkcs1V15Sha512,
+	},
+	"EC": {
+		crypto.SHA256: kms.SigningAlgorithmSpecEcdsaSha256,
+		crypto.SHA384: kms.SigningAlgorithmSpecEcdsaSha384,
+		crypto.SHA512: kms.SigningAlgorithmSpecEcdsaSha512,
+	},
+}
+
+// Sign signs a digest in KMS.  RSA keys make PKCS #1 v1.5 signatures; PSS
+// options are not supported.  The rand argument is unused.
+func (s *KMSSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	keyType := "RSA"
+	if _, ok := s.public.(*ecdsa.PublicKey); ok {
+		keyType = "EC"
+	}
+	algorithm, found := kmsSigningAlgorithms[keyType][opts.HashFunc()]
+	if _, pss := opts.(*rsa.PSSOptions); pss || !found {
+		return nil, &UnsupportedKMSHash{
+			KeyType: keyType,
+			Hash:    opts.HashFunc(),
+		}
+	}
+	output, err := s.Client.Sign(&kms.SignInput{
+		KeyId:            aws.String(s.KeyId),
+		Message:          digest,
+		MessageType:      aws.String(kms.MessageTypeDigest),
+		SigningAlgorithm: aws.String(algorithm),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.Signature, nil
+}
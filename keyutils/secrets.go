@@ -0,0 +1,67 @@
+package keyutils
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+// SECRET_KEY_PREFIX begins a stored key which references a secret in AWS
+// Secrets Manager holding the PEM encoded private key.  It is followed by the
+// secret name or ARN, for example
+// "secretsmanager:arn:aws:secretsmanager:us-east-1:111122223333:secret:app-key".
+const SECRET_KEY_PREFIX = "secretsmanager:"
+
+// SecretsManagerAPI is the part of the AWS Secrets Manager client used to
+// resolve keys, satisfied by *secretsmanager.SecretsManager
+type SecretsManagerAPI interface {
+	GetSecretValue(input *secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error)
+}
+
+// NoSecretsClient is an error indicating a key references a secret but no
+// Secrets Manager client is available to resolve it
+type NoSecretsClient string
+
+func (e NoSecretsClient) Error() string {
+	return fmt.Sprintf("key references secret %s but no Secrets Manager client is configured", string(e))
+}
+
+// EmptySecret is an error indicating a referenced secret has no value
+type EmptySecret string
+
+func (e EmptySecret) Error() string {
+	return fmt.Sprintf("secret %s has no value", string(e))
+}
+
+// SecretKeyId gets the secret id referenced by a stored key, if it is a
+// Secrets Manager reference
+func SecretKeyId(key []byte) (string, bool) {
+	key = bytes.TrimSpace(key)
+	if !bytes.HasPrefix(key, []byte(SECRET_KEY_PREFIX)) {
+		return "", false
+	}
+	return string(key[len(SECRET_KEY_PREFIX):]), true
+}
+
+// GetSecretKey gets the key held in a secret, either as its string or binary
+// value
+func GetSecretKey(client SecretsManagerAPI, secretId string) ([]byte, error) {
+	if client == nil {
+		return nil, NoSecretsClient(secretId)
+	}
+	output, err := client.GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretId),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if output.SecretString != nil && *output.SecretString != "" {
+		return []byte(*output.SecretString), nil
+	}
+	if len(output.SecretBinary) != 0 {
+		return output.SecretBinary, nil
+	}
+	return nil, EmptySecret(secretId)
+}
@@ -0,0 +1,23 @@
+package kslog
+
+import (
+	"context"
+)
+
+// loggerKey is the key of the logger of a context
+type loggerKey struct{}
+
+// NewContext gets a context carrying logger, for handlers to get with
+// FromContext
+func NewContext(ctx context.Context, logger KsLogger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// FromContext gets the logger carried by a context, or a DefaultLogger if it
+// carries none
+func FromContext(ctx context.Context) KsLogger {
+	if logger, ok := ctx.Value(loggerKey{}).(KsLogger); ok {
+		return logger
+	}
+	return DefaultLogger{}
+}
@@ -0,0 +1,145 @@
+package kslog
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Fields are structured key/values of a log message
+type Fields map[string]interface{}
+
+// merge gets the union of two sets of fields, preferring those of other
+func (f Fields) merge(other Fields) Fields {
+	merged := make(Fields, len(f)+len(other))
+	for k, v := range f {
+		merged[k] = v
+	}
+	for k, v := range other {
+		merged[k] = v
+	}
+	return merged
+}
+
+// FieldLogger is a KsLogger able to log structured key/values with a message
+type FieldLogger interface {
+	KsLogger
+	LogFields(level Level, msg string, fields Fields)
+}
+
+// LogFields logs a message with structured key/values.  Loggers that are not
+// a FieldLogger get the message followed by the fields as key=value pairs.
+func LogFields(logger KsLogger, level Level, msg string, fields Fields) {
+	if fieldLogger, ok := logger.(FieldLogger); ok {
+		fieldLogger.LogFields(level, msg, fields)
+		return
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys)+1)
+	pairs = append(pairs, msg)
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%v", k, fields[k]))
+	}
+	line := strings.Join(pairs, " ")
+	switch {
+	case level >= LEVEL_ERROR:
+		logger.Error(line)
+	case level >= LEVEL_WARN:
+		Warn(logger, line)
+	case level >= LEVEL_INFO:
+		Info(logger, line)
+	default:
+		logger.Debug(line)
+	}
+}
+
+// WithFields gets a logger adding fields to every message logged through it
+func WithFields(logger KsLogger, fields Fields) KsLogger {
+	if parent, ok := logger.(*fieldsLogger); ok {
+		return &fieldsLogger{parent.logger, parent.fields.merge(fields)}
+	}
+	return &fieldsLogger{logger, fields}
+}
+
+// ContextualLogger is a KsLogger able to derive loggers adding a field to
+// every message, for context such as the id of a request
+type ContextualLogger interface {
+	KsLogger
+	With(key string, value interface{}) KsLogger
+}
+
+// With gets a logger adding the field key to every message logged through it,
+// along with those of logger if it was itself derived.  It may be passed
+// wherever a KsLogger is taken, so callees log with the caller's context.
+func With(logger KsLogger, key string, value interface{}) KsLogger {
+	if contextual, ok := logger.(ContextualLogger); ok {
+		return contextual.With(key, value)
+	}
+	return WithFields(logger, Fields{key: value})
+}
+
+type fieldsLogger struct {
+	logger KsLogger
+	fields Fields
+}
+
+var _ FieldLogger = &fieldsLogger{}
+var _ ContextualLogger = &fieldsLogger{}
+var _ LevelLogger = &fieldsLogger{}
+
+func (l *fieldsLogger) With(key string, value interface{}) KsLogger {
+	return WithFields(l, Fields{key: value})
+}
+
+// sprintln formats args as log.Println does, without the newline
+func sprintln(args ...interface{}) string {
+	return strings.TrimSuffix(fmt.Sprintln(args...), "\n")
+}
+
+func (l *fieldsLogger) LogFields(level Level, msg string, fields Fields) {
+	LogFields(l.logger, level, msg, l.fields.merge(fields))
+}
+
+func (l *fieldsLogger) Error(args ...interface{}) {
+	l.LogFields(LEVEL_ERROR, sprintln(args...), nil)
+}
+
+func (l *fieldsLogger) Errorf(format string, args ...interface{}) {
+	l.LogFields(LEVEL_ERROR, fmt.Sprintf(format, args...), nil)
+}
+
+func (l *fieldsLogger) Warn(args ...interface{}) {
+	l.LogFields(LEVEL_WARN, sprintln(args...), nil)
+}
+
+func (l *fieldsLogger) Warnf(format string, args ...interface{}) {
+	l.LogFields(LEVEL_WARN, fmt.Sprintf(format, args...), nil)
+}
+
+func (l *fieldsLogger) Info(args ...interface{}) {
+	l.LogFields(LEVEL_INFO, sprintln(args...), nil)
+}
+
+func (l *fieldsLogger) Infof(format string, args ...interface{}) {
+	l.LogFields(LEVEL_INFO, fmt.Sprintf(format, args...), nil)
+}
+
+func (l *fieldsLogger) Log(args ...interface{}) {
+	l.LogFields(LEVEL_INFO, sprintln(args...), nil)
+}
+
+func (l *fieldsLogger) Logf(format string, args ...interface{}) {
+	l.LogFields(LEVEL_INFO, fmt.Sprintf(format, args...), nil)
+}
+
+func (l *fieldsLogger) Debug(args ...interface{}) {
+	l.LogFields(LEVEL_DEBUG, sprintln(args...), nil)
+}
+
+func (l *fieldsLogger) Debugf(format string, args ...interface{}) {
+	l.LogFields(LEVEL_DEBUG, fmt.Sprintf(format, args...), nil)
+}
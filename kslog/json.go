@@ -0,0 +1,118 @@
+package kslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// JSONLogger writes each message as a line of JSON with the fields level, msg
+// and time along with any structured key/values
+type JSONLogger struct {
+	Writer   io.Writer
+	Clock    func() time.Time // Time of messages; defaults to time.Now
+	MinLevel Level            // Messages below this level are dropped
+	mu       sync.Mutex
+}
+
+var _ FieldLogger = &JSONLogger{}
+var _ LevelLogger = &JSONLogger{}
+
+func NewJSONLogger(w io.Writer) *JSONLogger {
+	return &JSONLogger{
+		Writer: w,
+	}
+}
+
+func (l *JSONLogger) now() time.Time {
+	if l.Clock == nil {
+		return time.Now()
+	}
+	return l.Clock()
+}
+
+// LogFields writes a message.  Fields named level, msg or time are replaced
+// by those of the message.
+func (l *JSONLogger) LogFields(level Level, msg string, fields Fields) {
+	if level < l.MinLevel {
+		return
+	}
+	record := make(map[string]interface{}, len(fields)+3)
+	for k, v := range fields {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		record[k] = v
+	}
+	record["level"] = level.String()
+	record["msg"] = msg
+	record["time"] = l.now().UTC().Format(time.RFC3339Nano)
+	line, err := json.Marshal(record)
+	if err != nil {
+		line, _ = json.Marshal(map[string]interface{}{
+			"level": level.String(),
+			"msg":   msg,
+			"time":  record["time"],
+			"error": fmt.Sprintf("Failed to encode log fields: %s", err),
+		})
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.Writer.Write(append(line, '\n'))
+}
+
+// logArgs logs args formatted as by log.Println if level is enabled
+func (l *JSONLogger) logArgs(level Level, args []interface{}) {
+	if level >= l.MinLevel {
+		l.LogFields(level, sprintln(args...), nil)
+	}
+}
+
+// logFormat logs args formatted as by log.Printf if level is enabled
+func (l *JSONLogger) logFormat(level Level, format string, args []interface{}) {
+	if level >= l.MinLevel {
+		l.LogFields(level, fmt.Sprintf(format, args...), nil)
+	}
+}
+
+func (l *JSONLogger) Error(args ...interface{}) {
+	l.logArgs(LEVEL_ERROR, args)
+}
+
+func (l *JSONLogger) Errorf(format string, args ...interface{}) {
+	l.logFormat(LEVEL_ERROR, format, args)
+}
+
+func (l *JSONLogger) Warn(args ...interface{}) {
+	l.logArgs(LEVEL_WARN, args)
+}
+
+func (l *JSONLogger) Warnf(format string, args ...interface{}) {
+	l.logFormat(LEVEL_WARN, format, args)
+}
+
+func (l *JSONLogger) Info(args ...interface{}) {
+	l.logArgs(LEVEL_INFO, args)
+}
+
+func (l *JSONLogger) Infof(format string, args ...interface{}) {
+	l.logFormat(LEVEL_INFO, format, args)
+}
+
+func (l *JSONLogger) Log(args ...interface{}) {
+	l.logArgs(LEVEL_INFO, args)
+}
+
+func (l *JSONLogger) Logf(format string, args ...interface{}) {
+	l.logFormat(LEVEL_INFO, format, args)
+}
+
+func (l *JSONLogger) Debug(args ...interface{}) {
+	l.logArgs(LEVEL_DEBUG, args)
+}
+
+func (l *JSONLogger) Debugf(format string, args ...interface{}) {
+	l.logFormat(LEVEL_DEBUG, format, args)
+}
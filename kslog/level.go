@@ -0,0 +1,113 @@
+package kslog
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Level is the severity of a log message
+type Level int
+
+const (
+	LEVEL_DEBUG Level = iota
+	LEVEL_INFO
+	LEVEL_WARN
+	LEVEL_ERROR
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return fmt.Sprintf("level%d", int(l))
+	}
+	return levelNames[l]
+}
+
+type UnknownLevel string
+
+func (e UnknownLevel) Error() string {
+	return fmt.Sprintf("unknown log level %s", string(e))
+}
+
+// ParseLevel gets the level named debug, info, warn or error
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(i), nil
+		}
+	}
+	return 0, UnknownLevel(name)
+}
+
+// FilteredLogger drops messages of Logger below MinLevel without formatting
+// them
+type FilteredLogger struct {
+	Logger   KsLogger
+	MinLevel Level
+}
+
+var _ FieldLogger = FilteredLogger{}
+var _ LevelLogger = FilteredLogger{}
+
+func (l FilteredLogger) LogFields(level Level, msg string, fields Fields) {
+	if level >= l.MinLevel {
+		LogFields(l.Logger, level, msg, fields)
+	}
+}
+
+func (l FilteredLogger) Error(args ...interface{}) {
+	if LEVEL_ERROR >= l.MinLevel {
+		l.Logger.Error(args...)
+	}
+}
+
+func (l FilteredLogger) Errorf(format string, args ...interface{}) {
+	if LEVEL_ERROR >= l.MinLevel {
+		l.Logger.Errorf(format, args...)
+	}
+}
+
+func (l FilteredLogger) Warn(args ...interface{}) {
+	if LEVEL_WARN >= l.MinLevel {
+		Warn(l.Logger, args...)
+	}
+}
+
+func (l FilteredLogger) Warnf(format string, args ...interface{}) {
+	if LEVEL_WARN >= l.MinLevel {
+		Warnf(l.Logger, format, args...)
+	}
+}
+
+func (l FilteredLogger) Info(args ...interface{}) {
+	if LEVEL_INFO >= l.MinLevel {
+		Info(l.Logger, args...)
+	}
+}
+
+func (l FilteredLogger) Infof(format string, args ...interface{}) {
+	if LEVEL_INFO >= l.MinLevel {
+		Infof(l.Logger, format, args...)
+	}
+}
+
+func (l FilteredLogger) Log(args ...interface{}) {
+	l.Info(args...)
+}
+
+func (l FilteredLogger) Logf(format string, args ...interface{}) {
+	l.Infof(format, args...)
+}
+
+func (l FilteredLogger) Debug(args ...interface{}) {
+	if LEVEL_DEBUG >= l.MinLevel {
+		l.Logger.Debug(args...)
+	}
+}
+
+func (l FilteredLogger) Debugf(format string, args ...interface{}) {
+	if LEVEL_DEBUG >= l.MinLevel {
+		l.Logger.Debugf(format, args...)
+	}
+}
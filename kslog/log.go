@@ -13,6 +13,55 @@ type KsLogger interface {
 	Debugf(format string, args ...interface{})
 }
 
+// LevelLogger is a KsLogger logging warnings and information at their own
+// levels, as by the Warn and Info functions.  Log and Logf are aliases of
+// Info and Infof.
+type LevelLogger interface {
+	KsLogger
+	Warn(args ...interface{})
+	Warnf(format string, args ...interface{})
+	Info(args ...interface{})
+	Infof(format string, args ...interface{})
+}
+
+// Warn logs a warning.  Loggers that are not a LevelLogger log it as by Log.
+func Warn(logger KsLogger, args ...interface{}) {
+	if levelLogger, ok := logger.(LevelLogger); ok {
+		levelLogger.Warn(args...)
+		return
+	}
+	logger.Log(args...)
+}
+
+// Warnf logs a formatted warning.  Loggers that are not a LevelLogger log it
+// as by Logf.
+func Warnf(logger KsLogger, format string, args ...interface{}) {
+	if levelLogger, ok := logger.(LevelLogger); ok {
+		levelLogger.Warnf(format, args...)
+		return
+	}
+	logger.Logf(format, args...)
+}
+
+// Info logs information.  Loggers that are not a LevelLogger log it as by Log.
+func Info(logger KsLogger, args ...interface{}) {
+	if levelLogger, ok := logger.(LevelLogger); ok {
+		levelLogger.Info(args...)
+		return
+	}
+	logger.Log(args...)
+}
+
+// Infof logs formatted information.  Loggers that are not a LevelLogger log
+// it as by Logf.
+func Infof(logger KsLogger, format string, args ...interface{}) {
+	if levelLogger, ok := logger.(LevelLogger); ok {
+		levelLogger.Infof(format, args...)
+		return
+	}
+	logger.Logf(format, args...)
+}
+
 type TestLogger interface {
 	Error(args ...interface{})
 	Errorf(format string, args ...interface{})
@@ -25,7 +74,7 @@ type KsTestLogger struct {
 	FailOnError bool
 }
 
-var _ KsLogger = KsTestLogger{}
+var _ LevelLogger = KsTestLogger{}
 
 func (l KsTestLogger) Debug(args ...interface{}) {
 	TestLogger(l).Log(args...)
@@ -35,6 +84,22 @@ func (l KsTestLogger) Debugf(format string, args ...interface{}) {
 	TestLogger(l).Logf(format, args...)
 }
 
+func (l KsTestLogger) Info(args ...interface{}) {
+	TestLogger(l).Log(args...)
+}
+
+func (l KsTestLogger) Infof(format string, args ...interface{}) {
+	TestLogger(l).Logf(format, args...)
+}
+
+func (l KsTestLogger) Warn(args ...interface{}) {
+	TestLogger(l).Log(args...)
+}
+
+func (l KsTestLogger) Warnf(format string, args ...interface{}) {
+	TestLogger(l).Logf(format, args...)
+}
+
 func (l KsTestLogger) Error(args ...interface{}) {
 	if l.FailOnError {
 		TestLogger(l).Error(args...)
@@ -53,7 +118,7 @@ func (l KsTestLogger) Errorf(format string, args ...interface{}) {
 
 type DefaultLogger struct{}
 
-var _ KsLogger = DefaultLogger{}
+var _ LevelLogger = DefaultLogger{}
 
 func (l DefaultLogger) Error(args ...interface{}) {
 	log.Println(args...)
@@ -63,6 +128,22 @@ func (l DefaultLogger) Errorf(format string, args ...interface{}) {
 	log.Printf(format, args...)
 }
 
+func (l DefaultLogger) Warn(args ...interface{}) {
+	log.Println(args...)
+}
+
+func (l DefaultLogger) Warnf(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
+
+func (l DefaultLogger) Info(args ...interface{}) {
+	log.Println(args...)
+}
+
+func (l DefaultLogger) Infof(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
+
 func (l DefaultLogger) Log(args ...interface{}) {
 	log.Println(args...)
 }
@@ -81,6 +162,8 @@ func (l DefaultLogger) Debugf(format string, args ...interface{}) {
 
 type LogLogger log.Logger
 
+var _ LevelLogger = &LogLogger{}
+
 func (l *LogLogger) Error(args ...interface{}) {
 	(*log.Logger)(l).Println(args...)
 }
@@ -89,6 +172,22 @@ func (l *LogLogger) Errorf(format string, args ...interface{}) {
 	(*log.Logger)(l).Printf(format, args...)
 }
 
+func (l *LogLogger) Warn(args ...interface{}) {
+	(*log.Logger)(l).Println(args...)
+}
+
+func (l *LogLogger) Warnf(format string, args ...interface{}) {
+	(*log.Logger)(l).Printf(format, args...)
+}
+
+func (l *LogLogger) Info(args ...interface{}) {
+	(*log.Logger)(l).Println(args...)
+}
+
+func (l *LogLogger) Infof(format string, args ...interface{}) {
+	(*log.Logger)(l).Printf(format, args...)
+}
+
 func (l *LogLogger) Log(args ...interface{}) {
 	(*log.Logger)(l).Println(args...)
 }
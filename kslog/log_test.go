@@ -0,0 +1,197 @@
+package kslog
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	logger := NewJSONLogger(&buf)
+	logger.Clock = func() time.Time { return now }
+	logger.Logf("added app %d", 1)
+	WithFields(logger, Fields{"app": 1}).Errorf("failed: %s", "cause")
+	LogFields(logger, LEVEL_DEBUG, "fetched", Fields{"err": errors.New("boom"), "msg": "ignored"})
+	expected := []map[string]interface{}{
+		{"level": "info", "msg": "added app 1"},
+		{"level": "error", "msg": "failed: cause", "app": float64(1)},
+		{"level": "debug", "msg": "fetched", "err": "boom"},
+	}
+	scanner := bufio.NewScanner(&buf)
+	lines := 0
+	for ; scanner.Scan(); lines++ {
+		var record map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("Line %s is invalid JSON: %s", scanner.Text(), err)
+		}
+		if lines >= len(expected) {
+			continue
+		}
+		for k, v := range expected[lines] {
+			if record[k] != v {
+				t.Errorf("Line %d has %s %v instead of %v", lines, k, record[k], v)
+			}
+		}
+		if record["time"] != "2020-01-02T03:04:05Z" {
+			t.Errorf("Line %d has time %v", lines, record["time"])
+		}
+	}
+	if lines != len(expected) {
+		t.Fatalf("Logged %d lines instead of %d", lines, len(expected))
+	}
+}
+
+func TestWithFieldsPlainLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := (*LogLogger)(log.New(&buf, "", 0))
+	WithFields(WithFields(logger, Fields{"b": 2}), Fields{"a": 1}).Log("message")
+	if line := strings.TrimSpace(buf.String()); line != "message a=1 b=2" {
+		t.Fatalf("Logged %q", line)
+	}
+}
+
+func TestMinLevel(t *testing.T) {
+	var plainBuf, jsonBuf bytes.Buffer
+	jsonLogger := NewJSONLogger(&jsonBuf)
+	jsonLogger.MinLevel = LEVEL_WARN
+	loggers := []LevelLogger{
+		FilteredLogger{
+			Logger:   (*LogLogger)(log.New(&plainBuf, "", 0)),
+			MinLevel: LEVEL_WARN,
+		},
+		jsonLogger,
+	}
+	for _, logger := range loggers {
+		logger.Debugf("debug %d", 1)
+		logger.Info("info")
+		logger.Logf("log %d", 2)
+		LogFields(logger, LEVEL_INFO, "info fields", nil)
+		WithFields(logger, Fields{"a": 1}).Debug("debug fields")
+		logger.Warnf("warn %d", 3)
+		logger.Error("error")
+	}
+	plainLines := strings.Split(strings.TrimSpace(plainBuf.String()), "\n")
+	if len(plainLines) != 2 || plainLines[0] != "warn 3" || plainLines[1] != "error" {
+		t.Errorf("Filtered logger logged %q", plainLines)
+	}
+	jsonLines := strings.Split(strings.TrimSpace(jsonBuf.String()), "\n")
+	if len(jsonLines) != 2 {
+		t.Fatalf("JSON logger logged %q", jsonLines)
+	}
+	for i, expected := range []string{"warn", "error"} {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(jsonLines[i]), &record); err != nil {
+			t.Fatalf("Line %s is invalid JSON: %s", jsonLines[i], err)
+		}
+		if record["level"] != expected {
+			t.Errorf("Line %d has level %v instead of %s", i, record["level"], expected)
+		}
+	}
+}
+
+// plainLogger is a KsLogger which is not a LevelLogger, marking messages
+// logged as by Log
+type plainLogger struct {
+	logger *log.Logger
+}
+
+func (l plainLogger) Error(args ...interface{}) {
+	l.logger.Println(args...)
+}
+
+func (l plainLogger) Errorf(format string, args ...interface{}) {
+	l.logger.Printf(format, args...)
+}
+
+func (l plainLogger) Log(args ...interface{}) {
+	l.logger.Println(append([]interface{}{"log:"}, args...)...)
+}
+
+func (l plainLogger) Logf(format string, args ...interface{}) {
+	l.logger.Printf("log: "+format, args...)
+}
+
+func (l plainLogger) Debug(args ...interface{}) {
+	l.logger.Println(args...)
+}
+
+func (l plainLogger) Debugf(format string, args ...interface{}) {
+	l.logger.Printf(format, args...)
+}
+
+func TestLevelFallback(t *testing.T) {
+	var buf bytes.Buffer
+	var logger KsLogger = plainLogger{log.New(&buf, "", 0)}
+	if _, ok := logger.(LevelLogger); ok {
+		t.Fatalf("Plain logger is a LevelLogger")
+	}
+	Warn(logger, "warn")
+	Warnf(logger, "warn %d", 1)
+	Info(logger, "info")
+	Infof(logger, "info %d", 2)
+	FilteredLogger{Logger: logger, MinLevel: LEVEL_WARN}.Warnf("filtered %d", 3)
+	LogFields(logger, LEVEL_WARN, "fields", Fields{"a": 1})
+	expected := []string{"log: warn", "log: warn 1", "log: info", "log: info 2", "log: filtered 3", "log: fields a=1"}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if strings.Join(lines, "|") != strings.Join(expected, "|") {
+		t.Fatalf("Logged %q instead of %q", lines, expected)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, level := range []Level{LEVEL_DEBUG, LEVEL_INFO, LEVEL_WARN, LEVEL_ERROR} {
+		parsed, err := ParseLevel(strings.ToUpper(level.String()))
+		if err != nil || parsed != level {
+			t.Errorf("Parsed %s as %s, %v", level, parsed, err)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Errorf("Parsed unknown level")
+	}
+}
+
+func TestWith(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewJSONLogger(&buf)
+	request := With(logger, "request_id", "req-1")
+	app := With(request, "app", 7)
+	app.Logf("signed")
+	Warn(request, "slow")
+	ctxLogger := FromContext(NewContext(context.Background(), app))
+	ctxLogger.Errorf("failed")
+	expected := []map[string]interface{}{
+		{"msg": "signed", "request_id": "req-1", "app": float64(7)},
+		{"msg": "slow", "request_id": "req-1", "app": nil},
+		{"msg": "failed", "request_id": "req-1", "app": float64(7)},
+	}
+	scanner := bufio.NewScanner(&buf)
+	lines := 0
+	for ; scanner.Scan(); lines++ {
+		var record map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("Line %s is invalid JSON: %s", scanner.Text(), err)
+		}
+		if lines >= len(expected) {
+			continue
+		}
+		for k, v := range expected[lines] {
+			if record[k] != v {
+				t.Errorf("Line %d has %s %v instead of %v", lines, k, record[k], v)
+			}
+		}
+	}
+	if lines != len(expected) {
+		t.Fatalf("Logged %d lines instead of %d", lines, len(expected))
+	}
+	if _, ok := FromContext(context.Background()).(DefaultLogger); !ok {
+		t.Errorf("Context without a logger did not give a DefaultLogger")
+	}
+}
@@ -3,16 +3,24 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/aefalcon/github-keystore-protobuf/go/appkeypb"
 	"github.com/aefalcon/github-keystore-protobuf/go/locationpb"
 	"github.com/aefalcon/go-github-keystore/appkeystore"
+	"github.com/aefalcon/go-github-keystore/keyservice"
 	"github.com/aefalcon/go-github-keystore/kslog"
 	"github.com/aefalcon/go-github-keystore/messagestore"
+	"github.com/aefalcon/go-github-keystore/metrics"
 	"github.com/aefalcon/go-github-keystore/s3store"
+	"github.com/aefalcon/go-github-keystore/storeloc"
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/golang/protobuf/jsonpb"
 )
 
@@ -27,6 +35,7 @@ func (r *LambdaSignJwtRequest) UnmarshalJSON(data []byte) error {
 
 type LambdaSignJwtResponse struct {
 	appkeypb.SignJwtResponse
+	Diagnostics *appkeystore.SignJwtDiagnostics // Description of the signature, if diagnostics were requested
 }
 
 func (r *LambdaSignJwtResponse) MarshalJSON() ([]byte, error) {
@@ -36,42 +45,181 @@ func (r *LambdaSignJwtResponse) MarshalJSON() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	return buffer.Bytes(), nil
+	if r.Diagnostics == nil {
+		return buffer.Bytes(), nil
+	}
+	// Add the diagnostics as a field of the protobuf JSON object
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(buffer.Bytes(), &fields); err != nil {
+		return nil, err
+	}
+	if fields["diagnostics"], err = json.Marshal(r.Diagnostics); err != nil {
+		return nil, err
+	}
+	return json.Marshal(fields)
+}
+
+// DiagnosingSigningService is a SigningService which can describe the
+// signatures it makes, such as an *appkeystore.AppKeyService
+type DiagnosingSigningService interface {
+	keyservice.SigningService
+	SignJwtWithDiagnostics(*appkeypb.SignJwtRequest, kslog.KsLogger) (*appkeypb.SignJwtResponse, *appkeystore.SignJwtDiagnostics, error)
+}
+
+var _ DiagnosingSigningService = &appkeystore.AppKeyService{}
+
+// diagnosticsKey is the context key of whether signing diagnostics are
+// requested
+type diagnosticsKey struct{}
+
+// WithDiagnostics derives a context requesting that HandleRequest return the
+// diagnostics of the signature along with the JWT
+func WithDiagnostics(ctx context.Context) context.Context {
+	return context.WithValue(ctx, diagnosticsKey{}, true)
+}
+
+// diagnosticsRequested tells whether a context was derived by WithDiagnostics
+func diagnosticsRequested(ctx context.Context) bool {
+	requested, _ := ctx.Value(diagnosticsKey{}).(bool)
+	return requested
+}
+
+// LambdaError is the error returned by the function when signing fails.  Its
+// message is a JSON object so invokers may branch on the code rather than
+// parsing the message.
+type LambdaError struct {
+	Code    string `json:"code"`    // One of the appkeystore CODE_ constants
+	Message string `json:"message"` // Description of the failure
 }
 
-func HandleRequest(service *appkeystore.AppKeyService, ctx context.Context, req *LambdaSignJwtRequest) (*LambdaSignJwtResponse, error) {
-	logger := kslog.DefaultLogger{}
-	resp, err := service.SignJwt(&req.SignJwtRequest, logger)
+func (e *LambdaError) Error() string {
+	data, err := json.Marshal(e)
 	if err != nil {
-		return nil, err
+		return e.Message
+	}
+	return string(data)
+}
+
+// NewLambdaError creates the error reported to invokers for an error of the
+// key service
+func NewLambdaError(err error) *LambdaError {
+	return &LambdaError{
+		Code:    appkeystore.ErrorCode(err),
+		Message: err.Error(),
+	}
+}
+
+// HandleRequest signs the claims of a request with the signing service, such
+// as an *appkeystore.AppKeyService.  Requests for app id 0 are rejected with
+// appkeystore.UnallowedAppId before the service is called.  Failures are
+// counted by error code in recorder, if set.  Messages are logged with the
+// logger of ctx, as by kslog.FromContext, and the AWS request id of the
+// invocation as the field request_id.  If ctx was derived by WithDiagnostics
+// and the service is a DiagnosingSigningService, the response carries the
+// diagnostics of the signature.
+func HandleRequest(service keyservice.SigningService, recorder metrics.Metrics, ctx context.Context, req *LambdaSignJwtRequest) (*LambdaSignJwtResponse, error) {
+	logger := kslog.FromContext(ctx)
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		logger = kslog.With(logger, "request_id", lc.AwsRequestID)
+	}
+	var resp *appkeypb.SignJwtResponse
+	var diag *appkeystore.SignJwtDiagnostics
+	var err error
+	diagnosingService, canDiagnose := service.(DiagnosingSigningService)
+	if req.App == 0 {
+		logger.Errorf("Attempted to sign JWT for app %d", req.App)
+		err = appkeystore.UnallowedAppId(req.App)
+	} else if canDiagnose && diagnosticsRequested(ctx) {
+		resp, diag, err = diagnosingService.SignJwtWithDiagnostics(&req.SignJwtRequest, logger)
+	} else {
+		resp, err = service.SignJwt(&req.SignJwtRequest, logger)
+	}
+	if err != nil {
+		lambdaErr := NewLambdaError(err)
+		if recorder != nil {
+			recorder.IncrCounter(metrics.METRIC_SIGN_JWT_ERROR, metrics.Tag{Name: metrics.TAG_CODE, Value: lambdaErr.Code})
+		}
+		return nil, lambdaErr
+	}
+	reply := LambdaSignJwtResponse{
+		SignJwtResponse: *resp,
+		Diagnostics:     diag,
 	}
-	reply := LambdaSignJwtResponse{*resp}
 	return &reply, nil
 }
 
+// ServeMetrics serves the metrics of a registry at /metrics on addr in the
+// background, for scraping while the execution environment lives.  Failing to
+// listen is logged rather than fatal so invocations are unaffected.
+func ServeMetrics(addr string, registry *metrics.Registry) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Failed to serve metrics on %s: %s", addr, err)
+		}
+	}()
+}
+
+// CloseOnShutdown closes a store when the runtime is told to shut down, so
+// its pending writes are flushed before the process exits.  The process is
+// left for the runtime to end, and further signals are handled as by default.
+func CloseOnShutdown(store messagestore.BlobStore) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-signals
+		signal.Stop(signals)
+		if err := messagestore.CloseBlobStore(store); err != nil {
+			log.Printf("Failed to close store: %s", err)
+		}
+	}()
+}
+
 func main() {
 	storeBucket := os.Getenv("STORE_BUCKET")
 	storePrefix := os.Getenv("STORE_PREFIX")
 	storeRegion := os.Getenv("STORE_REGION")
-	location := locationpb.Location{
-		Location: &locationpb.Location_S3{
-			S3: &locationpb.S3Ref{
-				Bucket: storeBucket,
-				Key:    storePrefix,
-				Region: storeRegion,
+	location := s3store.S3Location(storeBucket, storeRegion, storePrefix)
+	if storeUrl := os.Getenv("STORE_URL"); storeUrl != "" {
+		location = &locationpb.Location{
+			Location: &locationpb.Location_Url{
+				Url: storeUrl,
 			},
-		},
+		}
 	}
-	blobStore, err := s3store.NewS3BlobStore(&location)
+	blobStore, err := storeloc.NewFromLocation(location, kslog.DefaultLogger{})
 	if err != nil {
 		log.Fatalf("Failed to create store: %s", err)
 	}
-	messageStore := messagestore.BlobMessageStore{
-		BlobStore: blobStore,
+	CloseOnShutdown(blobStore)
+	// The check may need more permissions than signing, such as s3:ListBucket
+	// for HeadBucket, so a failure is only reported
+	startupService := appkeystore.NewAppKeyService(&messagestore.BlobMessageStore{BlobStore: blobStore}, nil)
+	if err := startupService.Healthy(kslog.DefaultLogger{}); err != nil {
+		log.Printf("Warning: store did not pass its health check: %s", err)
+	}
+	var registry *metrics.Registry
+	if metricsAddr := os.Getenv("METRICS_ADDR"); metricsAddr != "" {
+		registry = &metrics.Registry{Namespace: "getappjwt"}
+		ServeMetrics(metricsAddr, registry)
 	}
-	keyService := appkeystore.NewAppKeyService(&messageStore, nil)
+	// Diagnostics describe signatures without key material, but are opt-in
+	// since invokers rarely need them
+	diagnose := os.Getenv("SIGN_DIAGNOSTICS") != ""
 	handleFunc := func(ctx context.Context, req *LambdaSignJwtRequest) (*LambdaSignJwtResponse, error) {
-		return HandleRequest(keyService, ctx, req)
+		// Bind the store to the invocation so reads abort when the function times out
+		messageStore := messagestore.BlobMessageStore{
+			BlobStore: storeloc.WithContext(blobStore, ctx),
+		}
+		keyService := appkeystore.NewAppKeyService(&messageStore, nil)
+		if registry != nil {
+			keyService.Metrics = registry
+		}
+		if diagnose {
+			ctx = WithDiagnostics(ctx)
+		}
+		return HandleRequest(keyService, keyService.Metrics, ctx, req)
 	}
 	lambda.Start(handleFunc)
 }
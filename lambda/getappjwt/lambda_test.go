@@ -1,14 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto"
+	"crypto/ecdsa"
 	"crypto/rsa"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
@@ -20,7 +23,9 @@ import (
 	"github.com/aefalcon/go-github-keystore/keyutils"
 	"github.com/aefalcon/go-github-keystore/kslog"
 	"github.com/aefalcon/go-github-keystore/messagestore"
+	"github.com/aefalcon/go-github-keystore/metrics"
 	"github.com/aefalcon/go-github-keystore/timeutils"
+	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/golang/protobuf/jsonpb"
 	structpb "github.com/golang/protobuf/ptypes/struct"
 )
@@ -105,7 +110,7 @@ func TestSignJwt(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Failed to unmarshal protobuf json into lambda request object: %s", err)
 	}
-	resp, err := HandleRequest(keyService, context.Background(), &lambdaReq)
+	resp, err := HandleRequest(keyService, keyService.Metrics, context.Background(), &lambdaReq)
 	if err != nil {
 		t.Fatalf("handler failure: %s", err)
 	}
@@ -124,3 +129,309 @@ func TestSignJwt(t *testing.T) {
 	}
 	t.Log("signiture verifies")
 }
+
+func TestSignJwtErrorCode(t *testing.T) {
+	keyService := NewTestKeyService()
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	if err := keyService.Store.InitDb(&logger); err != nil {
+		t.Fatalf("Failed to initialize database: %s", err)
+	}
+	keyService.Claims = appkeystore.CLAIMS_UNCHECKED
+	lambdaReq := LambdaSignJwtRequest{}
+	lambdaReq.App = 1
+	lambdaReq.Algorithm = "RS256"
+	_, err := HandleRequest(keyService, keyService.Metrics, context.Background(), &lambdaReq)
+	if err == nil {
+		t.Fatalf("Signed JWT of unknown app")
+	}
+	var reported LambdaError
+	if jsonErr := json.Unmarshal([]byte(err.Error()), &reported); jsonErr != nil {
+		t.Fatalf("Error %s is not JSON: %s", err, jsonErr)
+	}
+	if reported.Code != appkeystore.CODE_APP_NOT_FOUND || reported.Message == "" {
+		t.Fatalf("Reported error %+v", reported)
+	}
+}
+
+// countingBlobStore counts the accesses of a store which holds nothing
+type countingBlobStore struct {
+	Accesses int
+}
+
+func (s *countingBlobStore) GetBlob(name string) ([]byte, *messagestore.CacheMeta, error) {
+	s.Accesses++
+	return nil, nil, messagestore.NoSuchResource(name)
+}
+
+func (s *countingBlobStore) PutBlob(name string, content []byte) (*messagestore.CacheMeta, error) {
+	s.Accesses++
+	return nil, nil
+}
+
+func (s *countingBlobStore) DeleteBlob(name string) (*messagestore.CacheMeta, error) {
+	s.Accesses++
+	return nil, messagestore.NoSuchResource(name)
+}
+
+func TestSignJwtAppZero(t *testing.T) {
+	blobStore := countingBlobStore{}
+	keyService := appkeystore.NewAppKeyService(&messagestore.BlobMessageStore{BlobStore: &blobStore}, nil)
+	lambdaReq := LambdaSignJwtRequest{}
+	lambdaReq.Algorithm = "RS256"
+	_, err := HandleRequest(keyService, keyService.Metrics, context.Background(), &lambdaReq)
+	if err == nil {
+		t.Fatalf("Signed JWT of app 0")
+	}
+	var reported LambdaError
+	if jsonErr := json.Unmarshal([]byte(err.Error()), &reported); jsonErr != nil {
+		t.Fatalf("Error %s is not JSON: %s", err, jsonErr)
+	}
+	if reported.Code != appkeystore.CODE_INVALID_REQUEST || reported.Message != appkeystore.UnallowedAppId(0).Error() {
+		t.Fatalf("Reported error %+v", reported)
+	}
+	_, err = keyService.SignJwt(&lambdaReq.SignJwtRequest, &kslog.KsTestLogger{TestLogger: t})
+	if err != appkeystore.UnallowedAppId(0) {
+		t.Fatalf("Expected UnallowedAppId(0) from key service but got %v", err)
+	}
+	if blobStore.Accesses != 0 {
+		t.Fatalf("Store was accessed %d times for app 0", blobStore.Accesses)
+	}
+}
+
+func readTestKey(t *testing.T, name string) []byte {
+	keyFileName := filepath.Join("testdata", name)
+	keyBytes, err := ioutil.ReadFile(keyFileName)
+	if err != nil {
+		t.Fatalf("Failed to read file %s: %s", keyFileName, err)
+	}
+	return keyBytes
+}
+
+func TestParsePrivateKeyFormats(t *testing.T) {
+	pkcs1Key, err := keyutils.ParsePrivateKey(readTestKey(t, "priv1.pem"))
+	if err != nil {
+		t.Fatalf("Failed to parse PKCS#1 key: %s", err)
+	}
+	pkcs8Key, err := keyutils.ParsePrivateKey(readTestKey(t, "priv1_pkcs8.pem"))
+	if err != nil {
+		t.Fatalf("Failed to parse PKCS#8 key: %s", err)
+	}
+	if pkcs8Key.N.Cmp(pkcs1Key.N) != 0 {
+		t.Errorf("PKCS#8 key differs from PKCS#1 key")
+	}
+	ecKey, err := keyutils.ParseSigningKey(readTestKey(t, "ec256.pem"))
+	if err != nil {
+		t.Fatalf("Failed to parse EC key: %s", err)
+	}
+	if _, ok := ecKey.(*ecdsa.PrivateKey); !ok {
+		t.Errorf("EC key parsed as %T", ecKey)
+	}
+	_, err = keyutils.ParsePrivateKey(readTestKey(t, "ec256.pem"))
+	if _, ok := err.(keyutils.UnsupportedKeyType); !ok {
+		t.Errorf("Expected UnsupportedKeyType parsing EC key as RSA but got %v", err)
+	}
+	_, err = keyutils.ParseSigningKey(readTestKey(t, "ed25519.pem"))
+	if _, ok := err.(keyutils.UnsupportedKeyType); !ok {
+		t.Errorf("Expected UnsupportedKeyType parsing ed25519 key but got %v", err)
+	}
+}
+
+func TestParsePrivateKeyWithPassphrase(t *testing.T) {
+	encrypted := readTestKey(t, "priv1_encrypted.pem")
+	pkcs1Key, err := keyutils.ParsePrivateKey(readTestKey(t, "priv1.pem"))
+	if err != nil {
+		t.Fatalf("Failed to parse PKCS#1 key: %s", err)
+	}
+	decrypted, err := keyutils.ParsePrivateKeyWithPassphrase(encrypted, []byte("passphrase"))
+	if err != nil {
+		t.Fatalf("Failed to parse encrypted key: %s", err)
+	}
+	if rsaKey, ok := decrypted.(*rsa.PrivateKey); !ok || rsaKey.N.Cmp(pkcs1Key.N) != 0 {
+		t.Errorf("Decrypted key differs from PKCS#1 key")
+	}
+	_, err = keyutils.ParseSigningKey(encrypted)
+	if _, ok := err.(*keyutils.NeedsPassphrase); !ok {
+		t.Errorf("Expected NeedsPassphrase but got %v", err)
+	}
+	_, err = keyutils.ParsePrivateKeyWithPassphrase(encrypted, []byte("wrong"))
+	if _, ok := err.(*keyutils.WrongPassphrase); !ok {
+		t.Errorf("Expected WrongPassphrase but got %v", err)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	keyService := NewTestKeyService()
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	if err := keyService.Store.InitDb(&logger); err != nil {
+		t.Fatalf("Failed to initialize database: %s", err)
+	}
+	addReq := appkeypb.AddAppRequest{
+		App:  1,
+		Keys: []*appkeypb.AppKey{&appkeypb.AppKey{Key: readTestKey(t, "priv1.pem")}},
+	}
+	if _, err := keyService.AddApp(&addReq, &logger); err != nil {
+		t.Fatalf("Failed to add app: %s", err)
+	}
+	registry := &metrics.Registry{Namespace: "getappjwt"}
+	keyService.Metrics = registry
+	keyService.DefaultClaims = true
+	for _, app := range []uint64{1, 1, 2} {
+		lambdaReq := LambdaSignJwtRequest{}
+		lambdaReq.App = app
+		lambdaReq.Algorithm = "RS256"
+		_, err := HandleRequest(keyService, keyService.Metrics, context.Background(), &lambdaReq)
+		if (err == nil) != (app == 1) {
+			t.Fatalf("Unexpected result signing for app %d: %v", app, err)
+		}
+	}
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	scraped := recorder.Body.String()
+	t.Logf("scraped metrics:\n%s", scraped)
+	expected := []string{
+		`getappjwt_sign_jwt_total{result="success"} 2`,
+		`getappjwt_sign_jwt_total{result="error"} 1`,
+		`getappjwt_sign_jwt_error_total{code="AppNotFound"} 1`,
+		`getappjwt_sign_jwt_duration_seconds_bucket{le="+Inf"} 3`,
+		`getappjwt_sign_jwt_duration_seconds_count 3`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(scraped, line+"\n") {
+			t.Errorf("Scraped metrics lack %s", line)
+		}
+	}
+}
+
+// stubSigningService records the requests it is given and signs them with a
+// canned JWT
+type stubSigningService struct {
+	Requests []*appkeypb.SignJwtRequest
+	Jwt      string
+	Err      error
+}
+
+func (s *stubSigningService) SignJwt(req *appkeypb.SignJwtRequest, logger kslog.KsLogger) (*appkeypb.SignJwtResponse, error) {
+	s.Requests = append(s.Requests, req)
+	if s.Err != nil {
+		return nil, s.Err
+	}
+	return &appkeypb.SignJwtResponse{Jwt: s.Jwt}, nil
+}
+
+func TestHandleRequestStubService(t *testing.T) {
+	service := stubSigningService{Jwt: "header.claims.signature"}
+	lambdaReq := LambdaSignJwtRequest{}
+	if err := json.Unmarshal([]byte(`{"app": 7, "algorithm": "ES256"}`), &lambdaReq); err != nil {
+		t.Fatalf("Failed to unmarshal lambda request: %s", err)
+	}
+	resp, err := HandleRequest(&service, nil, context.Background(), &lambdaReq)
+	if err != nil {
+		t.Fatalf("handler failure: %s", err)
+	}
+	if resp.Jwt != service.Jwt {
+		t.Errorf("Expected canned JWT but got %s", resp.Jwt)
+	}
+	if len(service.Requests) != 1 || service.Requests[0].App != 7 || service.Requests[0].Algorithm != "ES256" {
+		t.Fatalf("Service was given requests %v", service.Requests)
+	}
+	registry := &metrics.Registry{Namespace: "getappjwt"}
+	service.Err = appkeystore.NoSuchApp(7)
+	_, err = HandleRequest(&service, registry, context.Background(), &lambdaReq)
+	var reported LambdaError
+	if err == nil || json.Unmarshal([]byte(err.Error()), &reported) != nil || reported.Code != appkeystore.CODE_APP_NOT_FOUND {
+		t.Fatalf("Expected AppNotFound error but got %v", err)
+	}
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if line := `getappjwt_sign_jwt_error_total{code="AppNotFound"} 1`; !strings.Contains(recorder.Body.String(), line+"\n") {
+		t.Errorf("Scraped metrics lack %s", line)
+	}
+	lambdaReq.App = 0
+	if _, err = HandleRequest(&service, nil, context.Background(), &lambdaReq); err == nil {
+		t.Fatalf("Signed JWT of app 0")
+	}
+	if len(service.Requests) != 2 {
+		t.Errorf("Service was called for app 0")
+	}
+}
+
+func TestHandleRequestLogsRequestId(t *testing.T) {
+	keyService := NewTestKeyService()
+	var buf bytes.Buffer
+	ctx := kslog.NewContext(context.Background(), kslog.NewJSONLogger(&buf))
+	ctx = lambdacontext.NewContext(ctx, &lambdacontext.LambdaContext{AwsRequestID: "req-1"})
+	lambdaReq := LambdaSignJwtRequest{}
+	lambdaReq.Algorithm = "RS256"
+	if _, err := HandleRequest(keyService, keyService.Metrics, ctx, &lambdaReq); err == nil {
+		t.Fatalf("Signed JWT of app 0")
+	}
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Log %q is not a JSON line: %s", buf.String(), err)
+	}
+	if record["request_id"] != "req-1" {
+		t.Fatalf("Logged %v instead of request id req-1", record)
+	}
+}
+
+// stubDiagnosingService signs like stubSigningService with canned
+// diagnostics
+type stubDiagnosingService struct {
+	stubSigningService
+	Diagnostics appkeystore.SignJwtDiagnostics
+}
+
+func (s *stubDiagnosingService) SignJwtWithDiagnostics(req *appkeypb.SignJwtRequest, logger kslog.KsLogger) (*appkeypb.SignJwtResponse, *appkeystore.SignJwtDiagnostics, error) {
+	resp, err := s.SignJwt(req, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, &s.Diagnostics, nil
+}
+
+func TestHandleRequestDiagnostics(t *testing.T) {
+	service := stubDiagnosingService{
+		stubSigningService: stubSigningService{Jwt: "header.claims.signature"},
+		Diagnostics: appkeystore.SignJwtDiagnostics{
+			Fingerprint: "fingerprint",
+			Algorithm:   "RS256",
+			InputHash:   "hash",
+		},
+	}
+	lambdaReq := LambdaSignJwtRequest{}
+	lambdaReq.App = 7
+	lambdaReq.Algorithm = "RS256"
+	resp, err := HandleRequest(&service, nil, context.Background(), &lambdaReq)
+	if err != nil {
+		t.Fatalf("handler failure: %s", err)
+	}
+	respJson, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatalf("Failed to marshal response: %s", err)
+	}
+	if resp.Diagnostics != nil || strings.Contains(string(respJson), "diagnostics") {
+		t.Fatalf("Diagnostics were returned without being requested: %s", respJson)
+	}
+	resp, err = HandleRequest(&service, nil, WithDiagnostics(context.Background()), &lambdaReq)
+	if err != nil {
+		t.Fatalf("handler failure: %s", err)
+	}
+	respJson, err = json.Marshal(resp)
+	if err != nil {
+		t.Fatalf("Failed to marshal response: %s", err)
+	}
+	var reply struct {
+		Jwt         string                         `json:"jwt"`
+		Diagnostics appkeystore.SignJwtDiagnostics `json:"diagnostics"`
+	}
+	if err = json.Unmarshal(respJson, &reply); err != nil {
+		t.Fatalf("Failed to unmarshal response %s: %s", respJson, err)
+	}
+	if reply.Jwt != service.Jwt || reply.Diagnostics != service.Diagnostics {
+		t.Fatalf("Expected JWT and diagnostics but got %s", respJson)
+	}
+}
@@ -3,15 +3,17 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"log"
 	"os"
 
-	"github.com/aefalcon/github-keystore-protobuf/go/locationpb"
 	"github.com/aefalcon/github-keystore-protobuf/go/tokenpb"
 	"github.com/aefalcon/go-github-keystore/kslog"
 	"github.com/aefalcon/go-github-keystore/lambdacall"
 	"github.com/aefalcon/go-github-keystore/messagestore"
 	"github.com/aefalcon/go-github-keystore/s3store"
+	"github.com/aefalcon/go-github-keystore/s3storev2"
+	"github.com/aefalcon/go-github-keystore/storeloc"
 	"github.com/aefalcon/go-github-keystore/tokenstore"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
@@ -20,11 +22,31 @@ import (
 	"github.com/golang/protobuf/jsonpb"
 )
 
+// FIELD_IDEMPOTENCY_KEY is the field of a request naming the key under which
+// retries of the request are served the same token
+const FIELD_IDEMPOTENCY_KEY = "idempotencyKey"
+
 type LambdaGetInstallTokenRequest struct {
 	tokenpb.GetInstallTokenRequest
+	IdempotencyKey string
 }
 
 func (r *LambdaGetInstallTokenRequest) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	r.IdempotencyKey = ""
+	if key, ok := fields[FIELD_IDEMPOTENCY_KEY]; ok {
+		if err := json.Unmarshal(key, &r.IdempotencyKey); err != nil {
+			return err
+		}
+		delete(fields, FIELD_IDEMPOTENCY_KEY)
+		var err error
+		if data, err = json.Marshal(fields); err != nil {
+			return err
+		}
+	}
 	dataReader := bytes.NewReader(data)
 	return jsonpb.Unmarshal(dataReader, &r.GetInstallTokenRequest)
 }
@@ -49,7 +71,9 @@ type RequestHandler struct {
 
 func (h *RequestHandler) HandleRequest(ctx context.Context, req *LambdaGetInstallTokenRequest) (*LambdaGetInstallTokenResponse, error) {
 	logger := kslog.DefaultLogger{}
-	reply, err := h.Service.GetInstallToken(&req.GetInstallTokenRequest, logger)
+	// Callers retrying a request repeat its idempotency key, so they are
+	// served the token of the first attempt rather than minting more
+	reply, err := h.Service.GetInstallTokenIdempotent(&req.GetInstallTokenRequest, req.IdempotencyKey, logger)
 	if err != nil {
 		return nil, err
 	}
@@ -64,6 +88,7 @@ const (
 	ENV_TOKEN_STORE_PREFIX = "TOKEN_STORE_PREFIX"
 	ENV_REGION             = "REGION"
 	ENV_SIGN_JWT_FUNC      = "SIGN_JWT_APP"
+	ENV_TAG_OBJECTS        = "TAG_OBJECTS"
 )
 
 func main() {
@@ -89,22 +114,30 @@ func main() {
 	if !ok {
 		log.Fatalf("Exiting due to missing environment variables")
 	}
-	location := locationpb.Location{
-		Location: &locationpb.Location_S3{
-			S3: &locationpb.S3Ref{
-				Bucket: tokenStoreBucket,
-				Key:    tokenStorePrefix,
-				Region: awsRegion,
-			},
-		},
-	}
-	blobStore, err := s3store.NewS3BlobStore(&location)
+	location := s3store.S3Location(tokenStoreBucket, awsRegion, tokenStorePrefix)
+	blobStore, err := storeloc.NewFromLocation(location, kslog.DefaultLogger{})
 	if err != nil {
 		log.Fatalf("Failed to create store: %s", err)
 	}
 	messageStore := messagestore.BlobMessageStore{
 		BlobStore: blobStore,
 	}
+	tokenStore, err := tokenstore.LoadTokenMessageStore(&messageStore)
+	if err != nil {
+		log.Fatalf("Failed to load token store links: %s", err)
+	}
+	if os.Getenv(ENV_TAG_OBJECTS) != "" {
+		// Tag tokens so lifecycle rules may expire them by type and expiry;
+		// opt-in since tagging needs s3:PutObjectTagging
+		switch s3Store := blobStore.(type) {
+		case *s3store.S3BlobStore:
+			s3Store.Tagger = s3store.DocTypeTagger(tokenStore.DocumentType)
+			s3Store.TagExpires = true
+		case *s3storev2.S3BlobStore:
+			s3Store.Tagger = s3store.DocTypeTagger(tokenStore.DocumentType)
+			s3Store.TagExpires = true
+		}
+	}
 	sess := session.Must(session.NewSession())
 	signLambdaService := lambdaService.New(sess, aws.NewConfig().WithRegion(awsRegion))
 	signingService := lambdacall.LambdaSigningService{
@@ -112,7 +145,7 @@ func main() {
 		FuncName: jwtFunc,
 	}
 	service := tokenstore.InstallTokenService{
-		TokenMessageStore:    tokenstore.NewTokenMessageStore(&messageStore, nil),
+		TokenMessageStore:    tokenStore,
 		SigningService:       &signingService,
 		InstallTokenProvider: tokenstore.V3InstallTokenProvider,
 	}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+
+	"github.com/aefalcon/github-keystore-protobuf/go/locationpb"
+	"github.com/aefalcon/go-github-keystore/appkeystore"
+	"github.com/aefalcon/go-github-keystore/kslog"
+	"github.com/aefalcon/go-github-keystore/messagestore"
+	"github.com/aefalcon/go-github-keystore/s3store"
+	"github.com/aefalcon/go-github-keystore/storeloc"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+type LambdaGetJwksRequest struct {
+	App uint64 `json:"app"`
+}
+
+func HandleRequest(service *appkeystore.AppKeyService, ctx context.Context, req *LambdaGetJwksRequest) (json.RawMessage, error) {
+	logger := kslog.DefaultLogger{}
+	keys, err := service.GetPublicKeys(req.App, logger)
+	if err != nil {
+		return nil, err
+	}
+	jwks, err := appkeystore.MarshalJwks(keys)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(jwks), nil
+}
+
+func main() {
+	storeBucket := os.Getenv("STORE_BUCKET")
+	storePrefix := os.Getenv("STORE_PREFIX")
+	storeRegion := os.Getenv("STORE_REGION")
+	location := s3store.S3Location(storeBucket, storeRegion, storePrefix)
+	if storeUrl := os.Getenv("STORE_URL"); storeUrl != "" {
+		location = &locationpb.Location{
+			Location: &locationpb.Location_Url{
+				Url: storeUrl,
+			},
+		}
+	}
+	blobStore, err := storeloc.NewFromLocation(location, kslog.DefaultLogger{})
+	if err != nil {
+		log.Fatalf("Failed to create store: %s", err)
+	}
+	handleFunc := func(ctx context.Context, req *LambdaGetJwksRequest) (json.RawMessage, error) {
+		messageStore := messagestore.BlobMessageStore{
+			BlobStore: storeloc.WithContext(blobStore, ctx),
+		}
+		keyService := appkeystore.NewAppKeyService(&messageStore, nil)
+		return HandleRequest(keyService, ctx, req)
+	}
+	lambda.Start(handleFunc)
+}
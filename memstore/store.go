@@ -0,0 +1,53 @@
+// Store messages and blobs in memory with versioned cache metadata
+package memstore
+
+import (
+	"github.com/aefalcon/go-github-keystore/messagestore"
+)
+
+// MemStore is a message and blob store held in memory.  Blobs are kept in a
+// messagestore.MemStore, so each write of a name increments its Version, which
+// is not reused after the name is deleted, while ETags are derived from
+// content.  Messages are encoded and decoded as by
+// messagestore.BlobMessageStore.  Getting or deleting a missing resource is a
+// not found error.  It is safe for concurrent use.
+type MemStore struct {
+	messagestore.BlobMessageStore
+	Blobs *messagestore.MemStore // Stored blobs
+}
+
+var _ messagestore.BlobStore = &MemStore{}
+var _ messagestore.MetadataBlobStore = &MemStore{}
+var _ messagestore.StatBlobStore = &MemStore{}
+var _ messagestore.ListableBlobStore = &MemStore{}
+var _ messagestore.MessageStore = &MemStore{}
+var _ messagestore.MetadataMessageStore = &MemStore{}
+var _ messagestore.MessageMetaStore = &MemStore{}
+var _ messagestore.ListableMessageStore = &MemStore{}
+var _ messagestore.ConditionalMetadataBlobStore = &MemStore{}
+var _ messagestore.ConditionalMetadataMessageStore = &MemStore{}
+var _ messagestore.PingableBlobStore = &MemStore{}
+var _ messagestore.ExistenceDeleteBlobStore = &MemStore{}
+var _ messagestore.ExistenceDeleteMessageStore = &MemStore{}
+var _ messagestore.CapableStore = &MemStore{}
+
+func NewMemStore() *MemStore {
+	blobs := messagestore.NewMemBlobStore()
+	return &MemStore{
+		BlobMessageStore: messagestore.BlobMessageStore{BlobStore: blobs},
+		Blobs:            blobs,
+	}
+}
+
+func (s *MemStore) StatBlob(name string) (*messagestore.CacheMeta, error) {
+	return s.Blobs.StatBlob(name)
+}
+
+func (s *MemStore) PutBlobWithMetadata(name string, content []byte, metadata map[string]string) (*messagestore.CacheMeta, error) {
+	return s.Blobs.PutBlobWithMetadata(name, content, metadata)
+}
+
+// ListBlobs lists the names of blobs beginning with prefix
+func (s *MemStore) ListBlobs(prefix string) ([]string, error) {
+	return s.Blobs.ListBlobs(prefix)
+}
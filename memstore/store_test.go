@@ -0,0 +1,211 @@
+package memstore
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aefalcon/go-github-keystore/messagestore"
+	"github.com/golang/protobuf/proto"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+)
+
+func newTestMessage(n float64) *structpb.Struct {
+	return &structpb.Struct{
+		Fields: map[string]*structpb.Value{
+			"n": &structpb.Value{
+				Kind: &structpb.Value_NumberValue{NumberValue: n},
+			},
+		},
+	}
+}
+
+func TestVersions(t *testing.T) {
+	store := NewMemStore()
+	for i := uint64(1); i <= 3; i++ {
+		meta, err := store.PutMessage("doc", newTestMessage(float64(i)))
+		if err != nil {
+			t.Fatalf("Failed to put message: %s", err)
+		}
+		if meta.Version != strconv.FormatUint(i, 10) {
+			t.Fatalf("Write %d has version %q", i, meta.Version)
+		}
+	}
+	var message structpb.Struct
+	meta, err := store.GetMessage("doc", &message)
+	if err != nil {
+		t.Fatalf("Failed to get message: %s", err)
+	}
+	if meta.Version != "3" || !proto.Equal(&message, newTestMessage(3)) {
+		t.Fatalf("Got message %v with version %q", &message, meta.Version)
+	}
+	statMeta, err := store.GetMessageMeta("doc")
+	if err != nil || statMeta.ETag != meta.ETag || statMeta.Version != meta.Version {
+		t.Fatalf("Got metadata %v, %v", statMeta, err)
+	}
+	if _, err = store.DeleteMessage("doc"); err != nil {
+		t.Fatalf("Failed to delete message: %s", err)
+	}
+	meta, err = store.PutMessage("doc", newTestMessage(4))
+	if err != nil {
+		t.Fatalf("Failed to put message: %s", err)
+	}
+	if meta.Version != "4" {
+		t.Fatalf("Write after delete reused version %q", meta.Version)
+	}
+	meta, err = store.PutMessage("other", newTestMessage(1))
+	if err != nil || meta.Version != "1" {
+		t.Fatalf("First write of another name has metadata %v, %v", meta, err)
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	store := NewMemStore()
+	var message structpb.Struct
+	_, err := store.GetMessage("missing", &message)
+	if !messagestore.IsNotFound(err) {
+		t.Fatalf("Expected not found error getting message but got %v", err)
+	}
+	_, _, err = store.GetBlob("missing")
+	if !messagestore.IsNotFound(err) {
+		t.Fatalf("Expected not found error getting blob but got %v", err)
+	}
+	_, err = store.GetMessageMeta("missing")
+	if !messagestore.IsNotFound(err) {
+		t.Fatalf("Expected not found error getting metadata but got %v", err)
+	}
+	_, err = store.DeleteMessage("missing")
+	if !messagestore.IsNotFound(err) {
+		t.Fatalf("Expected not found error deleting message but got %v", err)
+	}
+	_, err = store.DeleteBlob("missing")
+	if !messagestore.IsNotFound(err) {
+		t.Fatalf("Expected not found error deleting blob but got %v", err)
+	}
+}
+
+func TestCachingParity(t *testing.T) {
+	store := NewMemStore()
+	cache := messagestore.NewCachingMessageStore(store, 10)
+	if _, err := cache.PutMessage("doc", newTestMessage(1)); err != nil {
+		t.Fatalf("Failed to put message: %s", err)
+	}
+	var message structpb.Struct
+	for i := 0; i < 2; i++ {
+		if _, err := cache.GetMessage("doc", &message); err != nil {
+			t.Fatalf("Failed to get message: %s", err)
+		}
+	}
+	if hits, misses := cache.Stats(); hits != 1 || misses != 1 {
+		t.Fatalf("Cache had %d hits and %d misses", hits, misses)
+	}
+	if _, err := store.PutMessage("doc", newTestMessage(2)); err != nil {
+		t.Fatalf("Failed to put message: %s", err)
+	}
+	if _, err := cache.GetMessage("doc", &message); err != nil {
+		t.Fatalf("Failed to get message: %s", err)
+	}
+	if !proto.Equal(&message, newTestMessage(2)) {
+		t.Fatalf("Cache served stale message %v", &message)
+	}
+}
+
+func TestListMessages(t *testing.T) {
+	store := NewMemStore()
+	for i, name := range []string{"apps/2", "apps/1", "tokens/1"} {
+		if _, err := store.PutMessage(name, newTestMessage(float64(i))); err != nil {
+			t.Fatalf("Failed to put %s: %s", name, err)
+		}
+	}
+	names, err := messagestore.ListMessages(store, "apps/")
+	if err != nil || len(names) != 2 || names[0] != "apps/1" || names[1] != "apps/2" {
+		t.Fatalf("Listed %v, %v", names, err)
+	}
+	store.DeleteMessage("apps/1")
+	if names, err = store.ListMessages("apps/1"); err != nil || names == nil || len(names) != 0 {
+		t.Fatalf("Listed %v, %v after deletion", names, err)
+	}
+}
+
+func TestPutBlobIfMatch(t *testing.T) {
+	store := NewMemStore()
+	staleMeta, err := store.PutBlobIfMatch("blob", []byte("first"), nil)
+	if err != nil {
+		t.Fatalf("Failed to create blob conditionally: %s", err)
+	}
+	if _, err = store.PutBlob("blob", []byte("second")); err != nil {
+		t.Fatalf("Failed to put blob: %s", err)
+	}
+	if _, err = store.PutBlobIfMatch("blob", []byte("stale"), staleMeta); !messagestore.IsConflict(err) {
+		t.Fatalf("Expected a conflict for a stale write but got %v", err)
+	}
+	_, meta, _ := store.GetBlob("blob")
+	if _, err = store.PutBlobIfMatch("blob", []byte("third"), meta); err != nil {
+		t.Fatalf("Failed to put blob matching its version: %s", err)
+	}
+}
+
+func TestDeleteExisted(t *testing.T) {
+	store := NewMemStore()
+	if _, err := store.PutMessage("doc", newTestMessage(1)); err != nil {
+		t.Fatalf("Failed to put message: %s", err)
+	}
+	for _, want := range []bool{true, false} {
+		existed, err := messagestore.DeleteMessage(store, "doc")
+		if err != nil || existed != want {
+			t.Errorf("Deleting message reported %t, %v instead of %t", existed, err, want)
+		}
+	}
+	existed, err := messagestore.DeleteBlob(store, "missing")
+	if err != nil || existed {
+		t.Errorf("Deleting missing blob reported %t, %v", existed, err)
+	}
+}
+
+func TestCacheMetaVersion(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewMemStore()
+	store.Blobs.Clock = func() time.Time { return now }
+	var previous string
+	for i := 1; i <= 2; i++ {
+		now = now.Add(time.Minute)
+		putMeta, err := store.PutMessage("doc", newTestMessage(float64(i)))
+		if err != nil {
+			t.Fatalf("Failed to put message: %s", err)
+		}
+		if putMeta.GetVersion() == "" || putMeta.GetVersion() == previous {
+			t.Fatalf("Write %d has version %q after %q", i, putMeta.GetVersion(), previous)
+		}
+		previous = putMeta.GetVersion()
+		var message structpb.Struct
+		getMeta, err := store.GetMessage("doc", &message)
+		if err != nil {
+			t.Fatalf("Failed to get message: %s", err)
+		}
+		if getMeta.GetVersion() != putMeta.GetVersion() || getMeta.GetETag() != putMeta.GetETag() {
+			t.Fatalf("Got version %q, ETag %s after putting %q, %s", getMeta.GetVersion(), getMeta.GetETag(), putMeta.GetVersion(), putMeta.GetETag())
+		}
+		if !getMeta.GetLastModified().Equal(now) {
+			t.Fatalf("Got modification time %s instead of %s", getMeta.GetLastModified(), now)
+		}
+	}
+	var nilMeta *messagestore.CacheMeta
+	if nilMeta.GetVersion() != "" || nilMeta.GetETag() != "" || !nilMeta.GetLastModified().IsZero() {
+		t.Fatalf("Nil metadata has version, ETag or modification time")
+	}
+	if meta := (&messagestore.CacheMeta{ETag: `"etag"`}); meta.GetVersion() != `"etag"` {
+		t.Fatalf("Unversioned metadata has version %q", meta.GetVersion())
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	expected := messagestore.Caps{
+		List:        true,
+		Conditional: true,
+		Metadata:    true,
+		Stat:        true,
+	}
+	if caps := messagestore.Capabilities(NewMemStore()); caps != expected {
+		t.Errorf("Store has capabilities %+v instead of %+v", caps, expected)
+	}
+}
@@ -0,0 +1,151 @@
+package messagestore
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// BatchBlobStore is a BlobStore able to get several blobs at once.  The
+// returned slices are parallel to names.
+type BatchBlobStore interface {
+	BlobStore
+	GetBlobs(names []string) ([][]byte, []*CacheMeta, error)
+}
+
+// BatchMessageStore is a MessageStore able to get several messages at once.
+// The returned cache metadata is parallel to names.
+type BatchMessageStore interface {
+	MessageStore
+	GetMessages(names []string, into []proto.Message) ([]*CacheMeta, error)
+}
+
+// BatchError reports the names that failed in a batch operation.  Errors is
+// parallel to Names and is nil for names that succeeded.
+type BatchError struct {
+	Names  []string
+	Errors []error
+}
+
+func (e *BatchError) Error() string {
+	failures := make([]string, 0, len(e.Names))
+	for i, err := range e.Errors {
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", e.Names[i], err))
+		}
+	}
+	return fmt.Sprintf("failed %d of %d resources: %s", len(failures), len(e.Names), strings.Join(failures, "; "))
+}
+
+// batchErr gets a *BatchError for errs, or nil if none failed
+func batchErr(names []string, errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return &BatchError{
+				Names:  names,
+				Errors: errs,
+			}
+		}
+	}
+	return nil
+}
+
+type BatchLengthMismatch struct {
+	Names    int
+	Messages int
+}
+
+func (e *BatchLengthMismatch) Error() string {
+	return fmt.Sprintf("batch of %d names has %d messages", e.Names, e.Messages)
+}
+
+// GetBlobs gets the named blobs, using the store's GetBlobs if it is a
+// BatchBlobStore and getting them one at a time otherwise.  If some blobs
+// fail, the error is a *BatchError.
+func GetBlobs(store BlobStore, names []string) ([][]byte, []*CacheMeta, error) {
+	if batchStore, ok := store.(BatchBlobStore); ok {
+		return batchStore.GetBlobs(names)
+	}
+	contents := make([][]byte, len(names))
+	metas := make([]*CacheMeta, len(names))
+	errs := make([]error, len(names))
+	for i, name := range names {
+		contents[i], metas[i], errs[i] = store.GetBlob(name)
+	}
+	return contents, metas, batchErr(names, errs)
+}
+
+// GetMessages gets the named messages into the parallel messages of into,
+// using the store's GetMessages if it is a BatchMessageStore and getting them
+// one at a time otherwise.  If some messages fail, the error is a *BatchError
+// and the metadata of the failed names is nil.
+func GetMessages(store MessageStore, names []string, into []proto.Message) ([]*CacheMeta, error) {
+	if batchStore, ok := store.(BatchMessageStore); ok {
+		return batchStore.GetMessages(names, into)
+	}
+	return getMessagesSequential(store, names, into)
+}
+
+func getMessagesSequential(store MessageStore, names []string, into []proto.Message) ([]*CacheMeta, error) {
+	if len(names) != len(into) {
+		return nil, &BatchLengthMismatch{len(names), len(into)}
+	}
+	metas := make([]*CacheMeta, len(names))
+	errs := make([]error, len(names))
+	for i, name := range names {
+		metas[i], errs[i] = store.GetMessage(name, into[i])
+	}
+	return metas, batchErr(names, errs)
+}
+
+var _ BatchBlobStore = &BlobMessageStore{}
+var _ BatchMessageStore = &BlobMessageStore{}
+
+// GetBlobs gets several blobs from the BlobStore
+func (s *BlobMessageStore) GetBlobs(names []string) ([][]byte, []*CacheMeta, error) {
+	return GetBlobs(s.BlobStore, names)
+}
+
+// GetMessages gets several messages, fetching them with GetBlobs if the
+// BlobStore is a BatchBlobStore.
+func (s *BlobMessageStore) GetMessages(names []string, into []proto.Message) ([]*CacheMeta, error) {
+	if _, ok := s.BlobStore.(BatchBlobStore); !ok {
+		return getMessagesSequential(s, names, into)
+	}
+	if len(names) != len(into) {
+		return nil, &BatchLengthMismatch{len(names), len(into)}
+	}
+	contents, metas, err := s.GetBlobs(names)
+	errs := make([]error, len(names))
+	if failures, ok := err.(*BatchError); ok {
+		copy(errs, failures.Errors)
+	} else if err != nil {
+		return nil, err
+	}
+	for i, name := range names {
+		if errs[i] != nil {
+			errs[i] = &GetResourceError{
+				Name:  name,
+				Cause: errs[i],
+			}
+			continue
+		}
+		if err := s.verifyChecksum(name, contents[i], metas[i]); err != nil {
+			metas[i] = nil
+			errs[i] = &GetResourceError{
+				Name:  name,
+				Cause: err,
+			}
+			continue
+		}
+		if _, err := s.decode(name, contents[i], into[i]); err != nil {
+			metas[i] = nil
+			errs[i] = &DecodeResourceError{
+				Name:  name,
+				Cause: err,
+			}
+		}
+	}
+	return metas, batchErr(names, errs)
+}
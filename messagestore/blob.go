@@ -1,17 +1,49 @@
 package messagestore
 
 import (
+	"context"
 	"fmt"
 	"time"
 
 	"github.com/aefalcon/github-keystore-protobuf/go/locationpb"
 )
 
+// CacheMeta describes a stored blob for caching and conditional writes.  The
+// ETag and Version identify the stored content, so callers may compare them
+// between reads and pass them to conditional puts.  Backends fill in what
+// they know; the accessors give the zero value for a nil CacheMeta.
 type CacheMeta struct {
 	CacheControl string
-	ETag         string
+	ETag         string // Quoted, opaque identifier of the stored content; empty if unknown
+	Version      string // Opaque version changing with each put, if the backend tracks versions
 	Expires      time.Time
-	LastModified time.Time
+	LastModified time.Time         // When the blob was last put, if known
+	Metadata     map[string]string // User metadata stored with a blob, if supported
+}
+
+func (m *CacheMeta) GetETag() string {
+	if m == nil {
+		return ""
+	}
+	return m.ETag
+}
+
+// GetVersion gets the version of a blob, which is its ETag when the backend
+// does not track versions
+func (m *CacheMeta) GetVersion() string {
+	if m == nil {
+		return ""
+	} else if m.Version == "" {
+		return m.ETag
+	}
+	return m.Version
+}
+
+func (m *CacheMeta) GetLastModified() time.Time {
+	if m == nil {
+		return time.Time{}
+	}
+	return m.LastModified
 }
 
 type UnsupportedLocation locationpb.Location
@@ -25,3 +57,32 @@ type BlobStore interface {
 	PutBlob(name string, content []byte) (*CacheMeta, error)
 	DeleteBlob(name string) (*CacheMeta, error)
 }
+
+// MetadataBlobStore is a BlobStore able to store user metadata with a blob.
+// The metadata is returned in the CacheMeta of GetBlob.
+type MetadataBlobStore interface {
+	BlobStore
+	PutBlobWithMetadata(name string, content []byte, metadata map[string]string) (*CacheMeta, error)
+}
+
+// ContextBlobStore is a BlobStore with variants of its methods taking a
+// context.  Requests are cancelled when the context is done.
+type ContextBlobStore interface {
+	BlobStore
+	GetBlobCtx(ctx context.Context, name string) ([]byte, *CacheMeta, error)
+	PutBlobCtx(ctx context.Context, name string, content []byte) (*CacheMeta, error)
+	DeleteBlobCtx(ctx context.Context, name string) (*CacheMeta, error)
+}
+
+// ListableBlobStore is a BlobStore able to list the names of its blobs
+type ListableBlobStore interface {
+	BlobStore
+	ListBlobs(prefix string) ([]string, error) // Names beginning with prefix, in lexical order
+}
+
+// StatBlobStore is a BlobStore able to get the cache metadata of a blob
+// without fetching its content
+type StatBlobStore interface {
+	BlobStore
+	StatBlob(name string) (*CacheMeta, error)
+}
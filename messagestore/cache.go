@@ -0,0 +1,156 @@
+package messagestore
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// cacheEntry is a decoded message held by CachingMessageStore
+type cacheEntry struct {
+	Name    string
+	Message proto.Message
+	Meta    *CacheMeta
+}
+
+// CachingMessageStore wraps a MessageStore with an in-process LRU cache of
+// decoded messages.  If the wrapped store is a MessageMetaStore, a cached
+// message is only used while its ETag or modification time is unchanged.
+// Messages put or deleted through the cache are invalidated.
+type CachingMessageStore struct {
+	MessageStore
+	MaxEntries int // Maximum number of cached messages
+	mu         sync.Mutex
+	entries    map[string]*list.Element
+	lru        *list.List
+	hits       uint64
+	misses     uint64
+}
+
+var _ MessageStore = &CachingMessageStore{}
+
+func NewCachingMessageStore(store MessageStore, maxEntries int) *CachingMessageStore {
+	return &CachingMessageStore{
+		MessageStore: store,
+		MaxEntries:   maxEntries,
+		entries:      make(map[string]*list.Element),
+		lru:          list.New(),
+	}
+}
+
+// Stats gets the number of cache hits and misses of GetMessage
+func (s *CachingMessageStore) Stats() (hits, misses uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hits, s.misses
+}
+
+// sameVersion reports whether two cache metadata describe the same version
+// of a message
+func sameVersion(a, b *CacheMeta) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	if a.ETag != "" || b.ETag != "" {
+		return a.ETag == b.ETag
+	}
+	return !a.LastModified.IsZero() && a.LastModified.Equal(b.LastModified)
+}
+
+// isFresh reports whether a cached message is still current in the wrapped store
+func (s *CachingMessageStore) isFresh(entry *cacheEntry) bool {
+	metaStore, ok := s.MessageStore.(MessageMetaStore)
+	if !ok {
+		return true
+	}
+	meta, err := metaStore.GetMessageMeta(entry.Name)
+	if err != nil {
+		return false
+	}
+	if meta == nil {
+		return true
+	}
+	return sameVersion(meta, entry.Meta)
+}
+
+func (s *CachingMessageStore) GetMessage(name string, pb proto.Message) (*CacheMeta, error) {
+	s.mu.Lock()
+	if s.entries == nil {
+		s.entries = make(map[string]*list.Element)
+		s.lru = list.New()
+	}
+	var entry *cacheEntry
+	if elem, found := s.entries[name]; found {
+		entry = elem.Value.(*cacheEntry)
+	}
+	s.mu.Unlock()
+	if entry != nil && s.isFresh(entry) {
+		s.mu.Lock()
+		if elem, found := s.entries[name]; found && elem.Value == entry {
+			s.lru.MoveToFront(elem)
+		}
+		s.hits++
+		s.mu.Unlock()
+		pb.Reset()
+		proto.Merge(pb, entry.Message)
+		return entry.Meta, nil
+	}
+	s.mu.Lock()
+	s.misses++
+	s.mu.Unlock()
+	meta, err := s.MessageStore.GetMessage(name, pb)
+	if err != nil {
+		s.invalidate(name)
+		return meta, err
+	}
+	s.add(name, proto.Clone(pb), meta)
+	return meta, nil
+}
+
+func (s *CachingMessageStore) PutMessage(name string, pb proto.Message) (*CacheMeta, error) {
+	s.invalidate(name)
+	return s.MessageStore.PutMessage(name, pb)
+}
+
+func (s *CachingMessageStore) DeleteMessage(name string) (*CacheMeta, error) {
+	s.invalidate(name)
+	return s.MessageStore.DeleteMessage(name)
+}
+
+// add caches a message, evicting the least recently used messages above
+// MaxEntries
+func (s *CachingMessageStore) add(name string, pb proto.Message, meta *CacheMeta) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.MaxEntries <= 0 {
+		return
+	}
+	if elem, found := s.entries[name]; found {
+		s.removeElement(elem)
+	}
+	entry := cacheEntry{
+		Name:    name,
+		Message: pb,
+		Meta:    meta,
+	}
+	s.entries[name] = s.lru.PushFront(&entry)
+	for s.lru.Len() > s.MaxEntries {
+		s.removeElement(s.lru.Back())
+	}
+}
+
+// invalidate removes a message from the cache
+func (s *CachingMessageStore) invalidate(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, found := s.entries[name]; found {
+		s.removeElement(elem)
+	}
+}
+
+// removeElement removes an entry from the cache.  The caller must hold mu.
+func (s *CachingMessageStore) removeElement(elem *list.Element) {
+	entry := s.lru.Remove(elem).(*cacheEntry)
+	delete(s.entries, entry.Name)
+}
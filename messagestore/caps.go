@@ -0,0 +1,141 @@
+package messagestore
+
+// Caps are the optional features a store supports, so callers and wrappers
+// may check for a feature before using it rather than handling the error of
+// an unsupported one
+type Caps struct {
+	List        bool // Names may be listed, as by ListableBlobStore
+	Conditional bool // Puts may be conditional, as by ConditionalBlobStore
+	Metadata    bool // User metadata is stored, as by MetadataBlobStore
+	Stream      bool // Blobs may be got and put as streams, as by StreamBlobStore
+	Stat        bool // Cache metadata may be got without content, as by StatBlobStore
+}
+
+// CapableStore is a store reporting the features it supports.  Wrappers
+// whose optional methods fail unless the store they wrap supports them
+// report the features of the wrapped store.
+type CapableStore interface {
+	Capabilities() Caps
+}
+
+// Capabilities gets the features supported by a BlobStore or MessageStore.
+// Those of a CapableStore are the ones it reports, while those of other
+// stores are derived from the optional interfaces they implement.
+func Capabilities(store interface{}) Caps {
+	if capable, ok := store.(CapableStore); ok {
+		return capable.Capabilities()
+	}
+	var caps Caps
+	switch store.(type) {
+	case ListableBlobStore, ListableMessageStore:
+		caps.List = true
+	}
+	switch store.(type) {
+	case ConditionalBlobStore, ConditionalMessageStore:
+		caps.Conditional = true
+	}
+	switch store.(type) {
+	case MetadataBlobStore, MetadataMessageStore:
+		caps.Metadata = true
+	}
+	switch store.(type) {
+	case StreamBlobStore:
+		caps.Stream = true
+	}
+	switch store.(type) {
+	case StatBlobStore, MessageMetaStore:
+		caps.Stat = true
+	}
+	return caps
+}
+
+var _ CapableStore = &MemStore{}
+
+// Capabilities reports that the store supports every feature
+func (s *MemStore) Capabilities() Caps {
+	return Caps{
+		List:        true,
+		Conditional: true,
+		Metadata:    true,
+		Stream:      true,
+		Stat:        true,
+	}
+}
+
+var _ CapableStore = &BlobMessageStore{}
+
+// Capabilities reports the features of the BlobStore which messages may use;
+// messages are not streamed
+func (s *BlobMessageStore) Capabilities() Caps {
+	caps := Capabilities(s.BlobStore)
+	caps.Stream = false
+	return caps
+}
+
+var _ CapableStore = &ContentETagStore{}
+
+// Capabilities reports the features of the wrapped store, except that it
+// cannot put conditionally or stream, since the wrapped store's ETags are not
+// those of the content, and stats only if the content ETag is recorded in
+// metadata
+func (s *ContentETagStore) Capabilities() Caps {
+	caps := Capabilities(s.BlobStore)
+	caps.Conditional = false
+	caps.Stream = false
+	caps.Stat = caps.Stat && caps.Metadata
+	return caps
+}
+
+var _ CapableStore = &GzipBlobStore{}
+
+// Capabilities reports that the store keeps metadata, and lists, puts
+// conditionally and stats if the wrapped store does
+func (s *GzipBlobStore) Capabilities() Caps {
+	wrapped := Capabilities(s.BlobStore)
+	return Caps{
+		List:        wrapped.List,
+		Conditional: wrapped.Conditional,
+		Metadata:    true,
+		Stat:        wrapped.Stat,
+	}
+}
+
+var _ CapableStore = &TimeoutBlobStore{}
+
+// Capabilities reports that the store lists, puts conditionally, keeps
+// metadata and stats if the wrapped store does
+func (s *TimeoutBlobStore) Capabilities() Caps {
+	wrapped := Capabilities(s.BlobStore)
+	return Caps{
+		List:        wrapped.List,
+		Conditional: wrapped.Conditional,
+		Metadata:    wrapped.Metadata,
+		Stat:        wrapped.Stat,
+	}
+}
+
+var _ CapableStore = &HashedBlobStore{}
+
+// Capabilities reports that the store lists, puts conditionally, keeps
+// metadata and stats if the wrapped store does
+func (s *HashedBlobStore) Capabilities() Caps {
+	wrapped := Capabilities(s.BlobStore)
+	return Caps{
+		List:        wrapped.List,
+		Conditional: wrapped.Conditional,
+		Metadata:    wrapped.Metadata,
+		Stat:        wrapped.Stat,
+	}
+}
+
+var _ CapableStore = &ReadOnlyBlobStore{}
+
+// Capabilities reports the features of the wrapped store, except those
+// which put blobs: conditional puts, metadata and streams
+func (s *ReadOnlyBlobStore) Capabilities() Caps {
+	caps := Capabilities(s.BlobStore)
+	caps.Conditional = false
+	caps.Metadata = false
+	caps.Stream = false
+	return caps
+}
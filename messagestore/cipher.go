@@ -0,0 +1,166 @@
+package messagestore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+)
+
+// ENCRYPTED_PREFIX begins the content of messages encrypted by a
+// BlobMessageStore with a Cipher.  It is followed by the nonce, then the
+// ciphertext.
+const ENCRYPTED_PREFIX = "ks-aead-v1:"
+
+// Cipher encrypts and decrypts the content of stored messages.  It is
+// satisfied by the AEADs of crypto/cipher, such as one from cipher.NewGCM.
+type Cipher interface {
+	NonceSize() int
+	Seal(dst, nonce, plaintext, additionalData []byte) []byte
+	Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error)
+}
+
+// UnencryptedMessage is an error indicating a message read by a store with a
+// Cipher was not encrypted, and the store does not AllowPlaintext.  It may be
+// converted to string to get the name of the message.
+type UnencryptedMessage string
+
+func (e UnencryptedMessage) Error() string {
+	return fmt.Sprintf("message %s is not encrypted", string(e))
+}
+
+// DecryptError is an error indicating the content of an encrypted message
+// could not be decrypted, such as when it was encrypted with another key or
+// modified
+type DecryptError struct {
+	Name  string
+	Cause error
+}
+
+func (e *DecryptError) Error() string {
+	return fmt.Sprintf("failed to decrypt message %s: %s", e.Name, e.Cause)
+}
+
+// seal encrypts encoded message content if the store has a Cipher.  The name
+// of the message is authenticated along with it, so content cannot be moved
+// to another name.
+func (s *BlobMessageStore) seal(name string, content []byte) ([]byte, error) {
+	if s.Cipher == nil {
+		return content, nil
+	}
+	nonce := make([]byte, s.Cipher.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := make([]byte, 0, len(ENCRYPTED_PREFIX)+len(nonce)+len(content))
+	sealed = append(sealed, ENCRYPTED_PREFIX...)
+	sealed = append(sealed, nonce...)
+	return s.Cipher.Seal(sealed, nonce, content, []byte(name)), nil
+}
+
+// open decrypts message content if the store has a Cipher.  Content not
+// encrypted is returned unchanged if the store does not have a Cipher or
+// AllowPlaintext, and fails with UnencryptedMessage otherwise.
+func (s *BlobMessageStore) open(name string, content []byte) ([]byte, error) {
+	if s.Cipher == nil {
+		return content, nil
+	}
+	if !bytes.HasPrefix(content, []byte(ENCRYPTED_PREFIX)) {
+		if s.AllowPlaintext {
+			return content, nil
+		}
+		return nil, UnencryptedMessage(name)
+	}
+	sealed := content[len(ENCRYPTED_PREFIX):]
+	nonceSize := s.Cipher.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, &DecryptError{
+			Name:  name,
+			Cause: fmt.Errorf("content shorter than the %d byte nonce", nonceSize),
+		}
+	}
+	plaintext, err := s.Cipher.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(name))
+	if err != nil {
+		return nil, &DecryptError{
+			Name:  name,
+			Cause: err,
+		}
+	}
+	return plaintext, nil
+}
+
+// SealingBlobStore is a BlobStore able to encrypt blobs as it encrypts
+// messages, for blobs as sensitive as messages, such as private keys
+type SealingBlobStore interface {
+	BlobStore
+	SealBlob(name string, content []byte) ([]byte, error) // Encrypt content to be put as the blob name
+	OpenBlob(name string, content []byte) ([]byte, error) // Decrypt the content of the blob name
+}
+
+var _ SealingBlobStore = &BlobMessageStore{}
+
+// SealBlob encrypts the content of a blob with the store's Cipher, as the
+// content of messages is encrypted.  Content is returned unchanged if the
+// store has no Cipher.
+func (s *BlobMessageStore) SealBlob(name string, content []byte) ([]byte, error) {
+	return s.seal(name, content)
+}
+
+// OpenBlob decrypts the content of a blob sealed by SealBlob, as the content
+// of messages is decrypted
+func (s *BlobMessageStore) OpenBlob(name string, content []byte) ([]byte, error) {
+	return s.open(name, content)
+}
+
+// PutSealedBlob puts a blob encrypted by the store if it is a
+// SealingBlobStore, and as is otherwise
+func PutSealedBlob(store BlobStore, name string, content []byte) (*CacheMeta, error) {
+	if sealingStore, ok := store.(SealingBlobStore); ok {
+		sealed, err := sealingStore.SealBlob(name, content)
+		if err != nil {
+			return nil, err
+		}
+		content = sealed
+	}
+	return store.PutBlob(name, content)
+}
+
+// GetSealedBlob gets a blob put by PutSealedBlob, decrypted by the store if it
+// is a SealingBlobStore
+func GetSealedBlob(store BlobStore, name string) ([]byte, *CacheMeta, error) {
+	content, meta, err := store.GetBlob(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if sealingStore, ok := store.(SealingBlobStore); ok {
+		if content, err = sealingStore.OpenBlob(name, content); err != nil {
+			return nil, nil, err
+		}
+	}
+	return content, meta, nil
+}
+
+// GetSealedBlobs gets several blobs put by PutSealedBlob as GetBlobs does,
+// decrypted by the store if it is a SealingBlobStore.  Blobs failing to be
+// decrypted fail as part of the *BatchError.
+func GetSealedBlobs(store BlobStore, names []string) ([][]byte, []*CacheMeta, error) {
+	contents, metas, err := GetBlobs(store, names)
+	sealingStore, ok := store.(SealingBlobStore)
+	if !ok {
+		return contents, metas, err
+	}
+	errs := make([]error, len(names))
+	if batchErr, isBatch := err.(*BatchError); isBatch {
+		copy(errs, batchErr.Errors)
+	} else if err != nil {
+		return nil, nil, err
+	}
+	for i, name := range names {
+		if errs[i] != nil {
+			continue
+		}
+		if contents[i], errs[i] = sealingStore.OpenBlob(name, contents[i]); errs[i] != nil {
+			metas[i] = nil
+		}
+	}
+	return contents, metas, batchErr(names, errs)
+}
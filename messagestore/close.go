@@ -0,0 +1,89 @@
+package messagestore
+
+import (
+	"io"
+)
+
+// ClosableBlobStore is a BlobStore holding resources, such as buffered
+// writes or connections, which must be flushed and released when the store
+// is no longer used.  A store is not used after it is closed.
+type ClosableBlobStore interface {
+	BlobStore
+	io.Closer
+}
+
+// ClosableMessageStore is a MessageStore which must be closed, as for
+// ClosableBlobStore
+type ClosableMessageStore interface {
+	MessageStore
+	io.Closer
+}
+
+// CloseBlobStore closes a store, flushing its pending writes.  Stores which
+// are not a ClosableBlobStore, such as S3 and in-memory stores, hold nothing
+// to release, so closing them does nothing.
+func CloseBlobStore(store BlobStore) error {
+	if closer, ok := store.(ClosableBlobStore); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// CloseMessageStore closes a store, flushing its pending writes.  Closing a
+// store which is not a ClosableMessageStore does nothing.
+func CloseMessageStore(store MessageStore) error {
+	if closer, ok := store.(ClosableMessageStore); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+var _ ClosableMessageStore = &BlobMessageStore{}
+var _ ClosableMessageStore = &CachingMessageStore{}
+var _ ClosableBlobStore = &ContentETagStore{}
+var _ ClosableBlobStore = &GzipBlobStore{}
+var _ ClosableBlobStore = &HashedBlobStore{}
+var _ ClosableBlobStore = &ReadOnlyBlobStore{}
+var _ ClosableBlobStore = &TimeoutBlobStore{}
+
+// Close closes the underlying BlobStore
+func (s *BlobMessageStore) Close() error {
+	return CloseBlobStore(s.BlobStore)
+}
+
+// Close drops the cached messages and closes the underlying MessageStore
+func (s *CachingMessageStore) Close() error {
+	s.mu.Lock()
+	for _, elem := range s.entries {
+		s.removeElement(elem)
+	}
+	s.mu.Unlock()
+	return CloseMessageStore(s.MessageStore)
+}
+
+// Close closes the underlying BlobStore
+func (s *ContentETagStore) Close() error {
+	return CloseBlobStore(s.BlobStore)
+}
+
+// Close closes the underlying BlobStore
+func (s *GzipBlobStore) Close() error {
+	return CloseBlobStore(s.BlobStore)
+}
+
+// Close closes the underlying BlobStore
+func (s *HashedBlobStore) Close() error {
+	return CloseBlobStore(s.BlobStore)
+}
+
+// Close closes the underlying BlobStore, flushing writes made through it
+// before it was wrapped
+func (s *ReadOnlyBlobStore) Close() error {
+	return CloseBlobStore(s.BlobStore)
+}
+
+// Close closes the underlying BlobStore without a timeout, so pending writes
+// are flushed however long they take
+func (s *TimeoutBlobStore) Close() error {
+	return CloseBlobStore(s.BlobStore)
+}
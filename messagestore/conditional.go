@@ -0,0 +1,193 @@
+package messagestore
+
+import (
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// ConditionalBlobStore is a BlobStore able to put a blob only if the stored
+// blob is the version described by cache metadata, as given when the blob was
+// got or put.  With nil metadata or an empty ETag, the blob is put only if it
+// does not exist.  If the condition fails, the error is a *PutResourceError
+// caused by a WriteConflict.
+type ConditionalBlobStore interface {
+	BlobStore
+	PutBlobIfMatch(name string, content []byte, meta *CacheMeta) (*CacheMeta, error)
+}
+
+// ConditionalMetadataBlobStore is a ConditionalBlobStore able to store user
+// metadata with a blob it puts conditionally
+type ConditionalMetadataBlobStore interface {
+	ConditionalBlobStore
+	PutBlobIfMatchWithMetadata(name string, content []byte, meta *CacheMeta, metadata map[string]string) (*CacheMeta, error)
+}
+
+// ConditionalMessageStore is a MessageStore able to put a message only if the
+// stored message is the version described by cache metadata, as for
+// ConditionalBlobStore
+type ConditionalMessageStore interface {
+	MessageStore
+	PutMessageIfMatch(name string, pb proto.Message, meta *CacheMeta) (*CacheMeta, error)
+}
+
+// ConditionalMetadataMessageStore is a ConditionalMessageStore able to store
+// user metadata with a message it puts conditionally
+type ConditionalMetadataMessageStore interface {
+	ConditionalMessageStore
+	PutMessageIfMatchWithMetadata(name string, pb proto.Message, meta *CacheMeta, metadata map[string]string) (*CacheMeta, error)
+}
+
+// WriteConflict is an error indicating a resource was not put because it was
+// changed since the version given to a conditional put
+type WriteConflict string
+
+func (e WriteConflict) Error() string {
+	return fmt.Sprintf("resource %s was changed by another writer", string(e))
+}
+
+// ConditionalUnsupported is an error indicating a store of the named type
+// cannot put resources conditionally
+type ConditionalUnsupported string
+
+func (e ConditionalUnsupported) Error() string {
+	return fmt.Sprintf("store %s cannot put resources conditionally", string(e))
+}
+
+// IsConflict reports whether an error indicates a conditional put failed
+// because the resource was changed
+func IsConflict(err error) bool {
+	switch e := err.(type) {
+	case WriteConflict:
+		return true
+	case *PutResourceError:
+		return IsConflict(e.Cause)
+	}
+	return false
+}
+
+// matchETag gets the ETag a stored resource must have for a conditional put
+// with meta to succeed, or "" if it must not exist
+func matchETag(meta *CacheMeta) string {
+	if meta == nil {
+		return ""
+	}
+	return meta.ETag
+}
+
+// PutMessageIfMatch puts a message only if the stored message is the version
+// described by meta.  It fails with ConditionalUnsupported if the store is not
+// a ConditionalMessageStore.
+func PutMessageIfMatch(store MessageStore, name string, pb proto.Message, meta *CacheMeta) (*CacheMeta, error) {
+	conditionalStore, ok := store.(ConditionalMessageStore)
+	if !ok {
+		return nil, ConditionalUnsupported(fmt.Sprintf("%T", store))
+	}
+	return conditionalStore.PutMessageIfMatch(name, pb, meta)
+}
+
+// PutMessageIfMatchWithMetadata puts a message along with user metadata only
+// if the stored message is the version described by meta.  It fails with
+// ConditionalUnsupported if the store is not a
+// ConditionalMetadataMessageStore.
+func PutMessageIfMatchWithMetadata(store MessageStore, name string, pb proto.Message, meta *CacheMeta, metadata map[string]string) (*CacheMeta, error) {
+	conditionalStore, ok := store.(ConditionalMetadataMessageStore)
+	if !ok {
+		return nil, ConditionalUnsupported(fmt.Sprintf("%T", store))
+	}
+	return conditionalStore.PutMessageIfMatchWithMetadata(name, pb, meta, metadata)
+}
+
+var _ ConditionalMetadataMessageStore = &BlobMessageStore{}
+
+// PutMessageIfMatch puts a message only if the stored message is the version
+// described by meta.  If the BlobStore is a ConditionalMetadataBlobStore, the
+// message is put with its metadata as by PutMessageIfMatchWithMetadata.  It
+// fails with ConditionalUnsupported if the BlobStore is not a
+// ConditionalBlobStore.
+func (s *BlobMessageStore) PutMessageIfMatch(name string, pb proto.Message, meta *CacheMeta) (*CacheMeta, error) {
+	if _, ok := s.BlobStore.(ConditionalMetadataBlobStore); ok {
+		return s.PutMessageIfMatchWithMetadata(name, pb, meta, nil)
+	}
+	conditionalStore, ok := s.BlobStore.(ConditionalBlobStore)
+	if !ok {
+		return nil, ConditionalUnsupported(fmt.Sprintf("%T", s.BlobStore))
+	}
+	content, err := s.encode(name, pb)
+	if err != nil {
+		return nil, &EncodeResourceError{
+			Name:  name,
+			Cause: err,
+		}
+	}
+	return conditionalStore.PutBlobIfMatch(name, content, meta)
+}
+
+// PutMessageIfMatchWithMetadata puts a message along with user metadata only
+// if the stored message is the version described by meta.  Its MIME type and,
+// with Checksums, its content ETag are recorded in the metadata as by
+// PutMessage.  It fails with ConditionalUnsupported if the BlobStore is not
+// a ConditionalMetadataBlobStore.
+func (s *BlobMessageStore) PutMessageIfMatchWithMetadata(name string, pb proto.Message, meta *CacheMeta, metadata map[string]string) (*CacheMeta, error) {
+	conditionalStore, ok := s.BlobStore.(ConditionalMetadataBlobStore)
+	if !ok {
+		return nil, ConditionalUnsupported(fmt.Sprintf("%T", s.BlobStore))
+	}
+	content, err := s.encode(name, pb)
+	if err != nil {
+		return nil, &EncodeResourceError{
+			Name:  name,
+			Cause: err,
+		}
+	}
+	return conditionalStore.PutBlobIfMatchWithMetadata(name, content, meta, s.messageMetadata(content, metadata))
+}
+
+var _ ConditionalMetadataBlobStore = &BlobMessageStore{}
+
+// PutBlobIfMatch puts a blob with the BlobStore only if the stored blob is
+// the version described by meta.  It fails with ConditionalUnsupported if the
+// BlobStore is not a ConditionalBlobStore.
+func (s *BlobMessageStore) PutBlobIfMatch(name string, content []byte, meta *CacheMeta) (*CacheMeta, error) {
+	conditionalStore, ok := s.BlobStore.(ConditionalBlobStore)
+	if !ok {
+		return nil, ConditionalUnsupported(fmt.Sprintf("%T", s.BlobStore))
+	}
+	return conditionalStore.PutBlobIfMatch(name, content, meta)
+}
+
+// PutBlobIfMatchWithMetadata puts a blob and its metadata with the BlobStore
+// only if the stored blob is the version described by meta.  It fails with
+// ConditionalUnsupported if the BlobStore is not a
+// ConditionalMetadataBlobStore.
+func (s *BlobMessageStore) PutBlobIfMatchWithMetadata(name string, content []byte, meta *CacheMeta, metadata map[string]string) (*CacheMeta, error) {
+	conditionalStore, ok := s.BlobStore.(ConditionalMetadataBlobStore)
+	if !ok {
+		return nil, ConditionalUnsupported(fmt.Sprintf("%T", s.BlobStore))
+	}
+	return conditionalStore.PutBlobIfMatchWithMetadata(name, content, meta, metadata)
+}
+
+var _ ConditionalMetadataBlobStore = &MemStore{}
+
+// PutBlobIfMatch puts a blob only if the content ETag of the stored blob is
+// that of meta
+func (s *MemStore) PutBlobIfMatch(name string, content []byte, meta *CacheMeta) (*CacheMeta, error) {
+	return s.PutBlobIfMatchWithMetadata(name, content, meta, nil)
+}
+
+// PutBlobIfMatchWithMetadata puts a blob and its metadata only if the
+// content ETag of the stored blob is that of meta
+func (s *MemStore) PutBlobIfMatchWithMetadata(name string, content []byte, meta *CacheMeta, metadata map[string]string) (*CacheMeta, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, found := s.Blobs[name]
+	etag := matchETag(meta)
+	if (etag == "" && found) || (etag != "" && (!found || ContentETag(stored) != etag)) {
+		return nil, &PutResourceError{
+			Name:  name,
+			Cause: WriteConflict(name),
+		}
+	}
+	return s.store(name, content, metadata), nil
+}
@@ -0,0 +1,110 @@
+package messagestore
+
+// ExistenceDeleteBlobStore is a BlobStore able to report whether a blob it
+// deleted existed.  Deleting a missing blob is not an error.
+type ExistenceDeleteBlobStore interface {
+	BlobStore
+	DeleteBlobExisted(name string) (bool, error)
+}
+
+// ExistenceDeleteMessageStore is a MessageStore able to report whether a
+// message it deleted existed.  Deleting a missing message is not an error.
+type ExistenceDeleteMessageStore interface {
+	MessageStore
+	DeleteMessageExisted(name string) (bool, error)
+}
+
+// DeleteBlob deletes a blob, reporting whether it existed.  Deleting a missing
+// blob is not an error.  Stores which cannot report existence themselves are
+// statted, or failing that read, before deleting, so a blob created
+// concurrently may be deleted without being reported.
+func DeleteBlob(store BlobStore, name string) (bool, error) {
+	if existenceStore, ok := store.(ExistenceDeleteBlobStore); ok {
+		return existenceStore.DeleteBlobExisted(name)
+	}
+	var err error
+	if statStore, ok := store.(StatBlobStore); ok {
+		_, err = statStore.StatBlob(name)
+	} else {
+		_, _, err = store.GetBlob(name)
+	}
+	if IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, &GetResourceError{
+			Name:  name,
+			Cause: err,
+		}
+	}
+	_, err = store.DeleteBlob(name)
+	if IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// DeleteMessage deletes a message, reporting whether it existed.  Deleting a
+// missing message is not an error.  Stores which cannot report existence
+// themselves have the cache metadata of the message fetched before deleting
+// if they are a MessageMetaStore, and otherwise are trusted to fail with a
+// not found error deleting a missing message.
+func DeleteMessage(store MessageStore, name string) (bool, error) {
+	if existenceStore, ok := store.(ExistenceDeleteMessageStore); ok {
+		return existenceStore.DeleteMessageExisted(name)
+	}
+	if metaStore, ok := store.(MessageMetaStore); ok {
+		_, err := metaStore.GetMessageMeta(name)
+		if IsNotFound(err) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+	_, err := store.DeleteMessage(name)
+	if IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+var _ ExistenceDeleteBlobStore = &MemStore{}
+var _ ExistenceDeleteBlobStore = &GzipBlobStore{}
+var _ ExistenceDeleteBlobStore = &BlobMessageStore{}
+var _ ExistenceDeleteMessageStore = &BlobMessageStore{}
+var _ ExistenceDeleteMessageStore = &CachingMessageStore{}
+
+// DeleteBlobExisted deletes a blob, reporting whether it existed
+func (s *MemStore) DeleteBlobExisted(name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, found := s.Blobs[name]
+	delete(s.Blobs, name)
+	delete(s.Metadata, name)
+	delete(s.modified, name)
+	return found, nil
+}
+
+// DeleteBlobExisted deletes a blob of the wrapped store, reporting whether it
+// existed
+func (s *GzipBlobStore) DeleteBlobExisted(name string) (bool, error) {
+	return DeleteBlob(s.BlobStore, name)
+}
+
+// DeleteBlobExisted deletes a blob of the underlying BlobStore, reporting
+// whether it existed
+func (s *BlobMessageStore) DeleteBlobExisted(name string) (bool, error) {
+	return DeleteBlob(s.BlobStore, name)
+}
+
+// DeleteMessageExisted deletes the blob of a message, reporting whether it
+// existed
+func (s *BlobMessageStore) DeleteMessageExisted(name string) (bool, error) {
+	return DeleteBlob(s.BlobStore, name)
+}
+
+// DeleteMessageExisted evicts a message and deletes it from the wrapped
+// store, reporting whether it existed
+func (s *CachingMessageStore) DeleteMessageExisted(name string) (bool, error) {
+	s.invalidate(name)
+	return DeleteMessage(s.MessageStore, name)
+}
@@ -0,0 +1,104 @@
+package messagestore
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+)
+
+// MessageEncoding is the format in which a BlobMessageStore stores messages
+type MessageEncoding string
+
+const (
+	ENCODING_PROTO  MessageEncoding = "proto"  // Protobuf binary encoding
+	ENCODING_JSONPB MessageEncoding = "jsonpb" // Protobuf JSON mapping, for human inspection of messages mapped to JSON objects
+)
+
+// MIME types of blobs, as given by MessageEncoding.ContentType
+const (
+	CONTENT_TYPE_JSON         = "application/json"
+	CONTENT_TYPE_PROTOBUF     = "application/x-protobuf"
+	CONTENT_TYPE_OCTET_STREAM = "application/octet-stream"
+)
+
+// CONTENT_TYPE_META is the metadata key under which BlobMessageStore gives
+// the MIME type of the messages it puts, such as for stores serving blobs
+// over HTTP
+const CONTENT_TYPE_META = "content-type"
+
+// ContentType gets the MIME type of messages in the encoding, where the empty
+// encoding is ENCODING_PROTO
+func (e MessageEncoding) ContentType() string {
+	switch e {
+	case "", ENCODING_PROTO:
+		return CONTENT_TYPE_PROTOBUF
+	case ENCODING_JSONPB:
+		return CONTENT_TYPE_JSON
+	}
+	return CONTENT_TYPE_OCTET_STREAM
+}
+
+// UnsupportedEncoding is an error indicating a message encoding is not known.
+// It may be converted to string to get the encoding.
+type UnsupportedEncoding string
+
+func (e UnsupportedEncoding) Error() string {
+	return fmt.Sprintf("unsupported message encoding %s", string(e))
+}
+
+// ParseEncoding gets the encoding named by s, as used in configuration.  The
+// empty string is ENCODING_PROTO.
+func ParseEncoding(s string) (MessageEncoding, error) {
+	switch MessageEncoding(s) {
+	case "", ENCODING_PROTO:
+		return ENCODING_PROTO, nil
+	case ENCODING_JSONPB:
+		return ENCODING_JSONPB, nil
+	}
+	return "", UnsupportedEncoding(s)
+}
+
+// encodeMessage encodes a message in an encoding, where the empty encoding is
+// ENCODING_PROTO
+func encodeMessage(pb proto.Message, encoding MessageEncoding) ([]byte, error) {
+	switch encoding {
+	case "", ENCODING_PROTO:
+		return proto.Marshal(pb)
+	case ENCODING_JSONPB:
+		var buf bytes.Buffer
+		marshaler := jsonpb.Marshaler{Indent: "  "}
+		if err := marshaler.Marshal(&buf, pb); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, UnsupportedEncoding(encoding)
+}
+
+// decodeMessage decodes a message in either encoding.  JSON is recognized by
+// its opening brace, which cannot begin a valid protobuf binary message.
+// Whitespace can, so JSON with leading whitespace, as when edited by hand, is
+// only tried when the content does not decode as binary.  Well-known types
+// whose JSON mapping is not an object, such as structpb.Value, can therefore
+// only be read in binary.
+func decodeMessage(content []byte, pb proto.Message) error {
+	if len(content) != 0 && content[0] == '{' {
+		return decodeJsonMessage(content, pb)
+	}
+	err := proto.Unmarshal(content, pb)
+	if err == nil {
+		return nil
+	}
+	if trimmed := bytes.TrimLeft(content, " \t\r\n"); len(trimmed) != 0 && trimmed[0] == '{' {
+		return decodeJsonMessage(trimmed, pb)
+	}
+	return err
+}
+
+// decodeJsonMessage decodes a message in ENCODING_JSONPB
+func decodeJsonMessage(content []byte, pb proto.Message) error {
+	unmarshaler := jsonpb.Unmarshaler{AllowUnknownFields: true}
+	return unmarshaler.Unmarshal(bytes.NewReader(content), pb)
+}
@@ -0,0 +1,129 @@
+package messagestore
+
+import (
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+)
+
+// DEFAULT_SCHEMA_VERSION is the schema version of messages put in an
+// Envelope unless configured otherwise
+const DEFAULT_SCHEMA_VERSION = 1
+
+// Envelope wraps a stored message with the version of its schema, so readers
+// can detect and migrate documents of older schemas.  It is declared here
+// rather than generated, since the keystore's protobuf packages only
+// describe the documents themselves; its fields are encoded as those of the
+// protobuf message
+//
+//	message Envelope {
+//	    google.protobuf.Any document = 1;
+//	    uint32 schema_version = 2;
+//	}
+type Envelope struct {
+	Document      *any.Any `protobuf:"bytes,1,opt,name=document,proto3" json:"document,omitempty"`
+	SchemaVersion uint32   `protobuf:"varint,2,opt,name=schema_version,json=schemaVersion,proto3" json:"schema_version,omitempty"`
+}
+
+func (m *Envelope) Reset()         { *m = Envelope{} }
+func (m *Envelope) String() string { return proto.CompactTextString(m) }
+func (*Envelope) ProtoMessage()    {}
+
+// UnknownSchemaVersion is an error indicating an enveloped message has a
+// schema version newer than a store reads, such as one written by a newer
+// release
+type UnknownSchemaVersion struct {
+	Name      string
+	Version   uint32
+	Supported uint32 // Newest schema version the store reads
+}
+
+func (e *UnknownSchemaVersion) Error() string {
+	return fmt.Sprintf("message %s has unknown schema version %d, newer than %d", e.Name, e.Version, e.Supported)
+}
+
+// schemaVersion gets the schema version of put enveloped messages
+func (s *BlobMessageStore) schemaVersion() uint32 {
+	if s.SchemaVersion == 0 {
+		return DEFAULT_SCHEMA_VERSION
+	}
+	return s.SchemaVersion
+}
+
+// encode encodes a message in the Encoding, wrapped in an Envelope if the
+// store envelopes messages, and encrypted if the store has a Cipher
+func (s *BlobMessageStore) encode(name string, pb proto.Message) ([]byte, error) {
+	if !s.Envelope {
+		content, err := encodeMessage(pb, s.Encoding)
+		if err != nil {
+			return nil, err
+		}
+		return s.seal(name, content)
+	}
+	document, err := ptypes.MarshalAny(pb)
+	if err != nil {
+		return nil, err
+	}
+	envelope := Envelope{
+		Document:      document,
+		SchemaVersion: s.schemaVersion(),
+	}
+	content, err := encodeMessage(&envelope, s.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	return s.seal(name, content)
+}
+
+// decode decodes a message, getting its schema version.  If the store
+// envelopes messages, content which is an Envelope of a message of pb's type
+// is unwrapped, and other content is read as a legacy message of version 0.
+// Content is first decrypted if the store has a Cipher.
+func (s *BlobMessageStore) decode(name string, content []byte, pb proto.Message) (uint32, error) {
+	content, err := s.open(name, content)
+	if err != nil {
+		return 0, err
+	}
+	if !s.Envelope {
+		return 0, decodeMessage(content, pb)
+	}
+	var envelope Envelope
+	if err := decodeMessage(content, &envelope); err != nil || envelope.SchemaVersion == 0 || !ptypes.Is(envelope.Document, pb) {
+		return 0, decodeMessage(content, pb)
+	}
+	if envelope.SchemaVersion > s.schemaVersion() {
+		return 0, &UnknownSchemaVersion{
+			Name:      name,
+			Version:   envelope.SchemaVersion,
+			Supported: s.schemaVersion(),
+		}
+	}
+	return envelope.SchemaVersion, ptypes.UnmarshalAny(envelope.Document, pb)
+}
+
+// GetMessageVersion gets a message as GetMessage does, along with its schema
+// version, which is 0 for messages not in an Envelope
+func (s *BlobMessageStore) GetMessageVersion(name string, pb proto.Message) (uint32, *CacheMeta, error) {
+	content, meta, err := s.GetBlob(name)
+	if err == nil {
+		err = s.verifyChecksum(name, content, meta)
+	}
+	if err != nil {
+		wrapErr := GetResourceError{
+			Name:  name,
+			Cause: err,
+		}
+		return 0, nil, &wrapErr
+	}
+	version, err := s.decode(name, content, pb)
+	if err != nil {
+		wrapErr := DecodeResourceError{
+			Name:  name,
+			Cause: err,
+		}
+		return 0, nil, &wrapErr
+	}
+	return version, meta, nil
+}
@@ -37,6 +37,23 @@ func (e *DeleteResourceError) Error() string {
 	return fmt.Sprintf("failed to delete resource %s: %s", e.Name, e.Cause)
 }
 
+type ListResourcesError struct {
+	Prefix string
+	Cause  error
+}
+
+func (e *ListResourcesError) Error() string {
+	return fmt.Sprintf("failed to list resources with prefix %q: %s", e.Prefix, e.Cause)
+}
+
+// ListUnsupported is an error indicating a store of the named type cannot
+// list its resources
+type ListUnsupported string
+
+func (e ListUnsupported) Error() string {
+	return fmt.Sprintf("store %s cannot list resources", string(e))
+}
+
 type DecodeResourceError struct {
 	Name  string
 	Cause error
@@ -63,3 +80,48 @@ type ReadResourceError struct {
 func (e *ReadResourceError) Error() string {
 	return fmt.Sprintf("failed to decode resource %s: %s", e.Name, e.Cause)
 }
+
+// NotFoundError is implemented by errors of backends indicating a resource
+// does not exist when they are not a NoSuchResource
+type NotFoundError interface {
+	error
+	NotFound() bool
+}
+
+// IsNotFound reports whether an error indicates a resource does not exist.
+// Every store gives such an error when getting a missing resource, so other
+// errors, such as timeouts, are not mistaken for absence.
+func IsNotFound(err error) bool {
+	switch e := err.(type) {
+	case NoSuchResource:
+		return true
+	case *GetResourceError:
+		return IsNotFound(e.Cause)
+	case *DeleteResourceError:
+		return IsNotFound(e.Cause)
+	case NotFoundError:
+		return e.NotFound()
+	}
+	return false
+}
+
+// ContentETagMismatch is an error indicating the content of a blob does not
+// match the content ETag recorded when it was stored
+type ContentETagMismatch struct {
+	Name     string
+	Stored   string
+	Computed string
+}
+
+func (e *ContentETagMismatch) Error() string {
+	return fmt.Sprintf("resource %s has ETag %s instead of stored ETag %s", e.Name, e.Computed, e.Stored)
+}
+
+// StoreUnreachable is an error indicating a store failed a health check
+type StoreUnreachable struct {
+	Cause error
+}
+
+func (e *StoreUnreachable) Error() string {
+	return fmt.Sprintf("store is unreachable: %s", e.Cause)
+}
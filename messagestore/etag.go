@@ -0,0 +1,98 @@
+package messagestore
+
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
+// CONTENT_ETAG_META is the metadata key under which ContentETagStore records
+// the content ETag of a blob
+const CONTENT_ETAG_META = "content-etag"
+
+// ContentETag gets a strong ETag derived from the SHA-256 hash of content
+func ContentETag(content []byte) string {
+	return fmt.Sprintf("\"%x\"", sha256.Sum256(content))
+}
+
+// ContentETagStore wraps a BlobStore so that ETags are derived from blob
+// content, giving identical ETags for identical content on any backend.  If
+// the wrapped store supports metadata, the ETag is recorded when a blob is put
+// and verified when it is read.
+type ContentETagStore struct {
+	BlobStore
+}
+
+var _ MetadataBlobStore = &ContentETagStore{}
+var _ StatBlobStore = &ContentETagStore{}
+var _ ListableBlobStore = &ContentETagStore{}
+
+func (s *ContentETagStore) GetBlob(name string) ([]byte, *CacheMeta, error) {
+	content, meta, err := s.BlobStore.GetBlob(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	etag := ContentETag(content)
+	if meta == nil {
+		meta = &CacheMeta{}
+	}
+	if stored, found := meta.Metadata[CONTENT_ETAG_META]; found && stored != etag {
+		return nil, nil, &ContentETagMismatch{
+			Name:     name,
+			Stored:   stored,
+			Computed: etag,
+		}
+	}
+	meta.ETag = etag
+	return content, meta, nil
+}
+
+// StatBlob gets the cache metadata of a blob with the content ETag recorded
+// in its metadata.  If the wrapped store cannot stat, or the ETag is not
+// recorded, the blob is got to derive it.
+func (s *ContentETagStore) StatBlob(name string) (*CacheMeta, error) {
+	if statStore, ok := s.BlobStore.(StatBlobStore); ok {
+		meta, err := statStore.StatBlob(name)
+		if err != nil {
+			return nil, err
+		}
+		if meta != nil && meta.Metadata[CONTENT_ETAG_META] != "" {
+			meta.ETag = meta.Metadata[CONTENT_ETAG_META]
+			return meta, nil
+		}
+	}
+	_, meta, err := s.GetBlob(name)
+	return meta, err
+}
+
+func (s *ContentETagStore) ListBlobs(prefix string) ([]string, error) {
+	listStore, ok := s.BlobStore.(ListableBlobStore)
+	if !ok {
+		return nil, ListUnsupported(fmt.Sprintf("%T", s.BlobStore))
+	}
+	return listStore.ListBlobs(prefix)
+}
+
+func (s *ContentETagStore) PutBlob(name string, content []byte) (*CacheMeta, error) {
+	return s.PutBlobWithMetadata(name, content, nil)
+}
+
+func (s *ContentETagStore) PutBlobWithMetadata(name string, content []byte, metadata map[string]string) (*CacheMeta, error) {
+	etag := ContentETag(content)
+	var meta *CacheMeta
+	var err error
+	if metaStore, ok := s.BlobStore.(MetadataBlobStore); ok {
+		etagMetadata := copyMetadata(metadata)
+		etagMetadata[CONTENT_ETAG_META] = etag
+		meta, err = metaStore.PutBlobWithMetadata(name, content, etagMetadata)
+	} else {
+		meta, err = s.BlobStore.PutBlob(name, content)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		meta = &CacheMeta{}
+	}
+	meta.ETag = etag
+	return meta, nil
+}
@@ -0,0 +1,18 @@
+package messagestore
+
+import (
+	"time"
+)
+
+// EXPIRES_META is the metadata key under which the time the content of a
+// blob expires is recorded, in RFC 3339 format.  Stores may use it to have
+// expired blobs removed, as s3store tags objects with it.
+const EXPIRES_META = "expires"
+
+// ExpiresMetadata gets a copy of metadata recording that a blob's content
+// expires at expiration
+func ExpiresMetadata(expiration time.Time, metadata map[string]string) map[string]string {
+	expiresMetadata := copyMetadata(metadata)
+	expiresMetadata[EXPIRES_META] = expiration.UTC().Format(time.RFC3339)
+	return expiresMetadata
+}
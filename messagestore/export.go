@@ -0,0 +1,70 @@
+package messagestore
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// ExportRecord is a blob within an export stream.  A stream is a sequence of
+// JSON encoded records.
+type ExportRecord struct {
+	Name    string `json:"name"`
+	Content []byte `json:"content"`
+}
+
+// ExportBlobs writes the blobs with names beginning with any of prefixes to
+// an export stream.  The number of blobs exported is returned.
+func ExportBlobs(store ListableBlobStore, prefixes []string, w io.Writer) (int, error) {
+	encoder := json.NewEncoder(w)
+	exported := 0
+	seen := make(map[string]bool)
+	for _, prefix := range prefixes {
+		names, err := store.ListBlobs(prefix)
+		if err != nil {
+			return exported, err
+		}
+		for _, name := range names {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			content, _, err := store.GetBlob(name)
+			if err != nil {
+				return exported, &GetResourceError{
+					Name:  name,
+					Cause: err,
+				}
+			}
+			err = encoder.Encode(&ExportRecord{
+				Name:    name,
+				Content: content,
+			})
+			if err != nil {
+				return exported, err
+			}
+			exported++
+		}
+	}
+	return exported, nil
+}
+
+// ImportBlobs puts the blobs of an export stream into a store.  The number of
+// blobs imported is returned.
+func ImportBlobs(store BlobStore, r io.Reader) (int, error) {
+	decoder := json.NewDecoder(r)
+	imported := 0
+	for {
+		var record ExportRecord
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			return imported, nil
+		} else if err != nil {
+			return imported, err
+		}
+		_, err = store.PutBlob(record.Name, record.Content)
+		if err != nil {
+			return imported, err
+		}
+		imported++
+	}
+}
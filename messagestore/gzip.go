@@ -0,0 +1,189 @@
+package messagestore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+)
+
+// CONTENT_ENCODING_META is the metadata key under which GzipBlobStore marks
+// the encoding of a compressed blob
+const CONTENT_ENCODING_META = "content-encoding"
+
+// CONTENT_ENCODING_GZIP is the content encoding of gzip compressed blobs
+const CONTENT_ENCODING_GZIP = "gzip"
+
+// UnsupportedContentEncoding is an error indicating a blob is marked with a
+// content encoding which cannot be decoded
+type UnsupportedContentEncoding struct {
+	Name     string
+	Encoding string
+}
+
+func (e *UnsupportedContentEncoding) Error() string {
+	return fmt.Sprintf("resource %s has unsupported content encoding %s", e.Name, e.Encoding)
+}
+
+// GzipBlobStore wraps a MetadataBlobStore so that blobs are gzip compressed
+// when put and transparently decompressed when read.  Compressed blobs are
+// marked with the CONTENT_ENCODING_META metadata key, so blobs stored before
+// compression was enabled are read unchanged.  The marker is removed from the
+// metadata of read blobs.  Blobs put conditionally are compressed only if the
+// wrapped store is a ConditionalMetadataBlobStore, which can keep the marker.
+type GzipBlobStore struct {
+	BlobStore MetadataBlobStore
+	MinSize   int // Blobs smaller than this are stored uncompressed; zero compresses all blobs
+}
+
+var _ MetadataBlobStore = &GzipBlobStore{}
+var _ ListableBlobStore = &GzipBlobStore{}
+var _ ConditionalMetadataBlobStore = &GzipBlobStore{}
+var _ StatBlobStore = &GzipBlobStore{}
+
+func (s *GzipBlobStore) GetBlob(name string) ([]byte, *CacheMeta, error) {
+	content, meta, err := s.BlobStore.GetBlob(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if meta == nil {
+		return content, meta, nil
+	}
+	encoding, found := meta.Metadata[CONTENT_ENCODING_META]
+	if !found {
+		return content, meta, nil
+	}
+	if encoding != CONTENT_ENCODING_GZIP {
+		return nil, nil, &UnsupportedContentEncoding{
+			Name:     name,
+			Encoding: encoding,
+		}
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(content))
+	if err == nil {
+		content, err = ioutil.ReadAll(reader)
+	}
+	if err != nil {
+		return nil, nil, &ReadResourceError{
+			Name:  name,
+			Cause: err,
+		}
+	}
+	unmarkMeta(meta)
+	return content, meta, nil
+}
+
+// unmarkMeta removes the content encoding marker from the metadata of a blob
+func unmarkMeta(meta *CacheMeta) {
+	meta.Metadata = copyMetadata(meta.Metadata)
+	delete(meta.Metadata, CONTENT_ENCODING_META)
+	if len(meta.Metadata) == 0 {
+		meta.Metadata = nil
+	}
+}
+
+// StatBlob gets the cache metadata of a blob from the wrapped store, without
+// the content encoding marker.  If the wrapped store cannot stat, the blob
+// is got instead.
+func (s *GzipBlobStore) StatBlob(name string) (*CacheMeta, error) {
+	statStore, ok := s.BlobStore.(StatBlobStore)
+	if !ok {
+		_, meta, err := s.BlobStore.GetBlob(name)
+		if err != nil {
+			return nil, err
+		}
+		if meta != nil {
+			unmarkMeta(meta)
+		}
+		return meta, nil
+	}
+	meta, err := statStore.StatBlob(name)
+	if err != nil || meta == nil {
+		return meta, err
+	}
+	unmarkMeta(meta)
+	return meta, nil
+}
+
+func (s *GzipBlobStore) PutBlob(name string, content []byte) (*CacheMeta, error) {
+	return s.PutBlobWithMetadata(name, content, nil)
+}
+
+func (s *GzipBlobStore) PutBlobWithMetadata(name string, content []byte, metadata map[string]string) (*CacheMeta, error) {
+	encoded, encodedMetadata, err := s.compress(name, content, metadata)
+	if err != nil {
+		return nil, err
+	}
+	return s.BlobStore.PutBlobWithMetadata(name, encoded, encodedMetadata)
+}
+
+// PutBlobIfMatch puts a blob only if the stored blob is the version described
+// by meta.  It fails with ConditionalUnsupported if the wrapped store is not a
+// ConditionalBlobStore.
+func (s *GzipBlobStore) PutBlobIfMatch(name string, content []byte, meta *CacheMeta) (*CacheMeta, error) {
+	return s.PutBlobIfMatchWithMetadata(name, content, meta, nil)
+}
+
+// PutBlobIfMatchWithMetadata puts a blob and its metadata only if the stored
+// blob is the version described by meta.  If the wrapped store cannot keep
+// metadata with conditional puts, the blob is put uncompressed and the
+// metadata is dropped.
+func (s *GzipBlobStore) PutBlobIfMatchWithMetadata(name string, content []byte, meta *CacheMeta, metadata map[string]string) (*CacheMeta, error) {
+	if metaStore, ok := s.BlobStore.(ConditionalMetadataBlobStore); ok {
+		encoded, encodedMetadata, err := s.compress(name, content, metadata)
+		if err != nil {
+			return nil, err
+		}
+		return metaStore.PutBlobIfMatchWithMetadata(name, encoded, meta, encodedMetadata)
+	}
+	conditionalStore, ok := s.BlobStore.(ConditionalBlobStore)
+	if !ok {
+		return nil, ConditionalUnsupported(fmt.Sprintf("%T", s.BlobStore))
+	}
+	return conditionalStore.PutBlobIfMatch(name, content, meta)
+}
+
+// compress gets the content of a blob to put and its metadata marked with the
+// content encoding, unless it is smaller than MinSize
+func (s *GzipBlobStore) compress(name string, content []byte, metadata map[string]string) ([]byte, map[string]string, error) {
+	if len(content) < s.MinSize {
+		return content, metadata, nil
+	}
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	_, err := writer.Write(content)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		return nil, nil, &EncodeResourceError{
+			Name:  name,
+			Cause: err,
+		}
+	}
+	encodedMetadata := copyMetadata(metadata)
+	encodedMetadata[CONTENT_ENCODING_META] = CONTENT_ENCODING_GZIP
+	return buf.Bytes(), encodedMetadata, nil
+}
+
+func (s *GzipBlobStore) DeleteBlob(name string) (*CacheMeta, error) {
+	return s.BlobStore.DeleteBlob(name)
+}
+
+// ListBlobs lists the blobs of the wrapped store, failing with a
+// ListUnsupported error if it cannot list
+func (s *GzipBlobStore) ListBlobs(prefix string) ([]string, error) {
+	listStore, ok := s.BlobStore.(ListableBlobStore)
+	if !ok {
+		return nil, ListUnsupported(fmt.Sprintf("%T", s.BlobStore))
+	}
+	return listStore.ListBlobs(prefix)
+}
+
+// NewGzipMessageStore allocates a BlobMessageStore compressing the messages
+// it stores in store
+func NewGzipMessageStore(store MetadataBlobStore) *BlobMessageStore {
+	return &BlobMessageStore{
+		BlobStore: &GzipBlobStore{BlobStore: store},
+	}
+}
@@ -0,0 +1,237 @@
+package messagestore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// NAME_MAPPING_PREFIX is the prefix of the blobs of a HashedBlobStore mapping
+// the keys of blobs back to their names, for listing
+const NAME_MAPPING_PREFIX = "names/"
+
+// DEFAULT_HASH_SHARD_DEPTH is the number of directory levels of the keys of a
+// SHA256NameHasher unless configured otherwise
+const DEFAULT_HASH_SHARD_DEPTH = 2
+
+// NameHasher maps the names of blobs to the keys under which they are stored
+type NameHasher interface {
+	HashName(name string) string
+}
+
+// IdentityNameHasher stores blobs under their names
+type IdentityNameHasher struct{}
+
+func (IdentityNameHasher) HashName(name string) string {
+	return name
+}
+
+// SHA256NameHasher stores blobs under the hex SHA-256 of their names, sharded
+// into directories named by successive pairs of its leading digits, for
+// example "3f/a1/3fa1...".  Keys never begin with NAME_MAPPING_PREFIX.
+type SHA256NameHasher struct {
+	ShardDepth int // Directory levels of keys; defaults to DEFAULT_HASH_SHARD_DEPTH, negative for none
+}
+
+func (h SHA256NameHasher) HashName(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	digest := hex.EncodeToString(sum[:])
+	depth := h.ShardDepth
+	if depth == 0 {
+		depth = DEFAULT_HASH_SHARD_DEPTH
+	}
+	var key strings.Builder
+	for i := 0; i < depth && 2*i+2 <= len(digest); i++ {
+		key.WriteString(digest[2*i : 2*i+2])
+		key.WriteByte('/')
+	}
+	key.WriteString(digest)
+	return key.String()
+}
+
+// HashedBlobStore wraps a BlobStore so that blobs are stored under keys of
+// their names given by Hasher, for stores which behave poorly with deeply
+// nested or varied names.  With a Hasher other than the identity, each put
+// also stores the name of the blob in a mapping blob under
+// NAME_MAPPING_PREFIX and its key, which are read to list blobs.  The
+// optional operations of the wrapped store are passed through under keys.  A
+// nil Hasher is the identity.
+type HashedBlobStore struct {
+	BlobStore BlobStore
+	Hasher    NameHasher
+}
+
+var _ BlobStore = &HashedBlobStore{}
+var _ ListableBlobStore = &HashedBlobStore{}
+var _ StatBlobStore = &HashedBlobStore{}
+var _ MetadataBlobStore = &HashedBlobStore{}
+var _ ConditionalMetadataBlobStore = &HashedBlobStore{}
+var _ BatchBlobStore = &HashedBlobStore{}
+
+// hashed determines if keys differ from names, requiring name mappings
+func (s *HashedBlobStore) hashed() bool {
+	if s.Hasher == nil {
+		return false
+	}
+	_, identity := s.Hasher.(IdentityNameHasher)
+	return !identity
+}
+
+// key gets the key under which a blob is stored
+func (s *HashedBlobStore) key(name string) string {
+	if !s.hashed() {
+		return name
+	}
+	return s.Hasher.HashName(name)
+}
+
+func (s *HashedBlobStore) GetBlob(name string) ([]byte, *CacheMeta, error) {
+	return s.BlobStore.GetBlob(s.key(name))
+}
+
+// PutBlob puts a blob under its key, then its name mapping
+func (s *HashedBlobStore) PutBlob(name string, content []byte) (*CacheMeta, error) {
+	key := s.key(name)
+	meta, err := s.BlobStore.PutBlob(key, content)
+	return s.mapName(name, key, meta, err)
+}
+
+// mapName completes a put of a blob under its key giving meta and err by
+// putting its name mapping, if the put succeeded
+func (s *HashedBlobStore) mapName(name, key string, meta *CacheMeta, err error) (*CacheMeta, error) {
+	if err != nil || !s.hashed() {
+		return meta, err
+	}
+	if _, err = s.BlobStore.PutBlob(NAME_MAPPING_PREFIX+key, []byte(name)); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// StatBlob gets the cache metadata of a blob under its key.  If the wrapped
+// store cannot stat, the blob is got instead.
+func (s *HashedBlobStore) StatBlob(name string) (*CacheMeta, error) {
+	statStore, ok := s.BlobStore.(StatBlobStore)
+	if !ok {
+		_, meta, err := s.GetBlob(name)
+		return meta, err
+	}
+	return statStore.StatBlob(s.key(name))
+}
+
+// PutBlobWithMetadata puts a blob and its metadata under its key, then its
+// name mapping.  If the wrapped store is not a MetadataBlobStore, the
+// metadata is dropped.
+func (s *HashedBlobStore) PutBlobWithMetadata(name string, content []byte, metadata map[string]string) (*CacheMeta, error) {
+	metaStore, ok := s.BlobStore.(MetadataBlobStore)
+	if !ok {
+		return s.PutBlob(name, content)
+	}
+	key := s.key(name)
+	meta, err := metaStore.PutBlobWithMetadata(key, content, metadata)
+	return s.mapName(name, key, meta, err)
+}
+
+// PutBlobIfMatch puts a blob under its key only if the stored blob is the
+// version described by meta, then its name mapping.  It fails with
+// ConditionalUnsupported if the wrapped store is not a ConditionalBlobStore.
+func (s *HashedBlobStore) PutBlobIfMatch(name string, content []byte, meta *CacheMeta) (*CacheMeta, error) {
+	conditionalStore, ok := s.BlobStore.(ConditionalBlobStore)
+	if !ok {
+		return nil, ConditionalUnsupported(fmt.Sprintf("%T", s.BlobStore))
+	}
+	key := s.key(name)
+	putMeta, err := conditionalStore.PutBlobIfMatch(key, content, meta)
+	return s.mapName(name, key, putMeta, err)
+}
+
+// PutBlobIfMatchWithMetadata puts a blob and its metadata under its key only
+// if the stored blob is the version described by meta, then its name
+// mapping.  It fails with ConditionalUnsupported if the wrapped store is not
+// a ConditionalMetadataBlobStore.
+func (s *HashedBlobStore) PutBlobIfMatchWithMetadata(name string, content []byte, meta *CacheMeta, metadata map[string]string) (*CacheMeta, error) {
+	conditionalStore, ok := s.BlobStore.(ConditionalMetadataBlobStore)
+	if !ok {
+		return nil, ConditionalUnsupported(fmt.Sprintf("%T", s.BlobStore))
+	}
+	key := s.key(name)
+	putMeta, err := conditionalStore.PutBlobIfMatchWithMetadata(key, content, meta, metadata)
+	return s.mapName(name, key, putMeta, err)
+}
+
+// GetBlobs gets several blobs under their keys, at once if the wrapped store
+// is a BatchBlobStore.  A *BatchError names the blobs rather than their keys.
+func (s *HashedBlobStore) GetBlobs(names []string) ([][]byte, []*CacheMeta, error) {
+	keys := make([]string, len(names))
+	for i, name := range names {
+		keys[i] = s.key(name)
+	}
+	contents, metas, err := GetBlobs(s.BlobStore, keys)
+	if batchErr, ok := err.(*BatchError); ok {
+		return contents, metas, &BatchError{
+			Names:  names,
+			Errors: batchErr.Errors,
+		}
+	}
+	return contents, metas, err
+}
+
+// DeleteBlob deletes a blob under its key, then its name mapping
+func (s *HashedBlobStore) DeleteBlob(name string) (*CacheMeta, error) {
+	key := s.key(name)
+	meta, err := s.BlobStore.DeleteBlob(key)
+	if err != nil || !s.hashed() {
+		return meta, err
+	}
+	if _, err = s.BlobStore.DeleteBlob(NAME_MAPPING_PREFIX + key); err != nil && !IsNotFound(err) {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// ListBlobs lists the names of blobs beginning with prefix, failing with a
+// ListUnsupported error if the wrapped store cannot list.  With hashing, all
+// name mappings are read, so listing takes time in the number of blobs
+// rather than the number listed.
+func (s *HashedBlobStore) ListBlobs(prefix string) ([]string, error) {
+	listStore, ok := s.BlobStore.(ListableBlobStore)
+	if !ok {
+		return nil, ListUnsupported(fmt.Sprintf("%T", s.BlobStore))
+	}
+	if !s.hashed() {
+		return listStore.ListBlobs(prefix)
+	}
+	mappingNames, err := listStore.ListBlobs(NAME_MAPPING_PREFIX)
+	if err != nil {
+		return nil, err
+	}
+	contents, _, err := GetBlobs(s.BlobStore, mappingNames)
+	errs := make([]error, len(mappingNames))
+	if batchErr, ok := err.(*BatchError); ok {
+		errs = batchErr.Errors
+		err = nil
+		for _, mappingErr := range errs {
+			// Mappings of blobs deleted since listing are skipped
+			if mappingErr != nil && !IsNotFound(mappingErr) {
+				err = batchErr
+				break
+			}
+		}
+	}
+	if err != nil {
+		return nil, &ListResourcesError{
+			Prefix: prefix,
+			Cause:  err,
+		}
+	}
+	names := make([]string, 0)
+	for i, content := range contents {
+		if name := string(content); errs[i] == nil && strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,202 @@
+package messagestore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// DEFAULT_LOCK_POLL is how often a held lock is retried while waiting for it
+// unless configured otherwise
+const DEFAULT_LOCK_POLL = 100 * time.Millisecond
+
+// LockHeld is an error indicating a lock document is held by another owner
+// until it expires
+type LockHeld struct {
+	Name    string
+	Expires time.Time
+}
+
+func (e *LockHeld) Error() string {
+	return fmt.Sprintf("lock %s is held until %s", e.Name, e.Expires.Format(time.RFC3339))
+}
+
+// LockNotOwned is an error indicating a lock being released was taken over
+// by another owner after expiring, or removed
+type LockNotOwned string
+
+func (e LockNotOwned) Error() string {
+	return fmt.Sprintf("lock %s is no longer owned", string(e))
+}
+
+// lockDocument is the content of a lock document
+type lockDocument struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+// Lock is an advisory lock held through a lock document, as acquired by
+// AcquireLock
+type Lock struct {
+	Name    string    // Name of the lock document
+	Owner   string    // Random token identifying the holder
+	Expires time.Time // When other owners may take over the lock
+}
+
+// LockOptions modifies how AcquireLockWithOptions acquires a lock
+type LockOptions struct {
+	Wait  time.Duration    // How long to wait for a held lock; fail immediately if 0
+	Poll  time.Duration    // How often a held lock is retried while waiting; defaults to DEFAULT_LOCK_POLL
+	Clock func() time.Time // Current time of lock expirations, but not of the wait; defaults to time.Now
+}
+
+// now gets the current time from the options' clock
+func (o *LockOptions) now() time.Time {
+	if o.Clock == nil {
+		return time.Now()
+	}
+	return o.Clock()
+}
+
+// AcquireLock takes an advisory lock by creating the document name with a
+// conditional put, so processes sharing a store may serialize changes.  The
+// lock expires after ttl, so one left by a crashed process is taken over
+// rather than held forever.  A *LockHeld error is returned if another owner
+// holds the lock, and ConditionalUnsupported if the store cannot put
+// conditionally, as reported by Capabilities.
+func AcquireLock(store BlobStore, name string, ttl time.Duration) (*Lock, error) {
+	return AcquireLockWithOptions(store, name, ttl, LockOptions{})
+}
+
+// AcquireLockWithOptions takes a lock like AcquireLock.  With opts.Wait, a
+// held lock is retried every opts.Poll until it is acquired or the wait is
+// over, when the *LockHeld error is returned.  The wait is timed by the real
+// clock; opts.Clock only decides when locks expire.
+func AcquireLockWithOptions(store BlobStore, name string, ttl time.Duration, opts LockOptions) (*Lock, error) {
+	conditionalStore, ok := store.(ConditionalBlobStore)
+	if !ok || !Capabilities(store).Conditional {
+		return nil, ConditionalUnsupported(fmt.Sprintf("%T", store))
+	}
+	poll := opts.Poll
+	if poll <= 0 {
+		poll = DEFAULT_LOCK_POLL
+	}
+	owner, err := lockOwner()
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(opts.Wait)
+	for {
+		lock, err := tryLock(conditionalStore, name, owner, ttl, opts.now())
+		held, isHeld := err.(*LockHeld)
+		remaining := time.Until(deadline)
+		if !isHeld || remaining <= 0 {
+			return lock, err
+		}
+		wait := poll
+		if untilExpiry := held.Expires.Sub(opts.now()); untilExpiry > 0 && untilExpiry < wait {
+			wait = untilExpiry
+		}
+		if remaining < wait {
+			wait = remaining
+		}
+		time.Sleep(wait)
+	}
+}
+
+// lockOwner generates a random token identifying the owner of a lock
+func lockOwner() (string, error) {
+	var token [16]byte
+	if _, err := rand.Read(token[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token[:]), nil
+}
+
+// tryLock makes one attempt to create or take over a lock document
+func tryLock(store ConditionalBlobStore, name, owner string, ttl time.Duration, now time.Time) (*Lock, error) {
+	lock := Lock{
+		Name:    name,
+		Owner:   owner,
+		Expires: now.Add(ttl),
+	}
+	content, err := json.Marshal(&lockDocument{
+		Owner:   lock.Owner,
+		Expires: lock.Expires,
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, err = store.PutBlobIfMatch(name, content, nil)
+	if !IsConflict(err) {
+		if err != nil {
+			return nil, err
+		}
+		return &lock, nil
+	}
+	stored, meta, err := store.GetBlob(name)
+	if IsNotFound(err) {
+		// Released since the put; the next attempt may create it
+		return nil, &LockHeld{
+			Name:    name,
+			Expires: now,
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	var held lockDocument
+	if err = json.Unmarshal(stored, &held); err != nil {
+		return nil, &DecodeResourceError{
+			Name:  name,
+			Cause: err,
+		}
+	}
+	if now.Before(held.Expires) {
+		return nil, &LockHeld{
+			Name:    name,
+			Expires: held.Expires,
+		}
+	}
+	// Take over the expired lock only if no other owner took it over first
+	_, err = store.PutBlobIfMatch(name, content, lockMeta(stored, meta))
+	if IsConflict(err) {
+		return nil, &LockHeld{
+			Name:    name,
+			Expires: now,
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return &lock, nil
+}
+
+// lockMeta gets the cache metadata naming the version of a stored lock
+// document for a conditional put
+func lockMeta(content []byte, meta *CacheMeta) *CacheMeta {
+	if meta != nil && meta.ETag != "" {
+		return meta
+	}
+	return &CacheMeta{ETag: ContentETag(content)}
+}
+
+// ReleaseLock deletes the document of a lock if it is still held by the
+// lock's owner.  A LockNotOwned error is returned if it is not, such as when
+// it expired and was taken over.  Since stores cannot delete conditionally,
+// a lock taken over between the check and the delete is still deleted; the
+// ttl should comfortably exceed the time the lock is held.
+func ReleaseLock(store BlobStore, lock *Lock) error {
+	stored, _, err := store.GetBlob(lock.Name)
+	if IsNotFound(err) {
+		return LockNotOwned(lock.Name)
+	} else if err != nil {
+		return err
+	}
+	var held lockDocument
+	if err = json.Unmarshal(stored, &held); err != nil || held.Owner != lock.Owner {
+		return LockNotOwned(lock.Name)
+	}
+	_, err = store.DeleteBlob(lock.Name)
+	return err
+}
@@ -1,12 +1,31 @@
 package messagestore
 
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemStore is a BlobStore held in memory.  ETags are derived from content as
+// by ContentETag, while each put of a name increments its Version, even if
+// the content is unchanged.  Versions are not reused after a name is
+// deleted.  Its methods are safe for concurrent use, but Blobs and Metadata
+// must not be accessed directly while they may be called.
 type MemStore struct {
-	Blobs map[string][]byte
+	Blobs    map[string][]byte
+	Metadata map[string]map[string]string
+	Clock    func() time.Time // Modification time of puts; defaults to time.Now
+	mu       sync.RWMutex
+	versions map[string]uint64
+	modified map[string]time.Time
 }
 
 func NewMemBlobStore() *MemStore {
 	return &MemStore{
-		Blobs: make(map[string][]byte),
+		Blobs:    make(map[string][]byte),
+		Metadata: make(map[string]map[string]string),
 	}
 }
 
@@ -17,29 +36,120 @@ func NewMemMessageStore() *BlobMessageStore {
 }
 
 var _ BlobStore = &MemStore{}
+var _ MetadataBlobStore = &MemStore{}
+var _ ListableBlobStore = &MemStore{}
+var _ StatBlobStore = &MemStore{}
+
+func (s *MemStore) now() time.Time {
+	if s.Clock == nil {
+		return time.Now()
+	}
+	return s.Clock()
+}
+
+// cacheMeta gets the cache metadata of a stored blob.  The lock must be held.
+func (s *MemStore) cacheMeta(name string, content []byte) *CacheMeta {
+	cacheMeta := CacheMeta{
+		ETag:         ContentETag(content),
+		LastModified: s.modified[name],
+	}
+	if version := s.versions[name]; version > 0 {
+		cacheMeta.Version = strconv.FormatUint(version, 10)
+	}
+	if metadata, found := s.Metadata[name]; found {
+		cacheMeta.Metadata = copyMetadata(metadata)
+	}
+	return &cacheMeta
+}
+
+// store stores a new version of a blob and its metadata, getting its cache
+// metadata.  The write lock must be held.
+func (s *MemStore) store(name string, content []byte, metadata map[string]string) *CacheMeta {
+	storeCopy := make([]byte, len(content))
+	copy(storeCopy, content)
+	if s.Blobs == nil {
+		s.Blobs = make(map[string][]byte)
+	}
+	if s.versions == nil {
+		s.versions = make(map[string]uint64)
+		s.modified = make(map[string]time.Time)
+	}
+	s.Blobs[name] = storeCopy
+	s.versions[name]++
+	s.modified[name] = s.now()
+	if len(metadata) == 0 {
+		delete(s.Metadata, name)
+	} else {
+		if s.Metadata == nil {
+			s.Metadata = make(map[string]map[string]string)
+		}
+		s.Metadata[name] = copyMetadata(metadata)
+	}
+	return s.cacheMeta(name, storeCopy)
+}
+
+func copyMetadata(metadata map[string]string) map[string]string {
+	metaCopy := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		metaCopy[k] = v
+	}
+	return metaCopy
+}
 
 func (s *MemStore) GetBlob(name string) ([]byte, *CacheMeta, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	storeBlob, found := s.Blobs[name]
 	if !found {
 		return nil, nil, NoSuchResource(name)
 	}
 	blobCopy := make([]byte, len(storeBlob))
 	copy(blobCopy, storeBlob)
-	return blobCopy, nil, nil
+	return blobCopy, s.cacheMeta(name, storeBlob), nil
+}
+
+func (s *MemStore) StatBlob(name string) (*CacheMeta, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	storeBlob, found := s.Blobs[name]
+	if !found {
+		return nil, NoSuchResource(name)
+	}
+	return s.cacheMeta(name, storeBlob), nil
 }
 
 func (s *MemStore) PutBlob(name string, content []byte) (*CacheMeta, error) {
-	storeCopy := make([]byte, len(content))
-	copy(storeCopy, content)
-	s.Blobs[name] = storeCopy
-	return nil, nil
+	return s.PutBlobWithMetadata(name, content, nil)
+}
+
+func (s *MemStore) PutBlobWithMetadata(name string, content []byte, metadata map[string]string) (*CacheMeta, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.store(name, content, metadata), nil
 }
 
 func (s *MemStore) DeleteBlob(name string) (*CacheMeta, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	_, found := s.Blobs[name]
 	if !found {
 		return nil, NoSuchResource(name)
 	}
 	delete(s.Blobs, name)
+	delete(s.Metadata, name)
+	delete(s.modified, name)
 	return nil, nil
 }
+
+func (s *MemStore) ListBlobs(prefix string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0)
+	for name := range s.Blobs {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -1,6 +1,8 @@
 package messagestore
 
 import (
+	"fmt"
+
 	"github.com/golang/protobuf/proto"
 )
 
@@ -10,12 +12,90 @@ type MessageStore interface {
 	DeleteMessage(name string) (*CacheMeta, error)
 }
 
+// MetadataMessageStore is a MessageStore able to store user metadata with a
+// message.
+type MetadataMessageStore interface {
+	MessageStore
+	PutMessageWithMetadata(name string, pb proto.Message, metadata map[string]string) (*CacheMeta, error)
+}
+
+// MessageMetaStore is a MessageStore able to get the cache metadata of a
+// message without fetching it.  Nil metadata is returned if the store cannot
+// describe the message's version.
+type MessageMetaStore interface {
+	MessageStore
+	GetMessageMeta(name string) (*CacheMeta, error)
+}
+
+// ListableMessageStore is a MessageStore able to list the names of its
+// messages.  The names are those accepted by GetMessage.
+type ListableMessageStore interface {
+	MessageStore
+	ListMessages(prefix string) ([]string, error) // Names beginning with prefix, in lexical order
+}
+
+// ListMessages lists the names of messages beginning with prefix.  It fails
+// with ListUnsupported if the store is not a ListableMessageStore.
+func ListMessages(store MessageStore, prefix string) ([]string, error) {
+	listStore, ok := store.(ListableMessageStore)
+	if !ok {
+		return nil, ListUnsupported(fmt.Sprintf("%T", store))
+	}
+	return listStore.ListMessages(prefix)
+}
+
+// BlobMessageStore is a MessageStore keeping each message in a blob.
+// Messages are put in the Encoding, but either encoding is read, so the
+// encoding of a store may be changed.
+//
+// With Checksums, the content ETag of each message is recorded in the
+// metadata of its blob, as ContentETagStore records it, and verified when the
+// message is read.  A mismatch fails the read with a *ContentETagMismatch.
+// Blobs without a recorded ETag, such as those written before checksums were
+// enabled or by conditional puts to stores which are not
+// ConditionalMetadataBlobStores, are read unverified.  Checksums cannot be
+// recorded unless the BlobStore is a MetadataBlobStore.
+//
+// The MIME type of each message is given to a MetadataBlobStore under the
+// CONTENT_TYPE_META metadata key: that of the Encoding, or
+// CONTENT_TYPE_OCTET_STREAM for messages encrypted with a Cipher.
+//
+// With Envelope, messages are put wrapped in an Envelope of the
+// SchemaVersion, and read unwrapped.  Messages of a newer schema version fail
+// to be read with an *UnknownSchemaVersion, while legacy messages put without
+// an envelope are still read.
+//
+// With a Cipher, messages are encrypted before they are put, each with a
+// random nonce stored ahead of the ciphertext, and decrypted when read.
+// Messages which are not encrypted, such as those put before the Cipher was
+// configured, fail to be read with UnencryptedMessage unless AllowPlaintext
+// is set.  Blobs put directly, rather than as messages, are only encrypted
+// if put by PutSealedBlob.  Checksums are of the encrypted content.
 type BlobMessageStore struct {
 	BlobStore
+	Encoding       MessageEncoding // Encoding of put messages; defaults to ENCODING_PROTO
+	Checksums      bool            // Record and verify content checksums of messages
+	Envelope       bool            // Put messages in an Envelope and unwrap enveloped messages read
+	SchemaVersion  uint32          // Schema version of enveloped messages put, and the newest read; defaults to DEFAULT_SCHEMA_VERSION
+	Cipher         Cipher          // Encrypts put messages and decrypts those read, if set
+	AllowPlaintext bool            // Read messages which are not encrypted despite the Cipher
 }
 
+var _ ListableMessageStore = &BlobMessageStore{}
+
 func (s *BlobMessageStore) GetMessage(name string, pb proto.Message) (*CacheMeta, error) {
-	content, meta, err := s.GetBlob(name)
+	_, meta, err := s.GetMessageVersion(name, pb)
+	return meta, err
+}
+
+// GetMessageMeta gets the cache metadata of a message if the BlobStore is a
+// StatBlobStore, otherwise nil metadata is returned.
+func (s *BlobMessageStore) GetMessageMeta(name string) (*CacheMeta, error) {
+	statStore, ok := s.BlobStore.(StatBlobStore)
+	if !ok {
+		return nil, nil
+	}
+	meta, err := statStore.StatBlob(name)
 	if err != nil {
 		wrapErr := GetResourceError{
 			Name:  name,
@@ -23,19 +103,32 @@ func (s *BlobMessageStore) GetMessage(name string, pb proto.Message) (*CacheMeta
 		}
 		return nil, &wrapErr
 	}
-	err = proto.Unmarshal(content, pb)
+	return meta, nil
+}
+
+func (s *BlobMessageStore) PutMessage(name string, pb proto.Message) (*CacheMeta, error) {
+	content, err := s.encode(name, pb)
 	if err != nil {
-		wrapErr := DecodeResourceError{
+		wrapErr := EncodeResourceError{
 			Name:  name,
 			Cause: err,
 		}
 		return nil, &wrapErr
 	}
-	return meta, nil
+	if metaStore, ok := s.BlobStore.(MetadataBlobStore); ok {
+		return metaStore.PutBlobWithMetadata(name, content, s.messageMetadata(content, nil))
+	}
+	return s.PutBlob(name, content)
 }
 
-func (s *BlobMessageStore) PutMessage(name string, pb proto.Message) (*CacheMeta, error) {
-	content, err := proto.Marshal(pb)
+// PutMessageWithMetadata stores a message along with user metadata.  If the
+// BlobStore is not a MetadataBlobStore, the metadata is dropped.
+func (s *BlobMessageStore) PutMessageWithMetadata(name string, pb proto.Message, metadata map[string]string) (*CacheMeta, error) {
+	metaStore, ok := s.BlobStore.(MetadataBlobStore)
+	if !ok {
+		return s.PutMessage(name, pb)
+	}
+	content, err := s.encode(name, pb)
 	if err != nil {
 		wrapErr := EncodeResourceError{
 			Name:  name,
@@ -43,9 +136,58 @@ func (s *BlobMessageStore) PutMessage(name string, pb proto.Message) (*CacheMeta
 		}
 		return nil, &wrapErr
 	}
-	return s.PutBlob(name, content)
+	return metaStore.PutBlobWithMetadata(name, content, s.messageMetadata(content, metadata))
+}
+
+// messageMetadata gets a copy of the metadata of a message put with content,
+// recording its MIME type and, with Checksums, its content ETag
+func (s *BlobMessageStore) messageMetadata(content []byte, metadata map[string]string) map[string]string {
+	messageMetadata := copyMetadata(metadata)
+	messageMetadata[CONTENT_TYPE_META] = s.contentType()
+	if s.Checksums {
+		messageMetadata[CONTENT_ETAG_META] = ContentETag(content)
+	}
+	return messageMetadata
+}
+
+// contentType gets the MIME type of the messages put by the store
+func (s *BlobMessageStore) contentType() string {
+	if s.Cipher != nil {
+		return CONTENT_TYPE_OCTET_STREAM
+	}
+	return s.Encoding.ContentType()
+}
+
+// verifyChecksum ensures content has the content ETag recorded in meta, if
+// the store verifies checksums and an ETag was recorded
+func (s *BlobMessageStore) verifyChecksum(name string, content []byte, meta *CacheMeta) error {
+	if !s.Checksums || meta == nil {
+		return nil
+	}
+	stored, found := meta.Metadata[CONTENT_ETAG_META]
+	if !found {
+		return nil
+	}
+	if computed := ContentETag(content); computed != stored {
+		return &ContentETagMismatch{
+			Name:     name,
+			Stored:   stored,
+			Computed: computed,
+		}
+	}
+	return nil
 }
 
 func (s *BlobMessageStore) DeleteMessage(name string) (*CacheMeta, error) {
 	return s.DeleteBlob(name)
 }
+
+// ListMessages lists the names of messages beginning with prefix.  It fails
+// with ListUnsupported if the BlobStore is not a ListableBlobStore.
+func (s *BlobMessageStore) ListMessages(prefix string) ([]string, error) {
+	listStore, ok := s.BlobStore.(ListableBlobStore)
+	if !ok {
+		return nil, ListUnsupported(fmt.Sprintf("%T", s.BlobStore))
+	}
+	return listStore.ListBlobs(prefix)
+}
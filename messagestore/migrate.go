@@ -0,0 +1,132 @@
+package messagestore
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/aefalcon/go-github-keystore/kslog"
+)
+
+// MigrationIncomplete is an error indicating blobs of the source store are
+// missing from the destination after a migration
+type MigrationIncomplete struct {
+	Missing []string
+}
+
+func (e *MigrationIncomplete) Error() string {
+	return fmt.Sprintf("%d blobs missing after migration: %s", len(e.Missing), strings.Join(e.Missing, ", "))
+}
+
+// Migrate copies every blob of src into dst.  Blobs already in dst with
+// identical content are skipped, so an interrupted migration may be resumed
+// by migrating again.  User metadata is copied if dst keeps metadata, as
+// reported by Capabilities.  A blob which fails to be copied does not stop the
+// others being copied; if any fail, the error is a *MultiError of the failures
+// by blob name.  If dst can list, it is listed afterwards to verify that every
+// blob of src was migrated.
+func Migrate(src ListableBlobStore, dst BlobStore, logger kslog.KsLogger) error {
+	names, err := src.ListBlobs("")
+	if err != nil {
+		return err
+	}
+	kslog.Infof(logger, "Migrating %d blobs", len(names))
+	caps := Capabilities(dst)
+	copied := 0
+	var failures MultiError
+	for i, name := range names {
+		content, meta, err := src.GetBlob(name)
+		if err != nil {
+			failures.Add(name, &GetResourceError{
+				Name:  name,
+				Cause: err,
+			})
+			continue
+		}
+		identical, err := hasIdenticalBlob(dst, name, content)
+		if err != nil {
+			failures.Add(name, err)
+			continue
+		}
+		if identical {
+			logger.Debugf("Skipping identical blob %s (%d of %d)", name, i+1, len(names))
+			continue
+		}
+		metaStore, ok := dst.(MetadataBlobStore)
+		if ok && caps.Metadata && meta != nil && len(meta.Metadata) != 0 {
+			_, err = metaStore.PutBlobWithMetadata(name, content, meta.Metadata)
+		} else {
+			_, err = dst.PutBlob(name, content)
+		}
+		if err != nil {
+			failures.Add(name, &PutResourceError{
+				Name:  name,
+				Cause: err,
+			})
+			continue
+		}
+		copied++
+		logger.Debugf("Copied blob %s (%d of %d)", name, i+1, len(names))
+	}
+	if failures.Len() != 0 {
+		logger.Errorf("Copied %d blobs but failed to copy %d blobs", copied, failures.Len())
+		return &failures
+	}
+	kslog.Infof(logger, "Copied %d blobs and skipped %d identical blobs", copied, len(names)-copied)
+	listStore, ok := dst.(ListableBlobStore)
+	if !ok || !caps.List {
+		kslog.Warnf(logger, "Cannot verify migration to store %T which cannot list blobs", dst)
+		return nil
+	}
+	migrated, err := listStore.ListBlobs("")
+	if err != nil {
+		return err
+	}
+	present := make(map[string]bool, len(migrated))
+	for _, name := range migrated {
+		present[name] = true
+	}
+	missing := make([]string, 0)
+	for _, name := range names {
+		if !present[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) != 0 {
+		return &MigrationIncomplete{missing}
+	}
+	kslog.Infof(logger, "Verified %d blobs in destination", len(names))
+	return nil
+}
+
+// hasIdenticalBlob determines if store has a blob with the given content.
+// The content ETag recorded by a ContentETagStore is compared if available to
+// avoid fetching the blob.
+func hasIdenticalBlob(store BlobStore, name string, content []byte) (bool, error) {
+	if statStore, ok := store.(StatBlobStore); ok {
+		meta, err := statStore.StatBlob(name)
+		if IsNotFound(err) {
+			return false, nil
+		} else if err != nil {
+			return false, &GetResourceError{
+				Name:  name,
+				Cause: err,
+			}
+		}
+		if meta != nil {
+			if etag, found := meta.Metadata[CONTENT_ETAG_META]; found {
+				return etag == ContentETag(content), nil
+			}
+		}
+	}
+	existing, _, err := store.GetBlob(name)
+	if IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, &GetResourceError{
+			Name:  name,
+			Cause: err,
+		}
+	}
+	return bytes.Equal(existing, content), nil
+}
@@ -0,0 +1,77 @@
+package messagestore
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ItemError is the error of one item of an operation on several documents,
+// such as a blob or an app, identified by Id
+type ItemError struct {
+	Id  string
+	Err error
+}
+
+func (e *ItemError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Id, e.Err)
+}
+
+// MultiError collects the errors of the items of an operation on several
+// documents which fail independently, so every failure is reported rather
+// than only the first.  The zero MultiError has no errors; use ErrorOrNil to
+// return it.
+type MultiError struct {
+	Errors []*ItemError // Errors in the order they were added
+}
+
+// Add collects the error of an item.  A nil err is not collected.
+func (e *MultiError) Add(id string, err error) {
+	if err == nil {
+		return
+	}
+	e.Errors = append(e.Errors, &ItemError{
+		Id:  id,
+		Err: err,
+	})
+}
+
+// Len gets the number of collected errors
+func (e *MultiError) Len() int {
+	if e == nil {
+		return 0
+	}
+	return len(e.Errors)
+}
+
+// Each calls f with each collected error and the id of its item, in order
+func (e *MultiError) Each(f func(id string, err error)) {
+	if e == nil {
+		return
+	}
+	for _, itemErr := range e.Errors {
+		f(itemErr.Id, itemErr.Err)
+	}
+}
+
+// ErrorOrNil gets e if any errors were collected, or nil otherwise, so an
+// empty MultiError is not returned as a non-nil error
+func (e *MultiError) ErrorOrNil() error {
+	if e.Len() == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e *MultiError) Error() string {
+	switch e.Len() {
+	case 0:
+		return "no errors"
+	case 1:
+		return e.Errors[0].Error()
+	}
+	failures := make([]string, len(e.Errors))
+	for i, itemErr := range e.Errors {
+		failures[i] = itemErr.Error()
+	}
+	return fmt.Sprintf("%d errors: %s", len(e.Errors), strings.Join(failures, "; "))
+}
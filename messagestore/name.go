@@ -0,0 +1,128 @@
+package messagestore
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/jtacoma/uritemplates"
+)
+
+// UnsafeName is an error indicating the values expanded into a name template
+// would change the hierarchy of names, such as by adding slashes or
+// expanding to "..".
+type UnsafeName struct {
+	Template string
+	Name     string // The rejected expansion
+}
+
+func (e *UnsafeName) Error() string {
+	return fmt.Sprintf("expansion %q of name template %s changes the name hierarchy", e.Name, e.Template)
+}
+
+// templates caches parsed URI templates by their text, as the few templates
+// of the links of stores are expanded for every name
+var templates sync.Map
+
+// parseTemplate parses a URI template, reusing a template parsed before.
+// Templates which fail to parse are not cached.
+func parseTemplate(template string) (*uritemplates.UriTemplate, error) {
+	if cached, ok := templates.Load(template); ok {
+		return cached.(*uritemplates.UriTemplate), nil
+	}
+	uritmpl, err := uritemplates.Parse(template)
+	if err != nil {
+		return nil, err
+	}
+	templates.Store(template, uritmpl)
+	return uritmpl, nil
+}
+
+// ExpandName expands a URI template naming a resource.  Values are escaped as
+// the template prescribes, so simple expansions escape slashes while reserved
+// expansions do not.  Expansions are rejected with *UnsafeName if values add
+// or remove slash separated segments of the name, or leave a segment empty,
+// "." or "..", so each value names a single resource within the hierarchy of
+// the template.  Each template is parsed once and reused.
+func ExpandName(template string, values map[string]interface{}) (string, error) {
+	uritmpl, err := parseTemplate(template)
+	if err != nil {
+		return "", err
+	}
+	name, err := uritmpl.Expand(values)
+	if err != nil {
+		return "", err
+	}
+	placeholders := make(map[string]interface{}, len(values))
+	for k := range values {
+		placeholders[k] = "x"
+	}
+	shape, err := uritmpl.Expand(placeholders)
+	if err != nil {
+		return "", err
+	}
+	segments := strings.Split(name, "/")
+	shapeSegments := strings.Split(shape, "/")
+	if len(segments) != len(shapeSegments) {
+		return "", &UnsafeName{
+			Template: template,
+			Name:     name,
+		}
+	}
+	for i, segment := range segments {
+		if segment == shapeSegments[i] {
+			continue
+		}
+		if segment == "" || segment == "." || segment == ".." {
+			return "", &UnsafeName{
+				Template: template,
+				Name:     name,
+			}
+		}
+	}
+	return name, nil
+}
+
+// TemplateVariables parses a URI template naming resources, getting the
+// names of the variables its expressions expand.  The parsed template is
+// reused by ExpandName, so validating templates with it up front parses them
+// before names are expanded.
+func TemplateVariables(template string) ([]string, error) {
+	uritmpl, err := parseTemplate(template)
+	if err != nil {
+		return nil, err
+	}
+	return uritmpl.Names(), nil
+}
+
+// MatchName determines if a name could be an expansion of a URI template
+// naming resources.  Simple expressions match a single segment of the name,
+// while reserved and other operator expressions may match across segments.
+// Invalid templates match no names.
+func MatchName(template, name string) bool {
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	rest := template
+	for {
+		start := strings.Index(rest, "{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(rest[start:], "}")
+		if end < 0 {
+			return false
+		}
+		pattern.WriteString(regexp.QuoteMeta(rest[:start]))
+		if expr := rest[start+1 : start+end]; expr != "" && strings.ContainsAny(expr[:1], "+#./;?&") {
+			pattern.WriteString(".*")
+		} else {
+			pattern.WriteString("[^/]+")
+		}
+		rest = rest[start+end+1:]
+	}
+	pattern.WriteString(regexp.QuoteMeta(rest))
+	pattern.WriteString("$")
+	matched, err := regexp.MatchString(pattern.String(), name)
+	return err == nil && matched
+}
@@ -0,0 +1,52 @@
+package messagestore
+
+import (
+	"github.com/aefalcon/go-github-keystore/kslog"
+)
+
+// PING_NAME is the name probed by Ping of stores which cannot ping.  The
+// resource need not exist.
+const PING_NAME = ".ping"
+
+// PingableBlobStore is a BlobStore able to cheaply check that it is reachable
+type PingableBlobStore interface {
+	BlobStore
+	Ping(logger kslog.KsLogger) error
+}
+
+// Ping checks that a store is reachable.  Stores which cannot ping are probed
+// by statting, or failing that getting, the PING_NAME blob, which need not
+// exist.  Failures are *StoreUnreachable errors.
+func Ping(store BlobStore, logger kslog.KsLogger) error {
+	var err error
+	if pingStore, ok := store.(PingableBlobStore); ok {
+		err = pingStore.Ping(logger)
+		if _, ok := err.(*StoreUnreachable); ok || err == nil {
+			return err
+		}
+	} else {
+		if statStore, ok := store.(StatBlobStore); ok {
+			_, err = statStore.StatBlob(PING_NAME)
+		} else {
+			_, _, err = store.GetBlob(PING_NAME)
+		}
+		if err == nil || IsNotFound(err) {
+			return nil
+		}
+	}
+	logger.Errorf("Store %T is unreachable: %s", store, err)
+	return &StoreUnreachable{Cause: err}
+}
+
+var _ PingableBlobStore = &BlobMessageStore{}
+var _ PingableBlobStore = &MemStore{}
+
+// Ping checks that the underlying BlobStore is reachable
+func (s *BlobMessageStore) Ping(logger kslog.KsLogger) error {
+	return Ping(s.BlobStore, logger)
+}
+
+// Ping always succeeds since the store is in memory
+func (s *MemStore) Ping(logger kslog.KsLogger) error {
+	return nil
+}
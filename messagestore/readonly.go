@@ -0,0 +1,92 @@
+package messagestore
+
+import (
+	"fmt"
+)
+
+// StoreReadOnly is an error indicating a resource was not changed because
+// the store is read-only
+type StoreReadOnly struct {
+	Op   string // The rejected operation, "put" or "delete"
+	Name string
+}
+
+func (e *StoreReadOnly) Error() string {
+	return fmt.Sprintf("cannot %s resource %s of a read-only store", e.Op, e.Name)
+}
+
+// IsReadOnly reports whether an error indicates a change was rejected by a
+// read-only store
+func IsReadOnly(err error) bool {
+	switch e := err.(type) {
+	case *StoreReadOnly:
+		return true
+	case *PutResourceError:
+		return IsReadOnly(e.Cause)
+	case *DeleteResourceError:
+		return IsReadOnly(e.Cause)
+	}
+	return false
+}
+
+// ReadOnlyBlobStore wraps a BlobStore so that blobs may be read and listed
+// but never put or deleted, for consumers which must not change a store, such
+// as services which only sign or verify.  Changes fail with *StoreReadOnly
+// without reaching the wrapped store.
+type ReadOnlyBlobStore struct {
+	BlobStore BlobStore
+}
+
+var _ BlobStore = &ReadOnlyBlobStore{}
+var _ ListableBlobStore = &ReadOnlyBlobStore{}
+var _ StatBlobStore = &ReadOnlyBlobStore{}
+
+func (s *ReadOnlyBlobStore) GetBlob(name string) ([]byte, *CacheMeta, error) {
+	return s.BlobStore.GetBlob(name)
+}
+
+func (s *ReadOnlyBlobStore) StatBlob(name string) (*CacheMeta, error) {
+	statStore, ok := s.BlobStore.(StatBlobStore)
+	if !ok {
+		_, meta, err := s.GetBlob(name)
+		return meta, err
+	}
+	return statStore.StatBlob(name)
+}
+
+func (s *ReadOnlyBlobStore) PutBlob(name string, content []byte) (*CacheMeta, error) {
+	return nil, &StoreReadOnly{
+		Op:   "put",
+		Name: name,
+	}
+}
+
+func (s *ReadOnlyBlobStore) DeleteBlob(name string) (*CacheMeta, error) {
+	return nil, &StoreReadOnly{
+		Op:   "delete",
+		Name: name,
+	}
+}
+
+func (s *ReadOnlyBlobStore) ListBlobs(prefix string) ([]string, error) {
+	listStore, ok := s.BlobStore.(ListableBlobStore)
+	if !ok {
+		return nil, ListUnsupported(fmt.Sprintf("%T", s.BlobStore))
+	}
+	return listStore.ListBlobs(prefix)
+}
+
+// NewReadOnlyMessageStore allocates a BlobMessageStore reading the messages
+// of store, with its encoding, checksums, envelopes and cipher, which fails
+// to put or delete messages with *StoreReadOnly
+func NewReadOnlyMessageStore(store *BlobMessageStore) *BlobMessageStore {
+	return &BlobMessageStore{
+		BlobStore:      &ReadOnlyBlobStore{BlobStore: store.BlobStore},
+		Encoding:       store.Encoding,
+		Checksums:      store.Checksums,
+		Envelope:       store.Envelope,
+		SchemaVersion:  store.SchemaVersion,
+		Cipher:         store.Cipher,
+		AllowPlaintext: store.AllowPlaintext,
+	}
+}
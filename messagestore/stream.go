@@ -0,0 +1,70 @@
+package messagestore
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+)
+
+// StreamBlobStore is a BlobStore able to get and put blobs as streams, so
+// large blobs need not be held in memory
+type StreamBlobStore interface {
+	BlobStore
+	GetBlobStream(name string) (io.ReadCloser, *CacheMeta, error)
+	PutBlobStream(name string, r io.Reader) (*CacheMeta, error)
+}
+
+// GetBlobStream gets a blob as a stream, which the caller must close.  Blobs
+// of stores which cannot stream are got whole and read from memory.
+func GetBlobStream(store BlobStore, name string) (io.ReadCloser, *CacheMeta, error) {
+	if streamStore, ok := store.(StreamBlobStore); ok {
+		return streamStore.GetBlobStream(name)
+	}
+	content, meta, err := store.GetBlob(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), meta, nil
+}
+
+// PutBlobStream puts a blob read from a stream.  Stores which cannot stream
+// have the stream read whole into memory and put.
+func PutBlobStream(store BlobStore, name string, r io.Reader) (*CacheMeta, error) {
+	if streamStore, ok := store.(StreamBlobStore); ok {
+		return streamStore.PutBlobStream(name, r)
+	}
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, &ReadResourceError{
+			Name:  name,
+			Cause: err,
+		}
+	}
+	return store.PutBlob(name, content)
+}
+
+var _ StreamBlobStore = &MemStore{}
+
+// GetBlobStream gets a blob as a stream reading the stored content, which the
+// store never modifies in place
+func (s *MemStore) GetBlobStream(name string) (io.ReadCloser, *CacheMeta, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	storeBlob, found := s.Blobs[name]
+	if !found {
+		return nil, nil, NoSuchResource(name)
+	}
+	return ioutil.NopCloser(bytes.NewReader(storeBlob)), s.cacheMeta(name, storeBlob), nil
+}
+
+// PutBlobStream puts a blob read from a stream into a buffer
+func (s *MemStore) PutBlobStream(name string, r io.Reader) (*CacheMeta, error) {
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, &ReadResourceError{
+			Name:  name,
+			Cause: err,
+		}
+	}
+	return s.PutBlob(name, buf.Bytes())
+}
@@ -0,0 +1,233 @@
+package messagestore
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// OperationTimeout is an error indicating a store operation did not finish
+// within the timeout of a TimeoutBlobStore
+type OperationTimeout struct {
+	Op      string // The operation, such as "get"
+	Name    string // Name of the resource operated on
+	Timeout time.Duration
+}
+
+func (e *OperationTimeout) Error() string {
+	return fmt.Sprintf("%s of resource %s timed out after %s", e.Op, e.Name, e.Timeout)
+}
+
+// TimeoutBlobStore wraps a BlobStore so that each operation fails with an
+// *OperationTimeout error if it does not finish within Timeout.  Operations
+// of a ContextBlobStore are given a context cancelled at the timeout.  Other
+// stores cannot be cancelled, so a timed out operation is abandoned and may
+// still complete later.  The optional operations of the wrapped store, which
+// take no context, are abandoned in the same way.  A Timeout of zero
+// disables timeouts.
+type TimeoutBlobStore struct {
+	BlobStore BlobStore
+	Timeout   time.Duration
+}
+
+var _ BlobStore = &TimeoutBlobStore{}
+var _ ListableBlobStore = &TimeoutBlobStore{}
+var _ StatBlobStore = &TimeoutBlobStore{}
+var _ MetadataBlobStore = &TimeoutBlobStore{}
+var _ ConditionalMetadataBlobStore = &TimeoutBlobStore{}
+var _ BatchBlobStore = &TimeoutBlobStore{}
+
+// run calls f in a goroutine with a context cancelled at the timeout,
+// returning its error if it finishes in time
+func (s *TimeoutBlobStore) run(op, name string, f func(ctx context.Context) error) error {
+	if s.Timeout <= 0 {
+		return f(context.Background())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- f(ctx)
+	}()
+	select {
+	case err := <-done:
+		// An error of a store cancelled by the deadline is a timeout
+		if err == nil || ctx.Err() != context.DeadlineExceeded {
+			return err
+		}
+	case <-ctx.Done():
+	}
+	return &OperationTimeout{
+		Op:      op,
+		Name:    name,
+		Timeout: s.Timeout,
+	}
+}
+
+// runMeta runs an operation giving cache metadata as run does
+func (s *TimeoutBlobStore) runMeta(op, name string, f func(ctx context.Context) (*CacheMeta, error)) (*CacheMeta, error) {
+	metas := make(chan *CacheMeta, 1)
+	err := s.run(op, name, func(ctx context.Context) error {
+		meta, err := f(ctx)
+		metas <- meta
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return <-metas, nil
+}
+
+func (s *TimeoutBlobStore) GetBlob(name string) ([]byte, *CacheMeta, error) {
+	type result struct {
+		Content []byte
+		Meta    *CacheMeta
+	}
+	results := make(chan result, 1)
+	err := s.run("get", name, func(ctx context.Context) error {
+		var r result
+		var err error
+		if ctxStore, ok := s.BlobStore.(ContextBlobStore); ok {
+			r.Content, r.Meta, err = ctxStore.GetBlobCtx(ctx, name)
+		} else {
+			r.Content, r.Meta, err = s.BlobStore.GetBlob(name)
+		}
+		results <- r
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	r := <-results
+	return r.Content, r.Meta, nil
+}
+
+func (s *TimeoutBlobStore) PutBlob(name string, content []byte) (*CacheMeta, error) {
+	return s.runMeta("put", name, func(ctx context.Context) (*CacheMeta, error) {
+		if ctxStore, ok := s.BlobStore.(ContextBlobStore); ok {
+			return ctxStore.PutBlobCtx(ctx, name, content)
+		}
+		return s.BlobStore.PutBlob(name, content)
+	})
+}
+
+func (s *TimeoutBlobStore) DeleteBlob(name string) (*CacheMeta, error) {
+	return s.runMeta("delete", name, func(ctx context.Context) (*CacheMeta, error) {
+		if ctxStore, ok := s.BlobStore.(ContextBlobStore); ok {
+			return ctxStore.DeleteBlobCtx(ctx, name)
+		}
+		return s.BlobStore.DeleteBlob(name)
+	})
+}
+
+// ListBlobs lists the names of the wrapped store within the timeout.  It
+// fails with ListUnsupported if the wrapped store is not a ListableBlobStore.
+func (s *TimeoutBlobStore) ListBlobs(prefix string) ([]string, error) {
+	listStore, ok := s.BlobStore.(ListableBlobStore)
+	if !ok {
+		return nil, ListUnsupported(fmt.Sprintf("%T", s.BlobStore))
+	}
+	lists := make(chan []string, 1)
+	err := s.run("list", prefix, func(ctx context.Context) error {
+		names, err := listStore.ListBlobs(prefix)
+		lists <- names
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return <-lists, nil
+}
+
+// StatBlob gets the cache metadata of a blob from the wrapped store within
+// the timeout.  If the wrapped store cannot stat, the blob is got instead.
+func (s *TimeoutBlobStore) StatBlob(name string) (*CacheMeta, error) {
+	statStore, ok := s.BlobStore.(StatBlobStore)
+	if !ok {
+		_, meta, err := s.GetBlob(name)
+		return meta, err
+	}
+	return s.runMeta("stat", name, func(ctx context.Context) (*CacheMeta, error) {
+		return statStore.StatBlob(name)
+	})
+}
+
+// PutBlobWithMetadata puts a blob and its metadata within the timeout.  If
+// the wrapped store is not a MetadataBlobStore, the metadata is dropped.
+func (s *TimeoutBlobStore) PutBlobWithMetadata(name string, content []byte, metadata map[string]string) (*CacheMeta, error) {
+	metaStore, ok := s.BlobStore.(MetadataBlobStore)
+	if !ok {
+		return s.PutBlob(name, content)
+	}
+	return s.runMeta("put", name, func(ctx context.Context) (*CacheMeta, error) {
+		return metaStore.PutBlobWithMetadata(name, content, metadata)
+	})
+}
+
+// PutBlobIfMatch puts a blob within the timeout only if the stored blob is
+// the version described by meta.  It fails with ConditionalUnsupported if the
+// wrapped store is not a ConditionalBlobStore.
+func (s *TimeoutBlobStore) PutBlobIfMatch(name string, content []byte, meta *CacheMeta) (*CacheMeta, error) {
+	conditionalStore, ok := s.BlobStore.(ConditionalBlobStore)
+	if !ok {
+		return nil, ConditionalUnsupported(fmt.Sprintf("%T", s.BlobStore))
+	}
+	return s.runMeta("put", name, func(ctx context.Context) (*CacheMeta, error) {
+		return conditionalStore.PutBlobIfMatch(name, content, meta)
+	})
+}
+
+// PutBlobIfMatchWithMetadata puts a blob and its metadata within the timeout
+// only if the stored blob is the version described by meta.  It fails with
+// ConditionalUnsupported if the wrapped store is not a
+// ConditionalMetadataBlobStore.
+func (s *TimeoutBlobStore) PutBlobIfMatchWithMetadata(name string, content []byte, meta *CacheMeta, metadata map[string]string) (*CacheMeta, error) {
+	conditionalStore, ok := s.BlobStore.(ConditionalMetadataBlobStore)
+	if !ok {
+		return nil, ConditionalUnsupported(fmt.Sprintf("%T", s.BlobStore))
+	}
+	return s.runMeta("put", name, func(ctx context.Context) (*CacheMeta, error) {
+		return conditionalStore.PutBlobIfMatchWithMetadata(name, content, meta, metadata)
+	})
+}
+
+// GetBlobs gets several blobs within the timeout if the wrapped store is a
+// BatchBlobStore, in which case a timeout names the first blob.  Otherwise
+// each blob is got within its own timeout, failing as part of the
+// *BatchError.
+func (s *TimeoutBlobStore) GetBlobs(names []string) ([][]byte, []*CacheMeta, error) {
+	batchStore, ok := s.BlobStore.(BatchBlobStore)
+	if !ok {
+		contents := make([][]byte, len(names))
+		metas := make([]*CacheMeta, len(names))
+		errs := make([]error, len(names))
+		for i, name := range names {
+			contents[i], metas[i], errs[i] = s.GetBlob(name)
+		}
+		return contents, metas, batchErr(names, errs)
+	}
+	if len(names) == 0 {
+		return batchStore.GetBlobs(names)
+	}
+	type result struct {
+		Contents [][]byte
+		Metas    []*CacheMeta
+		Err      error
+	}
+	results := make(chan result, 1)
+	err := s.run("get", names[0], func(ctx context.Context) error {
+		var r result
+		r.Contents, r.Metas, r.Err = batchStore.GetBlobs(names)
+		results <- r
+		// Blobs failing individually are not a failure of the operation
+		if _, isBatch := r.Err.(*BatchError); isBatch {
+			return nil
+		}
+		return r.Err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	r := <-results
+	return r.Contents, r.Metas, r.Err
+}
@@ -0,0 +1,85 @@
+// Instrumentation hooks for pushing operation counts and latencies to a
+// metrics system
+package metrics
+
+import (
+	"time"
+)
+
+// Metric names of instrumented operations
+const (
+	METRIC_ADD_APP           = "add_app"
+	METRIC_SIGN_JWT          = "sign_jwt"
+	METRIC_GET_INSTALL_TOKEN = "get_install_token"
+)
+
+// Counter names of install token caching.  METRIC_INSTALL_TOKEN_CACHE is
+// tagged with TAG_CACHE, while METRIC_MINT_INSTALL_TOKEN counts every install
+// token newly provisioned.
+const (
+	METRIC_INSTALL_TOKEN_CACHE = "install_token_cache"
+	METRIC_MINT_INSTALL_TOKEN  = "mint_install_token"
+)
+
+// METRIC_SIGN_JWT_ERROR counts failures to sign JWTs tagged with TAG_CODE,
+// by services able to classify errors
+const METRIC_SIGN_JWT_ERROR = "sign_jwt_error"
+
+// TAG_CODE is the name of the tag recording the machine-readable code of an
+// error
+const TAG_CODE = "code"
+
+// TAG_CACHE is the name of the tag recording how a cached resource was used,
+// one of CACHE_HIT, CACHE_MISS or CACHE_REFRESH
+const TAG_CACHE = "cache"
+
+const (
+	CACHE_HIT     = "hit"     // A valid cached resource was used
+	CACHE_MISS    = "miss"    // No resource was cached
+	CACHE_REFRESH = "refresh" // A cached resource was expired or about to expire
+)
+
+// TAG_RESULT is the name of the tag recording the outcome of an operation,
+// either RESULT_SUCCESS or RESULT_ERROR
+const TAG_RESULT = "result"
+
+const (
+	RESULT_SUCCESS = "success"
+	RESULT_ERROR   = "error"
+)
+
+// Tag is a name/value dimension of a metric
+type Tag struct {
+	Name  string
+	Value string
+}
+
+// Metrics receives measurements of operations.  Implementations must be safe
+// for concurrent use.
+type Metrics interface {
+	IncrCounter(name string, tags ...Tag)
+	ObserveLatency(name string, d time.Duration)
+}
+
+// NopMetrics discards all measurements
+type NopMetrics struct{}
+
+var _ Metrics = NopMetrics{}
+
+func (NopMetrics) IncrCounter(name string, tags ...Tag) {}
+
+func (NopMetrics) ObserveLatency(name string, d time.Duration) {}
+
+// Record counts an operation begun at start, tagged with its result according
+// to err, and observes its latency.  Nothing is recorded if m is nil.
+func Record(m Metrics, name string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	result := RESULT_SUCCESS
+	if err != nil {
+		result = RESULT_ERROR
+	}
+	m.IncrCounter(name, Tag{TAG_RESULT, result})
+	m.ObserveLatency(name, time.Since(start))
+}
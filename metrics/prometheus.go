@@ -0,0 +1,164 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DEFAULT_LATENCY_BUCKETS are the upper bounds in seconds of the latency
+// histogram buckets of a Registry unless configured otherwise
+var DEFAULT_LATENCY_BUCKETS = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Registry is Metrics held in memory and served by ServeHTTP in the
+// Prometheus text exposition format.  Counters are exposed as
+// <name>_total with their tags as labels, and latencies as the histogram
+// <name>_duration_seconds.  It is safe for concurrent use.
+type Registry struct {
+	Namespace  string    // Prefix of exposed metric names, joined by an underscore, if set
+	Buckets    []float64 // Upper bounds of latency buckets in seconds; defaults to DEFAULT_LATENCY_BUCKETS
+	mu         sync.Mutex
+	counters   map[string]map[string]uint64 // Counts by name and rendered labels
+	histograms map[string]*histogram
+}
+
+var _ Metrics = &Registry{}
+var _ http.Handler = &Registry{}
+
+// histogram counts observations in buckets, the last being +Inf
+type histogram struct {
+	bounds []float64
+	counts []uint64
+	sum    float64
+}
+
+func (r *Registry) IncrCounter(name string, tags ...Tag) {
+	labels := renderLabels(tags)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.counters == nil {
+		r.counters = make(map[string]map[string]uint64)
+	}
+	if r.counters[name] == nil {
+		r.counters[name] = make(map[string]uint64)
+	}
+	r.counters[name][labels]++
+}
+
+func (r *Registry) ObserveLatency(name string, d time.Duration) {
+	seconds := d.Seconds()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.histograms == nil {
+		r.histograms = make(map[string]*histogram)
+	}
+	h := r.histograms[name]
+	if h == nil {
+		bounds := r.Buckets
+		if len(bounds) == 0 {
+			bounds = DEFAULT_LATENCY_BUCKETS
+		}
+		h = &histogram{
+			bounds: bounds,
+			counts: make([]uint64, len(bounds)+1),
+		}
+		r.histograms[name] = h
+	}
+	i := sort.SearchFloat64s(h.bounds, seconds)
+	h.counts[i]++
+	h.sum += seconds
+}
+
+// ServeHTTP writes the metrics recorded so far
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WriteTo(w)
+}
+
+// WriteTo writes the metrics recorded so far in the Prometheus text
+// exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	r.mu.Lock()
+	counterNames := make([]string, 0, len(r.counters))
+	for name := range r.counters {
+		counterNames = append(counterNames, name)
+	}
+	sort.Strings(counterNames)
+	for _, name := range counterNames {
+		metric := r.metricName(name) + "_total"
+		fmt.Fprintf(&b, "# TYPE %s counter\n", metric)
+		series := r.counters[name]
+		labelSets := make([]string, 0, len(series))
+		for labels := range series {
+			labelSets = append(labelSets, labels)
+		}
+		sort.Strings(labelSets)
+		for _, labels := range labelSets {
+			fmt.Fprintf(&b, "%s%s %d\n", metric, labels, series[labels])
+		}
+	}
+	histogramNames := make([]string, 0, len(r.histograms))
+	for name := range r.histograms {
+		histogramNames = append(histogramNames, name)
+	}
+	sort.Strings(histogramNames)
+	for _, name := range histogramNames {
+		metric := r.metricName(name) + "_duration_seconds"
+		h := r.histograms[name]
+		fmt.Fprintf(&b, "# TYPE %s histogram\n", metric)
+		var cumulative uint64
+		for i, count := range h.counts {
+			cumulative += count
+			le := "+Inf"
+			if i < len(h.bounds) {
+				le = fmt.Sprintf("%g", h.bounds[i])
+			}
+			fmt.Fprintf(&b, "%s_bucket{le=%q} %d\n", metric, le, cumulative)
+		}
+		fmt.Fprintf(&b, "%s_sum %g\n", metric, h.sum)
+		fmt.Fprintf(&b, "%s_count %d\n", metric, cumulative)
+	}
+	r.mu.Unlock()
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// metricName gets the exposed name of a metric, with the Namespace and any
+// characters Prometheus does not allow replaced by underscores
+func (r *Registry) metricName(name string) string {
+	if r.Namespace != "" {
+		name = r.Namespace + "_" + name
+	}
+	return sanitizeName(name)
+}
+
+func sanitizeName(name string) string {
+	return strings.Map(func(c rune) rune {
+		if c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+			return c
+		}
+		return '_'
+	}, name)
+}
+
+// renderLabels formats tags as Prometheus labels sorted by name, or "" if
+// there are none
+func renderLabels(tags []Tag) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	sorted := make([]Tag, len(tags))
+	copy(sorted, tags)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	pairs := make([]string, len(sorted))
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	for i, tag := range sorted {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, sanitizeName(tag.Name), escaper.Replace(tag.Value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
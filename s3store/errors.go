@@ -0,0 +1,100 @@
+package s3store
+
+import (
+	"fmt"
+
+	"github.com/aefalcon/go-github-keystore/messagestore"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// NoSuchObject is an S3 error indicating the object of a blob does not exist.
+// It is recognized by messagestore.IsNotFound while remaining an awserr.Error.
+type NoSuchObject struct {
+	Name  string
+	Cause awserr.Error
+}
+
+var _ awserr.Error = &NoSuchObject{}
+
+func (e *NoSuchObject) Error() string {
+	return e.Cause.Error()
+}
+
+func (e *NoSuchObject) Code() string {
+	return e.Cause.Code()
+}
+
+func (e *NoSuchObject) Message() string {
+	return e.Cause.Message()
+}
+
+func (e *NoSuchObject) OrigErr() error {
+	return e.Cause
+}
+
+func (e *NoSuchObject) NotFound() bool {
+	return true
+}
+
+// notFoundCodes are the error codes of S3 for missing objects; HEAD requests
+// have no body and so report only NotFound
+var notFoundCodes = map[string]bool{
+	s3.ErrCodeNoSuchKey: true,
+	"NotFound":          true,
+}
+
+// translateNotFound replaces an S3 error for a missing object with a
+// *NoSuchObject, leaving other errors unchanged
+func translateNotFound(name string, err error) error {
+	if aerr, ok := err.(awserr.Error); ok && notFoundCodes[aerr.Code()] {
+		return &NoSuchObject{
+			Name:  name,
+			Cause: aerr,
+		}
+	}
+	return err
+}
+
+// conflictCodes are the error codes of S3 for failed conditional writes
+var conflictCodes = map[string]bool{
+	"PreconditionFailed":         true,
+	"ConditionalRequestConflict": true,
+}
+
+// translateConflict replaces an S3 error for a failed conditional write with
+// a messagestore.WriteConflict, leaving other errors unchanged
+func translateConflict(name string, err error) error {
+	if aerr, ok := err.(awserr.Error); ok && conflictCodes[aerr.Code()] {
+		return messagestore.WriteConflict(name)
+	}
+	return err
+}
+
+// NoSuchBucket is an error indicating the bucket of a store does not exist.
+// It may be converted to string to get the bucket.
+type NoSuchBucket string
+
+func (e NoSuchBucket) Error() string {
+	return fmt.Sprintf("bucket %s does not exist", string(e))
+}
+
+// InvalidLocationURI is an error indicating a URI does not describe an S3
+// location
+type InvalidLocationURI struct {
+	URI     string
+	Message string
+}
+
+func (e *InvalidLocationURI) Error() string {
+	return fmt.Sprintf("invalid S3 location %s: %s", e.URI, e.Message)
+}
+
+// UnreadableStorageClass is an error indicating a storage class was
+// configured whose objects cannot be read without first being restored.  It
+// may be converted to string to get the storage class.
+type UnreadableStorageClass string
+
+func (e UnreadableStorageClass) Error() string {
+	return fmt.Sprintf("objects of storage class %s cannot be read without restoring them", string(e))
+}
@@ -0,0 +1,93 @@
+package s3store
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aefalcon/github-keystore-protobuf/go/locationpb"
+)
+
+// LOCATION_SCHEME is the scheme of URIs of S3 locations
+const LOCATION_SCHEME = "s3"
+
+// S3Location creates the location of objects in a bucket under a key prefix
+func S3Location(bucket, region, prefix string) *locationpb.Location {
+	return &locationpb.Location{
+		Location: &locationpb.Location_S3{
+			S3: &locationpb.S3Ref{
+				Bucket: bucket,
+				Key:    prefix,
+				Region: region,
+			},
+		},
+	}
+}
+
+// ParseLocationURI parses an S3 location from a URI such as
+// "s3://bucket/prefix".  The region may be given by a region query parameter,
+// as in "s3://bucket/prefix?region=us-east-1".  The path is the key prefix,
+// without its leading slash.
+func ParseLocationURI(uri string) (*locationpb.Location, error) {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return nil, &InvalidLocationURI{
+			URI:     uri,
+			Message: err.Error(),
+		}
+	}
+	if parsed.Scheme != LOCATION_SCHEME {
+		return nil, &InvalidLocationURI{
+			URI:     uri,
+			Message: "scheme must be " + LOCATION_SCHEME,
+		}
+	}
+	if parsed.Host == "" {
+		return nil, &InvalidLocationURI{
+			URI:     uri,
+			Message: "no bucket",
+		}
+	}
+	region := parsed.Query().Get("region")
+	return S3Location(parsed.Host, region, strings.TrimPrefix(parsed.Path, "/")), nil
+}
+
+// LocationURIOptions gets the options of a store of an S3 location URI, as
+// parsed by ParseLocationURI, for stores of S3 compatible services.  The
+// endpoint query parameter gives the Endpoint and a path_style parameter of
+// true addresses buckets by path, as in
+// "s3://bucket/prefix?endpoint=https://minio.example.com:9000".  Options
+// retry with the DefaultRetryPolicy, as NewS3BlobStore does.
+func LocationURIOptions(uri string) (S3BlobStoreOptions, error) {
+	opts := S3BlobStoreOptions{
+		Retry: DefaultRetryPolicy,
+	}
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return opts, &InvalidLocationURI{
+			URI:     uri,
+			Message: err.Error(),
+		}
+	}
+	query := parsed.Query()
+	opts.Endpoint = query.Get("endpoint")
+	if opts.Endpoint != "" {
+		endpoint, err := url.Parse(opts.Endpoint)
+		if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+			return opts, &InvalidLocationURI{
+				URI:     uri,
+				Message: "endpoint must be an absolute URL",
+			}
+		}
+	}
+	if pathStyle := query.Get("path_style"); pathStyle != "" {
+		opts.PathStyle, err = strconv.ParseBool(pathStyle)
+		if err != nil {
+			return opts, &InvalidLocationURI{
+				URI:     uri,
+				Message: "path_style must be a boolean",
+			}
+		}
+	}
+	return opts, nil
+}
@@ -0,0 +1,104 @@
+package s3store
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// RetryPolicy configures retrying of requests failing with transient errors.
+// Delays between attempts grow exponentially with full jitter.
+type RetryPolicy struct {
+	MaxAttempts int           // Attempts including the first; 1 or less disables retries
+	BaseDelay   time.Duration // Upper bound of the delay before the first retry, doubled for each further retry
+	MaxDelay    time.Duration // Upper bound of any delay between attempts
+}
+
+// DefaultRetryPolicy is the retry policy of stores made by NewS3BlobStore
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	BaseDelay:   50 * time.Millisecond,
+	MaxDelay:    2 * time.Second,
+}
+
+// retryableCodes are the error codes of transient S3 failures
+var retryableCodes = map[string]bool{
+	"InternalError":        true,
+	"RequestTimeout":       true,
+	"ServiceUnavailable":   true,
+	"SlowDown":             true,
+	"Throttling":           true,
+	"ThrottlingException":  true,
+	"RequestThrottled":     true,
+	"RequestLimitExceeded": true,
+	"TooManyRequests":      true,
+}
+
+// IsRetryableCode determines if an S3 error code is of a transient failure
+func IsRetryableCode(code string) bool {
+	return retryableCodes[code]
+}
+
+// isRetryable determines if an error from S3 is transient
+func isRetryable(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	if retryableCodes[aerr.Code()] {
+		return true
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		status := reqErr.StatusCode()
+		return status >= http.StatusInternalServerError || status == http.StatusTooManyRequests
+	}
+	return false
+}
+
+// delay gets the randomized delay before a retry, where retry is 0 for the
+// first retry
+func (p *RetryPolicy) delay(retry int) time.Duration {
+	maxDelay := p.BaseDelay
+	for i := 0; i < retry && maxDelay < p.MaxDelay; i++ {
+		maxDelay *= 2
+	}
+	if p.MaxDelay > 0 && maxDelay > p.MaxDelay {
+		maxDelay = p.MaxDelay
+	}
+	if maxDelay <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(maxDelay) + 1))
+}
+
+// do calls op as Do does, retrying errors of version 1 of the SDK which are
+// transient
+func (p *RetryPolicy) do(ctx context.Context, op func() error) error {
+	return p.Do(ctx, isRetryable, op)
+}
+
+// Do calls op until it succeeds, fails with an error that is not retryable,
+// the attempts are exhausted or the next attempt would begin after the
+// deadline of ctx.  The last error is returned.
+func (p *RetryPolicy) Do(ctx context.Context, retryable func(error) bool, op func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= p.MaxAttempts || !retryable(err) {
+			return err
+		}
+		delay := p.delay(attempt - 1)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			return err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,353 @@
+// In memory fake of the S3 API used by s3store, for testing stores without a
+// bucket or network access.  The client counts its requests and can be
+// programmed to fail.
+package s3test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// DEFAULT_MAX_KEYS is the number of keys listed per page unless a request
+// asks for fewer, as S3 lists them
+const DEFAULT_MAX_KEYS = 1000
+
+// Object is an object held by a Client
+type Object struct {
+	Content      []byte
+	ETag         string // Quoted MD5 of the content, as S3 gives for unencrypted objects
+	Metadata     map[string]string
+	Tags         map[string]string
+	StorageClass string
+	LastModified time.Time
+	VersionId    string // Version of objects put while Versioned; empty otherwise
+}
+
+// Client is a fake S3 client holding the objects of its buckets in memory.
+// It may be used as the Client of an s3store.S3BlobStore.  Requests of a
+// bucket which was not created fail with a NoSuchBucket error.  Conditional
+// puts are supported.  It is safe for concurrent use.
+type Client struct {
+	Clock     func() time.Time // Time objects are modified at; defaults to time.Now
+	Versioned bool             // Give each put object a new version ID, as a versioned bucket does
+	Errs      []error          // Errors of successive requests; nil entries succeed
+	Err       error            // Error of requests beyond Errs, if set
+	mu        sync.Mutex
+	calls     int
+	versions  uint64
+	bkts      map[string]map[string]*Object
+}
+
+// NewClient allocates a client with empty buckets
+func NewClient(buckets ...string) *Client {
+	var c Client
+	for _, bucket := range buckets {
+		c.CreateBucket(bucket)
+	}
+	return &c
+}
+
+// CreateBucket creates an empty bucket if it does not exist
+func (c *Client) CreateBucket(bucket string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.bkts == nil {
+		c.bkts = make(map[string]map[string]*Object)
+	}
+	if _, found := c.bkts[bucket]; !found {
+		c.bkts[bucket] = make(map[string]*Object)
+	}
+}
+
+// Object gets a copy of an object, or nil if it does not exist
+func (c *Client) Object(bucket, key string) *Object {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	object, found := c.bkts[bucket][key]
+	if !found {
+		return nil
+	}
+	objectCopy := *object
+	return &objectCopy
+}
+
+// Keys gets the sorted keys of the objects of a bucket
+func (c *Client) Keys(bucket string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return sortedKeys(c.bkts[bucket], "", "")
+}
+
+// Calls gets the number of requests made, including failures
+func (c *Client) Calls() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls
+}
+
+// begin counts a request, returning the objects of its bucket.  The client
+// must be locked.
+func (c *Client) begin(ctx aws.Context, bucket *string) (map[string]*Object, error) {
+	c.calls++
+	if ctx != nil && ctx.Err() != nil {
+		return nil, awserr.New(request.CanceledErrorCode, "request context canceled", ctx.Err())
+	}
+	if c.calls <= len(c.Errs) && c.Errs[c.calls-1] != nil {
+		return nil, c.Errs[c.calls-1]
+	} else if c.calls > len(c.Errs) && c.Err != nil {
+		return nil, c.Err
+	}
+	objects, found := c.bkts[aws.StringValue(bucket)]
+	if !found {
+		return nil, requestFailure(s3.ErrCodeNoSuchBucket, http.StatusNotFound, "The specified bucket does not exist")
+	}
+	return objects, nil
+}
+
+func (c *Client) now() time.Time {
+	if c.Clock == nil {
+		return time.Now().UTC()
+	}
+	return c.Clock()
+}
+
+// requestFailure creates an error of a failed S3 request
+func requestFailure(code string, status int, message string) error {
+	return awserr.NewRequestFailure(awserr.New(code, message, nil), status, "")
+}
+
+// versionId gets the version ID S3 reports for an object, which is absent
+// for objects of unversioned buckets
+func versionId(object *Object) *string {
+	if object.VersionId == "" {
+		return nil
+	}
+	return aws.String(object.VersionId)
+}
+
+func noSuchKey() error {
+	return requestFailure(s3.ErrCodeNoSuchKey, http.StatusNotFound, "The specified key does not exist.")
+}
+
+// sortedKeys gets the sorted keys of objects beginning with prefix and after
+// the key after
+func sortedKeys(objects map[string]*Object, prefix, after string) []string {
+	keys := make([]string, 0)
+	for key := range objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (c *Client) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	objects, err := c.begin(ctx, input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	object, found := objects[aws.StringValue(input.Key)]
+	if !found {
+		return nil, noSuchKey()
+	}
+	return &s3.GetObjectOutput{
+		Body:          ioutil.NopCloser(bytes.NewReader(object.Content)),
+		ContentLength: aws.Int64(int64(len(object.Content))),
+		ETag:          aws.String(object.ETag),
+		LastModified:  aws.Time(object.LastModified),
+		Metadata:      aws.StringMap(object.Metadata),
+		StorageClass:  aws.String(object.StorageClass),
+		VersionId:     versionId(object),
+	}, nil
+}
+
+func (c *Client) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	objects, err := c.begin(ctx, input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	object, found := objects[aws.StringValue(input.Key)]
+	if !found {
+		// HEAD responses have no body, so S3 gives only the status
+		return nil, requestFailure("NotFound", http.StatusNotFound, "Not Found")
+	}
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(object.Content))),
+		ETag:          aws.String(object.ETag),
+		LastModified:  aws.Time(object.LastModified),
+		Metadata:      aws.StringMap(object.Metadata),
+		StorageClass:  aws.String(object.StorageClass),
+		VersionId:     versionId(object),
+	}, nil
+}
+
+func (c *Client) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	objects, err := c.begin(ctx, input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	key := aws.StringValue(input.Key)
+	current, found := objects[key]
+	if input.IfNoneMatch != nil && found {
+		return nil, requestFailure("PreconditionFailed", http.StatusPreconditionFailed, "At least one of the pre-conditions you specified did not hold")
+	}
+	if input.IfMatch != nil && (!found || current.ETag != *input.IfMatch) {
+		if !found {
+			return nil, noSuchKey()
+		}
+		return nil, requestFailure("PreconditionFailed", http.StatusPreconditionFailed, "At least one of the pre-conditions you specified did not hold")
+	}
+	var content []byte
+	if input.Body != nil {
+		content, err = ioutil.ReadAll(input.Body)
+		if err != nil {
+			return nil, awserr.New(request.ErrCodeRequestError, "failed to read request body", err)
+		}
+	}
+	sum := md5.Sum(content)
+	object := Object{
+		Content:      content,
+		ETag:         fmt.Sprintf(`"%s"`, hex.EncodeToString(sum[:])),
+		StorageClass: aws.StringValue(input.StorageClass),
+		LastModified: c.now(),
+	}
+	if object.StorageClass == "" {
+		object.StorageClass = s3.StorageClassStandard
+	}
+	if len(input.Metadata) != 0 {
+		object.Metadata = aws.StringValueMap(input.Metadata)
+	}
+	if input.Tagging != nil {
+		query, err := url.ParseQuery(*input.Tagging)
+		if err != nil {
+			return nil, requestFailure("InvalidTag", http.StatusBadRequest, err.Error())
+		}
+		object.Tags = make(map[string]string, len(query))
+		for k := range query {
+			object.Tags[k] = query.Get(k)
+		}
+	}
+	if c.Versioned {
+		c.versions++
+		object.VersionId = fmt.Sprintf("v%d", c.versions)
+	}
+	objects[key] = &object
+	return &s3.PutObjectOutput{
+		ETag:      aws.String(object.ETag),
+		VersionId: versionId(&object),
+	}, nil
+}
+
+// GetObjectTaggingWithContext gets the tags of an object in key order
+func (c *Client) GetObjectTaggingWithContext(ctx aws.Context, input *s3.GetObjectTaggingInput, opts ...request.Option) (*s3.GetObjectTaggingOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	objects, err := c.begin(ctx, input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	object, found := objects[aws.StringValue(input.Key)]
+	if !found {
+		return nil, noSuchKey()
+	}
+	keys := make([]string, 0, len(object.Tags))
+	for k := range object.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	output := s3.GetObjectTaggingOutput{
+		TagSet: make([]*s3.Tag, 0, len(keys)),
+	}
+	for _, k := range keys {
+		output.TagSet = append(output.TagSet, &s3.Tag{
+			Key:   aws.String(k),
+			Value: aws.String(object.Tags[k]),
+		})
+	}
+	return &output, nil
+}
+
+// DeleteObjectWithContext deletes an object.  Deleting a missing object
+// succeeds, as it does with S3.
+func (c *Client) DeleteObjectWithContext(ctx aws.Context, input *s3.DeleteObjectInput, opts ...request.Option) (*s3.DeleteObjectOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	objects, err := c.begin(ctx, input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	delete(objects, aws.StringValue(input.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (c *Client) HeadBucketWithContext(ctx aws.Context, input *s3.HeadBucketInput, opts ...request.Option) (*s3.HeadBucketOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.begin(ctx, input.Bucket); err != nil {
+		return nil, err
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+// ListObjectsV2WithContext lists a page of the objects of a bucket in key
+// order.  Continuation tokens are the last key of the previous page.
+func (c *Client) ListObjectsV2WithContext(ctx aws.Context, input *s3.ListObjectsV2Input, opts ...request.Option) (*s3.ListObjectsV2Output, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	objects, err := c.begin(ctx, input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	after := aws.StringValue(input.StartAfter)
+	if input.ContinuationToken != nil {
+		after = *input.ContinuationToken
+	}
+	keys := sortedKeys(objects, aws.StringValue(input.Prefix), after)
+	maxKeys := int(aws.Int64Value(input.MaxKeys))
+	if maxKeys <= 0 || maxKeys > DEFAULT_MAX_KEYS {
+		maxKeys = DEFAULT_MAX_KEYS
+	}
+	output := s3.ListObjectsV2Output{
+		ContinuationToken: input.ContinuationToken,
+		IsTruncated:       aws.Bool(len(keys) > maxKeys),
+		MaxKeys:           aws.Int64(int64(maxKeys)),
+		Prefix:            input.Prefix,
+	}
+	if len(keys) > maxKeys {
+		keys = keys[:maxKeys]
+		output.NextContinuationToken = aws.String(keys[len(keys)-1])
+	}
+	for _, key := range keys {
+		object := objects[key]
+		output.Contents = append(output.Contents, &s3.Object{
+			ETag:         aws.String(object.ETag),
+			Key:          aws.String(key),
+			LastModified: aws.Time(object.LastModified),
+			Size:         aws.Int64(int64(len(object.Content))),
+			StorageClass: aws.String(object.StorageClass),
+		})
+	}
+	output.KeyCount = aws.Int64(int64(len(output.Contents)))
+	return &output, nil
+}
@@ -2,50 +2,349 @@ package s3store
 
 import (
 	"bytes"
+	"context"
+	"io"
 	"io/ioutil"
+	"net/url"
 	"path"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aefalcon/github-keystore-protobuf/go/locationpb"
+	"github.com/aefalcon/go-github-keystore/kslog"
 	"github.com/aefalcon/go-github-keystore/messagestore"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
+// DEFAULT_BATCH_WORKERS is the number of concurrent requests made by GetBlobs
+// unless configured otherwise
+const DEFAULT_BATCH_WORKERS = 8
+
+// S3API is the part of the S3 client used by an S3BlobStore, satisfied by
+// *s3.S3 and by fakes such as s3test.Client
+type S3API interface {
+	GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error)
+	HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error)
+	PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error)
+	DeleteObjectWithContext(ctx aws.Context, input *s3.DeleteObjectInput, opts ...request.Option) (*s3.DeleteObjectOutput, error)
+	HeadBucketWithContext(ctx aws.Context, input *s3.HeadBucketInput, opts ...request.Option) (*s3.HeadBucketOutput, error)
+	ListObjectsV2WithContext(ctx aws.Context, input *s3.ListObjectsV2Input, opts ...request.Option) (*s3.ListObjectsV2Output, error)
+}
+
+var _ S3API = &s3.S3{}
+
 type S3BlobStore struct {
-	Client   *s3.S3
-	Location locationpb.S3Ref
+	Client       S3API
+	Location     locationpb.S3Ref
+	BatchWorkers int            // Concurrent requests of GetBlobs; defaults to DEFAULT_BATCH_WORKERS
+	Retry        RetryPolicy    // Retrying of transient errors getting, putting and deleting blobs
+	Encryption   Encryption     // Server side encryption of put objects
+	StorageClass string         // Storage class of put objects; STANDARD if empty
+	Fallbacks    []*S3BlobStore // Replicas from which blobs are got, in order, when getting fails with a transient error
+	FanOutWrites bool           // Puts and deletes are also made to the Fallbacks once made to this store
+	Tagger       ObjectTagger   // Tags of put objects, if set
+	TagExpires   bool           // Tag objects put with an expiration with EXPIRES_TAG, which needs s3:PutObjectTagging
+	RequestPayer string         // s3.RequestPayerRequester to pay for requests of a requester pays bucket; the bucket owner pays if empty
+	ACL          string         // Canned ACL of put objects, such as s3.ObjectCannedACLBucketOwnerFullControl; the bucket's default if empty
+	ContentType  string         // Content-Type of put objects; that given by their messagestore.CONTENT_TYPE_META, or S3's default, if empty
+	ctx          context.Context
+}
+
+// ObjectTagger gets the S3 object tags of the blob of a name, such as for
+// lifecycle rules to select objects by.  A nil or empty map puts the object
+// untagged.
+type ObjectTagger func(name string) map[string]string
+
+// DOCTYPE_TAG is the object tag of the type of document an object holds, set
+// by DocTypeTagger
+const DOCTYPE_TAG = "doctype"
+
+// DocTypeTagger creates an ObjectTagger tagging objects with the DOCTYPE_TAG
+// of the first of docTypes to recognize the name of their blob.  A docType
+// recognizes a name by giving a non-empty document type, such as
+// appkeystore.AppKeyStore.DocumentType.
+func DocTypeTagger(docTypes ...func(name string) string) ObjectTagger {
+	return func(name string) map[string]string {
+		for _, docType := range docTypes {
+			if t := docType(name); t != "" {
+				return map[string]string{DOCTYPE_TAG: t}
+			}
+		}
+		return nil
+	}
+}
+
+// EXPIRES_TAG is the object tag of when the content of an object expires, in
+// RFC 3339 format, set from the messagestore.EXPIRES_META metadata of put
+// blobs.  Lifecycle rules may select objects having it, such as to expire
+// short lived documents a day after they were last put.
+const EXPIRES_TAG = "expires"
+
+// copyTags gets a copy of object tags which may be modified
+func copyTags(tags map[string]string) map[string]string {
+	tagsCopy := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		tagsCopy[k] = v
+	}
+	return tagsCopy
+}
+
+// encodeTags encodes object tags as the query string of a put request
+func encodeTags(tags map[string]string) string {
+	values := make(url.Values, len(tags))
+	for k, v := range tags {
+		values.Set(k, v)
+	}
+	return values.Encode()
+}
+
+// Encryption configures server side encryption of objects
+type Encryption struct {
+	ServerSideEncryption string // s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms or empty for none
+	SSEKMSKeyId          string // KMS key of aws:kms encryption; the account default key if empty
+}
+
+// Credentials configures the AWS credentials of requests.  The zero value
+// uses the credentials of the default session.
+type Credentials struct {
+	Profile         string // Profile of the shared configuration; the default profile if empty
+	AccessKeyId     string // Static credentials used instead of those of the profile, if set
+	SecretAccessKey string
+	SessionToken    string
+	RoleArn         string // Role to assume with STS using the other credentials, if set
+	ExternalId      string // External ID required to assume the role, if any
+}
+
+// S3BlobStoreOptions configures stores made by NewS3BlobStoreWithOptions
+type S3BlobStoreOptions struct {
+	Retry        RetryPolicy
+	Encryption   Encryption
+	Prefix       string // Prefix of object keys under the key of the location, for sharing a bucket
+	Credentials  Credentials
+	Endpoint     string             // URL of an S3 compatible endpoint, such as of MinIO or Ceph, addressed path style; AWS if empty
+	PathStyle    bool               // Address buckets by path rather than virtual host, as always with an Endpoint
+	StorageClass string             // Storage class of put objects, which must allow immediate reads; STANDARD if empty
+	Fallbacks    []locationpb.S3Ref // Replicas of the location, such as in other regions, read when it fails
+	FanOutWrites bool               // Puts and deletes are also made to the Fallbacks
+	Tagger       ObjectTagger       // Tags of put objects, if set
+	TagExpires   bool               // Tag objects put with an expiration with EXPIRES_TAG
+	RequestPayer string             // s3.RequestPayerRequester for a requester pays bucket; the bucket owner pays if empty
+	ACL          string             // Canned ACL of put objects; the bucket's default if empty
+	ContentType  string             // Content-Type of put objects; that given by their metadata if empty
+}
+
+// archiveStorageClasses are the storage classes whose objects must be
+// restored before they can be read
+var archiveStorageClasses = map[string]bool{
+	s3.StorageClassGlacier:     true,
+	s3.StorageClassDeepArchive: true,
 }
 
 var _ messagestore.BlobStore = &S3BlobStore{}
+var _ messagestore.MetadataBlobStore = &S3BlobStore{}
+var _ messagestore.ContextBlobStore = &S3BlobStore{}
+var _ messagestore.ListableBlobStore = &S3BlobStore{}
+var _ messagestore.StatBlobStore = &S3BlobStore{}
+var _ messagestore.BatchBlobStore = &S3BlobStore{}
+var _ messagestore.ConditionalMetadataBlobStore = &S3BlobStore{}
+var _ messagestore.PingableBlobStore = &S3BlobStore{}
+var _ messagestore.ExistenceDeleteBlobStore = &S3BlobStore{}
+var _ messagestore.CapableStore = &S3BlobStore{}
 
 func NewS3BlobStore(loc *locationpb.Location) (*S3BlobStore, error) {
+	return NewS3BlobStoreWithRetry(loc, DefaultRetryPolicy)
+}
+
+// NewS3BlobStoreWithRetry allocates an S3BlobStore retrying transient errors
+// according to retry
+func NewS3BlobStoreWithRetry(loc *locationpb.Location, retry RetryPolicy) (*S3BlobStore, error) {
+	return NewS3BlobStoreWithOptions(loc, S3BlobStoreOptions{Retry: retry})
+}
+
+// NewS3BlobStoreWithOptions allocates an S3BlobStore configured by opts.  A
+// KMS key without an encryption type implies aws:kms encryption.  Archive
+// storage classes are rejected with an UnreadableStorageClass error, since
+// blobs put in them could not be got.
+func NewS3BlobStoreWithOptions(loc *locationpb.Location, opts S3BlobStoreOptions) (*S3BlobStore, error) {
+	if archiveStorageClasses[opts.StorageClass] {
+		return nil, UnreadableStorageClass(opts.StorageClass)
+	}
+	if opts.Encryption.SSEKMSKeyId != "" && opts.Encryption.ServerSideEncryption == "" {
+		opts.Encryption.ServerSideEncryption = s3.ServerSideEncryptionAwsKms
+	}
 	loc_s3loc, ok := loc.Location.(*locationpb.Location_S3)
 	if !ok {
 		return nil, (*messagestore.UnsupportedLocation)(loc)
 	}
-	sess := session.Must(session.NewSession())
-	client := s3.New(sess, aws.NewConfig().WithRegion(loc_s3loc.S3.Region))
+	store, err := newS3BlobStore(*loc_s3loc.S3, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, fallback := range opts.Fallbacks {
+		fallbackStore, err := newS3BlobStore(fallback, opts)
+		if err != nil {
+			return nil, err
+		}
+		store.Fallbacks = append(store.Fallbacks, fallbackStore)
+	}
+	store.FanOutWrites = opts.FanOutWrites
+	return store, nil
+}
+
+// newS3BlobStore allocates an S3BlobStore of a single location configured by
+// opts, other than its fallbacks
+func newS3BlobStore(loc locationpb.S3Ref, opts S3BlobStoreOptions) (*S3BlobStore, error) {
+	config := aws.NewConfig().WithRegion(loc.Region)
+	if opts.Endpoint != "" {
+		config = config.WithEndpoint(opts.Endpoint)
+	}
+	if opts.Endpoint != "" || opts.PathStyle {
+		config = config.WithS3ForcePathStyle(true)
+	}
+	if opts.Retry.MaxAttempts > 0 {
+		// The SDK's own retries would multiply the attempts of the policy
+		config = config.WithMaxRetries(0)
+	}
+	sess, err := newSession(opts.Credentials, config)
+	if err != nil {
+		return nil, err
+	}
+	client := s3.New(sess, config)
+	location := loc
+	location.Key = KeyPrefix(path.Join(location.Key, opts.Prefix))
 	return &S3BlobStore{
-		Client:   client,
-		Location: *loc_s3loc.S3,
+		Client:       client,
+		Location:     location,
+		Retry:        opts.Retry,
+		Encryption:   opts.Encryption,
+		StorageClass: opts.StorageClass,
+		Tagger:       opts.Tagger,
+		TagExpires:   opts.TagExpires,
+		RequestPayer: opts.RequestPayer,
+		ACL:          opts.ACL,
+		ContentType:  opts.ContentType,
 	}, nil
 }
 
+// newSession creates an AWS session with credentials, adding the credentials
+// of an assumed role to config
+func newSession(creds Credentials, config *aws.Config) (*session.Session, error) {
+	if creds == (Credentials{}) {
+		return session.NewSession()
+	}
+	opts := session.Options{
+		Profile:           creds.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	}
+	opts.Config.Region = config.Region
+	if creds.AccessKeyId != "" {
+		opts.Config.Credentials = credentials.NewStaticCredentials(creds.AccessKeyId, creds.SecretAccessKey, creds.SessionToken)
+	}
+	sess, err := session.NewSessionWithOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if creds.RoleArn != "" {
+		config.Credentials = stscreds.NewCredentials(sess, creds.RoleArn, func(p *stscreds.AssumeRoleProvider) {
+			if creds.ExternalId != "" {
+				p.ExternalID = aws.String(creds.ExternalId)
+			}
+		})
+	}
+	return sess, nil
+}
+
+// WithContext gets a copy of the store whose requests without an explicit
+// context use ctx, so they are cancelled when ctx is done
+func (s *S3BlobStore) WithContext(ctx context.Context) *S3BlobStore {
+	storeCopy := *s
+	storeCopy.ctx = ctx
+	return &storeCopy
+}
+
+// context gets the context of requests made without an explicit context
+func (s *S3BlobStore) context() context.Context {
+	if s.ctx == nil {
+		return aws.BackgroundContext()
+	}
+	return s.ctx
+}
+
+// KeyPrefix normalizes the key of a location to a prefix of object keys.  The
+// prefix is empty for the bucket root and otherwise has a single trailing
+// slash.
+func KeyPrefix(key string) string {
+	prefix := strings.Trim(path.Clean("/"+key), "/")
+	if prefix == "" {
+		return ""
+	}
+	return prefix + "/"
+}
+
+// requestPayer gets the payer of requests, nil for the bucket owner
+func (s *S3BlobStore) requestPayer() *string {
+	if s.RequestPayer == "" {
+		return nil
+	}
+	return aws.String(s.RequestPayer)
+}
+
+// DocKey gets the object key of a name.  Names are cleaned so they cannot
+// refer to objects outside the key prefix of the location.
 func (s *S3BlobStore) DocKey(name string) string {
-	return path.Join(s.Location.Key, name)
+	return KeyPrefix(s.Location.Key) + strings.TrimPrefix(path.Clean("/"+name), "/")
 }
 
 func (s *S3BlobStore) GetBlob(name string) ([]byte, *messagestore.CacheMeta, error) {
+	return s.GetBlobCtx(s.context(), name)
+}
+
+// GetBlobCtx gets a blob.  If getting fails with a transient error, the blob
+// is got from each of the Fallbacks in turn until one does not; the error of
+// the last store tried is returned.
+func (s *S3BlobStore) GetBlobCtx(ctx context.Context, name string) ([]byte, *messagestore.CacheMeta, error) {
+	content, meta, err := s.getBlob(ctx, name)
+	for _, fallback := range s.Fallbacks {
+		if err == nil || !shouldFailOver(err) || ctx.Err() != nil {
+			break
+		}
+		content, meta, err = fallback.getBlob(ctx, name)
+	}
+	return content, meta, err
+}
+
+// shouldFailOver determines if an error getting a blob may not occur getting
+// it from a replica, being transient or a failure to reach S3
+func shouldFailOver(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == request.ErrCodeRequestError {
+		return true
+	}
+	return isRetryable(err)
+}
+
+// getBlob gets a blob from this store only
+func (s *S3BlobStore) getBlob(ctx context.Context, name string) ([]byte, *messagestore.CacheMeta, error) {
 	key := s.DocKey(name)
 	getInput := s3.GetObjectInput{
-		Bucket: &s.Location.Bucket,
-		Key:    &key,
+		Bucket:       &s.Location.Bucket,
+		Key:          &key,
+		RequestPayer: s.requestPayer(),
 	}
-	result, err := s.Client.GetObject(&getInput)
+	var result *s3.GetObjectOutput
+	err := s.Retry.do(ctx, func() error {
+		var err error
+		result, err = s.Client.GetObjectWithContext(ctx, &getInput)
+		return err
+	})
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, translateNotFound(name, err)
 	}
 	defer result.Body.Close()
 	content, err := ioutil.ReadAll(result.Body)
@@ -56,34 +355,243 @@ func (s *S3BlobStore) GetBlob(name string) ([]byte, *messagestore.CacheMeta, err
 		}
 		return nil, nil, &wrapErr
 	}
+	cacheMeta := objectCacheMeta(result.CacheControl, result.ETag, result.VersionId, result.Expires, result.LastModified, result.Metadata)
+	return content, cacheMeta, nil
+}
+
+// GetBlobs gets several blobs concurrently with at most BatchWorkers requests
+// in flight.  If some blobs fail, the error is a *messagestore.BatchError.
+func (s *S3BlobStore) GetBlobs(names []string) ([][]byte, []*messagestore.CacheMeta, error) {
+	contents := make([][]byte, len(names))
+	metas := make([]*messagestore.CacheMeta, len(names))
+	errs := make([]error, len(names))
+	workers := s.BatchWorkers
+	if workers <= 0 {
+		workers = DEFAULT_BATCH_WORKERS
+	}
+	if workers > len(names) {
+		workers = len(names)
+	}
+	ctx := s.context()
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				contents[i], metas[i], errs[i] = s.GetBlobCtx(ctx, names[i])
+			}
+		}()
+	}
+	for i := range names {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return contents, metas, &messagestore.BatchError{
+				Names:  names,
+				Errors: errs,
+			}
+		}
+	}
+	return contents, metas, nil
+}
+
+// objectCacheMeta creates cache metadata from the attributes of an S3 object.
+// The version is the version ID of objects of versioned buckets, and is left
+// empty otherwise so that CacheMeta.GetVersion gives the ETag.
+func objectCacheMeta(cacheControl, etag, versionId, expires *string, lastModified *time.Time, metadata map[string]*string) *messagestore.CacheMeta {
 	var cacheMeta messagestore.CacheMeta
-	if result.CacheControl != nil {
-		cacheMeta.CacheControl = *result.CacheControl
+	if cacheControl != nil {
+		cacheMeta.CacheControl = *cacheControl
 	}
-	if result.ETag != nil {
-		cacheMeta.ETag = *result.ETag
+	if etag != nil {
+		cacheMeta.ETag = *etag
 	}
-	if result.Expires != nil {
-		cacheMeta.Expires, err = time.Parse(time.RFC1123, *result.Expires)
+	cacheMeta.Version = objectVersion(versionId)
+	if expires != nil {
+		var err error
+		cacheMeta.Expires, err = time.Parse(time.RFC1123, *expires)
 		if err != nil {
-			cacheMeta.Expires, err = time.Parse(time.RFC1123Z, *result.Expires)
+			cacheMeta.Expires, _ = time.Parse(time.RFC1123Z, *expires)
 		}
 	}
-	if result.LastModified != nil {
-		cacheMeta.LastModified = *result.LastModified
+	if lastModified != nil {
+		cacheMeta.LastModified = *lastModified
+	}
+	if len(metadata) != 0 {
+		// S3 returns metadata keys in canonical header form
+		cacheMeta.Metadata = make(map[string]string, len(metadata))
+		for k, v := range metadata {
+			if v != nil {
+				cacheMeta.Metadata[strings.ToLower(k)] = *v
+			}
+		}
 	}
-	return content, &cacheMeta, nil
+	return &cacheMeta
+}
+
+// objectVersion gets the version of an object from its version ID.  Objects
+// put before versioning was enabled have the version ID "null", which does
+// not change with puts, so they have no version.
+func objectVersion(versionId *string) string {
+	if versionId == nil || *versionId == "null" {
+		return ""
+	}
+	return *versionId
+}
+
+// StatBlob gets the cache metadata of a blob without fetching its content
+func (s *S3BlobStore) StatBlob(name string) (*messagestore.CacheMeta, error) {
+	key := s.DocKey(name)
+	input := s3.HeadObjectInput{
+		Bucket:       &s.Location.Bucket,
+		Key:          &key,
+		RequestPayer: s.requestPayer(),
+	}
+	result, err := s.Client.HeadObjectWithContext(s.context(), &input)
+	if err != nil {
+		return nil, translateNotFound(name, err)
+	}
+	return objectCacheMeta(result.CacheControl, result.ETag, result.VersionId, result.Expires, result.LastModified, result.Metadata), nil
 }
 
 func (s *S3BlobStore) PutBlob(name string, content []byte) (*messagestore.CacheMeta, error) {
+	return s.PutBlobWithMetadataCtx(s.context(), name, content, nil)
+}
+
+func (s *S3BlobStore) PutBlobCtx(ctx context.Context, name string, content []byte) (*messagestore.CacheMeta, error) {
+	return s.PutBlobWithMetadataCtx(ctx, name, content, nil)
+}
+
+// PutBlobWithMetadata stores a blob with the metadata as S3 user metadata
+func (s *S3BlobStore) PutBlobWithMetadata(name string, content []byte, metadata map[string]string) (*messagestore.CacheMeta, error) {
+	return s.PutBlobWithMetadataCtx(s.context(), name, content, metadata)
+}
+
+// PutBlobWithMetadataCtx puts a blob with metadata.  With FanOutWrites, it is
+// then put to each of the Fallbacks, and the error of the first fallback
+// which fails is returned even though the blob was put to this store.
+func (s *S3BlobStore) PutBlobWithMetadataCtx(ctx context.Context, name string, content []byte, metadata map[string]string) (*messagestore.CacheMeta, error) {
+	key := s.DocKey(name)
+	putInput := s3.PutObjectInput{
+		Bucket: &s.Location.Bucket,
+		Key:    &key,
+	}
+	meta, err := s.putObject(ctx, name, bytes.NewReader(content), metadata, &putInput)
+	if err != nil || !s.FanOutWrites {
+		return meta, err
+	}
+	for _, fallback := range s.Fallbacks {
+		if _, err = fallback.PutBlobWithMetadataCtx(ctx, name, content, metadata); err != nil {
+			return nil, err
+		}
+	}
+	return meta, nil
+}
+
+// PutBlobIfMatch puts a blob only if the object has the ETag of meta, using
+// a conditional write of S3.  Since the ETags of replicas may differ, it is
+// never fanned out to the Fallbacks.
+func (s *S3BlobStore) PutBlobIfMatch(name string, content []byte, meta *messagestore.CacheMeta) (*messagestore.CacheMeta, error) {
+	return s.PutBlobIfMatchWithMetadata(name, content, meta, nil)
+}
+
+// PutBlobIfMatchWithMetadata puts a blob with user metadata only if the
+// object has the ETag of meta, as PutBlobIfMatch does
+func (s *S3BlobStore) PutBlobIfMatchWithMetadata(name string, content []byte, meta *messagestore.CacheMeta, metadata map[string]string) (*messagestore.CacheMeta, error) {
 	key := s.DocKey(name)
 	putInput := s3.PutObjectInput{
 		Bucket: &s.Location.Bucket,
 		Key:    &key,
-		Body:   bytes.NewReader(content),
 	}
-	result, err := s.Client.PutObject(&putInput)
+	if meta != nil && meta.ETag != "" {
+		putInput.IfMatch = aws.String(meta.ETag)
+	} else {
+		putInput.IfNoneMatch = aws.String("*")
+	}
+	return s.putObject(s.context(), name, bytes.NewReader(content), metadata, &putInput)
+}
+
+// contentType gets the Content-Type of an object put with metadata, being
+// the CONTENT_TYPE_META of the metadata unless overridden by the ContentType
+// of the store, and the metadata without CONTENT_TYPE_META, which is given as
+// the Content-Type rather than kept as user metadata
+func (s *S3BlobStore) contentType(metadata map[string]string) (string, map[string]string) {
+	contentType, found := metadata[messagestore.CONTENT_TYPE_META]
+	if found {
+		userMetadata := make(map[string]string, len(metadata))
+		for k, v := range metadata {
+			if k != messagestore.CONTENT_TYPE_META {
+				userMetadata[k] = v
+			}
+		}
+		metadata = userMetadata
+	}
+	if s.ContentType != "" {
+		contentType = s.ContentType
+	}
+	return contentType, metadata
+}
+
+// putObject puts the content read from body and metadata of a blob with
+// putInput.  The body is read from its start by each attempt.  An expiration
+// recorded in the metadata is also given as the Expires of the object, and
+// its EXPIRES_TAG with TagExpires.
+func (s *S3BlobStore) putObject(ctx context.Context, name string, body io.ReadSeeker, metadata map[string]string, putInput *s3.PutObjectInput) (*messagestore.CacheMeta, error) {
+	contentType, metadata := s.contentType(metadata)
+	if contentType != "" {
+		putInput.ContentType = aws.String(contentType)
+	}
+	if len(metadata) != 0 {
+		putInput.Metadata = aws.StringMap(metadata)
+	}
+	if s.Encryption.ServerSideEncryption != "" {
+		putInput.ServerSideEncryption = aws.String(s.Encryption.ServerSideEncryption)
+	}
+	if s.Encryption.SSEKMSKeyId != "" {
+		putInput.SSEKMSKeyId = aws.String(s.Encryption.SSEKMSKeyId)
+	}
+	if s.StorageClass != "" {
+		putInput.StorageClass = aws.String(s.StorageClass)
+	}
+	if s.ACL != "" {
+		putInput.ACL = aws.String(s.ACL)
+	}
+	putInput.RequestPayer = s.requestPayer()
+	var tags map[string]string
+	if s.Tagger != nil {
+		tags = s.Tagger(name)
+	}
+	if expires, ok := metadata[messagestore.EXPIRES_META]; ok {
+		if s.TagExpires {
+			tags = copyTags(tags)
+			tags[EXPIRES_TAG] = expires
+		}
+		if expiration, err := time.Parse(time.RFC3339, expires); err == nil {
+			putInput.Expires = &expiration
+		}
+	}
+	if len(tags) != 0 {
+		putInput.Tagging = aws.String(encodeTags(tags))
+	}
+	var result *s3.PutObjectOutput
+	var putTime time.Time
+	err := s.Retry.do(ctx, func() error {
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		var err error
+		putInput.Body = body
+		putTime = time.Now()
+		result, err = s.Client.PutObjectWithContext(ctx, putInput)
+		return err
+	})
 	if err != nil {
+		err = translateConflict(name, err)
 		wrapErr := messagestore.PutResourceError{
 			Name:  name,
 			Cause: err,
@@ -94,16 +602,45 @@ func (s *S3BlobStore) PutBlob(name string, content []byte) (*messagestore.CacheM
 	if result.ETag != nil {
 		cacheMeta.ETag = *result.ETag
 	}
+	cacheMeta.Version = objectVersion(result.VersionId)
+	// S3 does not report the modification time of a put; it is when the
+	// request was made, to the second as S3 reports it
+	cacheMeta.LastModified = putTime.UTC().Truncate(time.Second)
 	return &cacheMeta, err
 }
 
 func (s *S3BlobStore) DeleteBlob(name string) (*messagestore.CacheMeta, error) {
+	return s.DeleteBlobCtx(s.context(), name)
+}
+
+// DeleteBlobCtx deletes a blob.  With FanOutWrites, it is then deleted from
+// each of the Fallbacks, and the error of the first fallback which fails is
+// returned even though the blob was deleted from this store.
+func (s *S3BlobStore) DeleteBlobCtx(ctx context.Context, name string) (*messagestore.CacheMeta, error) {
+	meta, err := s.deleteBlob(ctx, name)
+	if err != nil || !s.FanOutWrites {
+		return meta, err
+	}
+	for _, fallback := range s.Fallbacks {
+		if _, err = fallback.DeleteBlobCtx(ctx, name); err != nil {
+			return nil, err
+		}
+	}
+	return meta, nil
+}
+
+// deleteBlob deletes a blob from this store only
+func (s *S3BlobStore) deleteBlob(ctx context.Context, name string) (*messagestore.CacheMeta, error) {
 	key := s.DocKey(name)
 	input := s3.DeleteObjectInput{
-		Bucket: &s.Location.Bucket,
-		Key:    &key,
+		Bucket:       &s.Location.Bucket,
+		Key:          &key,
+		RequestPayer: s.requestPayer(),
 	}
-	_, err := s.Client.DeleteObject(&input)
+	err := s.Retry.do(ctx, func() error {
+		_, err := s.Client.DeleteObjectWithContext(ctx, &input)
+		return err
+	})
 	if err != nil {
 		wrapErr := messagestore.DeleteResourceError{
 			Name:  name,
@@ -113,3 +650,85 @@ func (s *S3BlobStore) DeleteBlob(name string) (*messagestore.CacheMeta, error) {
 	}
 	return nil, err
 }
+
+// DeleteBlobExisted deletes a blob, reporting whether it existed.  Since S3
+// deletes succeed whether or not the object exists, it is checked for with
+// a HEAD request first; an object created concurrently may be deleted without
+// being reported.
+func (s *S3BlobStore) DeleteBlobExisted(name string) (bool, error) {
+	_, err := s.StatBlob(name)
+	if messagestore.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, &messagestore.GetResourceError{
+			Name:  name,
+			Cause: err,
+		}
+	}
+	_, err = s.DeleteBlob(name)
+	return err == nil, err
+}
+
+// Ping checks that the bucket exists and is accessible with a HEAD request.
+// Transient errors are not retried so an unreachable store fails fast.
+func (s *S3BlobStore) Ping(logger kslog.KsLogger) error {
+	input := s3.HeadBucketInput{
+		Bucket: &s.Location.Bucket,
+	}
+	_, err := s.Client.HeadBucketWithContext(s.context(), &input)
+	if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == s3.ErrCodeNoSuchBucket || aerr.Code() == "NotFound") {
+		err = NoSuchBucket(s.Location.Bucket)
+	}
+	if err != nil {
+		logger.Errorf("Failed to reach bucket %s: %s", s.Location.Bucket, err)
+		return &messagestore.StoreUnreachable{Cause: err}
+	}
+	return nil
+}
+
+// ListBlobs lists the names of blobs beginning with prefix
+func (s *S3BlobStore) ListBlobs(prefix string) ([]string, error) {
+	keyPrefix := KeyPrefix(s.Location.Key) + prefix
+	input := s3.ListObjectsV2Input{
+		Bucket:       &s.Location.Bucket,
+		Prefix:       &keyPrefix,
+		RequestPayer: s.requestPayer(),
+	}
+	ctx := s.context()
+	names := make([]string, 0)
+	for {
+		var result *s3.ListObjectsV2Output
+		err := s.Retry.do(ctx, func() error {
+			var err error
+			result, err = s.Client.ListObjectsV2WithContext(ctx, &input)
+			return err
+		})
+		if err != nil {
+			return nil, &messagestore.ListResourcesError{
+				Prefix: prefix,
+				Cause:  err,
+			}
+		}
+		for _, object := range result.Contents {
+			if object.Key != nil {
+				names = append(names, prefix+strings.TrimPrefix(*object.Key, keyPrefix))
+			}
+		}
+		if !aws.BoolValue(result.IsTruncated) || result.NextContinuationToken == nil {
+			break
+		}
+		input.ContinuationToken = result.NextContinuationToken
+	}
+	return names, nil
+}
+
+// Capabilities reports that the store supports every feature
+func (s *S3BlobStore) Capabilities() messagestore.Caps {
+	return messagestore.Caps{
+		List:        true,
+		Conditional: true,
+		Metadata:    true,
+		Stream:      true,
+		Stat:        true,
+	}
+}
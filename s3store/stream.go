@@ -0,0 +1,113 @@
+package s3store
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/aefalcon/go-github-keystore/messagestore"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+var _ messagestore.StreamBlobStore = &S3BlobStore{}
+
+func (s *S3BlobStore) GetBlobStream(name string) (io.ReadCloser, *messagestore.CacheMeta, error) {
+	return s.GetBlobStreamCtx(s.context(), name)
+}
+
+// GetBlobStreamCtx gets a blob as the body of the S3 object, which the caller
+// must close.  Requests which fail with a transient error fail over to the
+// Fallbacks as GetBlobCtx does, but errors reading the body do not.
+func (s *S3BlobStore) GetBlobStreamCtx(ctx context.Context, name string) (io.ReadCloser, *messagestore.CacheMeta, error) {
+	body, meta, err := s.getBlobStream(ctx, name)
+	for _, fallback := range s.Fallbacks {
+		if err == nil || !shouldFailOver(err) || ctx.Err() != nil {
+			break
+		}
+		body, meta, err = fallback.getBlobStream(ctx, name)
+	}
+	return body, meta, err
+}
+
+// getBlobStream gets a blob as a stream from this store only
+func (s *S3BlobStore) getBlobStream(ctx context.Context, name string) (io.ReadCloser, *messagestore.CacheMeta, error) {
+	key := s.DocKey(name)
+	getInput := s3.GetObjectInput{
+		Bucket:       &s.Location.Bucket,
+		Key:          &key,
+		RequestPayer: s.requestPayer(),
+	}
+	var result *s3.GetObjectOutput
+	err := s.Retry.do(ctx, func() error {
+		var err error
+		result, err = s.Client.GetObjectWithContext(ctx, &getInput)
+		return err
+	})
+	if err != nil {
+		return nil, nil, translateNotFound(name, err)
+	}
+	cacheMeta := objectCacheMeta(result.CacheControl, result.ETag, result.VersionId, result.Expires, result.LastModified, result.Metadata)
+	return result.Body, cacheMeta, nil
+}
+
+func (s *S3BlobStore) PutBlobStream(name string, r io.Reader) (*messagestore.CacheMeta, error) {
+	return s.PutBlobStreamCtx(s.context(), name, r)
+}
+
+// PutBlobStreamCtx puts a blob read from a stream.  A stream which is an
+// io.ReadSeeker is read from its start.  S3 requires a seekable
+// body to sign and retry the request, so a stream which is not an io.Seeker
+// is first spooled to a temporary file rather than memory.  With
+// FanOutWrites, the blob is then put to each of the Fallbacks as by
+// PutBlobWithMetadataCtx.
+func (s *S3BlobStore) PutBlobStreamCtx(ctx context.Context, name string, r io.Reader) (*messagestore.CacheMeta, error) {
+	body, ok := r.(io.ReadSeeker)
+	if !ok {
+		spool, err := spoolStream(r)
+		if err != nil {
+			return nil, &messagestore.ReadResourceError{
+				Name:  name,
+				Cause: err,
+			}
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+		body = spool
+	}
+	key := s.DocKey(name)
+	putInput := s3.PutObjectInput{
+		Bucket: &s.Location.Bucket,
+		Key:    &key,
+	}
+	meta, err := s.putObject(ctx, name, body, nil, &putInput)
+	if err != nil || !s.FanOutWrites {
+		return meta, err
+	}
+	for _, fallback := range s.Fallbacks {
+		fallbackInput := s3.PutObjectInput{
+			Bucket: &fallback.Location.Bucket,
+			Key:    aws.String(fallback.DocKey(name)),
+		}
+		if _, err = fallback.putObject(ctx, name, body, nil, &fallbackInput); err != nil {
+			return nil, err
+		}
+	}
+	return meta, nil
+}
+
+// spoolStream copies a stream to a temporary file, which the caller must
+// close and remove
+func spoolStream(r io.Reader) (*os.File, error) {
+	spool, err := ioutil.TempFile("", "s3store-spool-")
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(spool, r); err != nil {
+		spool.Close()
+		os.Remove(spool.Name())
+		return nil, err
+	}
+	return spool, nil
+}
@@ -0,0 +1,101 @@
+package s3storev2
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/aefalcon/go-github-keystore/messagestore"
+	"github.com/aefalcon/go-github-keystore/s3store"
+	"github.com/aws/smithy-go"
+)
+
+// NoSuchObject is an S3 error indicating the object of a blob does not exist.
+// It is recognized by messagestore.IsNotFound while still unwrapping to the
+// error of the SDK.
+type NoSuchObject struct {
+	Name  string
+	Cause error
+}
+
+func (e *NoSuchObject) Error() string {
+	return e.Cause.Error()
+}
+
+func (e *NoSuchObject) Unwrap() error {
+	return e.Cause
+}
+
+func (e *NoSuchObject) NotFound() bool {
+	return true
+}
+
+// errorCode gets the S3 error code of an error of the SDK, or an empty string
+// if it is not an API error
+func errorCode(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.ErrorCode()
+	}
+	return ""
+}
+
+// statusError is an error of a response having an HTTP status, as are the
+// response errors of the SDK
+type statusError interface {
+	HTTPStatusCode() int
+}
+
+// isRetryable determines if an error from S3 is transient
+func isRetryable(err error) bool {
+	if s3store.IsRetryableCode(errorCode(err)) {
+		return true
+	}
+	var respErr statusError
+	if errors.As(err, &respErr) {
+		status := respErr.HTTPStatusCode()
+		return status >= http.StatusInternalServerError || status == http.StatusTooManyRequests
+	}
+	return false
+}
+
+// shouldFailOver determines if an error getting a blob may not occur getting
+// it from a replica, being transient or a failure to reach S3
+func shouldFailOver(err error) bool {
+	var netErr net.Error
+	return isRetryable(err) || errors.As(err, &netErr)
+}
+
+// notFoundCodes are the error codes of S3 for missing objects; HEAD requests
+// have no body and so report only NotFound
+var notFoundCodes = map[string]bool{
+	"NoSuchKey": true,
+	"NotFound":  true,
+}
+
+// translateNotFound replaces an S3 error for a missing object with a
+// *NoSuchObject, leaving other errors unchanged
+func translateNotFound(name string, err error) error {
+	if notFoundCodes[errorCode(err)] {
+		return &NoSuchObject{
+			Name:  name,
+			Cause: err,
+		}
+	}
+	return err
+}
+
+// conflictCodes are the error codes of S3 for failed conditional writes
+var conflictCodes = map[string]bool{
+	"PreconditionFailed":         true,
+	"ConditionalRequestConflict": true,
+}
+
+// translateConflict replaces an S3 error for a failed conditional write with
+// a messagestore.WriteConflict, leaving other errors unchanged
+func translateConflict(name string, err error) error {
+	if conflictCodes[errorCode(err)] {
+		return messagestore.WriteConflict(name)
+	}
+	return err
+}
@@ -0,0 +1,19 @@
+package s3storev2
+
+import (
+	"github.com/aefalcon/go-github-keystore/s3store"
+)
+
+// LocationURIOptions gets the options of a store of an S3 location URI, as
+// parsed by s3store.ParseLocationURI, taking its endpoint and path style
+// addressing as s3store.LocationURIOptions does.  Options retry with the
+// s3store.DefaultRetryPolicy, as NewS3BlobStore does.
+func LocationURIOptions(uri string) (S3BlobStoreOptions, error) {
+	v1Opts, err := s3store.LocationURIOptions(uri)
+	opts := S3BlobStoreOptions{
+		Retry:     v1Opts.Retry,
+		Endpoint:  v1Opts.Endpoint,
+		PathStyle: v1Opts.PathStyle,
+	}
+	return opts, err
+}
@@ -0,0 +1,628 @@
+// Package s3storev2 is a messagestore using S3 through version 2 of the AWS
+// SDK for Go.  It takes the same locations and options as s3store, which uses
+// version 1, so a deployment may choose either SDK when constructing its
+// store.
+package s3storev2
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aefalcon/github-keystore-protobuf/go/locationpb"
+	"github.com/aefalcon/go-github-keystore/kslog"
+	"github.com/aefalcon/go-github-keystore/messagestore"
+	"github.com/aefalcon/go-github-keystore/s3store"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// S3API is the part of the S3 client used by an S3BlobStore, satisfied by
+// *s3.Client and by fakes
+type S3API interface {
+	GetObject(ctx context.Context, input *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	HeadObject(ctx context.Context, input *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	PutObject(ctx context.Context, input *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	DeleteObject(ctx context.Context, input *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+	HeadBucket(ctx context.Context, input *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
+	ListObjectsV2(ctx context.Context, input *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+}
+
+var _ S3API = &s3.Client{}
+
+// S3BlobStore is a BlobStore of objects in S3 like s3store.S3BlobStore,
+// retrying transient errors by its RetryPolicy and failing over to its
+// Fallbacks in the same way.  Blobs are not streamed.
+type S3BlobStore struct {
+	Client       S3API
+	Location     locationpb.S3Ref
+	BatchWorkers int                  // Concurrent requests of GetBlobs; defaults to s3store.DEFAULT_BATCH_WORKERS
+	Retry        s3store.RetryPolicy  // Retrying of transient errors getting, putting and deleting blobs
+	Encryption   s3store.Encryption   // Server side encryption of put objects
+	StorageClass string               // Storage class of put objects; STANDARD if empty
+	Fallbacks    []*S3BlobStore       // Replicas from which blobs are got, in order, when getting fails with a transient error
+	FanOutWrites bool                 // Puts and deletes are also made to the Fallbacks once made to this store
+	Tagger       s3store.ObjectTagger // Tags of put objects, if set
+	TagExpires   bool                 // Tag objects put with an expiration with s3store.EXPIRES_TAG, which needs s3:PutObjectTagging
+	RequestPayer string               // types.RequestPayerRequester to pay for requests of a requester pays bucket; the bucket owner pays if empty
+	ACL          string               // Canned ACL of put objects, such as types.ObjectCannedACLBucketOwnerFullControl; the bucket's default if empty
+	ContentType  string               // Content-Type of put objects; that given by their messagestore.CONTENT_TYPE_META, or S3's default, if empty
+	ctx          context.Context
+}
+
+// S3BlobStoreOptions configures stores made by NewS3BlobStoreWithOptions
+type S3BlobStoreOptions struct {
+	Retry        s3store.RetryPolicy // Retrying of transient errors, replacing the SDK's retryer if it has MaxAttempts
+	MaxAttempts  int                 // Attempts of each request by the SDK's retryer, including the first, without a Retry policy; the SDK's default if 0
+	Encryption   s3store.Encryption
+	Prefix       string // Prefix of object keys under the key of the location, for sharing a bucket
+	Credentials  s3store.Credentials
+	Endpoint     string               // URL of an S3 compatible endpoint, such as of MinIO or Ceph, addressed path style; AWS if empty
+	PathStyle    bool                 // Address buckets by path rather than virtual host, as always with an Endpoint
+	StorageClass string               // Storage class of put objects, which must allow immediate reads; STANDARD if empty
+	Fallbacks    []locationpb.S3Ref   // Replicas of the location, such as in other regions, read when it fails
+	FanOutWrites bool                 // Puts and deletes are also made to the Fallbacks
+	Tagger       s3store.ObjectTagger // Tags of put objects, if set
+	TagExpires   bool                 // Tag objects put with an expiration with s3store.EXPIRES_TAG
+	RequestPayer string               // types.RequestPayerRequester for a requester pays bucket; the bucket owner pays if empty
+	ACL          string               // Canned ACL of put objects; the bucket's default if empty
+	ContentType  string               // Content-Type of put objects; that given by their metadata if empty
+}
+
+// archiveStorageClasses are the storage classes whose objects must be
+// restored before they can be read
+var archiveStorageClasses = map[string]bool{
+	string(types.StorageClassGlacier):     true,
+	string(types.StorageClassDeepArchive): true,
+}
+
+var _ messagestore.BlobStore = &S3BlobStore{}
+var _ messagestore.MetadataBlobStore = &S3BlobStore{}
+var _ messagestore.ContextBlobStore = &S3BlobStore{}
+var _ messagestore.ListableBlobStore = &S3BlobStore{}
+var _ messagestore.StatBlobStore = &S3BlobStore{}
+var _ messagestore.BatchBlobStore = &S3BlobStore{}
+var _ messagestore.ConditionalMetadataBlobStore = &S3BlobStore{}
+var _ messagestore.PingableBlobStore = &S3BlobStore{}
+var _ messagestore.ExistenceDeleteBlobStore = &S3BlobStore{}
+var _ messagestore.CapableStore = &S3BlobStore{}
+
+func NewS3BlobStore(loc *locationpb.Location) (*S3BlobStore, error) {
+	return NewS3BlobStoreWithOptions(loc, S3BlobStoreOptions{Retry: s3store.DefaultRetryPolicy})
+}
+
+// NewS3BlobStoreWithOptions allocates an S3BlobStore configured by opts, as
+// s3store.NewS3BlobStoreWithOptions does.  A KMS key without an encryption
+// type implies aws:kms encryption.  Archive storage classes are rejected with
+// an s3store.UnreadableStorageClass error, since blobs put in them could not
+// be got.
+func NewS3BlobStoreWithOptions(loc *locationpb.Location, opts S3BlobStoreOptions) (*S3BlobStore, error) {
+	if archiveStorageClasses[opts.StorageClass] {
+		return nil, s3store.UnreadableStorageClass(opts.StorageClass)
+	}
+	if opts.Encryption.SSEKMSKeyId != "" && opts.Encryption.ServerSideEncryption == "" {
+		opts.Encryption.ServerSideEncryption = string(types.ServerSideEncryptionAwsKms)
+	}
+	loc_s3loc, ok := loc.Location.(*locationpb.Location_S3)
+	if !ok {
+		return nil, (*messagestore.UnsupportedLocation)(loc)
+	}
+	store, err := newS3BlobStore(*loc_s3loc.S3, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, fallback := range opts.Fallbacks {
+		fallbackStore, err := newS3BlobStore(fallback, opts)
+		if err != nil {
+			return nil, err
+		}
+		store.Fallbacks = append(store.Fallbacks, fallbackStore)
+	}
+	store.FanOutWrites = opts.FanOutWrites
+	return store, nil
+}
+
+// newS3BlobStore allocates an S3BlobStore of a single location configured by
+// opts, other than its fallbacks
+func newS3BlobStore(loc locationpb.S3Ref, opts S3BlobStoreOptions) (*S3BlobStore, error) {
+	cfg, err := loadConfig(context.Background(), loc.Region, opts.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if opts.Endpoint != "" {
+			o.BaseEndpoint = aws.String(opts.Endpoint)
+		}
+		o.UsePathStyle = opts.Endpoint != "" || opts.PathStyle
+		if opts.Retry.MaxAttempts > 0 {
+			// The SDK's own retries would multiply the attempts of the policy
+			o.RetryMaxAttempts = 1
+		} else if opts.MaxAttempts > 0 {
+			o.RetryMaxAttempts = opts.MaxAttempts
+		}
+	})
+	location := loc
+	location.Key = s3store.KeyPrefix(path.Join(location.Key, opts.Prefix))
+	return &S3BlobStore{
+		Client:       client,
+		Location:     location,
+		Retry:        opts.Retry,
+		Encryption:   opts.Encryption,
+		StorageClass: opts.StorageClass,
+		Tagger:       opts.Tagger,
+		TagExpires:   opts.TagExpires,
+		RequestPayer: opts.RequestPayer,
+		ACL:          opts.ACL,
+		ContentType:  opts.ContentType,
+	}, nil
+}
+
+// loadConfig loads the default AWS configuration of a region with creds,
+// assuming their role if they name one
+func loadConfig(ctx context.Context, region string, creds s3store.Credentials) (aws.Config, error) {
+	loadOpts := []func(*config.LoadOptions) error{
+		config.WithRegion(region),
+	}
+	if creds.Profile != "" {
+		loadOpts = append(loadOpts, config.WithSharedConfigProfile(creds.Profile))
+	}
+	if creds.AccessKeyId != "" {
+		provider := credentials.NewStaticCredentialsProvider(creds.AccessKeyId, creds.SecretAccessKey, creds.SessionToken)
+		loadOpts = append(loadOpts, config.WithCredentialsProvider(provider))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, loadOpts...)
+	if err != nil {
+		return aws.Config{}, err
+	}
+	if creds.RoleArn != "" {
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), creds.RoleArn, func(o *stscreds.AssumeRoleOptions) {
+			if creds.ExternalId != "" {
+				o.ExternalID = aws.String(creds.ExternalId)
+			}
+		})
+		cfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+	return cfg, nil
+}
+
+// WithContext gets a copy of the store whose requests without an explicit
+// context use ctx, so they are cancelled when ctx is done
+func (s *S3BlobStore) WithContext(ctx context.Context) *S3BlobStore {
+	storeCopy := *s
+	storeCopy.ctx = ctx
+	return &storeCopy
+}
+
+// context gets the context of requests made without an explicit context
+func (s *S3BlobStore) context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// DocKey gets the object key of a name.  Names are cleaned so they cannot
+// refer to objects outside the key prefix of the location.
+func (s *S3BlobStore) DocKey(name string) string {
+	return s3store.KeyPrefix(s.Location.Key) + strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func (s *S3BlobStore) GetBlob(name string) ([]byte, *messagestore.CacheMeta, error) {
+	return s.GetBlobCtx(s.context(), name)
+}
+
+// GetBlobCtx gets a blob.  If getting fails with a transient error, the blob
+// is got from each of the Fallbacks in turn until one does not; the error of
+// the last store tried is returned.
+func (s *S3BlobStore) GetBlobCtx(ctx context.Context, name string) ([]byte, *messagestore.CacheMeta, error) {
+	content, meta, err := s.getBlob(ctx, name)
+	for _, fallback := range s.Fallbacks {
+		if err == nil || !shouldFailOver(err) || ctx.Err() != nil {
+			break
+		}
+		content, meta, err = fallback.getBlob(ctx, name)
+	}
+	return content, meta, err
+}
+
+// getBlob gets a blob from this store only
+func (s *S3BlobStore) getBlob(ctx context.Context, name string) ([]byte, *messagestore.CacheMeta, error) {
+	key := s.DocKey(name)
+	getInput := s3.GetObjectInput{
+		Bucket:       &s.Location.Bucket,
+		Key:          &key,
+		RequestPayer: types.RequestPayer(s.RequestPayer),
+	}
+	var result *s3.GetObjectOutput
+	err := s.Retry.Do(ctx, isRetryable, func() error {
+		var err error
+		result, err = s.Client.GetObject(ctx, &getInput)
+		return err
+	})
+	if err != nil {
+		return nil, nil, translateNotFound(name, err)
+	}
+	defer result.Body.Close()
+	content, err := ioutil.ReadAll(result.Body)
+	if err != nil {
+		wrapErr := messagestore.ReadResourceError{
+			Name:  name,
+			Cause: err,
+		}
+		return nil, nil, &wrapErr
+	}
+	cacheMeta := objectCacheMeta(result.CacheControl, result.ETag, result.VersionId, result.Expires, result.LastModified, result.Metadata)
+	return content, cacheMeta, nil
+}
+
+// GetBlobs gets several blobs concurrently with at most BatchWorkers requests
+// in flight.  If some blobs fail, the error is a *messagestore.BatchError.
+func (s *S3BlobStore) GetBlobs(names []string) ([][]byte, []*messagestore.CacheMeta, error) {
+	contents := make([][]byte, len(names))
+	metas := make([]*messagestore.CacheMeta, len(names))
+	errs := make([]error, len(names))
+	workers := s.BatchWorkers
+	if workers <= 0 {
+		workers = s3store.DEFAULT_BATCH_WORKERS
+	}
+	if workers > len(names) {
+		workers = len(names)
+	}
+	ctx := s.context()
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				contents[i], metas[i], errs[i] = s.GetBlobCtx(ctx, names[i])
+			}
+		}()
+	}
+	for i := range names {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return contents, metas, &messagestore.BatchError{
+				Names:  names,
+				Errors: errs,
+			}
+		}
+	}
+	return contents, metas, nil
+}
+
+// objectCacheMeta creates cache metadata from the attributes of an S3 object.
+// The version is the version ID of objects of versioned buckets, and is left
+// empty otherwise so that CacheMeta.GetVersion gives the ETag.
+func objectCacheMeta(cacheControl, etag, versionId *string, expires, lastModified *time.Time, metadata map[string]string) *messagestore.CacheMeta {
+	cacheMeta := messagestore.CacheMeta{
+		CacheControl: aws.ToString(cacheControl),
+		ETag:         aws.ToString(etag),
+		Version:      objectVersion(versionId),
+	}
+	if expires != nil {
+		cacheMeta.Expires = *expires
+	}
+	if lastModified != nil {
+		cacheMeta.LastModified = *lastModified
+	}
+	if len(metadata) != 0 {
+		cacheMeta.Metadata = make(map[string]string, len(metadata))
+		for k, v := range metadata {
+			cacheMeta.Metadata[strings.ToLower(k)] = v
+		}
+	}
+	return &cacheMeta
+}
+
+// objectVersion gets the version of an object from its version ID.  Objects
+// put before versioning was enabled have the version ID "null", which does
+// not change with puts, so they have no version.
+func objectVersion(versionId *string) string {
+	if versionId == nil || *versionId == "null" {
+		return ""
+	}
+	return *versionId
+}
+
+// StatBlob gets the cache metadata of a blob without fetching its content
+func (s *S3BlobStore) StatBlob(name string) (*messagestore.CacheMeta, error) {
+	key := s.DocKey(name)
+	input := s3.HeadObjectInput{
+		Bucket:       &s.Location.Bucket,
+		Key:          &key,
+		RequestPayer: types.RequestPayer(s.RequestPayer),
+	}
+	result, err := s.Client.HeadObject(s.context(), &input)
+	if err != nil {
+		return nil, translateNotFound(name, err)
+	}
+	return objectCacheMeta(result.CacheControl, result.ETag, result.VersionId, result.Expires, result.LastModified, result.Metadata), nil
+}
+
+func (s *S3BlobStore) PutBlob(name string, content []byte) (*messagestore.CacheMeta, error) {
+	return s.PutBlobWithMetadataCtx(s.context(), name, content, nil)
+}
+
+func (s *S3BlobStore) PutBlobCtx(ctx context.Context, name string, content []byte) (*messagestore.CacheMeta, error) {
+	return s.PutBlobWithMetadataCtx(ctx, name, content, nil)
+}
+
+// PutBlobWithMetadata stores a blob with the metadata as S3 user metadata
+func (s *S3BlobStore) PutBlobWithMetadata(name string, content []byte, metadata map[string]string) (*messagestore.CacheMeta, error) {
+	return s.PutBlobWithMetadataCtx(s.context(), name, content, metadata)
+}
+
+// PutBlobWithMetadataCtx puts a blob with metadata.  With FanOutWrites, it is
+// then put to each of the Fallbacks, and the error of the first fallback
+// which fails is returned even though the blob was put to this store.
+func (s *S3BlobStore) PutBlobWithMetadataCtx(ctx context.Context, name string, content []byte, metadata map[string]string) (*messagestore.CacheMeta, error) {
+	key := s.DocKey(name)
+	putInput := s3.PutObjectInput{
+		Bucket: &s.Location.Bucket,
+		Key:    &key,
+	}
+	meta, err := s.putObject(ctx, name, content, metadata, &putInput)
+	if err != nil || !s.FanOutWrites {
+		return meta, err
+	}
+	for _, fallback := range s.Fallbacks {
+		if _, err = fallback.PutBlobWithMetadataCtx(ctx, name, content, metadata); err != nil {
+			return nil, err
+		}
+	}
+	return meta, nil
+}
+
+// PutBlobIfMatch puts a blob only if the object has the ETag of meta, using
+// a conditional write of S3.  Since the ETags of replicas may differ, it is
+// never fanned out to the Fallbacks.
+func (s *S3BlobStore) PutBlobIfMatch(name string, content []byte, meta *messagestore.CacheMeta) (*messagestore.CacheMeta, error) {
+	return s.PutBlobIfMatchWithMetadata(name, content, meta, nil)
+}
+
+// PutBlobIfMatchWithMetadata puts a blob with user metadata only if the
+// object has the ETag of meta, as PutBlobIfMatch does
+func (s *S3BlobStore) PutBlobIfMatchWithMetadata(name string, content []byte, meta *messagestore.CacheMeta, metadata map[string]string) (*messagestore.CacheMeta, error) {
+	key := s.DocKey(name)
+	putInput := s3.PutObjectInput{
+		Bucket: &s.Location.Bucket,
+		Key:    &key,
+	}
+	if meta != nil && meta.ETag != "" {
+		putInput.IfMatch = aws.String(meta.ETag)
+	} else {
+		putInput.IfNoneMatch = aws.String("*")
+	}
+	return s.putObject(s.context(), name, content, metadata, &putInput)
+}
+
+// contentType gets the Content-Type of an object put with metadata, being
+// the CONTENT_TYPE_META of the metadata unless overridden by the ContentType
+// of the store, and the metadata without CONTENT_TYPE_META, which is given as
+// the Content-Type rather than kept as user metadata
+func (s *S3BlobStore) contentType(metadata map[string]string) (string, map[string]string) {
+	contentType, found := metadata[messagestore.CONTENT_TYPE_META]
+	if found {
+		userMetadata := make(map[string]string, len(metadata))
+		for k, v := range metadata {
+			if k != messagestore.CONTENT_TYPE_META {
+				userMetadata[k] = v
+			}
+		}
+		metadata = userMetadata
+	}
+	if s.ContentType != "" {
+		contentType = s.ContentType
+	}
+	return contentType, metadata
+}
+
+// putObject puts the content and metadata of a blob with putInput.  An
+// expiration recorded in the metadata is also given as the Expires of the
+// object, and its s3store.EXPIRES_TAG with TagExpires.
+func (s *S3BlobStore) putObject(ctx context.Context, name string, content []byte, metadata map[string]string, putInput *s3.PutObjectInput) (*messagestore.CacheMeta, error) {
+	contentType, metadata := s.contentType(metadata)
+	if contentType != "" {
+		putInput.ContentType = aws.String(contentType)
+	}
+	if len(metadata) != 0 {
+		putInput.Metadata = metadata
+	}
+	putInput.ServerSideEncryption = types.ServerSideEncryption(s.Encryption.ServerSideEncryption)
+	if s.Encryption.SSEKMSKeyId != "" {
+		putInput.SSEKMSKeyId = aws.String(s.Encryption.SSEKMSKeyId)
+	}
+	putInput.StorageClass = types.StorageClass(s.StorageClass)
+	putInput.ACL = types.ObjectCannedACL(s.ACL)
+	putInput.RequestPayer = types.RequestPayer(s.RequestPayer)
+	tags := make(map[string]string)
+	if s.Tagger != nil {
+		for k, v := range s.Tagger(name) {
+			tags[k] = v
+		}
+	}
+	if expires, ok := metadata[messagestore.EXPIRES_META]; ok {
+		if s.TagExpires {
+			tags[s3store.EXPIRES_TAG] = expires
+		}
+		if expiration, err := time.Parse(time.RFC3339, expires); err == nil {
+			putInput.Expires = &expiration
+		}
+	}
+	if len(tags) != 0 {
+		putInput.Tagging = aws.String(encodeTags(tags))
+	}
+	var result *s3.PutObjectOutput
+	var putTime time.Time
+	err := s.Retry.Do(ctx, isRetryable, func() error {
+		var err error
+		putInput.Body = bytes.NewReader(content)
+		putTime = time.Now()
+		result, err = s.Client.PutObject(ctx, putInput)
+		return err
+	})
+	if err != nil {
+		err = translateConflict(name, err)
+		wrapErr := messagestore.PutResourceError{
+			Name:  name,
+			Cause: err,
+		}
+		return nil, &wrapErr
+	}
+	cacheMeta := messagestore.CacheMeta{
+		ETag:    aws.ToString(result.ETag),
+		Version: objectVersion(result.VersionId),
+		// S3 does not report the modification time of a put; it is when the
+		// request was made, to the second as S3 reports it
+		LastModified: putTime.UTC().Truncate(time.Second),
+	}
+	return &cacheMeta, nil
+}
+
+func (s *S3BlobStore) DeleteBlob(name string) (*messagestore.CacheMeta, error) {
+	return s.DeleteBlobCtx(s.context(), name)
+}
+
+// DeleteBlobCtx deletes a blob.  With FanOutWrites, it is then deleted from
+// each of the Fallbacks, and the error of the first fallback which fails is
+// returned even though the blob was deleted from this store.
+func (s *S3BlobStore) DeleteBlobCtx(ctx context.Context, name string) (*messagestore.CacheMeta, error) {
+	meta, err := s.deleteBlob(ctx, name)
+	if err != nil || !s.FanOutWrites {
+		return meta, err
+	}
+	for _, fallback := range s.Fallbacks {
+		if _, err = fallback.DeleteBlobCtx(ctx, name); err != nil {
+			return nil, err
+		}
+	}
+	return meta, nil
+}
+
+// deleteBlob deletes a blob from this store only
+func (s *S3BlobStore) deleteBlob(ctx context.Context, name string) (*messagestore.CacheMeta, error) {
+	key := s.DocKey(name)
+	input := s3.DeleteObjectInput{
+		Bucket:       &s.Location.Bucket,
+		Key:          &key,
+		RequestPayer: types.RequestPayer(s.RequestPayer),
+	}
+	err := s.Retry.Do(ctx, isRetryable, func() error {
+		_, err := s.Client.DeleteObject(ctx, &input)
+		return err
+	})
+	if err != nil {
+		wrapErr := messagestore.DeleteResourceError{
+			Name:  name,
+			Cause: err,
+		}
+		return nil, &wrapErr
+	}
+	return nil, nil
+}
+
+// DeleteBlobExisted deletes a blob, reporting whether it existed.  Since S3
+// deletes succeed whether or not the object exists, it is checked for with
+// a HEAD request first; an object created concurrently may be deleted without
+// being reported.
+func (s *S3BlobStore) DeleteBlobExisted(name string) (bool, error) {
+	_, err := s.StatBlob(name)
+	if messagestore.IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, &messagestore.GetResourceError{
+			Name:  name,
+			Cause: err,
+		}
+	}
+	_, err = s.DeleteBlob(name)
+	return err == nil, err
+}
+
+// Ping checks that the bucket exists and is accessible with a HEAD request.
+// Transient errors are not retried so an unreachable store fails fast.
+func (s *S3BlobStore) Ping(logger kslog.KsLogger) error {
+	input := s3.HeadBucketInput{
+		Bucket: &s.Location.Bucket,
+	}
+	_, err := s.Client.HeadBucket(s.context(), &input)
+	if code := errorCode(err); code == "NoSuchBucket" || code == "NotFound" {
+		err = s3store.NoSuchBucket(s.Location.Bucket)
+	}
+	if err != nil {
+		logger.Errorf("Failed to reach bucket %s: %s", s.Location.Bucket, err)
+		return &messagestore.StoreUnreachable{Cause: err}
+	}
+	return nil
+}
+
+// ListBlobs lists the names of blobs beginning with prefix
+func (s *S3BlobStore) ListBlobs(prefix string) ([]string, error) {
+	keyPrefix := s3store.KeyPrefix(s.Location.Key) + prefix
+	input := s3.ListObjectsV2Input{
+		Bucket:       &s.Location.Bucket,
+		Prefix:       &keyPrefix,
+		RequestPayer: types.RequestPayer(s.RequestPayer),
+	}
+	ctx := s.context()
+	names := make([]string, 0)
+	for {
+		var result *s3.ListObjectsV2Output
+		err := s.Retry.Do(ctx, isRetryable, func() error {
+			var err error
+			result, err = s.Client.ListObjectsV2(ctx, &input)
+			return err
+		})
+		if err != nil {
+			return nil, &messagestore.ListResourcesError{
+				Prefix: prefix,
+				Cause:  err,
+			}
+		}
+		for _, object := range result.Contents {
+			if object.Key != nil {
+				names = append(names, prefix+strings.TrimPrefix(*object.Key, keyPrefix))
+			}
+		}
+		if !aws.ToBool(result.IsTruncated) || result.NextContinuationToken == nil {
+			break
+		}
+		input.ContinuationToken = result.NextContinuationToken
+	}
+	return names, nil
+}
+
+// encodeTags encodes object tags as the query string of a put request
+func encodeTags(tags map[string]string) string {
+	values := make(url.Values, len(tags))
+	for k, v := range tags {
+		values.Set(k, v)
+	}
+	return values.Encode()
+}
+
+// Capabilities reports that the store supports every feature but streams
+func (s *S3BlobStore) Capabilities() messagestore.Caps {
+	return messagestore.Caps{
+		List:        true,
+		Conditional: true,
+		Metadata:    true,
+		Stat:        true,
+	}
+}
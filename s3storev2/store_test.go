@@ -0,0 +1,551 @@
+package s3storev2
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aefalcon/github-keystore-protobuf/go/locationpb"
+	"github.com/aefalcon/go-github-keystore/kslog"
+	"github.com/aefalcon/go-github-keystore/messagestore"
+	"github.com/aefalcon/go-github-keystore/s3store"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// fakeObject is an object held by a fakeClient
+type fakeObject struct {
+	Content []byte
+	ETag    string
+	Input   s3.PutObjectInput // Request which put the object
+}
+
+// fakeClient is an in memory fake of the S3 API of version 2 of the SDK.
+// Requests of buckets other than Bucket fail with NoSuchBucket.
+type fakeClient struct {
+	Bucket   string
+	MaxKeys  int     // Keys listed per page; all keys if 0
+	Failures []error // Errors of the next requests of objects, in order
+	Requests int     // Requests of objects made
+	mu       sync.Mutex
+	objects  map[string]*fakeObject
+}
+
+var _ S3API = &fakeClient{}
+
+func newFakeClient(bucket string) *fakeClient {
+	return &fakeClient{
+		Bucket:  bucket,
+		objects: make(map[string]*fakeObject),
+	}
+}
+
+// Object gets a copy of an object, or nil if it does not exist
+func (c *fakeClient) Object(key string) *fakeObject {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	object, ok := c.objects[key]
+	if !ok {
+		return nil
+	}
+	objectCopy := *object
+	return &objectCopy
+}
+
+// checkBucket counts a request of an object in a bucket, failing it with the
+// next of the Failures or if the bucket is not Bucket
+func (c *fakeClient) checkBucket(bucket *string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Requests++
+	if len(c.Failures) != 0 {
+		err := c.Failures[0]
+		c.Failures = c.Failures[1:]
+		return err
+	}
+	if aws.ToString(bucket) != c.Bucket {
+		return &types.NoSuchBucket{Message: aws.String("The specified bucket does not exist")}
+	}
+	return nil
+}
+
+func (c *fakeClient) GetObject(ctx context.Context, input *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	if err := c.checkBucket(input.Bucket); err != nil {
+		return nil, err
+	}
+	object := c.Object(aws.ToString(input.Key))
+	if object == nil {
+		return nil, &smithy.OperationError{
+			ServiceID:     "S3",
+			OperationName: "GetObject",
+			Err:           &types.NoSuchKey{Message: aws.String("The specified key does not exist.")},
+		}
+	}
+	return &s3.GetObjectOutput{
+		Body:     ioutil.NopCloser(bytes.NewReader(object.Content)),
+		ETag:     aws.String(object.ETag),
+		Metadata: object.Input.Metadata,
+	}, nil
+}
+
+func (c *fakeClient) HeadObject(ctx context.Context, input *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	if err := c.checkBucket(input.Bucket); err != nil {
+		return nil, err
+	}
+	object := c.Object(aws.ToString(input.Key))
+	if object == nil {
+		return nil, &types.NotFound{}
+	}
+	return &s3.HeadObjectOutput{
+		ETag:     aws.String(object.ETag),
+		Metadata: object.Input.Metadata,
+	}, nil
+}
+
+func (c *fakeClient) PutObject(ctx context.Context, input *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	if err := c.checkBucket(input.Bucket); err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	digest := md5.Sum(content)
+	etag := fmt.Sprintf("%q", hex.EncodeToString(digest[:]))
+	key := aws.ToString(input.Key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	existing, exists := c.objects[key]
+	if (input.IfNoneMatch != nil && exists) || (input.IfMatch != nil && (!exists || existing.ETag != *input.IfMatch)) {
+		return nil, &smithy.GenericAPIError{Code: "PreconditionFailed", Message: "At least one of the pre-conditions you specified did not hold"}
+	}
+	c.objects[key] = &fakeObject{
+		Content: content,
+		ETag:    etag,
+		Input:   *input,
+	}
+	return &s3.PutObjectOutput{ETag: aws.String(etag)}, nil
+}
+
+func (c *fakeClient) DeleteObject(ctx context.Context, input *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	if err := c.checkBucket(input.Bucket); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.objects, aws.ToString(input.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (c *fakeClient) HeadBucket(ctx context.Context, input *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	if aws.ToString(input.Bucket) != c.Bucket {
+		return nil, &types.NotFound{}
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (c *fakeClient) ListObjectsV2(ctx context.Context, input *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	if err := c.checkBucket(input.Bucket); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	keys := make([]string, 0, len(c.objects))
+	for key := range c.objects {
+		if strings.HasPrefix(key, aws.ToString(input.Prefix)) && key > aws.ToString(input.ContinuationToken) {
+			keys = append(keys, key)
+		}
+	}
+	c.mu.Unlock()
+	sort.Strings(keys)
+	var output s3.ListObjectsV2Output
+	if c.MaxKeys > 0 && len(keys) > c.MaxKeys {
+		keys = keys[:c.MaxKeys]
+		output.IsTruncated = aws.Bool(true)
+		output.NextContinuationToken = aws.String(keys[len(keys)-1])
+	}
+	for _, key := range keys {
+		output.Contents = append(output.Contents, types.Object{Key: aws.String(key)})
+	}
+	return &output, nil
+}
+
+func newMockStore() (*S3BlobStore, *fakeClient) {
+	client := newFakeClient("bucket")
+	store := S3BlobStore{
+		Client: client,
+		Location: locationpb.S3Ref{
+			Bucket: "bucket",
+			Region: "us-east-1",
+			Key:    "root/",
+		},
+	}
+	return &store, client
+}
+
+func TestMockClient(t *testing.T) {
+	t.Run("GetPut", func(t *testing.T) {
+		store, client := newMockStore()
+		putMeta, err := store.PutBlobWithMetadata("apps/1", []byte("app"), map[string]string{"owner": "test"})
+		if err != nil {
+			t.Fatalf("Failed to put blob: %s", err)
+		}
+		if object := client.Object("root/apps/1"); object == nil || string(object.Content) != "app" {
+			t.Fatalf("Blob was put as %v", object)
+		}
+		content, meta, err := store.GetBlob("apps/1")
+		if err != nil {
+			t.Fatalf("Failed to get blob: %s", err)
+		}
+		if string(content) != "app" || meta.ETag != putMeta.ETag || meta.Metadata["owner"] != "test" {
+			t.Fatalf("Got %q, %v for put blob %v", content, meta, putMeta)
+		}
+		statMeta, err := store.StatBlob("apps/1")
+		if err != nil || statMeta.ETag != putMeta.ETag {
+			t.Fatalf("Stat gave %v, %v", statMeta, err)
+		}
+		contents, _, err := store.GetBlobs([]string{"apps/1", "apps/1"})
+		if err != nil || len(contents) != 2 || string(contents[1]) != "app" {
+			t.Fatalf("Got blobs %q, %v", contents, err)
+		}
+	})
+	t.Run("NotFound", func(t *testing.T) {
+		store, _ := newMockStore()
+		if _, _, err := store.GetBlob("missing"); !messagestore.IsNotFound(err) {
+			t.Errorf("Missing blob error %v is not a not found error", err)
+		}
+		if _, err := store.StatBlob("missing"); !messagestore.IsNotFound(err) {
+			t.Errorf("Missing blob stat error %v is not a not found error", err)
+		}
+		messageStore := messagestore.BlobMessageStore{BlobStore: store}
+		if _, err := messageStore.GetMessage("missing", &locationpb.S3Ref{}); !messagestore.IsNotFound(err) {
+			t.Errorf("Missing message error %v is not a not found error", err)
+		}
+	})
+	t.Run("Delete", func(t *testing.T) {
+		store, client := newMockStore()
+		if _, err := store.PutBlob("apps/1", []byte("app")); err != nil {
+			t.Fatalf("Failed to put blob: %s", err)
+		}
+		existed, err := store.DeleteBlobExisted("apps/1")
+		if err != nil || !existed {
+			t.Fatalf("Deleting put blob gave %t, %v", existed, err)
+		}
+		if object := client.Object("root/apps/1"); object != nil {
+			t.Fatalf("Object remains after delete")
+		}
+		existed, err = store.DeleteBlobExisted("apps/1")
+		if err != nil || existed {
+			t.Fatalf("Deleting missing blob gave %t, %v", existed, err)
+		}
+		if _, err = store.DeleteBlob("apps/1"); err != nil {
+			t.Fatalf("Failed to delete missing blob: %s", err)
+		}
+	})
+	t.Run("PutIfMatch", func(t *testing.T) {
+		store, _ := newMockStore()
+		meta, err := store.PutBlobIfMatch("apps/index", []byte("1"), nil)
+		if err != nil {
+			t.Fatalf("Failed to create blob: %s", err)
+		}
+		if _, err = store.PutBlobIfMatch("apps/index", []byte("2"), nil); !messagestore.IsConflict(err) {
+			t.Fatalf("Creating existing blob gave %v", err)
+		}
+		if _, err = store.PutBlobIfMatch("apps/index", []byte("2"), meta); err != nil {
+			t.Fatalf("Failed to replace blob: %s", err)
+		}
+		if _, err = store.PutBlobIfMatch("apps/index", []byte("3"), meta); !messagestore.IsConflict(err) {
+			t.Fatalf("Replacing stale blob gave %v", err)
+		}
+	})
+	t.Run("List", func(t *testing.T) {
+		store, client := newMockStore()
+		client.MaxKeys = 1
+		for _, name := range []string{"apps/1", "apps/2", "keys/1"} {
+			if _, err := store.PutBlob(name, []byte(name)); err != nil {
+				t.Fatalf("Failed to put blob: %s", err)
+			}
+		}
+		names, err := store.ListBlobs("apps/")
+		if err != nil || len(names) != 2 || names[0] != "apps/1" || names[1] != "apps/2" {
+			t.Fatalf("Listed %v, %v", names, err)
+		}
+	})
+	t.Run("Ping", func(t *testing.T) {
+		store, _ := newMockStore()
+		logger := kslog.KsTestLogger{TestLogger: t}
+		if err := store.Ping(&logger); err != nil {
+			t.Fatalf("Failed to ping bucket: %s", err)
+		}
+		store.Location.Bucket = "missing"
+		err := store.Ping(&logger)
+		unreachable, ok := err.(*messagestore.StoreUnreachable)
+		if !ok {
+			t.Fatalf("Expected *StoreUnreachable but got %v", err)
+		}
+		if _, ok := unreachable.Cause.(s3store.NoSuchBucket); !ok {
+			t.Fatalf("Expected NoSuchBucket but got %v", unreachable.Cause)
+		}
+	})
+}
+
+func TestKeyPrefix(t *testing.T) {
+	store, client := newMockStore()
+	if _, err := store.PutBlob("../../escape", []byte("content")); err != nil {
+		t.Fatalf("Failed to put blob: %s", err)
+	}
+	if object := client.Object("root/escape"); object == nil {
+		t.Fatalf("Blob escaped the key prefix")
+	}
+	other := *store
+	other.Location.Key = "other"
+	if _, _, err := other.GetBlob("escape"); !messagestore.IsNotFound(err) {
+		t.Fatalf("Blob of another prefix was got: %v", err)
+	}
+}
+
+func TestPutObjectOptions(t *testing.T) {
+	store, client := newMockStore()
+	store.Encryption = s3store.Encryption{
+		ServerSideEncryption: string(types.ServerSideEncryptionAwsKms),
+		SSEKMSKeyId:          "alias/keystore",
+	}
+	store.StorageClass = "STANDARD_IA"
+	store.ACL = string(types.ObjectCannedACLBucketOwnerFullControl)
+	store.RequestPayer = string(types.RequestPayerRequester)
+	store.Tagger = s3store.DocTypeTagger(func(name string) string {
+		return "app"
+	})
+	if _, err := store.PutBlob("apps/1", []byte(`{"id": 1}`)); err != nil {
+		t.Fatalf("Failed to put blob: %s", err)
+	}
+	input := client.Object("root/apps/1").Input
+	if input.ServerSideEncryption != types.ServerSideEncryptionAwsKms || aws.ToString(input.SSEKMSKeyId) != "alias/keystore" {
+		t.Errorf("Put with encryption %s key %s", input.ServerSideEncryption, aws.ToString(input.SSEKMSKeyId))
+	}
+	if input.StorageClass != "STANDARD_IA" {
+		t.Errorf("Put with storage class %s", input.StorageClass)
+	}
+	if input.ACL != types.ObjectCannedACLBucketOwnerFullControl || input.RequestPayer != types.RequestPayerRequester {
+		t.Errorf("Put with ACL %s request payer %s", input.ACL, input.RequestPayer)
+	}
+	if input.ContentType != nil {
+		t.Errorf("Put blob with content type %s", aws.ToString(input.ContentType))
+	}
+	tags, err := url.ParseQuery(aws.ToString(input.Tagging))
+	if err != nil || tags.Get(s3store.DOCTYPE_TAG) != "app" {
+		t.Errorf("Put with tags %s", aws.ToString(input.Tagging))
+	}
+	metadata := map[string]string{messagestore.CONTENT_TYPE_META: messagestore.CONTENT_TYPE_JSON}
+	if _, err := store.PutBlobWithMetadata("apps/2", []byte(`{"id": 2}`), metadata); err != nil {
+		t.Fatalf("Failed to put blob: %s", err)
+	}
+	input = client.Object("root/apps/2").Input
+	if ct := aws.ToString(input.ContentType); ct != messagestore.CONTENT_TYPE_JSON {
+		t.Errorf("Put with content type %s instead of %s", ct, messagestore.CONTENT_TYPE_JSON)
+	}
+	if _, found := input.Metadata[messagestore.CONTENT_TYPE_META]; found {
+		t.Errorf("Put with its content type as user metadata")
+	}
+	store.ContentType = "application/octet-stream"
+	if _, err := store.PutBlobWithMetadata("apps/2", []byte(`{"id": 2}`), metadata); err != nil {
+		t.Fatalf("Failed to put blob: %s", err)
+	}
+	if ct := aws.ToString(client.Object("root/apps/2").Input.ContentType); ct != store.ContentType {
+		t.Errorf("Put with content type %s instead of %s", ct, store.ContentType)
+	}
+}
+
+func TestNewS3BlobStoreWithOptions(t *testing.T) {
+	loc := s3store.S3Location("bucket", "us-east-1", "keystore")
+	_, err := NewS3BlobStoreWithOptions(loc, S3BlobStoreOptions{StorageClass: string(types.StorageClassGlacier)})
+	if _, ok := err.(s3store.UnreadableStorageClass); !ok {
+		t.Fatalf("Expected UnreadableStorageClass but got %v", err)
+	}
+	store, err := NewS3BlobStoreWithOptions(loc, S3BlobStoreOptions{
+		Prefix: "tenant",
+		Encryption: s3store.Encryption{
+			SSEKMSKeyId: "alias/keystore",
+		},
+		Credentials: s3store.Credentials{
+			AccessKeyId:     "AKIDEXAMPLE",
+			SecretAccessKey: "secret",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create store: %s", err)
+	}
+	if store.Location.Key != "keystore/tenant/" {
+		t.Errorf("Store has key prefix %s", store.Location.Key)
+	}
+	if store.Encryption.ServerSideEncryption != string(types.ServerSideEncryptionAwsKms) {
+		t.Errorf("KMS key did not imply aws:kms encryption")
+	}
+	if _, err = NewS3BlobStore(&locationpb.Location{}); err == nil {
+		t.Errorf("Created store of a location which is not S3")
+	}
+}
+
+func TestWithContext(t *testing.T) {
+	store, _ := newMockStore()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if ctxStore := store.WithContext(ctx); ctxStore.context() != ctx || store.context() == ctx {
+		t.Fatalf("WithContext did not give a copy using the context")
+	}
+}
+
+// slowDown is a response error of S3 throttling requests
+func slowDown() error {
+	return &smithy.OperationError{
+		ServiceID:     "S3",
+		OperationName: "GetObject",
+		Err:           &smithy.GenericAPIError{Code: "SlowDown", Message: "Please reduce your request rate."},
+	}
+}
+
+func TestRetry(t *testing.T) {
+	store, err := newS3BlobStore(locationpb.S3Ref{Bucket: "bucket", Region: "us-east-1"}, S3BlobStoreOptions{
+		Retry: s3store.RetryPolicy{
+			MaxAttempts: 3,
+			BaseDelay:   time.Millisecond,
+			MaxDelay:    10 * time.Millisecond,
+		},
+		MaxAttempts: 5,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create store: %s", err)
+	}
+	if attempts := store.Client.(*s3.Client).Options().RetryMaxAttempts; attempts != 1 {
+		t.Fatalf("SDK retries are not disabled under a retry policy: %d attempts", attempts)
+	}
+	client := newFakeClient("bucket")
+	store.Client = client
+	client.Failures = []error{slowDown(), slowDown()}
+	if _, err = store.PutBlob("present", []byte("content")); err != nil {
+		t.Fatalf("Failed to put blob after retries: %s", err)
+	}
+	if client.Requests != 3 {
+		t.Fatalf("Put blob after %d requests", client.Requests)
+	}
+	client.Requests = 0
+	client.Failures = []error{slowDown(), slowDown()}
+	content, _, err := store.GetBlob("present")
+	if err != nil || string(content) != "content" || client.Requests != 3 {
+		t.Fatalf("Got %q, %v after %d requests", content, err, client.Requests)
+	}
+	client.Requests = 0
+	if _, _, err = store.GetBlob("missing"); !messagestore.IsNotFound(err) || client.Requests != 1 {
+		t.Fatalf("Getting missing blob gave %v after %d requests", err, client.Requests)
+	}
+	client.Requests = 0
+	client.Failures = []error{slowDown(), slowDown(), slowDown()}
+	if _, err = store.DeleteBlob("present"); err == nil || client.Requests != 3 {
+		t.Fatalf("Deleting blob gave %v after %d requests", err, client.Requests)
+	}
+	sdkStore, err := newS3BlobStore(locationpb.S3Ref{Bucket: "bucket", Region: "us-east-1"}, S3BlobStoreOptions{MaxAttempts: 5})
+	if err != nil {
+		t.Fatalf("Failed to create store: %s", err)
+	}
+	if attempts := sdkStore.Client.(*s3.Client).Options().RetryMaxAttempts; attempts != 5 {
+		t.Fatalf("SDK retries %d times without a retry policy", attempts)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	store, primary := newMockStore()
+	unreachable, unreachableClient := newMockStore()
+	unreachableClient.Failures = []error{&smithy.OperationError{
+		ServiceID:     "S3",
+		OperationName: "GetObject",
+		Err:           &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")},
+	}}
+	fallback, fallbackClient := newMockStore()
+	if _, err := fallback.PutBlob("apps/1", []byte("replicated")); err != nil {
+		t.Fatalf("Failed to put blob to fallback: %s", err)
+	}
+	store.Fallbacks = []*S3BlobStore{unreachable, fallback}
+	primary.Failures = []error{slowDown()}
+	content, _, err := store.GetBlob("apps/1")
+	if err != nil {
+		t.Fatalf("Failed to get blob from fallback: %s", err)
+	}
+	if string(content) != "replicated" || unreachableClient.Requests != 1 {
+		t.Fatalf("Got content %s from fallback after %d requests of the unreachable replica", content, unreachableClient.Requests)
+	}
+	fallbackClient.Requests = 0
+	if _, _, err = store.GetBlob("missing"); !messagestore.IsNotFound(err) {
+		t.Fatalf("Expected not found error from primary but got %v", err)
+	}
+	if fallbackClient.Requests != 0 {
+		t.Fatalf("Missing blob was got from fallback")
+	}
+	primary.Failures = []error{slowDown()}
+	if _, err = store.PutBlob("apps/2", []byte("new")); err == nil {
+		t.Fatalf("Put to failing primary succeeded")
+	}
+	if fallbackClient.Object("root/apps/2") != nil {
+		t.Fatalf("Put was made to fallback without fan out")
+	}
+}
+
+func TestFanOutWrites(t *testing.T) {
+	store, primary := newMockStore()
+	fallback, fallbackClient := newMockStore()
+	store.Fallbacks = []*S3BlobStore{fallback}
+	if _, err := store.PutBlob("primary-only", []byte("content")); err != nil {
+		t.Fatalf("Failed to put blob: %s", err)
+	}
+	if fallbackClient.Object("root/primary-only") != nil {
+		t.Fatalf("Put was made to fallback without fan out")
+	}
+	store.FanOutWrites = true
+	if _, err := store.PutBlob("everywhere", []byte("content")); err != nil {
+		t.Fatalf("Failed to put blob: %s", err)
+	}
+	if primary.Object("root/everywhere") == nil || fallbackClient.Object("root/everywhere") == nil {
+		t.Fatalf("Fanned out put was not made to primary and fallback")
+	}
+	if _, err := store.DeleteBlob("everywhere"); err != nil {
+		t.Fatalf("Failed to delete blob: %s", err)
+	}
+	if fallbackClient.Object("root/everywhere") != nil {
+		t.Fatalf("Fanned out delete left fallback object")
+	}
+	if _, err := store.PutBlobIfMatch("conditional", []byte("content"), nil); err != nil {
+		t.Fatalf("Failed to put blob conditionally: %s", err)
+	}
+	if fallbackClient.Object("root/conditional") != nil {
+		t.Fatalf("Conditional put was fanned out")
+	}
+}
+
+func TestNewS3BlobStoreFallbacks(t *testing.T) {
+	loc := s3store.S3Location("bucket", "us-east-1", "keystore")
+	store, err := NewS3BlobStoreWithOptions(loc, S3BlobStoreOptions{
+		Retry:        s3store.DefaultRetryPolicy,
+		Fallbacks:    []locationpb.S3Ref{{Bucket: "replica", Region: "us-west-2", Key: "keystore"}},
+		FanOutWrites: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create store: %s", err)
+	}
+	if len(store.Fallbacks) != 1 || !store.FanOutWrites {
+		t.Fatalf("Store has fallbacks %v, fan out %t", store.Fallbacks, store.FanOutWrites)
+	}
+	if fallback := store.Fallbacks[0]; fallback.Location.Bucket != "replica" || fallback.Location.Key != "keystore/" || fallback.Retry != s3store.DefaultRetryPolicy {
+		t.Fatalf("Fallback at %v retrying by %+v", fallback.Location, fallback.Retry)
+	}
+}
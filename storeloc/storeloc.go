@@ -0,0 +1,124 @@
+// Create blob stores of the backend described by a location
+package storeloc
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/aefalcon/github-keystore-protobuf/go/locationpb"
+	"github.com/aefalcon/go-github-keystore/filestore"
+	"github.com/aefalcon/go-github-keystore/kslog"
+	"github.com/aefalcon/go-github-keystore/messagestore"
+	"github.com/aefalcon/go-github-keystore/s3store"
+	"github.com/aefalcon/go-github-keystore/s3storev2"
+)
+
+// FILE_SCHEME is the scheme of URL locations of directory trees
+const FILE_SCHEME = "file"
+
+// MEM_SCHEME is the scheme of URL locations of empty in-memory stores, such
+// as "mem:", for tests and local development
+const MEM_SCHEME = "mem"
+
+// SDK_PARAM is the query parameter of s3:// URL locations choosing the
+// version of the AWS SDK used, which is version 1 unless it is SDK_V2
+const SDK_PARAM = "sdk"
+
+// SDK_V2 is the SDK_PARAM value of locations of stores using version 2 of the
+// AWS SDK
+const SDK_V2 = "v2"
+
+// NoLocation is an error indicating a location is nil or has no backend set
+type NoLocation struct{}
+
+func (e NoLocation) Error() string {
+	return "no location is set"
+}
+
+// UnsupportedScheme is an error indicating no backend stores blobs at URLs
+// of a scheme.  It may be converted to string to get the scheme.
+type UnsupportedScheme string
+
+func (e UnsupportedScheme) Error() string {
+	return fmt.Sprintf("URL scheme %q is not supported", string(e))
+}
+
+// NewFromLocation creates a blob store of the backend described by loc.  S3
+// locations give an *s3store.S3BlobStore.  URL locations give an S3 store for
+// s3:// URLs, as parsed by s3store.ParseLocationURI with the endpoint of
+// s3store.LocationURIOptions, being an *s3storev2.S3BlobStore with an sdk=v2
+// query parameter, and a *filestore.FileBlobStore for file:// URLs, syncing
+// writes to disk with a fsync=true query parameter.  Each mem: URL gives a
+// new, empty *messagestore.MemStore.
+func NewFromLocation(loc *locationpb.Location, logger kslog.KsLogger) (messagestore.BlobStore, error) {
+	if loc == nil || loc.Location == nil {
+		logger.Errorf("Cannot create store without a location")
+		return nil, NoLocation{}
+	}
+	switch l := loc.Location.(type) {
+	case *locationpb.Location_S3:
+		logger.Debugf("Using S3 bucket %s", l.S3.Bucket)
+		return s3store.NewS3BlobStore(loc)
+	case *locationpb.Location_Url:
+		return newFromUrl(l.Url, logger)
+	}
+	logger.Errorf("Cannot create store at location of type %T", loc.Location)
+	return nil, (*messagestore.UnsupportedLocation)(loc)
+}
+
+// newFromUrl creates a blob store of the backend of a URL's scheme
+func newFromUrl(rawUrl string, logger kslog.KsLogger) (messagestore.BlobStore, error) {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		logger.Errorf("Failed to parse store URL %s: %s", rawUrl, err)
+		return nil, err
+	}
+	switch parsed.Scheme {
+	case s3store.LOCATION_SCHEME:
+		loc, err := s3store.ParseLocationURI(rawUrl)
+		if err != nil {
+			logger.Errorf("Failed to parse S3 location %s: %s", rawUrl, err)
+			return nil, err
+		}
+		if parsed.Query().Get(SDK_PARAM) == SDK_V2 {
+			opts, err := s3storev2.LocationURIOptions(rawUrl)
+			if err != nil {
+				logger.Errorf("Failed to parse S3 location %s: %s", rawUrl, err)
+				return nil, err
+			}
+			logger.Debugf("Using S3 bucket %s with version 2 of the AWS SDK", loc.GetS3().Bucket)
+			return s3storev2.NewS3BlobStoreWithOptions(loc, opts)
+		}
+		opts, err := s3store.LocationURIOptions(rawUrl)
+		if err != nil {
+			logger.Errorf("Failed to parse S3 location %s: %s", rawUrl, err)
+			return nil, err
+		}
+		logger.Debugf("Using S3 bucket %s", loc.GetS3().Bucket)
+		return s3store.NewS3BlobStoreWithOptions(loc, opts)
+	case FILE_SCHEME:
+		logger.Debugf("Using directory %s", parsed.Path)
+		store := filestore.NewFileBlobStore(parsed.Path)
+		store.Fsync = parsed.Query().Get("fsync") == "true"
+		return store, nil
+	case MEM_SCHEME:
+		logger.Debugf("Using an in-memory store")
+		return messagestore.NewMemBlobStore(), nil
+	}
+	logger.Errorf("No store supports URL %s", rawUrl)
+	return nil, UnsupportedScheme(parsed.Scheme)
+}
+
+// WithContext binds the requests of a store to ctx, so they are cancelled
+// when ctx is done.  Stores of backends without cancellable requests are
+// returned unchanged.
+func WithContext(store messagestore.BlobStore, ctx context.Context) messagestore.BlobStore {
+	switch s3Store := store.(type) {
+	case *s3store.S3BlobStore:
+		return s3Store.WithContext(ctx)
+	case *s3storev2.S3BlobStore:
+		return s3Store.WithContext(ctx)
+	}
+	return store
+}
@@ -0,0 +1,120 @@
+package storeloc
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aefalcon/github-keystore-protobuf/go/locationpb"
+	"github.com/aefalcon/go-github-keystore/filestore"
+	"github.com/aefalcon/go-github-keystore/kslog"
+	"github.com/aefalcon/go-github-keystore/messagestore"
+	"github.com/aefalcon/go-github-keystore/s3store"
+	"github.com/aefalcon/go-github-keystore/s3storev2"
+)
+
+func urlLocation(url string) *locationpb.Location {
+	return &locationpb.Location{
+		Location: &locationpb.Location_Url{
+			Url: url,
+		},
+	}
+}
+
+func TestNewFromS3Location(t *testing.T) {
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	locations := []*locationpb.Location{
+		s3store.S3Location("bucket", "us-east-1", "keystore"),
+		urlLocation("s3://bucket/keystore?region=us-east-1"),
+	}
+	for _, loc := range locations {
+		store, err := NewFromLocation(loc, &logger)
+		if err != nil {
+			t.Fatalf("Failed to create store at %v: %s", loc, err)
+		}
+		s3Store, ok := store.(*s3store.S3BlobStore)
+		if !ok {
+			t.Fatalf("Created %T at %v", store, loc)
+		}
+		if s3Store.Location.Bucket != "bucket" || s3Store.Location.Key != "keystore/" || s3Store.Location.Region != "us-east-1" {
+			t.Errorf("Created store at %v for %v", s3Store.Location, loc)
+		}
+		if _, ok := WithContext(store, context.Background()).(*s3store.S3BlobStore); !ok {
+			t.Errorf("Binding context of S3 store gave another type")
+		}
+	}
+}
+
+func TestNewFromS3V2Location(t *testing.T) {
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	store, err := NewFromLocation(urlLocation("s3://bucket/keystore?region=us-east-1&sdk=v2"), &logger)
+	if err != nil {
+		t.Fatalf("Failed to create store: %s", err)
+	}
+	s3Store, ok := store.(*s3storev2.S3BlobStore)
+	if !ok {
+		t.Fatalf("Created %T", store)
+	}
+	if s3Store.Location.Bucket != "bucket" || s3Store.Location.Key != "keystore/" || s3Store.Retry != s3store.DefaultRetryPolicy {
+		t.Errorf("Created store at %v retrying by %+v", s3Store.Location, s3Store.Retry)
+	}
+	if _, ok := WithContext(store, context.Background()).(*s3storev2.S3BlobStore); !ok {
+		t.Errorf("Binding context of S3 store gave another type")
+	}
+}
+
+func TestNewFromFileLocation(t *testing.T) {
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	store, err := NewFromLocation(urlLocation("file:///var/keystore"), &logger)
+	if err != nil {
+		t.Fatalf("Failed to create store: %s", err)
+	}
+	fileStore, ok := store.(*filestore.FileBlobStore)
+	if !ok || fileStore.Root != "/var/keystore" {
+		t.Fatalf("Created %#v", store)
+	}
+	store, err = NewFromLocation(urlLocation("file:///var/keystore?fsync=true"), &logger)
+	if fileStore, ok := store.(*filestore.FileBlobStore); err != nil || !ok || fileStore.Root != "/var/keystore" || !fileStore.Fsync {
+		t.Fatalf("Created %#v, %v for fsync location", store, err)
+	}
+	if WithContext(store, context.Background()) != store {
+		t.Errorf("Binding context changed file store")
+	}
+}
+
+func TestNewFromMemLocation(t *testing.T) {
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	store, err := NewFromLocation(urlLocation("mem:"), &logger)
+	if err != nil {
+		t.Fatalf("Failed to create store: %s", err)
+	}
+	if _, ok := store.(*messagestore.MemStore); !ok {
+		t.Fatalf("Created %T", store)
+	}
+}
+
+func TestNewFromUnsupportedLocation(t *testing.T) {
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	for _, loc := range []*locationpb.Location{nil, &locationpb.Location{}} {
+		if _, err := NewFromLocation(loc, &logger); err != (NoLocation{}) {
+			t.Errorf("Expected NoLocation for %v but got %v", loc, err)
+		}
+	}
+	_, err := NewFromLocation(urlLocation("gs://bucket/keystore"), &logger)
+	if scheme, ok := err.(UnsupportedScheme); !ok || string(scheme) != "gs" {
+		t.Errorf("Expected UnsupportedScheme(gs) but got %v", err)
+	}
+	_, err = NewFromLocation(urlLocation("s3:///keystore"), &logger)
+	if _, ok := err.(*s3store.InvalidLocationURI); !ok {
+		t.Errorf("Expected InvalidLocationURI but got %v", err)
+	}
+}
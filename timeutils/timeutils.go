@@ -1,19 +1,45 @@
 package timeutils
 
 import (
+	"math"
 	"time"
 )
 
+// FloatToTime converts seconds since the Unix epoch, as in the NumericDate of
+// JWT claims such as `exp` and `iat`, to a time.  It is the inverse of
+// TimeToFloat.  Whole seconds convert exactly, while fractions are rounded to
+// the nearest microsecond since a float64 cannot hold nanoseconds of current
+// times.
 func FloatToTime(ts float64) time.Time {
-	seconds := int64(ts)
-	fraction := ts - float64(seconds)
-	nanos := int64(fraction * 1e9)
-	return time.Unix(seconds, nanos)
+	seconds := math.Floor(ts)
+	micros := math.Round((ts - seconds) * 1e6)
+	return time.Unix(int64(seconds), int64(micros)*int64(time.Microsecond))
 }
 
+// TimeToFloat converts a time to seconds since the Unix epoch.  Claims given
+// to GitHub must be whole seconds, so callers truncate the result with int64.
 func TimeToFloat(t time.Time) float64 {
 	unixNano := t.UnixNano()
 	floatT := float64(unixNano / int64(1e9))
 	floatT += float64(unixNano%1e9) / float64(1e9)
 	return floatT
 }
+
+// Clock provides the current time
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is a Clock reading the system time
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// FixedClock is a Clock that always reports the same time, for use in tests
+type FixedClock time.Time
+
+func (c FixedClock) Now() time.Time {
+	return time.Time(c)
+}
@@ -0,0 +1,40 @@
+package timeutils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFloatToTimeRoundTrip(t *testing.T) {
+	times := []time.Time{
+		time.Unix(0, 0),
+		time.Unix(1, 0),
+		time.Unix(-1, 0),
+		time.Unix(-1, 500*int64(time.Millisecond)),
+		time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		time.Date(2020, 1, 2, 3, 4, 5, 250*int(time.Millisecond), time.UTC),
+		time.Date(2020, 1, 2, 3, 4, 5, 999999*int(time.Microsecond), time.UTC),
+		time.Date(2038, 1, 19, 3, 14, 8, 1000, time.UTC),
+		time.Date(2100, 12, 31, 23, 59, 59, 123456*int(time.Microsecond), time.UTC),
+	}
+	for _, tm := range times {
+		if converted := FloatToTime(TimeToFloat(tm)); !converted.Equal(tm) {
+			t.Errorf("%s converted to %s", tm, converted)
+		}
+		whole := FloatToTime(float64(int64(TimeToFloat(tm))))
+		if tm.Unix() >= 0 && !whole.Equal(tm.Truncate(time.Second)) {
+			t.Errorf("Whole seconds of %s converted to %s", tm, whole)
+		}
+	}
+}
+
+func TestFloatToTimeRoundsMicroseconds(t *testing.T) {
+	tm := time.Date(2020, 1, 2, 3, 4, 5, 123456789, time.UTC)
+	expected := time.Date(2020, 1, 2, 3, 4, 5, 123457000, time.UTC)
+	if converted := FloatToTime(TimeToFloat(tm)); !converted.Equal(expected) {
+		t.Fatalf("%s converted to %s instead of %s", tm, converted, expected)
+	}
+	if converted := FloatToTime(1.5); !converted.Equal(time.Unix(1, 500*int64(time.Millisecond))) {
+		t.Fatalf("1.5 converted to %s", converted)
+	}
+}
@@ -0,0 +1,110 @@
+package tokenstore
+
+import (
+	"sync"
+
+	"github.com/aefalcon/github-keystore-protobuf/go/tokenpb"
+	"github.com/aefalcon/go-github-keystore/kslog"
+)
+
+// DEFAULT_BATCH_WORKERS is the number of installs GetInstallTokens gets
+// concurrently unless configured otherwise
+const DEFAULT_BATCH_WORKERS = 8
+
+// GetInstallTokensRequest requests install tokens of several installs of an
+// app
+type GetInstallTokensRequest struct {
+	App      uint64
+	Installs []uint64
+}
+
+// GetInstallTokensResponse has the install tokens of a GetInstallTokens
+// request by install id.  Each requested install has either a token or an
+// error.
+type GetInstallTokensResponse struct {
+	Tokens map[uint64]*tokenpb.InstallToken
+	Errors map[uint64]error
+}
+
+// GetInstallTokens provides valid install tokens for several installs of an
+// app, as GetInstallToken does each, getting at most BatchWorkers
+// concurrently.  Failures are reported per install in the response; an error
+// is only returned if the request itself is invalid.
+func (s *InstallTokenService) GetInstallTokens(req *GetInstallTokensRequest, logger kslog.KsLogger) (*GetInstallTokensResponse, error) {
+	if err := s.checkApp(req.App, logger); err != nil {
+		return nil, err
+	}
+	installs := make([]uint64, 0, len(req.Installs))
+	seen := make(map[uint64]bool, len(req.Installs))
+	for _, install := range req.Installs {
+		if !seen[install] {
+			seen[install] = true
+			installs = append(installs, install)
+		}
+	}
+	workers := s.BatchWorkers
+	if workers <= 0 {
+		workers = DEFAULT_BATCH_WORKERS
+	}
+	if workers > len(installs) {
+		workers = len(installs)
+	}
+	resp := GetInstallTokensResponse{
+		Tokens: make(map[uint64]*tokenpb.InstallToken, len(installs)),
+		Errors: make(map[uint64]error),
+	}
+	var mu sync.Mutex
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				installReq := tokenpb.GetInstallTokenRequest{
+					App:     req.App,
+					Install: installs[i],
+				}
+				installResp, err := s.GetInstallToken(&installReq, logger)
+				mu.Lock()
+				if err != nil {
+					resp.Errors[installs[i]] = err
+				} else {
+					resp.Tokens[installs[i]] = installResp.Token
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range installs {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+	return &resp, nil
+}
+
+// WarmInstallTokens provisions and caches install tokens for several installs
+// of an app ahead of their use, so later GetInstallToken calls are cache
+// hits.  Installs with a valid cached token are left as they are, and at most
+// BatchWorkers are provisioned concurrently.  If some installs fail, the
+// error is an *InstallTokensNotWarmed; the others are still warmed.  Tokens
+// which cannot be cached are only failures with RequirePersist.
+func (s *InstallTokenService) WarmInstallTokens(app uint64, installs []uint64, logger kslog.KsLogger) error {
+	req := GetInstallTokensRequest{
+		App:      app,
+		Installs: installs,
+	}
+	resp, err := s.GetInstallTokens(&req, logger)
+	if err != nil {
+		return err
+	}
+	if len(resp.Errors) != 0 {
+		logger.Errorf("Failed to warm tokens of %d of %d installs of app %d", len(resp.Errors), len(resp.Errors)+len(resp.Tokens), app)
+		return &InstallTokensNotWarmed{
+			App:    app,
+			Errors: resp.Errors,
+		}
+	}
+	return nil
+}
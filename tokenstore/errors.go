@@ -2,6 +2,9 @@ package tokenstore
 
 import (
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 )
 
 type UnallowedAppId uint64
@@ -18,3 +21,115 @@ type ReceivedInvalidToken struct {
 func (e *ReceivedInvalidToken) Error() string {
 	return e.Message
 }
+
+// ProviderLimitTimeout is an error indicating that no slot to call the
+// InstallTokenProvider became available within the wait time.
+type ProviderLimitTimeout time.Duration
+
+func (e ProviderLimitTimeout) Error() string {
+	return fmt.Sprintf("no install token provider slot available after %s", time.Duration(e))
+}
+
+// ExportUnsupported is an error indicating tokens cannot be exported from a
+// store.  It may be converted to string to get the reason.
+type ExportUnsupported string
+
+func (e ExportUnsupported) Error() string {
+	return fmt.Sprintf("cannot export tokens: %s", string(e))
+}
+
+// ScopeDenied is an error indicating an install token was requested with a
+// scope the caller is not allowed
+type ScopeDenied struct {
+	App     uint64
+	Install uint64
+	Reason  string
+}
+
+func (e *ScopeDenied) Error() string {
+	return fmt.Sprintf("scope denied for app %d install %d: %s", e.App, e.Install, e.Reason)
+}
+
+// ExpiredInstallToken is an error indicating a provider returned an install
+// token which had already expired
+type ExpiredInstallToken struct {
+	App        uint64
+	Install    uint64
+	Expiration time.Time
+}
+
+func (e *ExpiredInstallToken) Error() string {
+	return fmt.Sprintf("provider returned token for app %d install %d which expired at %s", e.App, e.Install, e.Expiration.Format(time.RFC3339))
+}
+
+// AppPrefixUnsupported is an error indicating the names of an app's install
+// tokens have no common prefix distinguishing them from those of other apps.
+// It may be converted to string to get the InstallTokens template.
+type AppPrefixUnsupported string
+
+func (e AppPrefixUnsupported) Error() string {
+	return fmt.Sprintf("install token template %s has no prefix distinguishing apps", string(e))
+}
+
+// InvalidLinks is an error indicating a template of the links of a token
+// store cannot name tokens
+type InvalidLinks struct {
+	Link     string // Field of the template, such as "AppTokens"
+	Template string
+	Message  string
+}
+
+func (e *InvalidLinks) Error() string {
+	return fmt.Sprintf("invalid %s template %q: %s", e.Link, e.Template, e.Message)
+}
+
+// TokenNotPersisted is an error indicating a newly provisioned install token
+// could not be cached while the service requires tokens to be persisted
+type TokenNotPersisted struct {
+	App     uint64
+	Install uint64
+	Cause   error // Why the token could not be put
+}
+
+func (e *TokenNotPersisted) Error() string {
+	return fmt.Sprintf("token for app %d install %d was not persisted: %s", e.App, e.Install, e.Cause)
+}
+
+// InstallTokensNotWarmed is an error indicating WarmInstallTokens failed to
+// provide tokens for some installs of an app
+type InstallTokensNotWarmed struct {
+	App    uint64
+	Errors map[uint64]error // Errors by install
+}
+
+func (e *InstallTokensNotWarmed) Error() string {
+	installs := make([]uint64, 0, len(e.Errors))
+	for install := range e.Errors {
+		installs = append(installs, install)
+	}
+	sort.Slice(installs, func(i, j int) bool { return installs[i] < installs[j] })
+	failures := make([]string, len(installs))
+	for i, install := range installs {
+		failures[i] = fmt.Sprintf("install %d: %s", install, e.Errors[install])
+	}
+	return fmt.Sprintf("failed to warm tokens of app %d: %s", e.App, strings.Join(failures, "; "))
+}
+
+// RateLimitError is an error indicating GitHub refused to provide tokens
+// until its rate limit resets.  Providers may return it so InstallTokenService
+// stops calling them for the app until Reset.
+type RateLimitError struct {
+	Reset time.Time // When the rate limit resets and calls may resume
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("github rate limit exceeded until %s", e.Reset.Format(time.RFC3339))
+}
+
+// RetryAfter gets how long after now a call may be retried
+func (e *RateLimitError) RetryAfter(now time.Time) time.Duration {
+	if wait := e.Reset.Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
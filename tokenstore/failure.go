@@ -0,0 +1,102 @@
+package tokenstore
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/aefalcon/go-github-keystore/kslog"
+	"github.com/aefalcon/go-github-keystore/messagestore"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+)
+
+// Stages of provisioning an install token at which a TokenFailure occurs
+const (
+	FAILURE_STAGE_MINT    = "mint"    // The provider gave no usable token
+	FAILURE_STAGE_PERSIST = "persist" // The new token could not be cached
+)
+
+// DEFAULT_FAILURE_PREFIX is the name prefix of the records of a
+// MessageFailureSink unless configured otherwise
+const DEFAULT_FAILURE_PREFIX = "failures/"
+
+// TokenFailure describes a failure to mint or persist an install token
+type TokenFailure struct {
+	App     uint64
+	Install uint64
+	Stage   string    // FAILURE_STAGE_MINT or FAILURE_STAGE_PERSIST
+	Reason  string    // Message of the error
+	Time    time.Time // When the failure occurred, by the service's Clock
+}
+
+// FailureSink records the failures of an InstallTokenService to mint or
+// persist install tokens, so they outlive the logs.  Errors recording a
+// failure are logged and do not change the result of the request.
+type FailureSink interface {
+	RecordFailure(failure *TokenFailure) error
+}
+
+// NopFailureSink discards failures, as an InstallTokenService without a
+// FailureSink does
+type NopFailureSink struct{}
+
+func (NopFailureSink) RecordFailure(failure *TokenFailure) error {
+	return nil
+}
+
+// MessageFailureSink is a FailureSink appending a document for each failure
+// to a message store, named by the failure's app, install and time under
+// Prefix.  Each document is a struct with the fields app, install, stage,
+// reason and time, the time formatted as RFC 3339.
+type MessageFailureSink struct {
+	Store  messagestore.MessageStore
+	Prefix string // Prefix of the names of records; defaults to DEFAULT_FAILURE_PREFIX
+	seq    uint64
+}
+
+var _ FailureSink = &MessageFailureSink{}
+var _ FailureSink = NopFailureSink{}
+
+// FailureName gets the name of the record of a failure.  Names of an
+// install's records sort by time, with a sequence number distinguishing
+// failures at the same time.
+func (s *MessageFailureSink) FailureName(failure *TokenFailure) string {
+	prefix := s.Prefix
+	if prefix == "" {
+		prefix = DEFAULT_FAILURE_PREFIX
+	}
+	seq := atomic.AddUint64(&s.seq, 1)
+	return fmt.Sprintf("%s%d/%d/%020d-%d", prefix, failure.App, failure.Install, failure.Time.UnixNano(), seq)
+}
+
+func (s *MessageFailureSink) RecordFailure(failure *TokenFailure) error {
+	record := structpb.Struct{
+		Fields: map[string]*structpb.Value{
+			"app":     &structpb.Value{Kind: &structpb.Value_NumberValue{NumberValue: float64(failure.App)}},
+			"install": &structpb.Value{Kind: &structpb.Value_NumberValue{NumberValue: float64(failure.Install)}},
+			"stage":   &structpb.Value{Kind: &structpb.Value_StringValue{StringValue: failure.Stage}},
+			"reason":  &structpb.Value{Kind: &structpb.Value_StringValue{StringValue: failure.Reason}},
+			"time":    &structpb.Value{Kind: &structpb.Value_StringValue{StringValue: failure.Time.UTC().Format(time.RFC3339Nano)}},
+		},
+	}
+	_, err := s.Store.PutMessage(s.FailureName(failure), &record)
+	return err
+}
+
+// recordFailure passes a failure to provision a token to the FailureSink, if
+// set
+func (s *InstallTokenService) recordFailure(app, install uint64, stage string, cause error, logger kslog.KsLogger) {
+	if s.FailureSink == nil {
+		return
+	}
+	err := s.FailureSink.RecordFailure(&TokenFailure{
+		App:     app,
+		Install: install,
+		Stage:   stage,
+		Reason:  cause.Error(),
+		Time:    s.now(),
+	})
+	if err != nil {
+		logger.Errorf("Failed to record %s failure for app %d install %d: %s", stage, app, install, err)
+	}
+}
@@ -0,0 +1,85 @@
+package tokenstore
+
+import (
+	"sync"
+
+	"github.com/aefalcon/github-keystore-protobuf/go/tokenpb"
+	"github.com/golang/protobuf/proto"
+)
+
+// flightKey identifies the token a flight mints, with install 0 for app
+// tokens
+type flightKey struct {
+	App     uint64
+	Install uint64
+}
+
+// flight is a mint in progress, whose result is shared by every caller
+// waiting for it
+type flight struct {
+	done        chan struct{}
+	token       proto.Message
+	fingerprint string // Fingerprint of the app key the token was minted with, if known
+	err         error
+}
+
+// flightGroup de-duplicates concurrent mints of the same token, so a burst of
+// cache misses calls the providers once rather than once per request
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[flightKey]*flight
+}
+
+// do calls mint unless a mint of the same key is already in flight, in which
+// case its result is waited for instead.  Callers sharing another's result get
+// a copy of its token, so tokens are not shared between goroutines, along with
+// the fingerprint of the key it was minted with.
+func (g *flightGroup) do(key flightKey, mint func() (proto.Message, string, error)) (proto.Message, string, error) {
+	g.mu.Lock()
+	if g.flights == nil {
+		g.flights = make(map[flightKey]*flight)
+	}
+	if f, found := g.flights[key]; found {
+		g.mu.Unlock()
+		<-f.done
+		if f.err != nil {
+			return nil, "", f.err
+		}
+		return proto.Clone(f.token), f.fingerprint, nil
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	g.mu.Unlock()
+	f.token, f.fingerprint, f.err = mint()
+	g.mu.Lock()
+	delete(g.flights, key)
+	g.mu.Unlock()
+	close(f.done)
+	return f.token, f.fingerprint, f.err
+}
+
+// mintAppToken signs and caches a new app token, sharing the token with
+// concurrent callers for the same app
+func (s *InstallTokenService) mintAppToken(app uint64, getNew func() (*tokenpb.AppToken, error)) (*tokenpb.AppToken, error) {
+	token, _, err := s.appFlights.do(flightKey{App: app}, func() (proto.Message, string, error) {
+		appToken, err := getNew()
+		return appToken, "", err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return token.(*tokenpb.AppToken), nil
+}
+
+// mintInstallToken provisions and caches a new install token, sharing the
+// token and the fingerprint of the app key it was minted with with concurrent
+// callers for the same install
+func (s *InstallTokenService) mintInstallToken(app, install uint64, create func() (*tokenpb.InstallToken, string, error)) (*tokenpb.InstallToken, string, error) {
+	token, fingerprint, err := s.installFlights.do(flightKey{App: app, Install: install}, func() (proto.Message, string, error) {
+		return create()
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return token.(*tokenpb.InstallToken), fingerprint, nil
+}
@@ -0,0 +1,173 @@
+package tokenstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/aefalcon/github-keystore-protobuf/go/tokenpb"
+	"github.com/aefalcon/go-github-keystore/kslog"
+	"github.com/aefalcon/go-github-keystore/messagestore"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+)
+
+// DEFAULT_IDEMPOTENCY_WINDOW is how long the token served for an idempotency
+// key is served again for the same key unless configured otherwise
+const DEFAULT_IDEMPOTENCY_WINDOW = 5 * time.Minute
+
+// idempotencySuffix separates the name of an install token from the hashed
+// idempotency key in the name of its idempotency records
+const idempotencySuffix = "-idempotency-"
+
+// idempotencyWindow gets how long tokens are recorded for idempotency keys
+func (s *InstallTokenService) idempotencyWindow() time.Duration {
+	if s.IdempotencyWindow <= 0 {
+		return DEFAULT_IDEMPOTENCY_WINDOW
+	}
+	return s.IdempotencyWindow
+}
+
+// IdempotencyRecord is the document recording the install token served for
+// an idempotency key.  It holds a hash of the token rather than the token, so
+// the secret is only kept in the install's token document and a record can
+// serve nothing once that token is replaced or invalidated.  It is declared
+// here rather than generated, since the keystore's protobuf packages do not
+// describe it; its fields are encoded as those of the protobuf message
+//
+//	message IdempotencyRecord {
+//	    uint64 app = 1;
+//	    uint64 install = 2;
+//	    string token_sha256 = 3;
+//	}
+type IdempotencyRecord struct {
+	App         uint64 `protobuf:"varint,1,opt,name=app,proto3" json:"app,omitempty"`
+	Install     uint64 `protobuf:"varint,2,opt,name=install,proto3" json:"install,omitempty"`
+	TokenSha256 string `protobuf:"bytes,3,opt,name=token_sha256,json=tokenSha256,proto3" json:"token_sha256,omitempty"`
+}
+
+func (m *IdempotencyRecord) Reset()         { *m = IdempotencyRecord{} }
+func (m *IdempotencyRecord) String() string { return proto.CompactTextString(m) }
+func (*IdempotencyRecord) ProtoMessage()    {}
+
+// tokenSha256 gets the hex encoded SHA-256 hash of a token
+func tokenSha256(token string) string {
+	digest := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(digest[:])
+}
+
+// IdempotentInstallTokenName gets the name of the document recording the
+// install token served for an idempotency key.  The name is that of the
+// install token suffixed with a hash of the key, so records are deleted
+// along with the app's tokens by DeleteAppTokens, though PruneExpiredTokens
+// leaves them to expire by their window.
+func (s *TokenMessageStore) IdempotentInstallTokenName(app, install uint64, key string) (string, error) {
+	name, err := s.InstallTokenName(app, install)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("%s%s%s", name, idempotencySuffix, hex.EncodeToString(digest[:8])), nil
+}
+
+// GetInstallTokenIdempotent provides an install token like GetInstallToken,
+// recording the token served for an idempotency key chosen by the caller, so
+// a retried request repeating the key within the IdempotencyWindow is served
+// the same token rather than minting another.  Only while that token is still
+// the install's cached token is it served again; a token since refreshed,
+// invalidated or evicted is not.  Records expire with the window, or with
+// their token if it expires first, and are kept in the MessageStore, tagged
+// with messagestore.EXPIRES_META if it supports metadata.  Without a key, the
+// token is got as by GetInstallToken.
+func (s *InstallTokenService) GetInstallTokenIdempotent(req *tokenpb.GetInstallTokenRequest, key string, logger kslog.KsLogger) (*tokenpb.GetInstallTokenResponse, error) {
+	if key == "" {
+		return s.GetInstallToken(req, logger)
+	}
+	if err := s.checkApp(req.App, logger); err != nil {
+		return nil, err
+	}
+	name, err := s.IdempotentInstallTokenName(req.App, req.Install, key)
+	if err != nil {
+		return nil, err
+	}
+	if installToken := s.idempotentToken(name, req, logger); installToken != nil {
+		logger.Logf("Serving app %d install %d token recorded for idempotency key", req.App, req.Install)
+		resp := tokenpb.GetInstallTokenResponse{
+			Token: installToken,
+		}
+		return &resp, nil
+	}
+	resp, err := s.GetInstallToken(req, logger)
+	if err != nil {
+		return nil, err
+	}
+	s.recordIdempotentToken(name, resp.Token, logger)
+	return resp, nil
+}
+
+// idempotentToken gets the install's cached token if the record under name
+// is for the requested install, within the IdempotencyWindow and of that
+// token, and the token is still valid.  When the store keeps no metadata, the
+// window is from when the record was last modified, and records of stores
+// which report neither are never served.
+func (s *InstallTokenService) idempotentToken(name string, req *tokenpb.GetInstallTokenRequest, logger kslog.KsLogger) *tokenpb.InstallToken {
+	var record IdempotencyRecord
+	meta, err := s.GetMessage(name, &record)
+	if err != nil {
+		if !isCacheMiss(err) {
+			kslog.Warnf(logger, "Failed to get idempotency record %s: %s", name, err)
+		}
+		return nil
+	}
+	if record.App != req.App || record.Install != req.Install {
+		return nil
+	}
+	var expires time.Time
+	if meta != nil {
+		if expires, err = time.Parse(time.RFC3339, meta.Metadata[messagestore.EXPIRES_META]); err != nil {
+			expires = time.Time{}
+		}
+		if expires.IsZero() && !meta.LastModified.IsZero() {
+			expires = meta.LastModified.Add(s.idempotencyWindow())
+		}
+	}
+	if !s.now().Before(expires) {
+		return nil
+	}
+	installToken, _, err := s.TokenMessageStore.GetInstallToken(req.App, req.Install)
+	if err != nil {
+		if !isCacheMiss(err) {
+			kslog.Warnf(logger, "Failed to get app %d install %d token from store: %s", req.App, req.Install, err)
+		}
+		return nil
+	}
+	if tokenSha256(installToken.Token) != record.TokenSha256 || !s.installTokenIsValid(installToken, logger) {
+		return nil
+	}
+	return installToken
+}
+
+// recordIdempotentToken records a hash of the token served for an
+// idempotency key.  Failing to record it is only logged, since the token was
+// already served.
+func (s *InstallTokenService) recordIdempotentToken(name string, installToken *tokenpb.InstallToken, logger kslog.KsLogger) {
+	expires := s.now().Add(s.idempotencyWindow())
+	if expiration, err := ptypes.Timestamp(installToken.Expiration); err == nil && expiration.Before(expires) {
+		expires = expiration
+	}
+	record := IdempotencyRecord{
+		App:         installToken.App,
+		Install:     installToken.Install,
+		TokenSha256: tokenSha256(installToken.Token),
+	}
+	var err error
+	if metaStore, ok := s.MessageStore.(messagestore.MetadataMessageStore); ok {
+		_, err = metaStore.PutMessageWithMetadata(name, &record, messagestore.ExpiresMetadata(expires, nil))
+	} else {
+		_, err = s.PutMessage(name, &record)
+	}
+	if err != nil {
+		kslog.Warnf(logger, "Failed to put idempotency record %s: %s", name, err)
+	}
+}
@@ -1,8 +1,10 @@
 package tokenstore
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"time"
@@ -10,23 +12,79 @@ import (
 
 type InstallTokenProvider func(install uint64, appToken string) (string, time.Time, error)
 
+// ScopedInstallTokenProvider provides install tokens restricted to a scope
+type ScopedInstallTokenProvider func(install uint64, appToken string, scope *InstallTokenScope) (string, time.Time, error)
+
+// v3InstallTokenReq is the body of a v3 request for a scoped install token
+type v3InstallTokenReq struct {
+	Repositories  []string          `json:"repositories,omitempty"`
+	RepositoryIds []uint64          `json:"repository_ids,omitempty"`
+	Permissions   map[string]string `json:"permissions,omitempty"`
+}
+
 type V3InstallTokenResp struct {
 	Token     string `json:"token"`
 	ExpiresAt string `json:"expires_at"`
 }
 
+// V3_API_URL is the base URL of the github v3 API
+const V3_API_URL = "https://api.github.com"
+
+// V3InstallTokenClient requests install tokens from a github v3 API
+type V3InstallTokenClient struct {
+	BaseUrl string       // Base URL of the API, such as V3_API_URL
+	Client  *http.Client // Client used for requests
+}
+
+// V3InstallTokenProvider is an InstallTokenProvider using the public github
+// v3 API.
 func V3InstallTokenProvider(install uint64, appToken string) (string, time.Time, error) {
-	url := fmt.Sprintf("https://api.github.com/app/installations/%d/access_tokens", install)
-	httpReq, err := http.NewRequest(http.MethodPost, url, nil)
+	client := V3InstallTokenClient{
+		BaseUrl: V3_API_URL,
+		Client:  http.DefaultClient,
+	}
+	return client.InstallTokenProvider(install, appToken)
+}
+
+// InstallTokenProvider requests a new install token from the API.  It may be
+// used as an InstallTokenProvider.
+func (c *V3InstallTokenClient) InstallTokenProvider(install uint64, appToken string) (string, time.Time, error) {
+	return c.ScopedInstallTokenProvider(install, appToken, nil)
+}
+
+// ScopedInstallTokenProvider requests a new install token restricted to a
+// scope from the API.  It may be used as a ScopedInstallTokenProvider.
+func (c *V3InstallTokenClient) ScopedInstallTokenProvider(install uint64, appToken string, scope *InstallTokenScope) (string, time.Time, error) {
+	url := fmt.Sprintf("%s/app/installations/%d/access_tokens", c.BaseUrl, install)
+	var body io.Reader
+	if !scope.IsEmpty() {
+		reqEnt, err := json.Marshal(&v3InstallTokenReq{
+			Repositories:  scope.Repositories,
+			RepositoryIds: scope.RepositoryIds,
+			Permissions:   scope.Permissions,
+		})
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		body = bytes.NewReader(reqEnt)
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, url, body)
 	if err != nil {
 		return "", time.Time{}, err
 	}
+	if body != nil {
+		httpReq.Header.Add("Content-Type", "application/json")
+	}
 	httpReq.Header.Add("Authorization", fmt.Sprintf("Bearer %s", appToken))
 	httpReq.Header.Add("Accept", "application/vnd.github.machine-man-preview+json")
-	httpResp, err := http.DefaultClient.Do(httpReq)
+	httpResp, err := c.Client.Do(httpReq)
 	if err != nil {
 		return "", time.Time{}, err
 	}
+	defer httpResp.Body.Close()
+	if rateLimit := v3RateLimit(httpResp, time.Now()); rateLimit != nil {
+		return "", time.Time{}, rateLimit
+	}
 	respEnt, err := ioutil.ReadAll(httpResp.Body)
 	if err != nil {
 		return "", time.Time{}, err
@@ -0,0 +1,247 @@
+package tokenstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// INSTALL_TOKEN_SCOPE_META is the metadata key under which the scope of a
+// scoped install token is stored
+const INSTALL_TOKEN_SCOPE_META = "install-token-scope"
+
+// InstallTokenScope restricts an install token to a set of repositories and
+// permissions.  A nil or empty scope is the full scope of the installation.
+type InstallTokenScope struct {
+	Repositories  []string          // Repository names
+	RepositoryIds []uint64          // Repository IDs, restricting tokens along with any Repositories
+	Permissions   map[string]string // Permission names to access levels
+}
+
+// IsEmpty reports whether the scope places no restrictions on a token
+func (s *InstallTokenScope) IsEmpty() bool {
+	return s == nil || (len(s.Repositories) == 0 && len(s.RepositoryIds) == 0 && len(s.Permissions) == 0)
+}
+
+// String gets a canonical, human-readable form of the scope, such as
+// `repositories=a,b;permissions=contents:read,issues:write`.  Equal scopes have
+// the same canonical form regardless of ordering.  Repository IDs are appended
+// as `;repository_ids=1,2` only when set, so scopes without them keep the
+// form, and names, they had before IDs were supported.
+func (s *InstallTokenScope) String() string {
+	if s.IsEmpty() {
+		return ""
+	}
+	repos := make([]string, len(s.Repositories))
+	copy(repos, s.Repositories)
+	sort.Strings(repos)
+	perms := make([]string, 0, len(s.Permissions))
+	for name, level := range s.Permissions {
+		perms = append(perms, fmt.Sprintf("%s:%s", name, level))
+	}
+	sort.Strings(perms)
+	text := fmt.Sprintf("repositories=%s;permissions=%s", strings.Join(repos, ","), strings.Join(perms, ","))
+	if len(s.RepositoryIds) != 0 {
+		ids := make([]uint64, len(s.RepositoryIds))
+		copy(ids, s.RepositoryIds)
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		idTexts := make([]string, len(ids))
+		for i, id := range ids {
+			idTexts[i] = strconv.FormatUint(id, 10)
+		}
+		text += ";repository_ids=" + strings.Join(idTexts, ",")
+	}
+	return text
+}
+
+// Hash gets a short hash of the canonical form of the scope for use in names
+func (s *InstallTokenScope) Hash() string {
+	digest := sha256.Sum256([]byte(s.String()))
+	return hex.EncodeToString(digest[:8])
+}
+
+// ParseInstallTokenScope parses the canonical form of a scope
+func ParseInstallTokenScope(text string) (*InstallTokenScope, error) {
+	var scope InstallTokenScope
+	if text == "" {
+		return &scope, nil
+	}
+	for _, part := range strings.Split(text, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid install token scope %q", text)
+		}
+		if kv[1] == "" {
+			continue
+		}
+		switch kv[0] {
+		case "repositories":
+			scope.Repositories = strings.Split(kv[1], ",")
+		case "repository_ids":
+			for _, idText := range strings.Split(kv[1], ",") {
+				id, err := strconv.ParseUint(idText, 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid repository id %q in install token scope", idText)
+				}
+				scope.RepositoryIds = append(scope.RepositoryIds, id)
+			}
+		case "permissions":
+			scope.Permissions = make(map[string]string)
+			for _, perm := range strings.Split(kv[1], ",") {
+				nameLevel := strings.SplitN(perm, ":", 2)
+				if len(nameLevel) != 2 {
+					return nil, fmt.Errorf("invalid permission %q in install token scope", perm)
+				}
+				scope.Permissions[nameLevel[0]] = nameLevel[1]
+			}
+		default:
+			return nil, fmt.Errorf("unknown field %q in install token scope", kv[0])
+		}
+	}
+	return &scope, nil
+}
+
+// permissionLevels orders the access levels of permissions
+var permissionLevels = map[string]int{
+	"read":  1,
+	"write": 2,
+	"admin": 3,
+}
+
+// Within reports whether the scope grants no more than another scope.  An
+// empty scope grants everything.
+func (s *InstallTokenScope) Within(other *InstallTokenScope) bool {
+	if other.IsEmpty() {
+		return true
+	}
+	if s.IsEmpty() {
+		return false
+	}
+	if len(other.Repositories) != 0 {
+		if len(s.Repositories) == 0 {
+			return false
+		}
+		allowed := make(map[string]bool, len(other.Repositories))
+		for _, repo := range other.Repositories {
+			allowed[repo] = true
+		}
+		for _, repo := range s.Repositories {
+			if !allowed[repo] {
+				return false
+			}
+		}
+	}
+	if len(other.RepositoryIds) != 0 {
+		if len(s.RepositoryIds) == 0 {
+			return false
+		}
+		allowed := make(map[uint64]bool, len(other.RepositoryIds))
+		for _, id := range other.RepositoryIds {
+			allowed[id] = true
+		}
+		for _, id := range s.RepositoryIds {
+			if !allowed[id] {
+				return false
+			}
+		}
+	}
+	if len(other.Permissions) != 0 {
+		if len(s.Permissions) == 0 {
+			return false
+		}
+		for name, level := range s.Permissions {
+			otherLevel, found := other.Permissions[name]
+			if !found || permissionLevels[level] == 0 || permissionLevels[level] > permissionLevels[otherLevel] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ScopePolicy decides the scope of an install token before it is minted.  It
+// may narrow the requested scope based on the caller described by ctx, or
+// return a *ScopeDenied error if the caller requests more than allowed.
+type ScopePolicy func(ctx context.Context, app, install uint64, requested *InstallTokenScope) (*InstallTokenScope, error)
+
+type callerKey struct{}
+
+// WithCaller gets a context identifying the caller requesting a token
+func WithCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// CallerFromContext gets the caller identified by WithCaller
+func CallerFromContext(ctx context.Context) (string, bool) {
+	caller, ok := ctx.Value(callerKey{}).(string)
+	return caller, ok
+}
+
+// RepositoryAllowancePolicy is a ScopePolicy limiting each caller to a set of
+// repositories.  Requests without repositories are narrowed to the caller's
+// allowance, and requests for other repositories, or from callers without an
+// allowance, are denied.  Allowances name repositories, so requests for
+// repository IDs cannot be checked and are denied.
+func RepositoryAllowancePolicy(allowances map[string][]string) ScopePolicy {
+	return func(ctx context.Context, app, install uint64, requested *InstallTokenScope) (*InstallTokenScope, error) {
+		caller, _ := CallerFromContext(ctx)
+		allowed, found := allowances[caller]
+		if !found {
+			return nil, &ScopeDenied{
+				App:     app,
+				Install: install,
+				Reason:  fmt.Sprintf("caller %q has no repository allowance", caller),
+			}
+		}
+		if len(requested.getRepositoryIds()) != 0 {
+			return nil, &ScopeDenied{
+				App:     app,
+				Install: install,
+				Reason:  fmt.Sprintf("caller %q requested repositories by id", caller),
+			}
+		}
+		narrowed := InstallTokenScope{
+			Repositories: requested.getRepositories(),
+			Permissions:  requested.getPermissions(),
+		}
+		if len(narrowed.Repositories) == 0 {
+			narrowed.Repositories = allowed
+		}
+		allowance := InstallTokenScope{
+			Repositories: allowed,
+		}
+		if !narrowed.Within(&allowance) {
+			return nil, &ScopeDenied{
+				App:     app,
+				Install: install,
+				Reason:  fmt.Sprintf("caller %q requested repositories beyond %v", caller, allowed),
+			}
+		}
+		return &narrowed, nil
+	}
+}
+
+func (s *InstallTokenScope) getRepositories() []string {
+	if s == nil {
+		return nil
+	}
+	return s.Repositories
+}
+
+func (s *InstallTokenScope) getRepositoryIds() []uint64 {
+	if s == nil {
+		return nil
+	}
+	return s.RepositoryIds
+}
+
+func (s *InstallTokenScope) getPermissions() map[string]string {
+	if s == nil {
+		return nil
+	}
+	return s.Permissions
+}
@@ -0,0 +1,75 @@
+package tokenstore
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+
+	"github.com/aefalcon/github-keystore-protobuf/go/tokenpb"
+	"github.com/aefalcon/go-github-keystore/kslog"
+	"github.com/aefalcon/go-github-keystore/messagestore"
+)
+
+// INSTALL_TOKEN_KEY_META is the metadata key under which the fingerprint of
+// the app key which signed the app token an install token was minted with is
+// stored
+const INSTALL_TOKEN_KEY_META = "app-key-fingerprint"
+
+// appTokenKey gets the fingerprint of the key which signed an app token from
+// the `kid` of its JOSE header, as set by appkeystore.AppKeyService, or an
+// empty string if the header names none
+func appTokenKey(token string) string {
+	header64 := strings.SplitN(token, ".", 2)[0]
+	headerJson, err := base64.RawURLEncoding.DecodeString(header64)
+	if err != nil {
+		return ""
+	}
+	var header struct {
+		Kid string `json:"kid"`
+	}
+	if err = json.Unmarshal(headerJson, &header); err != nil {
+		return ""
+	}
+	return header.Kid
+}
+
+// PutInstallTokenWithKey stores an install token along with the fingerprint
+// of the app key it was minted with, in the token's metadata if the
+// MessageStore supports metadata.  Without a fingerprint it is put as by
+// PutInstallToken.
+func (s *TokenMessageStore) PutInstallTokenWithKey(token *tokenpb.InstallToken, fingerprint string) (*messagestore.CacheMeta, error) {
+	if fingerprint == "" {
+		return s.PutInstallToken(token)
+	}
+	name, err := s.InstallTokenName(token.App, token.Install)
+	if err != nil {
+		return nil, err
+	}
+	metadata := map[string]string{
+		INSTALL_TOKEN_KEY_META: fingerprint,
+	}
+	return s.putInstallToken(name, token, metadata)
+}
+
+// InstallTokenKeyFromMeta reads the fingerprint of the app key an install
+// token was minted with from the token's metadata.  An empty string is
+// returned if none is stored.
+func InstallTokenKeyFromMeta(meta *messagestore.CacheMeta) string {
+	if meta == nil {
+		return ""
+	}
+	return meta.Metadata[INSTALL_TOKEN_KEY_META]
+}
+
+// GetInstallTokenWithKey provides an install token like GetInstallToken,
+// along with the fingerprint of the app key which signed the app token it
+// was minted with.  A newly minted token's fingerprint is known even if
+// putting it failed, while a cached token's is as recorded when it was
+// cached, so is empty if the store does not keep metadata.
+func (s *InstallTokenService) GetInstallTokenWithKey(req *tokenpb.GetInstallTokenRequest, logger kslog.KsLogger) (*tokenpb.GetInstallTokenResponse, string, error) {
+	resp, fingerprint, err := s.serveInstallToken(req, logger)
+	if err != nil {
+		return nil, "", err
+	}
+	return resp, fingerprint, nil
+}
@@ -0,0 +1,78 @@
+package tokenstore
+
+import (
+	"strings"
+
+	"github.com/aefalcon/github-keystore-protobuf/go/tokenpb"
+	"github.com/aefalcon/go-github-keystore/kslog"
+	"github.com/aefalcon/go-github-keystore/messagestore"
+	"github.com/golang/protobuf/ptypes"
+)
+
+// PruneExpiredTokens deletes the expired install tokens, including scoped
+// tokens, of an app, for stores which do not remove them by their
+// messagestore.EXPIRES_META.  Tokens are found by listing names with the
+// app's prefix, so the store must be a messagestore.ListableMessageStore.
+// Tokens are expired by the service's clock, ignoring the ClockSkew and
+// ExpiryJitter.  Only documents which read as an install token with a token
+// and the app and installation of their name are deleted, and those without
+// a valid expiration are deleted as corrupt.  Other documents, including
+// idempotency records, are left in place.  A token replaced between being
+// read and deleted is deleted too, making the next request a miss.  The
+// number of tokens deleted is returned.
+func (s *InstallTokenService) PruneExpiredTokens(app uint64, logger kslog.KsLogger) (int, error) {
+	prefix, err := s.appInstallTokenPrefix(app)
+	if err != nil {
+		return 0, err
+	}
+	names, err := messagestore.ListMessages(s.MessageStore, prefix)
+	if err != nil {
+		logger.Errorf("Failed to list install tokens of app %d: %s", app, err)
+		return 0, err
+	}
+	pruned := 0
+	for _, name := range names {
+		if strings.Contains(name, idempotencySuffix) {
+			continue
+		}
+		var token tokenpb.InstallToken
+		_, err := s.GetMessage(name, &token)
+		if messagestore.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			logger.Logf("Skipping unreadable token %s: %s", name, err)
+			continue
+		}
+		if !s.isInstallTokenNamed(name, &token) {
+			logger.Logf("Skipping %s, which is not an install token of its name", name)
+			continue
+		}
+		expiration, err := ptypes.Timestamp(token.Expiration)
+		if err == nil && s.now().Before(expiration) {
+			continue
+		}
+		_, err = s.DeleteMessage(name)
+		if messagestore.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			logger.Errorf("Failed to delete expired token %s: %s", name, err)
+			return pruned, err
+		}
+		pruned++
+	}
+	logger.Logf("Pruned %d expired install tokens of app %d", pruned, app)
+	return pruned, nil
+}
+
+// isInstallTokenNamed checks that token has a token and is of the app and
+// installation of name, unscoped or scoped
+func (s *InstallTokenService) isInstallTokenNamed(name string, token *tokenpb.InstallToken) bool {
+	if token.Token == "" {
+		return false
+	}
+	expected, err := s.InstallTokenName(token.App, token.Install)
+	if err != nil {
+		return false
+	}
+	return name == expected || strings.HasPrefix(name, expected+"-")
+}
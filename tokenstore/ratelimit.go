@@ -0,0 +1,84 @@
+package tokenstore
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aefalcon/github-keystore-protobuf/go/tokenpb"
+	"github.com/golang/protobuf/ptypes"
+)
+
+// DEFAULT_RATE_LIMIT_BACKOFF is how long to stop calling GitHub after it
+// limits the rate of calls without saying when the limit resets
+const DEFAULT_RATE_LIMIT_BACKOFF = time.Minute
+
+// v3RateLimit gets the *RateLimitError of a v3 API response refusing a call
+// over the rate limit, or nil if the response is not one.  GitHub answers 429,
+// or 403 with no remaining calls, naming the reset in Retry-After or
+// X-RateLimit-Reset.
+func v3RateLimit(resp *http.Response, now time.Time) *RateLimitError {
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+	case resp.StatusCode == http.StatusForbidden && resp.Header.Get("X-RateLimit-Remaining") == "0":
+	case resp.StatusCode == http.StatusForbidden && resp.Header.Get("Retry-After") != "":
+	default:
+		return nil
+	}
+	if seconds, err := strconv.ParseInt(resp.Header.Get("Retry-After"), 10, 64); err == nil {
+		return &RateLimitError{Reset: now.Add(time.Duration(seconds) * time.Second)}
+	}
+	if epoch, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		return &RateLimitError{Reset: time.Unix(epoch, 0)}
+	}
+	return &RateLimitError{Reset: now.Add(DEFAULT_RATE_LIMIT_BACKOFF)}
+}
+
+// checkRateLimit returns the *RateLimitError last returned by a provider for
+// an app if its limit has not yet reset, so providers are not called for the
+// app again before then.  GitHub limits the calls of each app, so other apps
+// are not held back.
+func (s *InstallTokenService) checkRateLimit(app uint64) error {
+	s.rateLimitMu.Lock()
+	defer s.rateLimitMu.Unlock()
+	rateLimit, found := s.rateLimits[app]
+	if !found {
+		return nil
+	}
+	if s.now().Before(rateLimit.Reset) {
+		return rateLimit
+	}
+	delete(s.rateLimits, app)
+	return nil
+}
+
+// noteRateLimit remembers a *RateLimitError returned by a provider for an app
+func (s *InstallTokenService) noteRateLimit(app uint64, err error) {
+	rateLimit, ok := err.(*RateLimitError)
+	if !ok {
+		return
+	}
+	s.rateLimitMu.Lock()
+	defer s.rateLimitMu.Unlock()
+	if s.rateLimits == nil {
+		s.rateLimits = make(map[uint64]*RateLimitError)
+	}
+	if noted, found := s.rateLimits[app]; !found || rateLimit.Reset.After(noted.Reset) {
+		s.rateLimits[app] = rateLimit
+	}
+}
+
+// rateLimitedToken gets a cached install token to serve while providers are
+// rate limited, or nil if there is none.  The token need only be unexpired,
+// ignoring the ClockSkew and ExpiryJitter which would otherwise have it
+// refreshed early.
+func (s *InstallTokenService) rateLimitedToken(installToken *tokenpb.InstallToken) *tokenpb.InstallToken {
+	if installToken == nil {
+		return nil
+	}
+	expiration, err := ptypes.Timestamp(installToken.Expiration)
+	if err != nil || !s.now().Before(expiration) {
+		return nil
+	}
+	return installToken
+}
@@ -1,10 +1,14 @@
 package tokenstore
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aefalcon/github-keystore-protobuf/go/appkeypb"
@@ -12,10 +16,10 @@ import (
 	"github.com/aefalcon/go-github-keystore/keyservice"
 	"github.com/aefalcon/go-github-keystore/kslog"
 	"github.com/aefalcon/go-github-keystore/messagestore"
+	"github.com/aefalcon/go-github-keystore/metrics"
 	"github.com/aefalcon/go-github-keystore/timeutils"
 	"github.com/golang/protobuf/ptypes"
 	structpb "github.com/golang/protobuf/ptypes/struct"
-	"github.com/jtacoma/uritemplates"
 )
 
 type TokenMessageStore struct {
@@ -33,27 +37,291 @@ func NewTokenMessageStore(store messagestore.MessageStore, links *tokenpb.Links)
 	}
 }
 
-func (s *TokenMessageStore) AppTokenName(app uint64) (string, error) {
-	uritmpl, err := uritemplates.Parse(s.Links.AppTokens)
+// validateTemplate parses a template of links, checking it expands only the
+// variables allowed and each of those required
+func validateTemplate(link, tmpl string, allowed map[string]bool, required ...string) error {
+	names, err := messagestore.TemplateVariables(tmpl)
+	if err != nil {
+		return &InvalidLinks{
+			Link:     link,
+			Template: tmpl,
+			Message:  err.Error(),
+		}
+	}
+	found := make(map[string]bool, len(names))
+	for _, name := range names {
+		if !allowed[name] {
+			return &InvalidLinks{
+				Link:     link,
+				Template: tmpl,
+				Message:  fmt.Sprintf("unknown variable %s", name),
+			}
+		}
+		found[name] = true
+	}
+	for _, name := range required {
+		if !found[name] {
+			return &InvalidLinks{
+				Link:     link,
+				Template: tmpl,
+				Message:  fmt.Sprintf("missing variable %s", name),
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateLinks checks the templates of the store's links up front, rather
+// than on first naming a token, failing with *InvalidLinks.  Both templates
+// must reference AppId and the InstallTokens template must reference
+// InstallId.  The AppTokens template may reference InstallId, as legacy
+// install token names did, but install token names may not collide with the
+// app token name or legacy install token names of the same app.
+func (s *TokenMessageStore) ValidateLinks() error {
+	allowed := map[string]bool{
+		"AppId":     true,
+		"InstallId": true,
+	}
+	if err := validateTemplate("AppTokens", s.Links.AppTokens, allowed, "AppId"); err != nil {
+		return err
+	}
+	if err := validateTemplate("InstallTokens", s.Links.InstallTokens, allowed, "AppId", "InstallId"); err != nil {
+		return err
+	}
+	return s.validateDistinctNames()
+}
+
+// validateDistinctNames checks that a sample install token name differs from
+// the app token name and legacy install token name of the same app, which
+// templates naming the same documents would otherwise overwrite
+func (s *TokenMessageStore) validateDistinctNames() error {
+	const app, install = 1, 2
+	installName, err := s.InstallTokenName(app, install)
 	if err != nil {
-		return "", err
+		return &InvalidLinks{
+			Link:     "InstallTokens",
+			Template: s.Links.InstallTokens,
+			Message:  err.Error(),
+		}
+	}
+	appName, appErr := s.AppTokenName(app)
+	legacyName, legacyErr := s.legacyInstallTokenName(app, install)
+	if (appErr == nil && appName == installName) || (legacyErr == nil && legacyName == installName) {
+		return &InvalidLinks{
+			Link:     "InstallTokens",
+			Template: s.Links.InstallTokens,
+			Message:  fmt.Sprintf("install token name %s collides with AppTokens template %q", installName, s.Links.AppTokens),
+		}
 	}
-	return uritmpl.Expand(map[string]interface{}{
+	return nil
+}
+
+// LINKS_NAME is the name of the document recording the links of a token store
+const LINKS_NAME = "token-links"
+
+// LoadTokenMessageStore allocates a TokenMessageStore with the links recorded
+// in store by InitDb, or the default links if none are recorded.  Recorded
+// links are checked with ValidateLinks.
+func LoadTokenMessageStore(store messagestore.MessageStore) (*TokenMessageStore, error) {
+	var links tokenpb.Links
+	_, err := store.GetMessage(LINKS_NAME, &links)
+	if messagestore.IsNotFound(err) {
+		return NewTokenMessageStore(store, nil), nil
+	} else if err != nil {
+		return nil, err
+	}
+	tokenStore := NewTokenMessageStore(store, &links)
+	if err = tokenStore.ValidateLinks(); err != nil {
+		return nil, err
+	}
+	return tokenStore, nil
+}
+
+// InitDb records the store's links in the LINKS_NAME document so they may be
+// loaded with LoadTokenMessageStore.  A links document which already exists is
+// left unchanged, so initializing a store again has no effect.  Links which
+// fail ValidateLinks are not recorded.
+func (s *TokenMessageStore) InitDb(logger kslog.KsLogger) error {
+	if err := s.ValidateLinks(); err != nil {
+		logger.Errorf("Refusing to initialize token store: %s", err)
+		return err
+	}
+	var existing tokenpb.Links
+	_, err := s.GetMessage(LINKS_NAME, &existing)
+	if err == nil {
+		logger.Logf("Token store already initialized")
+		return nil
+	} else if !messagestore.IsNotFound(err) {
+		logger.Errorf("Failed to get token store links: %s", err)
+		return err
+	}
+	_, err = messagestore.PutMessageIfMatch(s.MessageStore, LINKS_NAME, &s.Links, nil)
+	if _, unsupported := err.(messagestore.ConditionalUnsupported); unsupported {
+		_, err = s.PutMessage(LINKS_NAME, &s.Links)
+	} else if messagestore.IsConflict(err) {
+		logger.Logf("Token store initialized concurrently")
+		return nil
+	}
+	if err != nil {
+		logger.Errorf("Failed to put token store links: %s", err)
+	}
+	return err
+}
+
+func (s *TokenMessageStore) AppTokenName(app uint64) (string, error) {
+	return messagestore.ExpandName(s.Links.AppTokens, map[string]interface{}{
 		"AppId": app,
 	})
 }
 
 func (s *TokenMessageStore) InstallTokenName(app, install uint64) (string, error) {
-	uritmpl, err := uritemplates.Parse(s.Links.AppTokens)
-	if err != nil {
-		return "", err
+	return messagestore.ExpandName(s.Links.InstallTokens, map[string]interface{}{
+		"AppId":     app,
+		"InstallId": install,
+	})
+}
+
+// ScopedInstallTokenName gets the name of an install token restricted to a
+// scope.  The name is that of the unscoped token suffixed with the scope's hash,
+// or the unscoped name if the scope is empty.
+func (s *TokenMessageStore) ScopedInstallTokenName(app, install uint64, scope *InstallTokenScope) (string, error) {
+	name, err := s.InstallTokenName(app, install)
+	if err != nil || scope.IsEmpty() {
+		return name, err
 	}
-	return uritmpl.Expand(map[string]interface{}{
+	return fmt.Sprintf("%s-%s", name, scope.Hash()), nil
+}
+
+// legacyInstallTokenName gets the name install tokens were stored under when
+// they were named using the AppTokens template
+func (s *TokenMessageStore) legacyInstallTokenName(app, install uint64) (string, error) {
+	return messagestore.ExpandName(s.Links.AppTokens, map[string]interface{}{
 		"AppId":     app,
 		"InstallId": install,
 	})
 }
 
+// MigrateLegacyInstallTokens moves install tokens stored with names from the
+// AppTokens template to names from the InstallTokens template.  installs maps
+// application IDs to the installations to migrate.  Legacy documents which are
+// not the install token for the expected installation are ambiguous and are left
+// in place, as are tokens which already exist in the new layout.  The number of
+// tokens moved is returned.
+func (s *TokenMessageStore) MigrateLegacyInstallTokens(installs map[uint64][]uint64, logger kslog.KsLogger) (int, error) {
+	moved := 0
+	for app, appInstalls := range installs {
+		for _, install := range appInstalls {
+			legacyName, err := s.legacyInstallTokenName(app, install)
+			if err != nil {
+				return moved, err
+			}
+			name, err := s.InstallTokenName(app, install)
+			if err != nil {
+				return moved, err
+			}
+			if legacyName == name {
+				continue
+			}
+			var token tokenpb.InstallToken
+			_, err = s.GetMessage(legacyName, &token)
+			if messagestore.IsNotFound(err) {
+				continue
+			} else if err != nil {
+				logger.Logf("Skipping ambiguous document %s: %s", legacyName, err)
+				continue
+			}
+			if token.App != app || token.Install != install {
+				logger.Logf("Skipping ambiguous document %s: it is not the token of app %d install %d", legacyName, app, install)
+				continue
+			}
+			var existing tokenpb.InstallToken
+			_, err = s.GetMessage(name, &existing)
+			if err == nil {
+				logger.Logf("Token for app %d install %d already exists at %s", app, install, name)
+				continue
+			} else if !messagestore.IsNotFound(err) {
+				return moved, err
+			}
+			_, err = s.putInstallToken(name, &token, nil)
+			if err != nil {
+				logger.Errorf("Failed to put token for app %d install %d: %s", app, install, err)
+				return moved, err
+			}
+			_, err = s.DeleteMessage(legacyName)
+			if err != nil && !messagestore.IsNotFound(err) {
+				logger.Errorf("Failed to delete legacy document %s: %s", legacyName, err)
+				return moved, err
+			}
+			logger.Logf("Moved token for app %d install %d from %s to %s", app, install, legacyName, name)
+			moved++
+		}
+	}
+	return moved, nil
+}
+
+// templatePrefix gets the literal text of a URI template before its first
+// expression
+func templatePrefix(tmpl string) string {
+	if i := strings.Index(tmpl, "{"); i >= 0 {
+		return tmpl[:i]
+	}
+	return tmpl
+}
+
+// TokenPrefixes gets the name prefixes under which tokens are stored
+func (s *TokenMessageStore) TokenPrefixes() []string {
+	appPrefix := templatePrefix(s.Links.AppTokens)
+	installPrefix := templatePrefix(s.Links.InstallTokens)
+	if strings.HasPrefix(installPrefix, appPrefix) {
+		return []string{appPrefix}
+	} else if strings.HasPrefix(appPrefix, installPrefix) {
+		return []string{installPrefix}
+	}
+	return []string{appPrefix, installPrefix}
+}
+
+// Document types of the documents of a TokenMessageStore, as given by
+// DocumentType
+const (
+	DOCTYPE_APP_TOKEN     = "apptoken"
+	DOCTYPE_INSTALL_TOKEN = "installtoken"
+)
+
+// DocumentType gets the type of the token document of a name under the
+// store's links, or an empty string if the name is not of a token.  Scoped
+// install tokens are install tokens.  It may be passed to
+// s3store.DocTypeTagger to tag objects by type.
+func (s *TokenMessageStore) DocumentType(name string) string {
+	if messagestore.MatchName(s.Links.AppTokens, name) {
+		return DOCTYPE_APP_TOKEN
+	} else if messagestore.MatchName(s.Links.InstallTokens, name) {
+		return DOCTYPE_INSTALL_TOKEN
+	}
+	return ""
+}
+
+// ExportTokens writes the token documents of the store, and no other
+// documents, to a stream which may be imported with messagestore.ImportBlobs.
+// The store must be a BlobMessageStore of a ListableBlobStore.  The number of
+// documents exported is returned.
+func (s *TokenMessageStore) ExportTokens(w io.Writer) (int, error) {
+	messageStore, ok := s.MessageStore.(*messagestore.BlobMessageStore)
+	if !ok {
+		return 0, ExportUnsupported(fmt.Sprintf("message store %T is not a blob message store", s.MessageStore))
+	}
+	blobStore, ok := messageStore.BlobStore.(messagestore.ListableBlobStore)
+	if !ok {
+		return 0, ExportUnsupported(fmt.Sprintf("blob store %T cannot list blobs", messageStore.BlobStore))
+	}
+	prefixes := s.TokenPrefixes()
+	for _, prefix := range prefixes {
+		if prefix == "" {
+			return 0, ExportUnsupported("token names have no prefix distinguishing them from other documents")
+		}
+	}
+	return messagestore.ExportBlobs(blobStore, prefixes, w)
+}
+
 func (s *TokenMessageStore) GetAppToken(app uint64) (*tokenpb.AppToken, *messagestore.CacheMeta, error) {
 	name, err := s.AppTokenName(app)
 	if err != nil {
@@ -74,6 +342,32 @@ func (s *TokenMessageStore) GetInstallToken(app, install uint64) (*tokenpb.Insta
 	return &token, meta, err
 }
 
+// GetScopedInstallToken gets an install token restricted to a scope.  The
+// scope stored with the token, if any, may be read from the returned CacheMeta
+// with InstallTokenScopeFromMeta.
+func (s *TokenMessageStore) GetScopedInstallToken(app, install uint64, scope *InstallTokenScope) (*tokenpb.InstallToken, *messagestore.CacheMeta, error) {
+	name, err := s.ScopedInstallTokenName(app, install, scope)
+	if err != nil {
+		return nil, nil, err
+	}
+	var token tokenpb.InstallToken
+	meta, err := s.GetMessage(name, &token)
+	return &token, meta, err
+}
+
+// InstallTokenScopeFromMeta reads the scope stored in the metadata of an
+// install token.  Nil is returned if no scope is stored.
+func InstallTokenScopeFromMeta(meta *messagestore.CacheMeta) (*InstallTokenScope, error) {
+	if meta == nil {
+		return nil, nil
+	}
+	text, found := meta.Metadata[INSTALL_TOKEN_SCOPE_META]
+	if !found {
+		return nil, nil
+	}
+	return ParseInstallTokenScope(text)
+}
+
 func (s *TokenMessageStore) PutAppToken(token *tokenpb.AppToken) (*messagestore.CacheMeta, error) {
 	name, err := s.AppTokenName(token.App)
 	if err != nil {
@@ -82,12 +376,57 @@ func (s *TokenMessageStore) PutAppToken(token *tokenpb.AppToken) (*messagestore.
 	return s.PutMessage(name, token)
 }
 
+// PutInstallToken stores an install token.  Its expiration is recorded in
+// its metadata as messagestore.EXPIRES_META if the MessageStore supports
+// metadata, so stores may have it removed once expired.
 func (s *TokenMessageStore) PutInstallToken(token *tokenpb.InstallToken) (*messagestore.CacheMeta, error) {
 	name, err := s.InstallTokenName(token.App, token.Install)
 	if err != nil {
 		return nil, err
 	}
-	return s.PutMessage(name, token)
+	return s.putInstallToken(name, token, nil)
+}
+
+// PutScopedInstallToken stores an install token restricted to a scope.  The
+// readable form of the scope is stored in the token's metadata if the
+// MessageStore supports metadata, along with its expiration as by
+// PutInstallToken.
+func (s *TokenMessageStore) PutScopedInstallToken(token *tokenpb.InstallToken, scope *InstallTokenScope) (*messagestore.CacheMeta, error) {
+	return s.PutScopedInstallTokenWithKey(token, scope, "")
+}
+
+// PutScopedInstallTokenWithKey stores an install token restricted to a scope
+// as by PutScopedInstallToken, along with the fingerprint of the app key it
+// was minted with as by PutInstallTokenWithKey.
+func (s *TokenMessageStore) PutScopedInstallTokenWithKey(token *tokenpb.InstallToken, scope *InstallTokenScope, fingerprint string) (*messagestore.CacheMeta, error) {
+	name, err := s.ScopedInstallTokenName(token.App, token.Install, scope)
+	if err != nil {
+		return nil, err
+	}
+	metadata := make(map[string]string)
+	if !scope.IsEmpty() {
+		metadata[INSTALL_TOKEN_SCOPE_META] = scope.String()
+	}
+	if fingerprint != "" {
+		metadata[INSTALL_TOKEN_KEY_META] = fingerprint
+	}
+	return s.putInstallToken(name, token, metadata)
+}
+
+// putInstallToken puts an install token of a name with metadata along with
+// its expiration, if the MessageStore supports metadata
+func (s *TokenMessageStore) putInstallToken(name string, token *tokenpb.InstallToken, metadata map[string]string) (*messagestore.CacheMeta, error) {
+	metaStore, ok := s.MessageStore.(messagestore.MetadataMessageStore)
+	if !ok {
+		return s.PutMessage(name, token)
+	}
+	if expiration, err := ptypes.Timestamp(token.Expiration); err == nil {
+		metadata = messagestore.ExpiresMetadata(expiration, metadata)
+	}
+	if len(metadata) == 0 {
+		return s.PutMessage(name, token)
+	}
+	return metaStore.PutMessageWithMetadata(name, token, metadata)
 }
 
 func (s *TokenMessageStore) DeleteAppToken(app uint64) (*messagestore.CacheMeta, error) {
@@ -106,20 +445,245 @@ func (s *TokenMessageStore) DeleteInstallToken(app, install uint64) (*messagesto
 	return s.DeleteMessage(name)
 }
 
+// appInstallTokenPrefix gets the prefix of the names of every install token
+// of an app.  The InstallTokens template must have a literal following AppId
+// and preceding InstallId, so the prefix of one app is not that of another.
+func (s *TokenMessageStore) appInstallTokenPrefix(app uint64) (string, error) {
+	tmpl := s.Links.InstallTokens
+	i := strings.Index(tmpl, "{InstallId")
+	if i < 0 || !strings.Contains(tmpl[:i], "{AppId") || strings.HasSuffix(tmpl[:i], "}") {
+		return "", AppPrefixUnsupported(tmpl)
+	}
+	return messagestore.ExpandName(tmpl[:i], map[string]interface{}{
+		"AppId": app,
+	})
+}
+
+// DeleteAppTokens deletes the app token and every install token, including
+// scoped tokens, of an app.  Install tokens are found by listing names with
+// the app's prefix, so the store must be a messagestore.ListableMessageStore.
+// Tokens which are already missing are skipped, while an app token which
+// cannot be decoded is logged and deleted.  The number of tokens deleted is
+// returned.
+func (s *TokenMessageStore) DeleteAppTokens(app uint64, logger kslog.KsLogger) (int, error) {
+	prefix, err := s.appInstallTokenPrefix(app)
+	if err != nil {
+		return 0, err
+	}
+	names, err := messagestore.ListMessages(s.MessageStore, prefix)
+	if err != nil {
+		logger.Errorf("Failed to list install tokens of app %d: %s", app, err)
+		return 0, err
+	}
+	appName, err := s.AppTokenName(app)
+	if err != nil {
+		return 0, err
+	}
+	_, _, err = s.GetAppToken(app)
+	if _, undecodable := err.(*messagestore.DecodeResourceError); undecodable {
+		kslog.Warnf(logger, "Deleting undecodable app token of app %d: %s", app, err)
+		names = append(names, appName)
+	} else if err == nil {
+		names = append(names, appName)
+	} else if !messagestore.IsNotFound(err) {
+		logger.Errorf("Failed to get app token of app %d: %s", app, err)
+		return 0, err
+	}
+	deleted := 0
+	for _, name := range names {
+		_, err := s.DeleteMessage(name)
+		if messagestore.IsNotFound(err) {
+			logger.Logf("Token %s already deleted", name)
+			continue
+		} else if err != nil {
+			logger.Errorf("Failed to delete token %s: %s", name, err)
+			return deleted, err
+		}
+		deleted++
+	}
+	logger.Logf("Deleted %d tokens of app %d", deleted, app)
+	return deleted, nil
+}
+
+// InvalidationSink receives the names of cached token documents which were
+// replaced or removed, so external caches of them may be purged
+type InvalidationSink func(names []string)
+
 type InstallTokenService struct {
 	*TokenMessageStore
 	keyservice.SigningService
 	InstallTokenProvider
+	ScopedInstallTokenProvider ScopedInstallTokenProvider // Provides scoped tokens for GetScopedInstallToken
+	ScopePolicy                ScopePolicy                // Decides the scope of tokens from GetScopedInstallToken and scoped MintInstallToken calls, if set
+	ProviderLimit              int                        // Maximum concurrent InstallTokenProvider calls, or 0 for no limit
+	ProviderLimitWait          time.Duration              // Longest time to wait for an InstallTokenProvider call slot
+	RefreshThreshold           time.Duration              // Cached install tokens expiring within this duration are refreshed
+	Clock                      func() time.Time           // Current time used to check expirations, such as a timeutils.Clock's Now; defaults to time.Now
+	ClockSkew                  time.Duration              // Cached tokens are treated as expired this long before their expiration
+	ExpiryJitter               time.Duration              // Cached install tokens expire up to this much earlier, varying by token
+	RequirePersist             bool                       // New install tokens which cannot be cached are not returned
+	AppPolicy                  keyservice.AppPolicy       // Decides which apps may get tokens, if set
+	InvalidationSink           InvalidationSink           // Notified when cached tokens are replaced or removed, if set
+	FailureSink                FailureSink                // Records failures to mint or persist install tokens, if set
+	Metrics                    metrics.Metrics            // Receives counts and latencies of GetInstallToken, if set
+	BatchWorkers               int                        // Installs GetInstallTokens gets concurrently; defaults to DEFAULT_BATCH_WORKERS
+	VerifyCachedToken          CachedTokenVerifier        // Checks valid cached install tokens before they are served, if set
+	IdempotencyWindow          time.Duration              // How long GetInstallTokenIdempotent serves the token of a request again; defaults to DEFAULT_IDEMPOTENCY_WINDOW
+	providerSlotsOnce          sync.Once
+	providerSlots              chan struct{}
+	rateLimitMu                sync.Mutex
+	rateLimits                 map[uint64]*RateLimitError
+	appFlights                 flightGroup
+	installFlights             flightGroup
+	statsMu                    sync.Mutex
+	stats                      InstallTokenStats
 }
 
-func (s *InstallTokenService) installTokenIsValid(tokenMsg *tokenpb.InstallToken, logger kslog.KsLogger) bool {
+// CachedTokenVerifier decides whether an unexpired cached install token may
+// still be served, such as by checking that the app key it was minted with,
+// as recorded in meta, was not rotated or revoked.  Rejected tokens are
+// replaced by a new one rather than served.
+type CachedTokenVerifier func(token *tokenpb.InstallToken, meta *messagestore.CacheMeta, logger kslog.KsLogger) bool
+
+// InstallTokenStats counts how GetInstallToken used cached install tokens
+type InstallTokenStats struct {
+	Hits      uint64 // Valid cached tokens returned
+	Misses    uint64 // Requests with no cached token
+	Refreshes uint64 // Requests whose cached token was expired, about to expire or corrupt
+	Mints     uint64 // New tokens provisioned, including by MintInstallToken
+}
+
+// Stats gets a snapshot of the service's install token counts
+func (s *InstallTokenService) Stats() InstallTokenStats {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	return s.stats
+}
+
+// recordCache counts a use of the install token cache with an outcome of
+// metrics.CACHE_HIT, metrics.CACHE_MISS or metrics.CACHE_REFRESH
+func (s *InstallTokenService) recordCache(outcome string) {
+	s.statsMu.Lock()
+	switch outcome {
+	case metrics.CACHE_HIT:
+		s.stats.Hits++
+	case metrics.CACHE_MISS:
+		s.stats.Misses++
+	case metrics.CACHE_REFRESH:
+		s.stats.Refreshes++
+	}
+	s.statsMu.Unlock()
+	if s.Metrics != nil {
+		s.Metrics.IncrCounter(metrics.METRIC_INSTALL_TOKEN_CACHE, metrics.Tag{Name: metrics.TAG_CACHE, Value: outcome})
+	}
+}
+
+// recordMint counts a newly provisioned install token
+func (s *InstallTokenService) recordMint() {
+	s.statsMu.Lock()
+	s.stats.Mints++
+	s.statsMu.Unlock()
+	if s.Metrics != nil {
+		s.Metrics.IncrCounter(metrics.METRIC_MINT_INSTALL_TOKEN)
+	}
+}
+
+// acquireProviderSlot waits for a slot to call the InstallTokenProvider when
+// ProviderLimit is set.  The returned function releases the slot.  While the
+// rate limit of the app has not reset, its *RateLimitError is returned
+// instead.
+func (s *InstallTokenService) acquireProviderSlot(app uint64) (func(), error) {
+	if err := s.checkRateLimit(app); err != nil {
+		return nil, err
+	}
+	if s.ProviderLimit <= 0 {
+		return func() {}, nil
+	}
+	s.providerSlotsOnce.Do(func() {
+		s.providerSlots = make(chan struct{}, s.ProviderLimit)
+	})
+	release := func() {
+		<-s.providerSlots
+	}
+	select {
+	case s.providerSlots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	timer := time.NewTimer(s.ProviderLimitWait)
+	defer timer.Stop()
+	select {
+	case s.providerSlots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, ProviderLimitTimeout(s.ProviderLimitWait)
+	}
+}
+
+// callInstallTokenProvider calls the InstallTokenProvider within the limit
+// of concurrent calls, for an install of app
+func (s *InstallTokenService) callInstallTokenProvider(app, install uint64, appToken string) (string, time.Time, error) {
+	release, err := s.acquireProviderSlot(app)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer release()
+	token, expiration, err := s.InstallTokenProvider(install, appToken)
+	s.noteRateLimit(app, err)
+	return token, expiration, err
+}
+
+// now gets the current time from the service's clock
+func (s *InstallTokenService) now() time.Time {
+	if s.Clock == nil {
+		return time.Now()
+	}
+	return s.Clock()
+}
+
+// isExpired reports whether a cached token with an expiration must no longer
+// be used.  The ClockSkew is added to the current time so a clock behind that
+// of GitHub errs toward refreshing tokens rather than serving rejected ones.
+func (s *InstallTokenService) isExpired(expiration time.Time) bool {
+	return s.now().Add(s.ClockSkew).After(expiration)
+}
+
+// effectiveExpiration gets the expiration of a cached install token,
+// shortened by up to the ExpiryJitter.  The amount is derived from a hash of
+// the token, so it is the same at every check of a token but differs between
+// tokens minted together, spreading their refreshes.
+func (s *InstallTokenService) effectiveExpiration(tokenMsg *tokenpb.InstallToken) (time.Time, error) {
 	expiration, err := ptypes.Timestamp(tokenMsg.Expiration)
+	if err != nil || s.ExpiryJitter <= 0 {
+		return expiration, err
+	}
+	hash := fnv.New64a()
+	hash.Write([]byte(tokenMsg.Token))
+	jitter := time.Duration(hash.Sum64() % uint64(s.ExpiryJitter+1))
+	return expiration.Add(-jitter), nil
+}
+
+// installTokenNeedsRefresh reports whether a valid install token expires
+// within the RefreshThreshold
+func (s *InstallTokenService) installTokenNeedsRefresh(tokenMsg *tokenpb.InstallToken, logger kslog.KsLogger) bool {
+	if s.RefreshThreshold <= 0 {
+		return false
+	}
+	expiration, err := s.effectiveExpiration(tokenMsg)
+	if err != nil {
+		logger.Errorf("Failed to parse fetched install token's expiration: %s", err)
+		return true
+	}
+	return expiration.Sub(s.now()) < s.RefreshThreshold
+}
+
+func (s *InstallTokenService) installTokenIsValid(tokenMsg *tokenpb.InstallToken, logger kslog.KsLogger) bool {
+	expiration, err := s.effectiveExpiration(tokenMsg)
 	if err != nil {
 		logger.Errorf("Failed to parse fetched install token's expiration: %s", err)
 		return false
 	}
-	now := time.Now()
-	if now.After(expiration) {
+	if s.isExpired(expiration) {
 		logger.Errorf("Fetched install token is expired")
 		return false
 	}
@@ -132,8 +696,7 @@ func (s *InstallTokenService) appTokenIsValid(tokenMsg *tokenpb.AppToken, logger
 		logger.Errorf("Failed to parse fetched app token's expiration: %s", err)
 		return false
 	}
-	now := time.Now()
-	if now.After(expiration) {
+	if s.isExpired(expiration) {
 		logger.Errorf("Fetched app token is expired")
 		return false
 	}
@@ -202,7 +765,7 @@ func getTokenExp(token string, logger kslog.KsLogger) (time.Time, error) {
 
 // getNewAppToken requests a new JWT and caches the token
 func (s *InstallTokenService) getNewAppToken(app uint64, logger kslog.KsLogger) (*tokenpb.AppToken, error) {
-	now := time.Now().UTC()
+	now := s.now().UTC()
 	signReq := appkeypb.SignJwtRequest{
 		App:       app,
 		Algorithm: "RS256",
@@ -227,9 +790,13 @@ func (s *InstallTokenService) getNewAppToken(app uint64, logger kslog.KsLogger)
 		return nil, err
 	}
 	expiration, err := getTokenExp(signResp.Jwt, logger)
+	if err != nil {
+		logger.Errorf("Failed to get expiration of new token for app %d: %s", app, err)
+		return nil, err
+	}
 	pbexp, err := ptypes.TimestampProto(expiration)
 	if err != nil {
-		logger.Errorf("Failed to convert expiration %v of new app token to pb time", expiration, err)
+		logger.Errorf("Failed to convert expiration %v of new app token to pb time: %s", expiration, err)
 		return nil, err
 	}
 	appTokenMsg := &tokenpb.AppToken{
@@ -240,23 +807,41 @@ func (s *InstallTokenService) getNewAppToken(app uint64, logger kslog.KsLogger)
 	_, err = s.PutAppToken(appTokenMsg)
 	if err != nil {
 		logger.Errorf("Failed to put app token: %s", err)
+	} else {
+		s.invalidated(s.AppTokenName(app))
 	}
 	return appTokenMsg, nil
 }
 
+// isCacheMiss determines if an error getting a cached token means a new token
+// should be provisioned.  Missing and undecodable tokens are misses, but other
+// errors, such as timeouts of the store, are not.
+func isCacheMiss(err error) bool {
+	if _, ok := err.(*messagestore.DecodeResourceError); ok {
+		return true
+	}
+	return messagestore.IsNotFound(err)
+}
+
 // getOrCreateAppToken will return a cached valid application token, or create
-// a new applicationt token and add it to the cache
+// a new applicationt token and add it to the cache.  A cached token is valid
+// until its expiration less the ClockSkew at the Clock, so an expired one is
+// replaced before an install token is minted with it.
 func (s *InstallTokenService) getOrCreateAppToken(app uint64, logger kslog.KsLogger) (*tokenpb.AppToken, error) {
 	appToken, _, err := s.GetAppToken(app)
-	if err != nil {
-		logger.Errorf("Failed to get app %d token from store: %s", app, err)
+	if err != nil && !isCacheMiss(err) {
+		kslog.Warnf(logger, "Failed to get app %d token from store; signing a new one: %s", app, err)
+		appToken = nil
+	} else if err != nil {
 		appToken = nil
 	}
 	if appToken != nil && !s.appTokenIsValid(appToken, logger) {
 		appToken = nil
 	}
 	if appToken == nil {
-		appToken, err = s.getNewAppToken(app, logger)
+		appToken, err = s.mintAppToken(app, func() (*tokenpb.AppToken, error) {
+			return s.getNewAppToken(app, logger)
+		})
 		if err != nil {
 			return nil, err
 		}
@@ -264,17 +849,47 @@ func (s *InstallTokenService) getOrCreateAppToken(app uint64, logger kslog.KsLog
 	return appToken, nil
 }
 
-// createInstallToken provisions a new install token and stores it in the cache
-func (s *InstallTokenService) createInstallToken(app, install uint64, appToken string, logger kslog.KsLogger) (*tokenpb.InstallToken, error) {
-	installToken, expiration, err := s.InstallTokenProvider(install, appToken)
+// checkProvidedExpiration ensures a token from a provider has not already
+// expired, so it is neither cached nor returned
+func (s *InstallTokenService) checkProvidedExpiration(app, install uint64, expiration time.Time) error {
+	if !expiration.After(s.now()) {
+		return &ExpiredInstallToken{
+			App:        app,
+			Install:    install,
+			Expiration: expiration,
+		}
+	}
+	return nil
+}
+
+// ResponseExpiration gets the time the token of a GetInstallTokenResponse
+// expires, which is when it must be refreshed at the latest
+func ResponseExpiration(resp *tokenpb.GetInstallTokenResponse) (time.Time, error) {
+	if resp == nil || resp.Token == nil {
+		return time.Time{}, fmt.Errorf("response has no token")
+	}
+	return ptypes.Timestamp(resp.Token.Expiration)
+}
+
+// createInstallToken provisions a new install token and stores it in the
+// cache.  The fingerprint of the app key it was minted with is returned too.
+func (s *InstallTokenService) createInstallToken(app, install uint64, appToken string, logger kslog.KsLogger) (*tokenpb.InstallToken, string, error) {
+	installToken, expiration, err := s.callInstallTokenProvider(app, install, appToken)
 	if err != nil {
 		logger.Errorf("Failed to get new token for app %d install %d: %s", app, install, err)
-		return nil, err
+		s.recordFailure(app, install, FAILURE_STAGE_MINT, err, logger)
+		return nil, "", err
+	}
+	err = s.checkProvidedExpiration(app, install, expiration)
+	if err != nil {
+		logger.Errorf("Refusing new token for app %d install %d: %s", app, install, err)
+		s.recordFailure(app, install, FAILURE_STAGE_MINT, err, logger)
+		return nil, "", err
 	}
 	pbexp, err := ptypes.TimestampProto(expiration)
 	if err != nil {
 		logger.Errorf("Failed to convert expiration %v to pb: %s", expiration, err)
-		return nil, err
+		return nil, "", err
 	}
 	installTokenMsg := tokenpb.InstallToken{
 		App:        app,
@@ -282,38 +897,346 @@ func (s *InstallTokenService) createInstallToken(app, install uint64, appToken s
 		Token:      installToken,
 		Expiration: pbexp,
 	}
-	_, err = s.PutInstallToken(&installTokenMsg)
+	s.recordMint()
+	fingerprint := appTokenKey(appToken)
+	_, err = s.PutInstallTokenWithKey(&installTokenMsg, fingerprint)
 	if err != nil {
 		logger.Errorf("Failed to put token for app %d install %d: %s", app, install, err)
+		s.recordFailure(app, install, FAILURE_STAGE_PERSIST, err, logger)
+		token, err := s.unpersisted(&installTokenMsg, err)
+		if err != nil {
+			return nil, "", err
+		}
+		return token, fingerprint, nil
 	}
-	return &installTokenMsg, nil
+	s.invalidated(s.InstallTokenName(app, install))
+	return &installTokenMsg, fingerprint, nil
 }
 
-// GetInstallToken provices a valid install token for the requested installation.
-// If a valid cached token is found, it will be returned, otherewise a new token
-// will be be provisioned.
-func (s *InstallTokenService) GetInstallToken(req *tokenpb.GetInstallTokenRequest, logger kslog.KsLogger) (*tokenpb.GetInstallTokenResponse, error) {
-	if req.App == 0 {
-		logger.Errorf("Attempted to add app %d", req.App)
-		return nil, UnallowedAppId(req.App)
-	}
-	installToken, _, err := s.TokenMessageStore.GetInstallToken(req.App, req.Install)
-	if err == nil && s.installTokenIsValid(installToken, logger) {
-		resp := tokenpb.GetInstallTokenResponse{
-			Token: installToken,
+// unpersisted decides the result of provisioning a token which could not be
+// put.  The token is returned regardless unless the service requires tokens
+// to be persisted.
+func (s *InstallTokenService) unpersisted(token *tokenpb.InstallToken, err error) (*tokenpb.InstallToken, error) {
+	if !s.RequirePersist {
+		return token, nil
+	}
+	return nil, &TokenNotPersisted{
+		App:     token.App,
+		Install: token.Install,
+		Cause:   err,
+	}
+}
+
+// evictInstallToken deletes a corrupt cached install token so it is not
+// fetched again
+func (s *InstallTokenService) evictInstallToken(app, install uint64, cause error, logger kslog.KsLogger) {
+	logger.Errorf("Evicting token for app %d install %d: %s", app, install, cause)
+	_, err := s.DeleteInstallToken(app, install)
+	if err != nil {
+		logger.Errorf("Failed to evict token for app %d install %d: %s", app, install, err)
+		return
+	}
+	s.invalidated(s.InstallTokenName(app, install))
+}
+
+// InvalidateInstallToken removes the cached install token of an installation
+// so the next request provisions a new token
+func (s *InstallTokenService) InvalidateInstallToken(app, install uint64, logger kslog.KsLogger) error {
+	_, err := s.DeleteInstallToken(app, install)
+	if err != nil && !messagestore.IsNotFound(err) {
+		logger.Errorf("Failed to invalidate token for app %d install %d: %s", app, install, err)
+		return err
+	}
+	s.invalidated(s.InstallTokenName(app, install))
+	return nil
+}
+
+// invalidated notifies the InvalidationSink of a replaced or removed document.
+// It accepts the results of a naming method; a document which cannot be named
+// could not have been stored.
+func (s *InstallTokenService) invalidated(name string, err error) {
+	if s.InvalidationSink == nil || err != nil {
+		return
+	}
+	s.InvalidationSink([]string{name})
+}
+
+// checkApp ensures an app id is not 0 and is allowed by the AppPolicy
+func (s *InstallTokenService) checkApp(app uint64, logger kslog.KsLogger) error {
+	if app == 0 {
+		logger.Errorf("Attempted to get token for app %d", app)
+		return UnallowedAppId(app)
+	}
+	if s.AppPolicy == nil {
+		return nil
+	}
+	err := s.AppPolicy.Allowed(app)
+	if err != nil {
+		logger.Errorf("App policy rejected app %d: %s", app, err)
+	}
+	return err
+}
+
+// MintInstallToken signs a new application token and exchanges it for a new
+// install token restricted to scope, bypassing any cached tokens.  A nil or
+// empty scope mints a token with every permission of the installation, as
+// GetInstallToken does; otherwise the scope is decided by the ScopePolicy
+// with ctx and the token provisioned with the ScopedInstallTokenProvider, as
+// GetScopedInstallToken does.  Both new tokens are cached.
+func (s *InstallTokenService) MintInstallToken(ctx context.Context, app, install uint64, scope *InstallTokenScope, logger kslog.KsLogger) (*tokenpb.InstallToken, error) {
+	if err := s.checkApp(app, logger); err != nil {
+		return nil, err
+	}
+	if !scope.IsEmpty() {
+		var err error
+		scope, err = s.decideScope(ctx, app, install, scope, logger)
+		if err != nil {
+			return nil, err
+		}
+		if s.ScopedInstallTokenProvider == nil {
+			return nil, fmt.Errorf("no scoped install token provider")
+		}
+	}
+	appToken, err := s.getNewAppToken(app, logger)
+	if err != nil {
+		return nil, err
+	}
+	if !scope.IsEmpty() {
+		return s.createScopedInstallToken(app, install, scope, appToken, logger)
+	}
+	installToken, _, err := s.createInstallToken(app, install, appToken.Token, logger)
+	return installToken, err
+}
+
+// decideScope decides the scope of a token by the ScopePolicy, if set.  The
+// policy may only narrow the requested scope.
+func (s *InstallTokenService) decideScope(ctx context.Context, app, install uint64, scope *InstallTokenScope, logger kslog.KsLogger) (*InstallTokenScope, error) {
+	if s.ScopePolicy == nil {
+		return scope, nil
+	}
+	narrowed, err := s.ScopePolicy(ctx, app, install, scope)
+	if err != nil {
+		logger.Errorf("Scope policy rejected scope %s for app %d install %d: %s", scope, app, install, err)
+		return nil, err
+	}
+	if !narrowed.Within(scope) {
+		logger.Errorf("Scope policy broadened scope %s to %s", scope, narrowed)
+		return nil, &ScopeDenied{
+			App:     app,
+			Install: install,
+			Reason:  fmt.Sprintf("policy scope %s is broader than requested scope %s", narrowed, scope),
 		}
-		return &resp, nil
 	}
-	appToken, err := s.getOrCreateAppToken(req.App, logger)
+	return narrowed, nil
+}
+
+// GetScopedInstallToken provides a valid install token restricted to a scope.
+// If ScopePolicy is set, it decides the scope from the requested scope and the
+// caller described by ctx; the policy may only narrow the requested scope.  If a
+// valid cached token has the scope, it will be returned, otherwise a new token
+// will be provisioned with the ScopedInstallTokenProvider.
+func (s *InstallTokenService) GetScopedInstallToken(ctx context.Context, app, install uint64, scope *InstallTokenScope, logger kslog.KsLogger) (*tokenpb.InstallToken, error) {
+	if err := s.checkApp(app, logger); err != nil {
+		return nil, err
+	}
+	scope, err := s.decideScope(ctx, app, install, scope, logger)
 	if err != nil {
 		return nil, err
 	}
-	installToken, err = s.createInstallToken(req.App, req.Install, appToken.Token, logger)
+	installToken, _, err := s.TokenMessageStore.GetScopedInstallToken(app, install, scope)
+	if err != nil && !isCacheMiss(err) {
+		kslog.Warnf(logger, "Failed to get app %d install %d token from store; provisioning a new one: %s", app, install, err)
+	}
+	if err == nil && s.installTokenIsValid(installToken, logger) && !s.installTokenNeedsRefresh(installToken, logger) {
+		return installToken, nil
+	}
+	if s.ScopedInstallTokenProvider == nil {
+		return nil, fmt.Errorf("no scoped install token provider")
+	}
+	appToken, err := s.getOrCreateAppToken(app, logger)
 	if err != nil {
 		return nil, err
 	}
+	return s.createScopedInstallToken(app, install, scope, appToken, logger)
+}
+
+// createScopedInstallToken provisions a new install token restricted to a
+// scope with the ScopedInstallTokenProvider and caches it
+func (s *InstallTokenService) createScopedInstallToken(app, install uint64, scope *InstallTokenScope, appToken *tokenpb.AppToken, logger kslog.KsLogger) (*tokenpb.InstallToken, error) {
+	release, err := s.acquireProviderSlot(app)
+	if err != nil {
+		s.recordFailure(app, install, FAILURE_STAGE_MINT, err, logger)
+		return nil, err
+	}
+	token, expiration, err := s.ScopedInstallTokenProvider(install, appToken.Token, scope)
+	release()
+	s.noteRateLimit(app, err)
+	if err != nil {
+		logger.Errorf("Failed to get new token for app %d install %d with scope %s: %s", app, install, scope, err)
+		s.recordFailure(app, install, FAILURE_STAGE_MINT, err, logger)
+		return nil, err
+	}
+	err = s.checkProvidedExpiration(app, install, expiration)
+	if err != nil {
+		logger.Errorf("Refusing new token for app %d install %d with scope %s: %s", app, install, scope, err)
+		s.recordFailure(app, install, FAILURE_STAGE_MINT, err, logger)
+		return nil, err
+	}
+	pbexp, err := ptypes.TimestampProto(expiration)
+	if err != nil {
+		logger.Errorf("Failed to convert expiration %v to pb: %s", expiration, err)
+		return nil, err
+	}
+	installToken := &tokenpb.InstallToken{
+		App:        app,
+		Install:    install,
+		Token:      token,
+		Expiration: pbexp,
+	}
+	_, err = s.PutScopedInstallTokenWithKey(installToken, scope, appTokenKey(appToken.Token))
+	if err != nil {
+		logger.Errorf("Failed to put token for app %d install %d: %s", app, install, err)
+		s.recordFailure(app, install, FAILURE_STAGE_PERSIST, err, logger)
+		return s.unpersisted(installToken, err)
+	}
+	s.invalidated(s.ScopedInstallTokenName(app, install, scope))
+	return installToken, nil
+}
+
+// PeekInstallToken gets the cached install token of an installation and
+// whether it is valid at the Clock, for monitoring.  Tokens are never
+// provisioned and invalid tokens are not evicted.  A missing token gives nil,
+// false and no error.
+func (s *InstallTokenService) PeekInstallToken(app, install uint64) (*tokenpb.InstallToken, bool, error) {
+	installToken, _, err := s.TokenMessageStore.GetInstallToken(app, install)
+	if messagestore.IsNotFound(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	expiration, err := s.effectiveExpiration(installToken)
+	if err != nil {
+		return installToken, false, nil
+	}
+	return installToken, !s.isExpired(expiration), nil
+}
+
+// GetInstallToken provices a valid install token for the requested installation.
+// If a valid cached token is found, it will be returned, otherewise a new token
+// will be be provisioned.  Failing to read the cache is logged as a warning
+// and treated as a miss, while failing to cache a new token is only an error
+// with RequirePersist.  Concurrent requests provisioning a token for the same
+// install share one call to the providers, as do those signing an app token.
+// When a provider returns a *RateLimitError, providers are not called again
+// until it resets; meanwhile a cached token is served while it has not
+// expired, and the *RateLimitError, naming when to retry, is returned
+// otherwise.  With VerifyCachedToken, cached tokens it rejects are replaced
+// as though they had expired.  Each call logs its TOKEN_DECISION_ at debug
+// level, with the fields app, install, decision and remaining, the seconds
+// the token is valid for.
+func (s *InstallTokenService) GetInstallToken(req *tokenpb.GetInstallTokenRequest, logger kslog.KsLogger) (*tokenpb.GetInstallTokenResponse, error) {
+	resp, _, err := s.serveInstallToken(req, logger)
+	return resp, err
+}
+
+// serveInstallToken provides an install token as GetInstallToken does, along
+// with the fingerprint of the app key it was minted with, if known
+func (s *InstallTokenService) serveInstallToken(req *tokenpb.GetInstallTokenRequest, logger kslog.KsLogger) (*tokenpb.GetInstallTokenResponse, string, error) {
+	start := time.Now()
+	resp, fingerprint, decision, err := s.getInstallToken(req, logger)
+	metrics.Record(s.Metrics, metrics.METRIC_GET_INSTALL_TOKEN, start, err)
+	s.logDecision(req, resp, decision, logger)
+	return resp, fingerprint, err
+}
+
+// Decisions of GetInstallToken, as logged in its decision field
+const (
+	TOKEN_DECISION_HIT         = "hit"         // A valid cached token was served
+	TOKEN_DECISION_REFRESH     = "refresh"     // A cached token expired or about to expire was replaced
+	TOKEN_DECISION_MINT        = "mint"        // No token was cached, so one was provisioned
+	TOKEN_DECISION_SERVE_STALE = "serve-stale" // Replacing a cached token failed, so the unexpired cached token was served
+	TOKEN_DECISION_ERROR       = "error"       // No token could be served
+)
+
+// logDecision logs how GetInstallToken served a request
+func (s *InstallTokenService) logDecision(req *tokenpb.GetInstallTokenRequest, resp *tokenpb.GetInstallTokenResponse, decision string, logger kslog.KsLogger) {
+	fields := kslog.Fields{
+		"app":      req.App,
+		"install":  req.Install,
+		"decision": decision,
+	}
+	if resp != nil {
+		if expiration, err := ptypes.Timestamp(resp.Token.Expiration); err == nil {
+			fields["remaining"] = int64(expiration.Sub(s.now()) / time.Second)
+		}
+	}
+	kslog.LogFields(logger, kslog.LEVEL_DEBUG, "Served install token", fields)
+}
+
+func (s *InstallTokenService) getInstallToken(req *tokenpb.GetInstallTokenRequest, logger kslog.KsLogger) (*tokenpb.GetInstallTokenResponse, string, string, error) {
+	if err := s.checkApp(req.App, logger); err != nil {
+		return nil, "", TOKEN_DECISION_ERROR, err
+	}
+	installToken, meta, err := s.TokenMessageStore.GetInstallToken(req.App, req.Install)
+	if err != nil && !isCacheMiss(err) {
+		// The cache is an optimization, so an unavailable store is a miss
+		kslog.Warnf(logger, "Failed to get app %d install %d token from store; provisioning a new one: %s", req.App, req.Install, err)
+	}
+	cached := err == nil
+	if err == nil {
+		if _, expErr := ptypes.Timestamp(installToken.Expiration); expErr != nil {
+			s.evictInstallToken(req.App, req.Install, expErr, logger)
+			err = expErr
+		}
+	}
+	var cachedToken, staleToken *tokenpb.InstallToken
+	valid := err == nil && s.installTokenIsValid(installToken, logger)
+	if valid && s.VerifyCachedToken != nil && !s.VerifyCachedToken(installToken, meta, logger) {
+		// A rejected token is not served, even should minting fail
+		logger.Logf("Cached token for app %d install %d failed verification; provisioning a new one", req.App, req.Install)
+		valid = false
+	} else if err == nil {
+		staleToken = installToken
+	}
+	if valid {
+		if !s.installTokenNeedsRefresh(installToken, logger) {
+			s.recordCache(metrics.CACHE_HIT)
+			resp := tokenpb.GetInstallTokenResponse{
+				Token: installToken,
+			}
+			return &resp, InstallTokenKeyFromMeta(meta), TOKEN_DECISION_HIT, nil
+		}
+		logger.Logf("Refreshing token for app %d install %d ahead of expiry", req.App, req.Install)
+		cachedToken = installToken
+	}
+	decision := TOKEN_DECISION_MINT
+	if cached {
+		decision = TOKEN_DECISION_REFRESH
+		s.recordCache(metrics.CACHE_REFRESH)
+	} else {
+		s.recordCache(metrics.CACHE_MISS)
+	}
+	cachedKey := InstallTokenKeyFromMeta(meta)
+	installToken, fingerprint, err := s.mintInstallToken(req.App, req.Install, func() (*tokenpb.InstallToken, string, error) {
+		appToken, err := s.getOrCreateAppToken(req.App, logger)
+		if err != nil {
+			return nil, "", err
+		}
+		return s.createInstallToken(req.App, req.Install, appToken.Token, logger)
+	})
+	if _, limited := err.(*RateLimitError); limited && cachedToken == nil {
+		cachedToken = s.rateLimitedToken(staleToken)
+	}
+	if err != nil && cachedToken != nil {
+		logger.Logf("Failed to refresh token for app %d install %d; using cached token: %s", req.App, req.Install, err)
+		installToken = cachedToken
+		fingerprint = cachedKey
+		decision = TOKEN_DECISION_SERVE_STALE
+	} else if err != nil {
+		return nil, "", TOKEN_DECISION_ERROR, err
+	}
 	resp := tokenpb.GetInstallTokenResponse{
 		Token: installToken,
 	}
-	return &resp, nil
+	return &resp, fingerprint, decision, nil
 }
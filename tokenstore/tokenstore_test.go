@@ -1,19 +1,41 @@
 package tokenstore
 
 import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/aefalcon/github-keystore-protobuf/go/appkeypb"
 	"github.com/aefalcon/github-keystore-protobuf/go/tokenpb"
+	"github.com/aefalcon/go-github-keystore/appkeystore"
+	"github.com/aefalcon/go-github-keystore/keyservice"
+	"github.com/aefalcon/go-github-keystore/keyutils"
 	"github.com/aefalcon/go-github-keystore/kslog"
 	"github.com/aefalcon/go-github-keystore/messagestore"
-	//"github.com/golang/protobuf/ptypes"
+	"github.com/aefalcon/go-github-keystore/metrics"
+	"github.com/aefalcon/go-github-keystore/timeutils"
+	"github.com/aefalcon/go-github-keystore/tokenstore/tokentest"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	structpb "github.com/golang/protobuf/ptypes/struct"
 )
 
 type MockProvider struct {
@@ -107,3 +129,2825 @@ func TestGetInstallToken(t *testing.T) {
 		t.Fatalf("Response contained nil token: %s", err)
 	}
 }
+
+func TestAppAndInstallTokenNames(t *testing.T) {
+	const appId = 1
+	const installId = 22
+	store := NewMemTokenStore()
+	store.Links = tokenpb.Links{
+		AppTokens:     "tokens/{AppId}/app",
+		InstallTokens: "tokens/{AppId}/installs/{InstallId}",
+	}
+	appName, err := store.AppTokenName(appId)
+	if err != nil {
+		t.Fatalf("Failed to name app token: %s", err)
+	}
+	installName, err := store.InstallTokenName(appId, installId)
+	if err != nil {
+		t.Fatalf("Failed to name install token: %s", err)
+	}
+	if appName == installName {
+		t.Fatalf("App token and install token share name %s", appName)
+	}
+	if !strings.Contains(installName, fmt.Sprintf("%d", installId)) {
+		t.Fatalf("Install token name %s does not contain install id %d", installName, installId)
+	}
+	expiration := time.Now().Add(time.Hour)
+	pbexp, err := ptypes.TimestampProto(expiration)
+	if err != nil {
+		t.Fatalf("Failed to convert expiration: %s", err)
+	}
+	appToken := tokenpb.AppToken{
+		App:        appId,
+		Token:      GenJwtToken(appId),
+		Expiration: pbexp,
+	}
+	installToken := tokenpb.InstallToken{
+		App:        appId,
+		Install:    installId,
+		Token:      GenInstallToken(),
+		Expiration: pbexp,
+	}
+	_, err = store.PutAppToken(&appToken)
+	if err != nil {
+		t.Fatalf("Failed to put app token: %s", err)
+	}
+	_, err = store.PutInstallToken(&installToken)
+	if err != nil {
+		t.Fatalf("Failed to put install token: %s", err)
+	}
+	appTokenBack, _, err := store.GetAppToken(appId)
+	if err != nil {
+		t.Fatalf("Failed to get app token back: %s", err)
+	}
+	if appTokenBack.Token != appToken.Token {
+		t.Fatalf("App token %s does not match expected token %s", appTokenBack.Token, appToken.Token)
+	}
+	installTokenBack, _, err := store.GetInstallToken(appId, installId)
+	if err != nil {
+		t.Fatalf("Failed to get install token back: %s", err)
+	}
+	if installTokenBack.Token != installToken.Token {
+		t.Fatalf("Install token %s does not match expected token %s", installTokenBack.Token, installToken.Token)
+	}
+	_, err = store.DeleteInstallToken(appId, installId)
+	if err != nil {
+		t.Fatalf("Failed to delete install token: %s", err)
+	}
+	_, _, err = store.GetAppToken(appId)
+	if err != nil {
+		t.Fatalf("App token missing after deleting install token: %s", err)
+	}
+}
+
+type StubProviders struct {
+	AppJwt            string
+	InstallToken      string
+	InstallExpiration time.Time
+	ReceivedAppToken  string
+	ReceivedInstallId uint64
+	InstallTokenCalls int
+}
+
+func (p *StubProviders) SignJwt(req *appkeypb.SignJwtRequest, logger kslog.KsLogger) (*appkeypb.SignJwtResponse, error) {
+	resp := appkeypb.SignJwtResponse{
+		Jwt: p.AppJwt,
+	}
+	return &resp, nil
+}
+
+func (p *StubProviders) InstallTokenProvider(install uint64, appToken string) (string, time.Time, error) {
+	p.InstallTokenCalls++
+	p.ReceivedAppToken = appToken
+	p.ReceivedInstallId = install
+	return p.InstallToken, p.InstallExpiration, nil
+}
+
+func TestGetInstallTokenUsesInstallProvider(t *testing.T) {
+	const appId = 1
+	const installId = 2
+	provider := StubProviders{
+		AppJwt:            GenJwtToken(appId),
+		InstallToken:      GenInstallToken(),
+		InstallExpiration: time.Now().Add(time.Hour).UTC().Truncate(time.Second),
+	}
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	service := InstallTokenService{
+		TokenMessageStore:    NewMemTokenStore(),
+		SigningService:       &provider,
+		InstallTokenProvider: provider.InstallTokenProvider,
+	}
+	req := tokenpb.GetInstallTokenRequest{
+		App:     appId,
+		Install: installId,
+	}
+	resp, err := service.GetInstallToken(&req, &logger)
+	if err != nil {
+		t.Fatalf("Failed to get token: %s", err)
+	}
+	if provider.InstallTokenCalls != 1 {
+		t.Fatalf("Install token provider called %d times instead of once", provider.InstallTokenCalls)
+	}
+	if resp.Token.Token == provider.AppJwt {
+		t.Fatalf("Install token is the app token")
+	}
+	if resp.Token.Token != provider.InstallToken {
+		t.Fatalf("Install token %s did not come from install provider (%s)", resp.Token.Token, provider.InstallToken)
+	}
+	if provider.ReceivedAppToken != provider.AppJwt {
+		t.Fatalf("Install provider received app token %s instead of %s", provider.ReceivedAppToken, provider.AppJwt)
+	}
+	if provider.ReceivedInstallId != installId {
+		t.Fatalf("Install provider received install %d instead of %d", provider.ReceivedInstallId, installId)
+	}
+	expiration, err := ptypes.Timestamp(resp.Token.Expiration)
+	if err != nil {
+		t.Fatalf("Failed to convert expiration: %s", err)
+	}
+	if !expiration.Equal(provider.InstallExpiration) {
+		t.Fatalf("Install token expiration %v does not match provider expiration %v", expiration, provider.InstallExpiration)
+	}
+}
+
+func TestGetInstallTokenRefreshesExpiredAppToken(t *testing.T) {
+	const appId = 1
+	const installId = 2
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, expiration := range []time.Time{now.Add(-time.Minute), now.Add(30 * time.Second)} {
+		provider := StubProviders{
+			AppJwt:            GenJwtToken(appId),
+			InstallToken:      GenInstallToken(),
+			InstallExpiration: now.Add(time.Hour),
+		}
+		store := NewMemTokenStore()
+		pbexp, err := ptypes.TimestampProto(expiration)
+		if err != nil {
+			t.Fatalf("Failed to convert expiration: %s", err)
+		}
+		stale := tokenpb.AppToken{
+			App:        appId,
+			Token:      GenJwtToken(appId),
+			Expiration: pbexp,
+		}
+		if _, err = store.PutAppToken(&stale); err != nil {
+			t.Fatalf("Failed to put app token: %s", err)
+		}
+		service := InstallTokenService{
+			TokenMessageStore:    store,
+			SigningService:       &provider,
+			InstallTokenProvider: provider.InstallTokenProvider,
+			Clock:                func() time.Time { return now },
+			ClockSkew:            time.Minute,
+		}
+		req := tokenpb.GetInstallTokenRequest{
+			App:     appId,
+			Install: installId,
+		}
+		if _, err = service.GetInstallToken(&req, &logger); err != nil {
+			t.Fatalf("Failed to get token: %s", err)
+		}
+		if provider.ReceivedAppToken != provider.AppJwt {
+			t.Errorf("Install token was minted with app token expiring at %v rather than a refreshed one", expiration)
+		}
+		cached, _, err := store.GetAppToken(appId)
+		if err != nil {
+			t.Fatalf("Failed to get app token: %s", err)
+		}
+		if cached.Token != provider.AppJwt {
+			t.Errorf("Refreshed app token was not cached in place of that expiring at %v", expiration)
+		}
+	}
+}
+
+// seedKeyService creates a key service holding the test key for an app
+func seedKeyService(t *testing.T, app uint64, logger kslog.KsLogger) (*appkeystore.AppKeyService, *rsa.PrivateKey) {
+	keyService := appkeystore.NewAppKeyService(messagestore.NewMemMessageStore(), nil)
+	err := keyService.Store.InitDb(logger)
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %s", err)
+	}
+	keyFileName := filepath.Join("testdata", "priv1.pem")
+	keyBytes, err := ioutil.ReadFile(keyFileName)
+	if err != nil {
+		t.Fatalf("Failed to read file %s: %s", keyFileName, err)
+	}
+	rsaKey, err := keyutils.ParsePrivateKey(keyBytes)
+	if err != nil {
+		t.Fatalf("Failed to parse key from file %s: %s", keyFileName, err)
+	}
+	fingerprint, err := keyutils.KeyFingerprint(rsaKey)
+	if err != nil {
+		t.Fatalf("Failed to derive fingerprint of key from file %s: %s", keyFileName, err)
+	}
+	addReq := appkeypb.AddAppRequest{
+		App: app,
+		Keys: []*appkeypb.AppKey{
+			&appkeypb.AppKey{
+				Key: keyBytes,
+				Meta: &appkeypb.AppKeyMeta{
+					Fingerprint: fingerprint,
+				},
+			},
+		},
+	}
+	_, err = keyService.AddApp(&addReq, logger)
+	if err != nil {
+		t.Fatalf("Failed to add app %d: %s", app, err)
+	}
+	return keyService, rsaKey
+}
+
+// verifyJwt checks a RS256 JWT signature
+func verifyJwt(token string, key *rsa.PrivateKey) error {
+	secureData64 := token[:strings.LastIndex(token, ".")]
+	sig, err := base64.RawURLEncoding.DecodeString(token[len(secureData64)+1:])
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256([]byte(secureData64))
+	return rsa.VerifyPKCS1v15(key.Public().(*rsa.PublicKey), crypto.SHA256, digest[:], sig)
+}
+
+func TestMintInstallToken(t *testing.T) {
+	const appId = 1
+	const installId = 7
+	const installToken = "v1.stubinstalltoken"
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	keyService, rsaKey := seedKeyService(t, appId, &logger)
+	requests := 0
+	var scoped v3InstallTokenReq
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		json.NewDecoder(r.Body).Decode(&scoped)
+		expectedPath := fmt.Sprintf("/app/installations/%d/access_tokens", installId)
+		if r.Method != http.MethodPost || r.URL.Path != expectedPath {
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		appToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if err := verifyJwt(appToken, rsaKey); err != nil {
+			t.Errorf("App token does not verify: %s", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"token": "%s", "expires_at": "2099-01-01T00:00:00Z"}`, installToken)
+	}))
+	defer github.Close()
+	client := V3InstallTokenClient{
+		BaseUrl: github.URL,
+		Client:  github.Client(),
+	}
+	service := InstallTokenService{
+		TokenMessageStore:          NewTokenMessageStore(messagestore.NewMemMessageStore(), nil),
+		SigningService:             keyService,
+		InstallTokenProvider:       client.InstallTokenProvider,
+		ScopedInstallTokenProvider: client.ScopedInstallTokenProvider,
+	}
+	token, err := service.MintInstallToken(context.Background(), appId, installId, nil, &logger)
+	if err != nil {
+		t.Fatalf("Failed to mint install token: %s", err)
+	}
+	if requests != 1 {
+		t.Fatalf("Github stub received %d requests instead of 1", requests)
+	}
+	if token.Token != installToken {
+		t.Fatalf("Minted token %s does not match %s", token.Token, installToken)
+	}
+	if token.App != appId || token.Install != installId {
+		t.Fatalf("Minted token is for app %d install %d", token.App, token.Install)
+	}
+	req := tokenpb.GetInstallTokenRequest{
+		App:     appId,
+		Install: installId,
+	}
+	resp, err := service.GetInstallToken(&req, &logger)
+	if err != nil {
+		t.Fatalf("Failed to get install token: %s", err)
+	}
+	if resp.Token.Token != installToken {
+		t.Fatalf("Cached token %s does not match %s", resp.Token.Token, installToken)
+	}
+	if requests != 1 {
+		t.Fatalf("Cached token was not used")
+	}
+	if len(scoped.Repositories) != 0 || len(scoped.Permissions) != 0 {
+		t.Fatalf("Unscoped token was requested with scope %+v", scoped)
+	}
+	scope := InstallTokenScope{
+		Repositories: []string{"keystore"},
+		Permissions:  map[string]string{"contents": "read"},
+	}
+	token, err = service.MintInstallToken(context.Background(), appId, installId, &scope, &logger)
+	if err != nil {
+		t.Fatalf("Failed to mint scoped install token: %s", err)
+	}
+	if requests != 2 || len(scoped.Repositories) != 1 || scoped.Repositories[0] != "keystore" || scoped.Permissions["contents"] != "read" {
+		t.Fatalf("Scoped token was requested with scope %+v after %d requests", scoped, requests)
+	}
+	cached, err := service.GetScopedInstallToken(context.Background(), appId, installId, &scope, &logger)
+	if err != nil || cached.Token != token.Token || requests != 2 {
+		t.Fatalf("Scoped minted token was not cached: %v, %v", cached, err)
+	}
+	service.ScopePolicy = func(ctx context.Context, app, install uint64, requested *InstallTokenScope) (*InstallTokenScope, error) {
+		return nil, &ScopeDenied{App: app, Install: install, Reason: "no scoped tokens"}
+	}
+	if _, err = service.MintInstallToken(context.Background(), appId, installId, &scope, &logger); err == nil || requests != 2 {
+		t.Fatalf("Scope policy did not reject mint: %v after %d requests", err, requests)
+	}
+}
+
+func TestGetInstallTokenLargeIds(t *testing.T) {
+	const appId = 123456
+	const installId = 9876543210
+	provider := StubProviders{
+		AppJwt:            GenJwtToken(appId),
+		InstallToken:      GenInstallToken(),
+		InstallExpiration: time.Now().Add(time.Hour),
+	}
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	store := NewMemTokenStore()
+	service := InstallTokenService{
+		TokenMessageStore:    store,
+		SigningService:       &provider,
+		InstallTokenProvider: provider.InstallTokenProvider,
+	}
+	req := tokenpb.GetInstallTokenRequest{
+		App:     appId,
+		Install: installId,
+	}
+	resp, err := service.GetInstallToken(&req, &logger)
+	if err != nil {
+		t.Fatalf("Failed to get token: %s", err)
+	}
+	if provider.ReceivedInstallId != installId {
+		t.Fatalf("Install provider received install %d instead of %d", provider.ReceivedInstallId, installId)
+	}
+	if resp.Token.App != appId || resp.Token.Install != installId {
+		t.Fatalf("Token is for app %d install %d", resp.Token.App, resp.Token.Install)
+	}
+	cached, _, err := store.GetInstallToken(appId, installId)
+	if err != nil {
+		t.Fatalf("Failed to get cached token: %s", err)
+	}
+	if cached.Token != provider.InstallToken {
+		t.Fatalf("Cached token %s does not match %s", cached.Token, provider.InstallToken)
+	}
+}
+
+func TestMigrateLegacyInstallTokens(t *testing.T) {
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	store := NewMemTokenStore()
+	store.Links = tokenpb.Links{
+		AppTokens:     "tokens/{AppId}/app",
+		InstallTokens: "tokens/{AppId}/installs/{InstallId}",
+	}
+	pbexp, err := ptypes.TimestampProto(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to convert expiration: %s", err)
+	}
+	legacyToken := tokenpb.InstallToken{
+		App:        1,
+		Install:    5,
+		Token:      GenInstallToken(),
+		Expiration: pbexp,
+	}
+	legacyName, err := store.AppTokenName(1)
+	if err != nil {
+		t.Fatalf("Failed to name app token: %s", err)
+	}
+	_, err = store.PutMessage(legacyName, &legacyToken)
+	if err != nil {
+		t.Fatalf("Failed to put legacy token: %s", err)
+	}
+	appToken := tokenpb.AppToken{
+		App:        2,
+		Token:      GenJwtToken(2),
+		Expiration: pbexp,
+	}
+	_, err = store.PutAppToken(&appToken)
+	if err != nil {
+		t.Fatalf("Failed to put app token: %s", err)
+	}
+	moved, err := store.MigrateLegacyInstallTokens(map[uint64][]uint64{1: {5}, 2: {6}}, &logger)
+	if err != nil {
+		t.Fatalf("Migration failed: %s", err)
+	}
+	if moved != 1 {
+		t.Fatalf("Moved %d tokens instead of 1", moved)
+	}
+	migrated, _, err := store.GetInstallToken(1, 5)
+	if err != nil {
+		t.Fatalf("Failed to get migrated token: %s", err)
+	}
+	if migrated.Token != legacyToken.Token {
+		t.Fatalf("Migrated token %s does not match %s", migrated.Token, legacyToken.Token)
+	}
+	var legacy tokenpb.InstallToken
+	_, err = store.GetMessage(legacyName, &legacy)
+	if !messagestore.IsNotFound(err) {
+		t.Fatalf("Legacy document remains after migration: %v", err)
+	}
+	appTokenBack, _, err := store.GetAppToken(2)
+	if err != nil {
+		t.Fatalf("Ambiguous app token was not left in place: %s", err)
+	}
+	if appTokenBack.Token != appToken.Token {
+		t.Fatalf("Ambiguous app token was modified")
+	}
+	_, _, err = store.GetInstallToken(2, 6)
+	if !messagestore.IsNotFound(err) {
+		t.Fatalf("Ambiguous document was migrated: %v", err)
+	}
+}
+
+func TestScopedInstallToken(t *testing.T) {
+	store := NewMemTokenStore()
+	store.Links = tokenpb.Links{
+		AppTokens:     "tokens/{AppId}/app",
+		InstallTokens: "tokens/{AppId}/installs/{InstallId}",
+	}
+	scope := &InstallTokenScope{
+		Repositories: []string{"repo-b", "repo-a"},
+		Permissions: map[string]string{
+			"issues":   "write",
+			"contents": "read",
+		},
+	}
+	reordered := &InstallTokenScope{
+		Repositories: []string{"repo-a", "repo-b"},
+		Permissions: map[string]string{
+			"contents": "read",
+			"issues":   "write",
+		},
+	}
+	if scope.Hash() != reordered.Hash() {
+		t.Fatalf("Hashes of equal scopes differ: %s and %s", scope.Hash(), reordered.Hash())
+	}
+	other := &InstallTokenScope{
+		Repositories: []string{"repo-a"},
+	}
+	if scope.Hash() == other.Hash() {
+		t.Fatalf("Hashes of different scopes are both %s", scope.Hash())
+	}
+	name, err := store.ScopedInstallTokenName(1, 5, scope)
+	if err != nil {
+		t.Fatalf("Failed to name scoped token: %s", err)
+	}
+	expectedName := "tokens/1/installs/5-" + scope.Hash()
+	if name != expectedName {
+		t.Fatalf("Expected name %s but got %s", expectedName, name)
+	}
+	unscopedName, err := store.ScopedInstallTokenName(1, 5, nil)
+	if err != nil {
+		t.Fatalf("Failed to name unscoped token: %s", err)
+	}
+	if unscopedName != "tokens/1/installs/5" {
+		t.Fatalf("Expected unscoped name tokens/1/installs/5 but got %s", unscopedName)
+	}
+	pbexp, err := ptypes.TimestampProto(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to convert expiration: %s", err)
+	}
+	token := tokenpb.InstallToken{
+		App:        1,
+		Install:    5,
+		Token:      GenInstallToken(),
+		Expiration: pbexp,
+	}
+	_, err = store.PutScopedInstallToken(&token, scope)
+	if err != nil {
+		t.Fatalf("Failed to put scoped token: %s", err)
+	}
+	tokenBack, meta, err := store.GetScopedInstallToken(1, 5, reordered)
+	if err != nil {
+		t.Fatalf("Failed to get scoped token: %s", err)
+	}
+	if tokenBack.Token != token.Token {
+		t.Fatalf("Scoped token %s does not match %s", tokenBack.Token, token.Token)
+	}
+	scopeBack, err := InstallTokenScopeFromMeta(meta)
+	if err != nil {
+		t.Fatalf("Failed to read scope from metadata: %s", err)
+	}
+	if scopeBack.String() != scope.String() {
+		t.Fatalf("Expected scope %s but got %v", scope, scopeBack)
+	}
+	_, _, err = store.GetInstallToken(1, 5)
+	if !messagestore.IsNotFound(err) {
+		t.Fatalf("Scoped token was stored as unscoped token: %v", err)
+	}
+}
+
+func TestScopedInstallTokenRepositoryIds(t *testing.T) {
+	const appId = 1
+	const installId = 5
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	named := &InstallTokenScope{
+		Repositories: []string{"repo-a"},
+	}
+	if named.String() != "repositories=repo-a;permissions=" {
+		t.Fatalf("Scope without repository ids has canonical form %s", named)
+	}
+	scope := &InstallTokenScope{
+		RepositoryIds: []uint64{22, 3},
+		Permissions: map[string]string{
+			"contents": "read",
+		},
+	}
+	parsed, err := ParseInstallTokenScope(scope.String())
+	if err != nil || parsed.String() != "repositories=;permissions=contents:read;repository_ids=3,22" {
+		t.Fatalf("Parsed scope %s as %v, %v", scope, parsed, err)
+	}
+	other := &InstallTokenScope{
+		RepositoryIds: []uint64{22},
+		Permissions: map[string]string{
+			"contents": "read",
+		},
+	}
+	if !other.Within(scope) || scope.Within(other) {
+		t.Fatalf("Scope %s is not strictly within %s", other, scope)
+	}
+	provider := StubProviders{
+		AppJwt: GenJwtToken(appId),
+	}
+	received := make([]*InstallTokenScope, 0)
+	store := NewMemTokenStore()
+	service := InstallTokenService{
+		TokenMessageStore: store,
+		SigningService:    &provider,
+		ScopedInstallTokenProvider: func(install uint64, appToken string, scope *InstallTokenScope) (string, time.Time, error) {
+			received = append(received, scope)
+			return GenInstallToken(), time.Now().Add(time.Hour), nil
+		},
+	}
+	ctx := context.Background()
+	first, err := service.GetScopedInstallToken(ctx, appId, installId, scope, &logger)
+	if err != nil {
+		t.Fatalf("Failed to get scoped token: %s", err)
+	}
+	second, err := service.GetScopedInstallToken(ctx, appId, installId, other, &logger)
+	if err != nil {
+		t.Fatalf("Failed to get scoped token: %s", err)
+	}
+	if first.Token == second.Token || len(received) != 2 || received[1].String() != other.String() {
+		t.Fatalf("Scopes %s and %s shared token %s after provider calls %v", scope, other, first.Token, received)
+	}
+	firstName, _ := store.ScopedInstallTokenName(appId, installId, scope)
+	secondName, _ := store.ScopedInstallTokenName(appId, installId, other)
+	if firstName == secondName {
+		t.Fatalf("Scopes %s and %s share document %s", scope, other, firstName)
+	}
+	for name, token := range map[string]string{firstName: first.Token, secondName: second.Token} {
+		var cached tokenpb.InstallToken
+		if _, err = store.GetMessage(name, &cached); err != nil || cached.Token != token {
+			t.Errorf("Cached %s as %v, %v instead of %s", name, cached.Token, err, token)
+		}
+	}
+	_, err = RepositoryAllowancePolicy(map[string][]string{"": {"repo-a"}})(ctx, appId, installId, scope)
+	if _, ok := err.(*ScopeDenied); !ok {
+		t.Fatalf("Expected ScopeDenied for repository ids but got %v", err)
+	}
+}
+
+func TestScopedInstallTokensCachedPerPermissions(t *testing.T) {
+	const appId = 1
+	const installId = 2
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	provider := StubProviders{
+		AppJwt: GenJwtToken(appId),
+	}
+	minted := 0
+	service := InstallTokenService{
+		TokenMessageStore: NewMemTokenStore(),
+		SigningService:    &provider,
+		ScopedInstallTokenProvider: func(install uint64, appToken string, scope *InstallTokenScope) (string, time.Time, error) {
+			minted++
+			return GenInstallToken(), time.Now().Add(time.Hour), nil
+		},
+	}
+	scopes := []*InstallTokenScope{
+		{Permissions: map[string]string{"contents": "read"}},
+		{Permissions: map[string]string{"contents": "write"}},
+	}
+	ctx := context.Background()
+	tokens := make([]string, len(scopes))
+	for i, scope := range scopes {
+		token, err := service.GetScopedInstallToken(ctx, appId, installId, scope, &logger)
+		if err != nil {
+			t.Fatalf("Failed to get token with scope %s: %s", scope, err)
+		}
+		tokens[i] = token.Token
+	}
+	if tokens[0] == tokens[1] || minted != 2 {
+		t.Fatalf("Minted %d tokens %v for scopes %s and %s", minted, tokens, scopes[0], scopes[1])
+	}
+	for i, scope := range scopes {
+		token, err := service.GetScopedInstallToken(ctx, appId, installId, scope, &logger)
+		if err != nil {
+			t.Fatalf("Failed to get cached token with scope %s: %s", scope, err)
+		}
+		if token.Token != tokens[i] {
+			t.Errorf("Got token %s with scope %s instead of cached %s", token.Token, scope, tokens[i])
+		}
+	}
+	if minted != 2 {
+		t.Errorf("Minted %d tokens instead of serving the 2 cached", minted)
+	}
+}
+
+func TestProviderLimit(t *testing.T) {
+	const limit = 3
+	var inFlight, maxInFlight int32
+	var mu sync.Mutex
+	service := InstallTokenService{
+		ProviderLimit:     limit,
+		ProviderLimitWait: 10 * time.Second,
+		InstallTokenProvider: func(install uint64, appToken string) (string, time.Time, error) {
+			n := atomic.AddInt32(&inFlight, 1)
+			mu.Lock()
+			if n > maxInFlight {
+				maxInFlight = n
+			}
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&inFlight, -1)
+			return GenInstallToken(), time.Now().Add(time.Hour), nil
+		},
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(install uint64) {
+			defer wg.Done()
+			_, _, err := service.callInstallTokenProvider(1, install, "app-token")
+			if err != nil {
+				errs <- err
+			}
+		}(uint64(i + 1))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Provider call failed: %s", err)
+	}
+	if maxInFlight > limit {
+		t.Fatalf("%d provider calls were in flight, exceeding limit %d", maxInFlight, limit)
+	}
+	if maxInFlight == 0 {
+		t.Fatalf("Provider was never called")
+	}
+}
+
+func TestProviderLimitTimeout(t *testing.T) {
+	block := make(chan struct{})
+	started := make(chan struct{})
+	service := InstallTokenService{
+		ProviderLimit:     1,
+		ProviderLimitWait: 10 * time.Millisecond,
+		InstallTokenProvider: func(install uint64, appToken string) (string, time.Time, error) {
+			close(started)
+			<-block
+			return GenInstallToken(), time.Now().Add(time.Hour), nil
+		},
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		service.callInstallTokenProvider(1, 1, "app-token")
+	}()
+	<-started
+	_, _, err := service.callInstallTokenProvider(1, 2, "app-token")
+	if _, ok := err.(ProviderLimitTimeout); !ok {
+		t.Fatalf("Expected ProviderLimitTimeout but got %v", err)
+	}
+	close(block)
+	<-done
+}
+
+func TestGetInstallTokenSharesMint(t *testing.T) {
+	const appId = 1
+	const installId = 2
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	provider := StubProviders{
+		AppJwt: GenJwtToken(appId),
+	}
+	var calls int32
+	token := GenInstallToken()
+	service := InstallTokenService{
+		TokenMessageStore: NewMemTokenStore(),
+		SigningService:    &provider,
+		InstallTokenProvider: func(install uint64, appToken string) (string, time.Time, error) {
+			atomic.AddInt32(&calls, 1)
+			time.Sleep(20 * time.Millisecond)
+			return token, time.Now().Add(time.Hour), nil
+		},
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := tokenpb.GetInstallTokenRequest{
+				App:     appId,
+				Install: installId,
+			}
+			resp, err := service.GetInstallToken(&req, &logger)
+			if err != nil {
+				errs <- err
+			} else if resp.Token.Token != token {
+				errs <- fmt.Errorf("got token %s instead of %s", resp.Token.Token, token)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Failed to get install token: %s", err)
+	}
+	if calls != 1 {
+		t.Fatalf("Provider called %d times for concurrent requests of one install", calls)
+	}
+}
+
+func TestExportTokens(t *testing.T) {
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	blobStore := messagestore.NewMemBlobStore()
+	messageStore := messagestore.BlobMessageStore{
+		BlobStore: blobStore,
+	}
+	keyService := appkeystore.NewAppKeyService(&messageStore, nil)
+	err := keyService.Store.InitDb(&logger)
+	if err != nil {
+		t.Fatalf("Failed to initialize database: %s", err)
+	}
+	_, err = keyService.Store.PutKey(1, "fingerprint", []byte("secret key"))
+	if err != nil {
+		t.Fatalf("Failed to put key: %s", err)
+	}
+	store := NewTokenMessageStore(&messageStore, nil)
+	pbexp, err := ptypes.TimestampProto(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to convert expiration: %s", err)
+	}
+	appToken := tokenpb.AppToken{
+		App:        1,
+		Token:      GenJwtToken(1),
+		Expiration: pbexp,
+	}
+	_, err = store.PutAppToken(&appToken)
+	if err != nil {
+		t.Fatalf("Failed to put app token: %s", err)
+	}
+	installToken := tokenpb.InstallToken{
+		App:        1,
+		Install:    5,
+		Token:      GenInstallToken(),
+		Expiration: pbexp,
+	}
+	_, err = store.PutInstallToken(&installToken)
+	if err != nil {
+		t.Fatalf("Failed to put install token: %s", err)
+	}
+	var stream bytes.Buffer
+	exported, err := store.ExportTokens(&stream)
+	if err != nil {
+		t.Fatalf("Failed to export tokens: %s", err)
+	}
+	if exported != 2 {
+		t.Fatalf("Exported %d documents instead of 2", exported)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(stream.Bytes()))
+	for {
+		var record messagestore.ExportRecord
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Failed to decode export stream: %s", err)
+		}
+		if !strings.HasPrefix(record.Name, "tokens/") {
+			t.Fatalf("Non-token document %s was exported", record.Name)
+		}
+	}
+	importStore := NewMemTokenStore()
+	importBlobs := importStore.MessageStore.(*messagestore.BlobMessageStore).BlobStore
+	imported, err := messagestore.ImportBlobs(importBlobs, &stream)
+	if err != nil {
+		t.Fatalf("Failed to import tokens: %s", err)
+	}
+	if imported != exported {
+		t.Fatalf("Imported %d documents instead of %d", imported, exported)
+	}
+	installTokenBack, _, err := importStore.GetInstallToken(1, 5)
+	if err != nil {
+		t.Fatalf("Failed to get imported install token: %s", err)
+	}
+	if installTokenBack.Token != installToken.Token {
+		t.Fatalf("Imported token %s does not match %s", installTokenBack.Token, installToken.Token)
+	}
+}
+
+func TestGetInstallTokenRefreshThreshold(t *testing.T) {
+	const appId = 1
+	const installId = 2
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := timeutils.FixedClock(now).Now
+	cases := []struct {
+		Threshold   time.Duration
+		ExpectCalls int
+	}{
+		{60 * time.Second, 1},
+		{10 * time.Second, 0},
+	}
+	for _, c := range cases {
+		provider := StubProviders{
+			AppJwt:            GenJwtToken(appId),
+			InstallToken:      GenInstallToken(),
+			InstallExpiration: now.Add(time.Hour),
+		}
+		store := NewMemTokenStore()
+		pbexp, err := ptypes.TimestampProto(now.Add(30 * time.Second))
+		if err != nil {
+			t.Fatalf("Failed to convert expiration: %s", err)
+		}
+		cachedToken := tokenpb.InstallToken{
+			App:        appId,
+			Install:    installId,
+			Token:      GenInstallToken(),
+			Expiration: pbexp,
+		}
+		_, err = store.PutInstallToken(&cachedToken)
+		if err != nil {
+			t.Fatalf("Failed to put install token: %s", err)
+		}
+		service := InstallTokenService{
+			TokenMessageStore:    store,
+			SigningService:       &provider,
+			InstallTokenProvider: provider.InstallTokenProvider,
+			RefreshThreshold:     c.Threshold,
+			Clock:                clock,
+		}
+		req := tokenpb.GetInstallTokenRequest{
+			App:     appId,
+			Install: installId,
+		}
+		resp, err := service.GetInstallToken(&req, &logger)
+		if err != nil {
+			t.Fatalf("Failed to get token: %s", err)
+		}
+		if provider.InstallTokenCalls != c.ExpectCalls {
+			t.Fatalf("Threshold %s: install token provider called %d times instead of %d", c.Threshold, provider.InstallTokenCalls, c.ExpectCalls)
+		}
+		expectedToken := cachedToken.Token
+		if c.ExpectCalls != 0 {
+			expectedToken = provider.InstallToken
+		}
+		if resp.Token.Token != expectedToken {
+			t.Fatalf("Threshold %s: got token %s instead of %s", c.Threshold, resp.Token.Token, expectedToken)
+		}
+	}
+}
+
+func TestGetInstallTokenRefreshFailure(t *testing.T) {
+	const appId = 1
+	const installId = 2
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	provider := StubProviders{
+		AppJwt: GenJwtToken(appId),
+	}
+	store := NewMemTokenStore()
+	pbexp, err := ptypes.TimestampProto(now.Add(30 * time.Second))
+	if err != nil {
+		t.Fatalf("Failed to convert expiration: %s", err)
+	}
+	cachedToken := tokenpb.InstallToken{
+		App:        appId,
+		Install:    installId,
+		Token:      GenInstallToken(),
+		Expiration: pbexp,
+	}
+	_, err = store.PutInstallToken(&cachedToken)
+	if err != nil {
+		t.Fatalf("Failed to put install token: %s", err)
+	}
+	service := InstallTokenService{
+		TokenMessageStore: store,
+		SigningService:    &provider,
+		InstallTokenProvider: func(install uint64, appToken string) (string, time.Time, error) {
+			return "", time.Time{}, fmt.Errorf("provider unavailable")
+		},
+		RefreshThreshold: time.Minute,
+		Clock:            timeutils.FixedClock(now).Now,
+	}
+	req := tokenpb.GetInstallTokenRequest{
+		App:     appId,
+		Install: installId,
+	}
+	resp, err := service.GetInstallToken(&req, &logger)
+	if err != nil {
+		t.Fatalf("Failed refresh did not fall back to cached token: %s", err)
+	}
+	if resp.Token.Token != cachedToken.Token {
+		t.Fatalf("Got token %s instead of cached token %s", resp.Token.Token, cachedToken.Token)
+	}
+}
+
+// deleteRecordingStore is a MessageStore recording deleted names
+type deleteRecordingStore struct {
+	messagestore.MessageStore
+	Deleted []string
+}
+
+func (s *deleteRecordingStore) DeleteMessage(name string) (*messagestore.CacheMeta, error) {
+	s.Deleted = append(s.Deleted, name)
+	return s.MessageStore.DeleteMessage(name)
+}
+
+func TestGetInstallTokenEvictsCorruptToken(t *testing.T) {
+	const appId = 1
+	const installId = 2
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	provider := StubProviders{
+		AppJwt:            GenJwtToken(appId),
+		InstallToken:      GenInstallToken(),
+		InstallExpiration: time.Now().Add(time.Hour).UTC().Truncate(time.Second),
+	}
+	messageStore := deleteRecordingStore{
+		MessageStore: messagestore.NewMemMessageStore(),
+	}
+	store := NewTokenMessageStore(&messageStore, nil)
+	corruptToken := tokenpb.InstallToken{
+		App:     appId,
+		Install: installId,
+		Token:   GenInstallToken(),
+	}
+	_, err := store.PutInstallToken(&corruptToken)
+	if err != nil {
+		t.Fatalf("Failed to put install token: %s", err)
+	}
+	service := InstallTokenService{
+		TokenMessageStore:    store,
+		SigningService:       &provider,
+		InstallTokenProvider: provider.InstallTokenProvider,
+	}
+	req := tokenpb.GetInstallTokenRequest{
+		App:     appId,
+		Install: installId,
+	}
+	resp, err := service.GetInstallToken(&req, &logger)
+	if err != nil {
+		t.Fatalf("Failed to get token: %s", err)
+	}
+	name, err := store.InstallTokenName(appId, installId)
+	if err != nil {
+		t.Fatalf("Failed to name install token: %s", err)
+	}
+	if len(messageStore.Deleted) != 1 || messageStore.Deleted[0] != name {
+		t.Fatalf("Expected eviction of %s but deleted %v", name, messageStore.Deleted)
+	}
+	if resp.Token.Token != provider.InstallToken {
+		t.Fatalf("Got token %s instead of re-minted token %s", resp.Token.Token, provider.InstallToken)
+	}
+	storedToken, _, err := store.GetInstallToken(appId, installId)
+	if err != nil {
+		t.Fatalf("Failed to get re-minted token: %s", err)
+	}
+	if storedToken.Expiration == nil {
+		t.Fatalf("Re-minted token has no expiration")
+	}
+}
+
+func TestGetInstallTokenExpiry(t *testing.T) {
+	const appId = 1
+	const installId = 2
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		Name        string
+		Expiration  time.Time
+		ExpectCalls int
+	}{
+		{"expired", now.Add(-time.Second), 1},
+		{"valid", now.Add(time.Hour), 0},
+		{"near expiry", now.Add(30 * time.Second), 1},
+	}
+	for _, c := range cases {
+		provider := StubProviders{
+			AppJwt:            GenJwtToken(appId),
+			InstallToken:      GenInstallToken(),
+			InstallExpiration: now.Add(time.Hour),
+		}
+		store := NewMemTokenStore()
+		pbexp, err := ptypes.TimestampProto(c.Expiration)
+		if err != nil {
+			t.Fatalf("Failed to convert expiration: %s", err)
+		}
+		cachedToken := tokenpb.InstallToken{
+			App:        appId,
+			Install:    installId,
+			Token:      GenInstallToken(),
+			Expiration: pbexp,
+		}
+		_, err = store.PutInstallToken(&cachedToken)
+		if err != nil {
+			t.Fatalf("Failed to put install token: %s", err)
+		}
+		service := InstallTokenService{
+			TokenMessageStore:    store,
+			SigningService:       &provider,
+			InstallTokenProvider: provider.InstallTokenProvider,
+			RefreshThreshold:     time.Minute,
+			Clock:                timeutils.FixedClock(now).Now,
+		}
+		req := tokenpb.GetInstallTokenRequest{
+			App:     appId,
+			Install: installId,
+		}
+		_, err = service.GetInstallToken(&req, &logger)
+		if err != nil {
+			t.Fatalf("%s: failed to get token: %s", c.Name, err)
+		}
+		if provider.InstallTokenCalls != c.ExpectCalls {
+			t.Fatalf("%s: install token provider called %d times instead of %d", c.Name, provider.InstallTokenCalls, c.ExpectCalls)
+		}
+	}
+}
+
+func TestGetScopedInstallTokenPolicy(t *testing.T) {
+	const appId = 1
+	const installId = 2
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	provider := StubProviders{
+		AppJwt: GenJwtToken(appId),
+	}
+	var receivedScope *InstallTokenScope
+	service := InstallTokenService{
+		TokenMessageStore: NewMemTokenStore(),
+		SigningService:    &provider,
+		ScopedInstallTokenProvider: func(install uint64, appToken string, scope *InstallTokenScope) (string, time.Time, error) {
+			receivedScope = scope
+			return GenInstallToken(), time.Now().Add(time.Hour), nil
+		},
+		ScopePolicy: RepositoryAllowancePolicy(map[string][]string{
+			"ci": {"repo-a", "repo-b"},
+		}),
+	}
+	ctx := WithCaller(context.Background(), "ci")
+	requested := &InstallTokenScope{
+		Permissions: map[string]string{
+			"contents": "read",
+		},
+	}
+	_, err := service.GetScopedInstallToken(ctx, appId, installId, requested, &logger)
+	if err != nil {
+		t.Fatalf("Failed to get scoped token: %s", err)
+	}
+	if receivedScope == nil || strings.Join(receivedScope.Repositories, ",") != "repo-a,repo-b" {
+		t.Fatalf("Scope was not narrowed to allowed repositories: %v", receivedScope)
+	}
+	if !receivedScope.Within(requested) {
+		t.Fatalf("Narrowed scope %s is broader than requested scope %s", receivedScope, requested)
+	}
+	overBroad := &InstallTokenScope{
+		Repositories: []string{"repo-a", "repo-c"},
+	}
+	_, err = service.GetScopedInstallToken(ctx, appId, installId, overBroad, &logger)
+	if _, ok := err.(*ScopeDenied); !ok {
+		t.Fatalf("Expected ScopeDenied but got %v", err)
+	}
+	_, err = service.GetScopedInstallToken(WithCaller(context.Background(), "other"), appId, installId, requested, &logger)
+	if _, ok := err.(*ScopeDenied); !ok {
+		t.Fatalf("Expected ScopeDenied for unknown caller but got %v", err)
+	}
+	service.ScopePolicy = func(ctx context.Context, app, install uint64, requested *InstallTokenScope) (*InstallTokenScope, error) {
+		return &InstallTokenScope{
+			Permissions: map[string]string{
+				"contents": "write",
+			},
+		}, nil
+	}
+	_, err = service.GetScopedInstallToken(ctx, appId, installId, requested, &logger)
+	if _, ok := err.(*ScopeDenied); !ok {
+		t.Fatalf("Expected ScopeDenied for broadening policy but got %v", err)
+	}
+}
+
+func TestInvalidationSink(t *testing.T) {
+	const appId = 1
+	const installId = 2
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	provider := StubProviders{
+		AppJwt:            GenJwtToken(appId),
+		InstallToken:      GenInstallToken(),
+		InstallExpiration: time.Now().Add(time.Hour),
+	}
+	var invalidated []string
+	service := InstallTokenService{
+		TokenMessageStore:    NewMemTokenStore(),
+		SigningService:       &provider,
+		InstallTokenProvider: provider.InstallTokenProvider,
+		InvalidationSink: func(names []string) {
+			invalidated = append(invalidated, names...)
+		},
+	}
+	appTokenName, err := service.AppTokenName(appId)
+	if err != nil {
+		t.Fatalf("Failed to name app token: %s", err)
+	}
+	installTokenName, err := service.InstallTokenName(appId, installId)
+	if err != nil {
+		t.Fatalf("Failed to name install token: %s", err)
+	}
+	_, err = service.MintInstallToken(context.Background(), appId, installId, nil, &logger)
+	if err != nil {
+		t.Fatalf("Failed to mint token: %s", err)
+	}
+	expected := []string{appTokenName, installTokenName}
+	if strings.Join(invalidated, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Force refresh invalidated %v instead of %v", invalidated, expected)
+	}
+	invalidated = nil
+	err = service.InvalidateInstallToken(appId, installId, &logger)
+	if err != nil {
+		t.Fatalf("Failed to invalidate token: %s", err)
+	}
+	if len(invalidated) != 1 || invalidated[0] != installTokenName {
+		t.Fatalf("InvalidateInstallToken invalidated %v instead of %s", invalidated, installTokenName)
+	}
+	_, _, err = service.TokenMessageStore.GetInstallToken(appId, installId)
+	if !messagestore.IsNotFound(err) {
+		t.Fatalf("Invalidated token remains in store: %v", err)
+	}
+}
+
+// failingGetStore is a MessageStore whose gets fail with Err
+type failingGetStore struct {
+	messagestore.MessageStore
+	Err error
+}
+
+func (s *failingGetStore) GetMessage(name string, pb proto.Message) (*messagestore.CacheMeta, error) {
+	return nil, &messagestore.GetResourceError{
+		Name:  name,
+		Cause: s.Err,
+	}
+}
+
+func TestGetInstallTokenTransientError(t *testing.T) {
+	const appId = 1
+	const installId = 2
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	provider := StubProviders{
+		AppJwt:            GenJwtToken(appId),
+		InstallToken:      GenInstallToken(),
+		InstallExpiration: time.Now().Add(time.Hour).UTC().Truncate(time.Second),
+	}
+	transientErr := errors.New("request timed out")
+	messageStore := failingGetStore{
+		MessageStore: messagestore.NewMemMessageStore(),
+		Err:          transientErr,
+	}
+	service := InstallTokenService{
+		TokenMessageStore:    NewTokenMessageStore(&messageStore, nil),
+		SigningService:       &provider,
+		InstallTokenProvider: provider.InstallTokenProvider,
+	}
+	req := tokenpb.GetInstallTokenRequest{
+		App:     appId,
+		Install: installId,
+	}
+	resp, err := service.GetInstallToken(&req, &logger)
+	if err != nil {
+		t.Fatalf("Failed to mint token despite an unreadable cache: %s", err)
+	}
+	if resp.Token.Token != provider.InstallToken {
+		t.Fatalf("Got token %s instead of %s", resp.Token.Token, provider.InstallToken)
+	}
+	if provider.InstallTokenCalls != 1 {
+		t.Fatalf("Minted %d tokens instead of 1 for an unreadable cache", provider.InstallTokenCalls)
+	}
+	messageStore.Err = messagestore.NoSuchResource("token")
+	if _, err = service.GetInstallToken(&req, &logger); err != nil {
+		t.Fatalf("Failed to mint token for a missing cached token: %s", err)
+	}
+	if provider.InstallTokenCalls != 2 {
+		t.Fatalf("Minted %d tokens instead of 2 for a missing cached token", provider.InstallTokenCalls)
+	}
+	// A failed write of the minted token is only fatal with RequirePersist
+	messageStore.Err = transientErr
+	putStore := failingPutStore{
+		MessageStore: &messageStore,
+		Err:          transientErr,
+	}
+	tokenStore := NewTokenMessageStore(&putStore, nil)
+	putStore.Name, err = tokenStore.InstallTokenName(appId, installId)
+	if err != nil {
+		t.Fatalf("Failed to name install token: %s", err)
+	}
+	service.TokenMessageStore = tokenStore
+	if _, err = service.GetInstallToken(&req, &logger); err != nil {
+		t.Fatalf("Failed to mint token despite failing reads and writes: %s", err)
+	}
+	service.RequirePersist = true
+	if _, err = service.GetInstallToken(&req, &logger); err == nil {
+		t.Fatalf("Returned an unpersisted token with RequirePersist")
+	} else if _, ok := err.(*TokenNotPersisted); !ok {
+		t.Fatalf("Expected TokenNotPersisted but got %v", err)
+	}
+}
+
+func TestGetInstallTokenPastExpiration(t *testing.T) {
+	const appId = 1
+	const installId = 2
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	provider := StubProviders{
+		AppJwt:            GenJwtToken(appId),
+		InstallToken:      GenInstallToken(),
+		InstallExpiration: now.Add(-time.Minute),
+	}
+	store := NewMemTokenStore()
+	service := InstallTokenService{
+		TokenMessageStore:    store,
+		SigningService:       &provider,
+		InstallTokenProvider: provider.InstallTokenProvider,
+		Clock:                timeutils.FixedClock(now).Now,
+	}
+	req := tokenpb.GetInstallTokenRequest{
+		App:     appId,
+		Install: installId,
+	}
+	_, err := service.GetInstallToken(&req, &logger)
+	expired, ok := err.(*ExpiredInstallToken)
+	if !ok {
+		t.Fatalf("Expected expired token error but got %v", err)
+	}
+	if !expired.Expiration.Equal(provider.InstallExpiration) {
+		t.Errorf("Error has expiration %s instead of %s", expired.Expiration, provider.InstallExpiration)
+	}
+	if _, _, err := store.GetInstallToken(appId, installId); !messagestore.IsNotFound(err) {
+		t.Fatalf("Expired token was cached: %v", err)
+	}
+	_, err = service.MintInstallToken(context.Background(), appId, installId, nil, &logger)
+	if _, ok := err.(*ExpiredInstallToken); !ok {
+		t.Fatalf("Minting expected expired token error but got %v", err)
+	}
+	provider.InstallExpiration = now.Add(time.Hour)
+	resp, err := service.GetInstallToken(&req, &logger)
+	if err != nil {
+		t.Fatalf("Failed to get token: %s", err)
+	}
+	expiration, err := ResponseExpiration(resp)
+	if err != nil {
+		t.Fatalf("Failed to get response expiration: %s", err)
+	}
+	if !expiration.Equal(provider.InstallExpiration) {
+		t.Fatalf("Response expires at %s instead of %s", expiration, provider.InstallExpiration)
+	}
+}
+
+func TestInitDb(t *testing.T) {
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	backend := messagestore.NewMemMessageStore()
+	links := tokenpb.Links{
+		AppTokens:     "custom/{AppId}/app",
+		InstallTokens: "custom/{AppId}/installs/{InstallId}",
+	}
+	store := NewTokenMessageStore(backend, &links)
+	if err := store.InitDb(&logger); err != nil {
+		t.Fatalf("Failed to initialize token store: %s", err)
+	}
+	first, _, err := backend.GetBlob(LINKS_NAME)
+	if err != nil {
+		t.Fatalf("Failed to get links document: %s", err)
+	}
+	reinit := NewTokenMessageStore(backend, nil)
+	if err := reinit.InitDb(&logger); err != nil {
+		t.Fatalf("Failed to initialize token store again: %s", err)
+	}
+	second, _, err := backend.GetBlob(LINKS_NAME)
+	if err != nil {
+		t.Fatalf("Failed to get links document: %s", err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Fatalf("Links document changed from %q to %q", first, second)
+	}
+	loaded, err := LoadTokenMessageStore(backend)
+	if err != nil {
+		t.Fatalf("Failed to load token store: %s", err)
+	}
+	if loaded.Links.AppTokens != links.AppTokens || loaded.Links.InstallTokens != links.InstallTokens {
+		t.Fatalf("Loaded links %v instead of %v", loaded.Links, links)
+	}
+	fresh, err := LoadTokenMessageStore(messagestore.NewMemMessageStore())
+	if err != nil || fresh.Links.AppTokens != tokenpb.DefaultLinks.AppTokens {
+		t.Fatalf("Loaded uninitialized store with links %v, %v", fresh, err)
+	}
+}
+
+func TestValidateLinks(t *testing.T) {
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	valid := []tokenpb.Links{
+		tokenpb.DefaultLinks,
+		{
+			AppTokens:     "custom/{AppId}/app",
+			InstallTokens: "custom/{AppId}/installs/{InstallId}",
+		},
+		{
+			AppTokens:     "legacy/{AppId}/{InstallId}",
+			InstallTokens: "tokens/{AppId}/{InstallId}",
+		},
+	}
+	for _, links := range valid {
+		if err := NewTokenMessageStore(messagestore.NewMemMessageStore(), &links).ValidateLinks(); err != nil {
+			t.Errorf("Links %v failed validation: %s", links, err)
+		}
+	}
+	invalid := []tokenpb.Links{
+		{
+			AppTokens:     "tokens/{AppId/app",
+			InstallTokens: tokenpb.DefaultLinks.InstallTokens,
+		},
+		{
+			AppTokens:     tokenpb.DefaultLinks.AppTokens,
+			InstallTokens: "tokens/{AppId}/installs/{Install}",
+		},
+		{
+			AppTokens:     tokenpb.DefaultLinks.AppTokens,
+			InstallTokens: "tokens/{AppId}/installs",
+		},
+		{
+			AppTokens:     "tokens/app",
+			InstallTokens: tokenpb.DefaultLinks.InstallTokens,
+		},
+		{
+			AppTokens:     tokenpb.DefaultLinks.AppTokens,
+			InstallTokens: "",
+		},
+		{
+			AppTokens:     tokenpb.DefaultLinks.InstallTokens,
+			InstallTokens: tokenpb.DefaultLinks.InstallTokens,
+		},
+		{
+			AppTokens:     "custom/{AppId}/{InstallId}",
+			InstallTokens: "custom/{AppId}/{InstallId}",
+		},
+	}
+	for _, links := range invalid {
+		backend := messagestore.NewMemMessageStore()
+		store := NewTokenMessageStore(backend, &links)
+		if _, ok := store.ValidateLinks().(*InvalidLinks); !ok {
+			t.Errorf("Links %v passed validation", links)
+		}
+		if _, ok := store.InitDb(&logger).(*InvalidLinks); !ok {
+			t.Errorf("Initialized store with links %v", links)
+		}
+		if _, err := backend.PutMessage(LINKS_NAME, &links); err != nil {
+			t.Fatalf("Failed to put links: %s", err)
+		}
+		if _, err := LoadTokenMessageStore(backend); err == nil {
+			t.Errorf("Loaded store with links %v", links)
+		}
+	}
+}
+
+func TestReadOnlyTokenStore(t *testing.T) {
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	store := NewTokenMessageStore(messagestore.NewReadOnlyMessageStore(messagestore.NewMemMessageStore()), nil)
+	if err := store.InitDb(&logger); !messagestore.IsReadOnly(err) {
+		t.Errorf("Expected read-only error initializing store but got %v", err)
+	}
+	if _, err := store.PutAppToken(&tokenpb.AppToken{App: 1}); !messagestore.IsReadOnly(err) {
+		t.Errorf("Expected read-only error putting token but got %v", err)
+	}
+	if _, _, err := store.GetAppToken(1); !messagestore.IsNotFound(err) {
+		t.Errorf("Expected missing token but got %v", err)
+	}
+}
+
+func TestDefaultLinks(t *testing.T) {
+	store := NewTokenMessageStore(messagestore.NewMemMessageStore(), nil)
+	appName, err := store.AppTokenName(1)
+	if err != nil {
+		t.Fatalf("Failed to name app token with default links: %s", err)
+	}
+	installName, err := store.InstallTokenName(1, 22)
+	if err != nil {
+		t.Fatalf("Failed to name install token with default links: %s", err)
+	}
+	if appName == installName || !strings.Contains(appName, "1") || !strings.Contains(installName, "22") {
+		t.Fatalf("Default links named app token %s and install token %s", appName, installName)
+	}
+	otherInstall, err := store.InstallTokenName(1, 23)
+	if err != nil || otherInstall == installName {
+		t.Fatalf("Default links named installs 22 and 23 %s and %s: %v", installName, otherInstall, err)
+	}
+}
+
+func TestGetInstallTokens(t *testing.T) {
+	const appId = 1
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	provider := StubProviders{
+		AppJwt: GenJwtToken(appId),
+	}
+	store := NewMemTokenStore()
+	cachedTokens := map[uint64]time.Time{
+		1: now.Add(time.Hour),
+		2: now.Add(-time.Second),
+	}
+	for install, expiration := range cachedTokens {
+		pbexp, err := ptypes.TimestampProto(expiration)
+		if err != nil {
+			t.Fatalf("Failed to convert expiration: %s", err)
+		}
+		_, err = store.PutInstallToken(&tokenpb.InstallToken{
+			App:        appId,
+			Install:    install,
+			Token:      fmt.Sprintf("cached-%d", install),
+			Expiration: pbexp,
+		})
+		if err != nil {
+			t.Fatalf("Failed to put install token: %s", err)
+		}
+	}
+	var mu sync.Mutex
+	minted := make(map[uint64]int)
+	service := InstallTokenService{
+		TokenMessageStore: store,
+		SigningService:    &provider,
+		InstallTokenProvider: func(install uint64, appToken string) (string, time.Time, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			minted[install]++
+			if install == 4 {
+				return "", time.Time{}, fmt.Errorf("install suspended")
+			}
+			return fmt.Sprintf("minted-%d", install), now.Add(time.Hour), nil
+		},
+		Clock:        timeutils.FixedClock(now).Now,
+		BatchWorkers: 2,
+	}
+	req := GetInstallTokensRequest{
+		App:      appId,
+		Installs: []uint64{1, 2, 3, 4, 3},
+	}
+	resp, err := service.GetInstallTokens(&req, &logger)
+	if err != nil {
+		t.Fatalf("Failed to get install tokens: %s", err)
+	}
+	expected := map[uint64]string{
+		1: "cached-1",
+		2: "minted-2",
+		3: "minted-3",
+	}
+	for install, token := range expected {
+		if got := resp.Tokens[install]; got == nil || got.Token != token {
+			t.Errorf("Install %d has token %v instead of %s", install, got, token)
+		}
+	}
+	if len(resp.Tokens) != len(expected) {
+		t.Errorf("Got %d tokens instead of %d", len(resp.Tokens), len(expected))
+	}
+	if len(resp.Errors) != 1 || resp.Errors[4] == nil {
+		t.Errorf("Expected only install 4 to fail but got errors %v", resp.Errors)
+	}
+	if minted[1] != 0 || minted[3] != 1 {
+		t.Errorf("Minted tokens %v", minted)
+	}
+	if _, err := service.GetInstallTokens(&GetInstallTokensRequest{}, &logger); err != UnallowedAppId(0) {
+		t.Errorf("Got tokens for app 0: %v", err)
+	}
+}
+
+// countingMetrics counts counter increments by name and tag values
+type countingMetrics struct {
+	mu       sync.Mutex
+	Counters map[string]int
+}
+
+func (m *countingMetrics) IncrCounter(name string, tags ...metrics.Tag) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, tag := range tags {
+		name += "," + tag.Value
+	}
+	m.Counters[name]++
+}
+
+func (m *countingMetrics) ObserveLatency(name string, d time.Duration) {}
+
+func TestInstallTokenStats(t *testing.T) {
+	const appId = 1
+	const installId = 2
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	provider := StubProviders{
+		AppJwt:            GenJwtToken(appId),
+		InstallToken:      GenInstallToken(),
+		InstallExpiration: now.Add(time.Hour),
+	}
+	recorder := countingMetrics{Counters: make(map[string]int)}
+	service := InstallTokenService{
+		TokenMessageStore:    NewMemTokenStore(),
+		SigningService:       &provider,
+		InstallTokenProvider: provider.InstallTokenProvider,
+		Clock:                func() time.Time { return now },
+		Metrics:              &recorder,
+	}
+	req := tokenpb.GetInstallTokenRequest{
+		App:     appId,
+		Install: installId,
+	}
+	steps := []struct {
+		Name     string
+		Advance  time.Duration
+		Expected InstallTokenStats
+	}{
+		{"cold", 0, InstallTokenStats{Misses: 1, Mints: 1}},
+		{"cached", 0, InstallTokenStats{Hits: 1, Misses: 1, Mints: 1}},
+		{"expired", 2 * time.Hour, InstallTokenStats{Hits: 1, Misses: 1, Refreshes: 1, Mints: 2}},
+	}
+	for _, step := range steps {
+		now = now.Add(step.Advance)
+		provider.InstallExpiration = now.Add(time.Hour)
+		if _, err := service.GetInstallToken(&req, &logger); err != nil {
+			t.Fatalf("%s: failed to get token: %s", step.Name, err)
+		}
+		if stats := service.Stats(); stats != step.Expected {
+			t.Fatalf("%s: stats are %+v instead of %+v", step.Name, stats, step.Expected)
+		}
+	}
+	if _, err := service.MintInstallToken(context.Background(), appId, installId, nil, &logger); err != nil {
+		t.Fatalf("Failed to mint token: %s", err)
+	}
+	if stats := service.Stats(); stats.Mints != 3 {
+		t.Fatalf("Minting gave %d mints instead of 3", stats.Mints)
+	}
+	expectedCounters := map[string]int{
+		metrics.METRIC_INSTALL_TOKEN_CACHE + "," + metrics.CACHE_HIT:     1,
+		metrics.METRIC_INSTALL_TOKEN_CACHE + "," + metrics.CACHE_MISS:    1,
+		metrics.METRIC_INSTALL_TOKEN_CACHE + "," + metrics.CACHE_REFRESH: 1,
+		metrics.METRIC_MINT_INSTALL_TOKEN:                                3,
+	}
+	for name, count := range expectedCounters {
+		if recorder.Counters[name] != count {
+			t.Errorf("Counter %s is %d instead of %d", name, recorder.Counters[name], count)
+		}
+	}
+}
+
+func TestDeleteAppTokens(t *testing.T) {
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	store := NewMemTokenStore()
+	pbexp, err := ptypes.TimestampProto(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to convert expiration: %s", err)
+	}
+	for _, app := range []uint64{1, 10} {
+		_, err = store.PutAppToken(&tokenpb.AppToken{App: app, Token: GenJwtToken(app), Expiration: pbexp})
+		if err != nil {
+			t.Fatalf("Failed to put app token: %s", err)
+		}
+		for install := uint64(1); install <= 3; install++ {
+			_, err = store.PutInstallToken(&tokenpb.InstallToken{App: app, Install: install, Token: GenInstallToken(), Expiration: pbexp})
+			if err != nil {
+				t.Fatalf("Failed to put install token: %s", err)
+			}
+		}
+	}
+	scope := InstallTokenScope{Repositories: []string{"repo"}}
+	_, err = store.PutScopedInstallToken(&tokenpb.InstallToken{App: 1, Install: 1, Token: GenInstallToken(), Expiration: pbexp}, &scope)
+	if err != nil {
+		t.Fatalf("Failed to put scoped install token: %s", err)
+	}
+	deleted, err := store.DeleteAppTokens(1, &logger)
+	if err != nil {
+		t.Fatalf("Failed to delete app tokens: %s", err)
+	}
+	if deleted != 5 {
+		t.Errorf("Deleted %d tokens instead of 5", deleted)
+	}
+	for install := uint64(1); install <= 3; install++ {
+		if _, _, err := store.GetInstallToken(1, install); !messagestore.IsNotFound(err) {
+			t.Errorf("Install %d token of app 1 not deleted: %v", install, err)
+		}
+		if _, _, err := store.GetInstallToken(10, install); err != nil {
+			t.Errorf("Install %d token of app 10 deleted: %v", install, err)
+		}
+	}
+	if _, _, err := store.GetAppToken(1); !messagestore.IsNotFound(err) {
+		t.Errorf("App token not deleted: %v", err)
+	}
+	if deleted, err = store.DeleteAppTokens(1, &logger); err != nil || deleted != 0 {
+		t.Errorf("Deleting tokens again deleted %d, %v", deleted, err)
+	}
+	appName, err := store.AppTokenName(10)
+	if err != nil {
+		t.Fatalf("Failed to name app token: %s", err)
+	}
+	blobStore := store.MessageStore.(*messagestore.BlobMessageStore)
+	if _, err = blobStore.PutBlob(appName, []byte("not a token")); err != nil {
+		t.Fatalf("Failed to corrupt app token: %s", err)
+	}
+	if deleted, err = store.DeleteAppTokens(10, &logger); err != nil || deleted != 4 {
+		t.Errorf("Deleting tokens with an undecodable app token deleted %d, %v", deleted, err)
+	}
+	if _, _, err = blobStore.GetBlob(appName); !messagestore.IsNotFound(err) {
+		t.Errorf("Undecodable app token not deleted: %v", err)
+	}
+	store.Links.InstallTokens = "tokens/installs/{InstallId}/{AppId}"
+	if _, err = store.DeleteAppTokens(1, &logger); err != AppPrefixUnsupported(store.Links.InstallTokens) {
+		t.Errorf("Expected unsupported prefix but got %v", err)
+	}
+}
+
+func TestFailureLogsFormatted(t *testing.T) {
+	const appId = 1
+	const installId = 2
+	var buf bytes.Buffer
+	logger := (*kslog.LogLogger)(log.New(&buf, "", 0))
+	provider := StubProviders{
+		AppJwt: "not-a-jwt",
+	}
+	service := InstallTokenService{
+		TokenMessageStore:    NewMemTokenStore(),
+		SigningService:       &provider,
+		InstallTokenProvider: provider.InstallTokenProvider,
+	}
+	req := tokenpb.GetInstallTokenRequest{
+		App:     appId,
+		Install: installId,
+	}
+	_, err := service.GetInstallToken(&req, logger)
+	if _, ok := err.(*ReceivedInvalidToken); !ok {
+		t.Fatalf("Expected ReceivedInvalidToken but got %v", err)
+	}
+	if provider.InstallTokenCalls != 0 {
+		t.Fatalf("Requested install token with invalid app token")
+	}
+	now := time.Now().UTC()
+	pbexp, err := ptypes.TimestampProto(now.Add(30 * time.Second))
+	if err != nil {
+		t.Fatalf("Failed to convert expiration: %s", err)
+	}
+	_, err = service.PutInstallToken(&tokenpb.InstallToken{
+		App:        appId,
+		Install:    installId,
+		Token:      GenInstallToken(),
+		Expiration: pbexp,
+	})
+	if err != nil {
+		t.Fatalf("Failed to put install token: %s", err)
+	}
+	service.RefreshThreshold = time.Minute
+	if _, err = service.GetInstallToken(&req, logger); err != nil {
+		t.Fatalf("Failed refresh did not fall back to cached token: %s", err)
+	}
+	output := buf.String()
+	if strings.Contains(output, "%!") {
+		t.Fatalf("Logs have malformed formatting:\n%s", output)
+	}
+	if !strings.Contains(output, "using cached token: ") {
+		t.Fatalf("Fallback to cached token did not log its cause:\n%s", output)
+	}
+}
+
+func TestGetInstallTokenClockSkew(t *testing.T) {
+	const appId = 1
+	const installId = 2
+	const skew = 5 * time.Minute
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		Name        string
+		Expiration  time.Time
+		ExpectCalls int
+	}{
+		{"beyond skew", now.Add(skew + time.Second), 0},
+		{"at skew", now.Add(skew), 0},
+		{"within skew", now.Add(skew - time.Nanosecond), 1},
+		{"expired", now.Add(-time.Second), 1},
+	}
+	for _, c := range cases {
+		provider := StubProviders{
+			AppJwt:            GenJwtToken(appId),
+			InstallToken:      GenInstallToken(),
+			InstallExpiration: now.Add(time.Hour),
+		}
+		store := NewMemTokenStore()
+		pbexp, err := ptypes.TimestampProto(c.Expiration)
+		if err != nil {
+			t.Fatalf("Failed to convert expiration: %s", err)
+		}
+		cachedToken := tokenpb.InstallToken{
+			App:        appId,
+			Install:    installId,
+			Token:      GenInstallToken(),
+			Expiration: pbexp,
+		}
+		if _, err = store.PutInstallToken(&cachedToken); err != nil {
+			t.Fatalf("Failed to put install token: %s", err)
+		}
+		service := InstallTokenService{
+			TokenMessageStore:    store,
+			SigningService:       &provider,
+			InstallTokenProvider: provider.InstallTokenProvider,
+			Clock:                timeutils.FixedClock(now).Now,
+			ClockSkew:            skew,
+		}
+		req := tokenpb.GetInstallTokenRequest{
+			App:     appId,
+			Install: installId,
+		}
+		resp, err := service.GetInstallToken(&req, &logger)
+		if err != nil {
+			t.Fatalf("%s: failed to get token: %s", c.Name, err)
+		}
+		if provider.InstallTokenCalls != c.ExpectCalls {
+			t.Fatalf("%s: install token provider called %d times instead of %d", c.Name, provider.InstallTokenCalls, c.ExpectCalls)
+		}
+		if c.ExpectCalls == 0 && resp.Token.Token != cachedToken.Token {
+			t.Fatalf("%s: got token %s instead of cached token %s", c.Name, resp.Token.Token, cachedToken.Token)
+		}
+	}
+}
+
+// failingPutStore is a MessageStore whose puts of Name fail with Err
+type failingPutStore struct {
+	messagestore.MessageStore
+	Name string
+	Err  error
+}
+
+func (s *failingPutStore) PutMessage(name string, pb proto.Message) (*messagestore.CacheMeta, error) {
+	if name == s.Name {
+		return nil, &messagestore.PutResourceError{
+			Name:  name,
+			Cause: s.Err,
+		}
+	}
+	return s.MessageStore.PutMessage(name, pb)
+}
+
+func TestRequirePersist(t *testing.T) {
+	const appId = 1
+	const installId = 2
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	for _, requirePersist := range []bool{false, true} {
+		provider := StubProviders{
+			AppJwt:            GenJwtToken(appId),
+			InstallToken:      GenInstallToken(),
+			InstallExpiration: time.Now().Add(time.Hour).UTC().Truncate(time.Second),
+		}
+		tokenStore := NewMemTokenStore()
+		installName, err := tokenStore.InstallTokenName(appId, installId)
+		if err != nil {
+			t.Fatalf("Failed to name install token: %s", err)
+		}
+		tokenStore.MessageStore = &failingPutStore{
+			MessageStore: tokenStore.MessageStore,
+			Name:         installName,
+			Err:          errors.New("store unavailable"),
+		}
+		service := InstallTokenService{
+			TokenMessageStore:    tokenStore,
+			SigningService:       &provider,
+			InstallTokenProvider: provider.InstallTokenProvider,
+			RequirePersist:       requirePersist,
+		}
+		req := tokenpb.GetInstallTokenRequest{
+			App:     appId,
+			Install: installId,
+		}
+		resp, err := service.GetInstallToken(&req, &logger)
+		if !requirePersist {
+			if err != nil || resp.Token.Token != provider.InstallToken {
+				t.Fatalf("Best effort caching did not return token: %v, %v", resp, err)
+			}
+			continue
+		}
+		notPersisted, ok := err.(*TokenNotPersisted)
+		if !ok {
+			t.Fatalf("Expected TokenNotPersisted but got %v, %v", resp, err)
+		}
+		if notPersisted.App != appId || notPersisted.Install != installId {
+			t.Fatalf("Token of app %d install %d not persisted", notPersisted.App, notPersisted.Install)
+		}
+	}
+}
+
+type recordingFailureSink struct {
+	Failures []*TokenFailure
+}
+
+func (s *recordingFailureSink) RecordFailure(failure *TokenFailure) error {
+	s.Failures = append(s.Failures, failure)
+	return nil
+}
+
+func TestFailureSink(t *testing.T) {
+	const appId = 1
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	provider := StubProviders{
+		AppJwt:            GenJwtToken(appId),
+		InstallToken:      GenInstallToken(),
+		InstallExpiration: now.Add(time.Hour),
+	}
+	tokenStore := NewMemTokenStore()
+	persistName, err := tokenStore.InstallTokenName(appId, 3)
+	if err != nil {
+		t.Fatalf("Failed to name install token: %s", err)
+	}
+	tokenStore.MessageStore = &failingPutStore{
+		MessageStore: tokenStore.MessageStore,
+		Name:         persistName,
+		Err:          errors.New("store unavailable"),
+	}
+	sink := recordingFailureSink{}
+	service := InstallTokenService{
+		TokenMessageStore: tokenStore,
+		SigningService:    &provider,
+		InstallTokenProvider: func(install uint64, appToken string) (string, time.Time, error) {
+			if install == 2 {
+				return "", time.Time{}, errors.New("install suspended")
+			}
+			return provider.InstallTokenProvider(install, appToken)
+		},
+		Clock:       func() time.Time { return now },
+		FailureSink: &sink,
+	}
+	if _, err = service.GetInstallToken(&tokenpb.GetInstallTokenRequest{App: appId, Install: 2}, &logger); err == nil {
+		t.Fatalf("Got token of failing install")
+	}
+	if _, err = service.GetInstallToken(&tokenpb.GetInstallTokenRequest{App: appId, Install: 3}, &logger); err != nil {
+		t.Fatalf("Failed to get unpersisted token: %s", err)
+	}
+	if _, err = service.GetInstallToken(&tokenpb.GetInstallTokenRequest{App: appId, Install: 4}, &logger); err != nil {
+		t.Fatalf("Failed to get token: %s", err)
+	}
+	expected := []TokenFailure{
+		{App: appId, Install: 2, Stage: FAILURE_STAGE_MINT, Reason: "install suspended", Time: now},
+		{App: appId, Install: 3, Stage: FAILURE_STAGE_PERSIST, Time: now},
+	}
+	if len(sink.Failures) != len(expected) {
+		t.Fatalf("Recorded failures %v instead of %v", sink.Failures, expected)
+	}
+	for i, failure := range sink.Failures {
+		e := expected[i]
+		if failure.App != e.App || failure.Install != e.Install || failure.Stage != e.Stage || !failure.Time.Equal(e.Time) {
+			t.Errorf("Recorded failure %v instead of %v", failure, e)
+		}
+		if e.Reason != "" && failure.Reason != e.Reason {
+			t.Errorf("Recorded reason %q instead of %q", failure.Reason, e.Reason)
+		}
+	}
+}
+
+func TestMessageFailureSink(t *testing.T) {
+	backend := messagestore.NewMemMessageStore()
+	sink := MessageFailureSink{
+		Store: backend,
+	}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	failure := TokenFailure{
+		App:     1,
+		Install: 2,
+		Stage:   FAILURE_STAGE_MINT,
+		Reason:  "install suspended",
+		Time:    now,
+	}
+	for i := 0; i < 2; i++ {
+		if err := sink.RecordFailure(&failure); err != nil {
+			t.Fatalf("Failed to record failure: %s", err)
+		}
+	}
+	names, err := backend.ListMessages(DEFAULT_FAILURE_PREFIX)
+	if err != nil {
+		t.Fatalf("Failed to list failures: %s", err)
+	}
+	if len(names) != 2 || names[0] == names[1] || !strings.HasPrefix(names[0], DEFAULT_FAILURE_PREFIX+"1/2/") {
+		t.Fatalf("Recorded failures as %q", names)
+	}
+	var record structpb.Struct
+	if _, err = backend.GetMessage(names[0], &record); err != nil {
+		t.Fatalf("Failed to get failure record: %s", err)
+	}
+	fields := record.Fields
+	if fields["app"].GetNumberValue() != 1 || fields["install"].GetNumberValue() != 2 ||
+		fields["stage"].GetStringValue() != FAILURE_STAGE_MINT || fields["reason"].GetStringValue() != failure.Reason ||
+		fields["time"].GetStringValue() != "2020-01-01T00:00:00Z" {
+		t.Fatalf("Recorded failure as %v", fields)
+	}
+}
+
+func TestInstallTokenAppPolicy(t *testing.T) {
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	provider := StubProviders{
+		AppJwt:            GenJwtToken(1),
+		InstallToken:      GenInstallToken(),
+		InstallExpiration: time.Now().Add(time.Hour).UTC().Truncate(time.Second),
+	}
+	service := InstallTokenService{
+		TokenMessageStore:    NewMemTokenStore(),
+		SigningService:       &provider,
+		InstallTokenProvider: provider.InstallTokenProvider,
+		AppPolicy:            keyservice.AllowList{1: true},
+	}
+	if _, err := service.GetInstallToken(&tokenpb.GetInstallTokenRequest{App: 1, Install: 2}, &logger); err != nil {
+		t.Fatalf("Failed to get token of allowed app: %s", err)
+	}
+	_, err := service.GetInstallToken(&tokenpb.GetInstallTokenRequest{App: 3, Install: 2}, &logger)
+	if notAllowed, ok := err.(*keyservice.AppNotAllowed); !ok || notAllowed.App != 3 {
+		t.Fatalf("Expected AppNotAllowed(3) but got %v", err)
+	}
+	if !strings.Contains(err.Error(), "allow list") {
+		t.Errorf("Rejection %q does not describe the policy", err)
+	}
+	if _, err = service.MintInstallToken(context.Background(), 3, 2, nil, &logger); err == nil {
+		t.Fatalf("Minted token of rejected app")
+	}
+	if provider.InstallTokenCalls != 1 {
+		t.Fatalf("Install token provider called %d times instead of 1", provider.InstallTokenCalls)
+	}
+}
+
+func TestExpiryJitter(t *testing.T) {
+	const jitter = 10 * time.Minute
+	const nTokens = 100
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	expiration := time.Date(2020, 1, 1, 1, 0, 0, 0, time.UTC)
+	pbexp, err := ptypes.TimestampProto(expiration)
+	if err != nil {
+		t.Fatalf("Failed to convert expiration: %s", err)
+	}
+	service := InstallTokenService{
+		Clock:        timeutils.FixedClock(expiration.Add(-jitter / 2)).Now,
+		ExpiryJitter: jitter,
+	}
+	distinct := make(map[time.Time]bool)
+	valid := 0
+	for i := 0; i < nTokens; i++ {
+		token := tokenpb.InstallToken{
+			Token:      GenInstallToken(),
+			Expiration: pbexp,
+		}
+		effective, err := service.effectiveExpiration(&token)
+		if err != nil {
+			t.Fatalf("Failed to get effective expiration: %s", err)
+		}
+		if effective.After(expiration) || effective.Before(expiration.Add(-jitter)) {
+			t.Fatalf("Effective expiration %s outside jitter window of %s", effective, expiration)
+		}
+		if again, _ := service.effectiveExpiration(&token); !again.Equal(effective) {
+			t.Fatalf("Effective expiration changed from %s to %s", effective, again)
+		}
+		distinct[effective] = true
+		if service.installTokenIsValid(&token, &logger) {
+			valid++
+		}
+	}
+	if len(distinct) < nTokens/2 {
+		t.Errorf("Only %d distinct effective expirations of %d tokens", len(distinct), nTokens)
+	}
+	if valid == 0 || valid == nTokens {
+		t.Errorf("%d of %d tokens valid midway through the jitter window", valid, nTokens)
+	}
+	service.ExpiryJitter = 0
+	token := tokenpb.InstallToken{
+		Token:      GenInstallToken(),
+		Expiration: pbexp,
+	}
+	if effective, _ := service.effectiveExpiration(&token); !effective.Equal(expiration) {
+		t.Errorf("Effective expiration without jitter is %s instead of %s", effective, expiration)
+	}
+}
+
+func TestGetInstallTokenUnknownApp(t *testing.T) {
+	const appId = 1
+	const unknownAppId = 2
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	keyService, _ := seedKeyService(t, appId, &logger)
+	provider := StubProviders{
+		InstallToken:      GenInstallToken(),
+		InstallExpiration: time.Now().Add(time.Hour).UTC().Truncate(time.Second),
+	}
+	service := InstallTokenService{
+		TokenMessageStore:    NewMemTokenStore(),
+		SigningService:       keyService,
+		InstallTokenProvider: provider.InstallTokenProvider,
+		AppPolicy:            appkeystore.KnownApps{Store: keyService.Store},
+	}
+	_, err := service.GetInstallToken(&tokenpb.GetInstallTokenRequest{App: unknownAppId, Install: 3}, &logger)
+	if noApp, ok := err.(appkeystore.NoSuchApp); !ok || uint64(noApp) != unknownAppId {
+		t.Fatalf("Expected NoSuchApp(%d) but got %v", unknownAppId, err)
+	}
+	if appkeystore.ErrorCode(err) != appkeystore.CODE_APP_NOT_FOUND {
+		t.Errorf("Unknown app has error code %s", appkeystore.ErrorCode(err))
+	}
+	if provider.InstallTokenCalls != 0 {
+		t.Fatalf("Install token provider called for unknown app")
+	}
+	if _, err = service.GetInstallToken(&tokenpb.GetInstallTokenRequest{App: appId, Install: 3}, &logger); err != nil {
+		t.Fatalf("Failed to get token of known app: %s", err)
+	}
+}
+
+func TestGetInstallTokenFakeProviders(t *testing.T) {
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	clock := timeutils.FixedClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	signer := tokentest.Signer{Clock: func() time.Time { return clock.Now() }}
+	provider := tokentest.InstallTokens{
+		Clock: func() time.Time { return clock.Now() },
+		Errs:  []error{nil, fmt.Errorf("GitHub unavailable")},
+	}
+	service := InstallTokenService{
+		TokenMessageStore:    NewMemTokenStore(),
+		SigningService:       &signer,
+		InstallTokenProvider: provider.Provide,
+		Clock:                func() time.Time { return clock.Now() },
+	}
+	req := tokenpb.GetInstallTokenRequest{App: 1, Install: 2}
+	for i := 0; i < 2; i++ {
+		if _, err := service.GetInstallToken(&req, &logger); err != nil {
+			t.Fatalf("Failed to get token: %s", err)
+		}
+	}
+	if signer.Calls() != 1 || provider.Calls() != 1 {
+		t.Fatalf("Signed %d app tokens and provided %d install tokens instead of one each", signer.Calls(), provider.Calls())
+	}
+	clock = timeutils.FixedClock(clock.Now().Add(tokentest.DEFAULT_INSTALL_TOKEN_LIFETIME + time.Minute))
+	if _, err := service.GetInstallToken(&req, &logger); err == nil {
+		t.Fatalf("Refreshing expired token succeeded despite provider failure")
+	}
+	if signer.Calls() != 2 || provider.Calls() != 2 {
+		t.Fatalf("Signed %d app tokens and provided %d install tokens refreshing", signer.Calls(), provider.Calls())
+	}
+}
+
+func TestPeekInstallToken(t *testing.T) {
+	const appId = 1
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	provider := StubProviders{
+		AppJwt:            GenJwtToken(appId),
+		InstallToken:      GenInstallToken(),
+		InstallExpiration: now.Add(time.Hour),
+	}
+	store := NewMemTokenStore()
+	service := InstallTokenService{
+		TokenMessageStore:    store,
+		SigningService:       &provider,
+		InstallTokenProvider: provider.InstallTokenProvider,
+		Clock:                timeutils.FixedClock(now).Now,
+	}
+	cases := []struct {
+		Install    uint64
+		Expiration time.Time
+		Valid      bool
+	}{
+		{2, now.Add(time.Minute), true},
+		{3, now.Add(-time.Minute), false},
+	}
+	for _, c := range cases {
+		pbexp, err := ptypes.TimestampProto(c.Expiration)
+		if err != nil {
+			t.Fatalf("Failed to convert expiration: %s", err)
+		}
+		cachedToken := tokenpb.InstallToken{
+			App:        appId,
+			Install:    c.Install,
+			Token:      GenInstallToken(),
+			Expiration: pbexp,
+		}
+		if _, err = store.PutInstallToken(&cachedToken); err != nil {
+			t.Fatalf("Failed to put install token: %s", err)
+		}
+		token, valid, err := service.PeekInstallToken(appId, c.Install)
+		if err != nil {
+			t.Fatalf("Failed to peek install %d token: %s", c.Install, err)
+		}
+		if token == nil || token.Token != cachedToken.Token || valid != c.Valid {
+			t.Fatalf("Peeked install %d token %v valid %t", c.Install, token, valid)
+		}
+	}
+	token, valid, err := service.PeekInstallToken(appId, 4)
+	if token != nil || valid || err != nil {
+		t.Fatalf("Peeked missing token as %v, %t, %v", token, valid, err)
+	}
+	if provider.InstallTokenCalls != 0 {
+		t.Fatalf("Peeking provisioned %d tokens", provider.InstallTokenCalls)
+	}
+	if _, _, err = store.GetAppToken(appId); !messagestore.IsNotFound(err) {
+		t.Fatalf("Peeking cached an app token: %v", err)
+	}
+	if _, _, err = store.GetInstallToken(appId, 3); err != nil {
+		t.Fatalf("Peeking evicted the expired token: %s", err)
+	}
+}
+
+func TestDocumentType(t *testing.T) {
+	store := NewMemTokenStore()
+	appName, _ := store.AppTokenName(1)
+	installName, _ := store.InstallTokenName(1, 2)
+	scopedName, _ := store.ScopedInstallTokenName(1, 2, &InstallTokenScope{Repositories: []string{"repo"}})
+	cases := map[string]string{
+		appName:      DOCTYPE_APP_TOKEN,
+		installName:  DOCTYPE_INSTALL_TOKEN,
+		scopedName:   DOCTYPE_INSTALL_TOKEN,
+		LINKS_NAME:   "",
+		"apps/1/app": "",
+	}
+	for name, expected := range cases {
+		if docType := store.DocumentType(name); docType != expected {
+			t.Errorf("Document %s has type %q instead of %q", name, docType, expected)
+		}
+	}
+}
+
+func TestWarmInstallTokens(t *testing.T) {
+	const appId = 1
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	provider := StubProviders{
+		AppJwt: GenJwtToken(appId),
+	}
+	var mu sync.Mutex
+	minted := make(map[uint64]int)
+	service := InstallTokenService{
+		TokenMessageStore: NewMemTokenStore(),
+		SigningService:    &provider,
+		InstallTokenProvider: func(install uint64, appToken string) (string, time.Time, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			minted[install]++
+			if install == 5 {
+				return "", time.Time{}, fmt.Errorf("install suspended")
+			}
+			return GenInstallToken(), time.Now().Add(time.Hour), nil
+		},
+		BatchWorkers: 2,
+	}
+	installs := []uint64{1, 2, 3, 4}
+	if err := service.WarmInstallTokens(appId, installs, &logger); err != nil {
+		t.Fatalf("Failed to warm install tokens: %s", err)
+	}
+	if err := service.WarmInstallTokens(appId, installs, &logger); err != nil {
+		t.Fatalf("Failed to warm install tokens again: %s", err)
+	}
+	for _, install := range installs {
+		req := tokenpb.GetInstallTokenRequest{
+			App:     appId,
+			Install: install,
+		}
+		if _, err := service.GetInstallToken(&req, &logger); err != nil {
+			t.Fatalf("Failed to get warmed install %d token: %s", install, err)
+		}
+		if minted[install] != 1 {
+			t.Errorf("Minted %d tokens for warmed install %d", minted[install], install)
+		}
+	}
+	err := service.WarmInstallTokens(appId, []uint64{4, 5}, &logger)
+	notWarmed, ok := err.(*InstallTokensNotWarmed)
+	if !ok {
+		t.Fatalf("Expected InstallTokensNotWarmed but got %v", err)
+	}
+	if _, failed := notWarmed.Errors[5]; !failed || len(notWarmed.Errors) != 1 || notWarmed.App != appId {
+		t.Fatalf("Failed to warm app %d installs %v", notWarmed.App, notWarmed.Errors)
+	}
+}
+
+func TestGetInstallTokenLogsDecision(t *testing.T) {
+	const appId = 1
+	const installId = 2
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	logger := kslog.NewJSONLogger(&buf)
+	provider := StubProviders{
+		AppJwt:            GenJwtToken(appId),
+		InstallToken:      GenInstallToken(),
+		InstallExpiration: now.Add(time.Hour),
+	}
+	failMinting := false
+	service := InstallTokenService{
+		TokenMessageStore: NewMemTokenStore(),
+		SigningService:    &provider,
+		InstallTokenProvider: func(install uint64, appToken string) (string, time.Time, error) {
+			if failMinting {
+				return "", time.Time{}, fmt.Errorf("provider unavailable")
+			}
+			return provider.InstallTokenProvider(install, appToken)
+		},
+		Clock: timeutils.FixedClock(now).Now,
+	}
+	cases := []struct {
+		App              uint64
+		RefreshThreshold time.Duration
+		FailMinting      bool
+		Decision         string
+	}{
+		{appId, 0, false, TOKEN_DECISION_MINT},
+		{appId, 0, false, TOKEN_DECISION_HIT},
+		{appId, 2 * time.Hour, false, TOKEN_DECISION_REFRESH},
+		{appId, 2 * time.Hour, true, TOKEN_DECISION_SERVE_STALE},
+		{0, 0, false, TOKEN_DECISION_ERROR},
+	}
+	for _, c := range cases {
+		buf.Reset()
+		service.RefreshThreshold = c.RefreshThreshold
+		failMinting = c.FailMinting
+		req := tokenpb.GetInstallTokenRequest{
+			App:     c.App,
+			Install: installId,
+		}
+		_, err := service.GetInstallToken(&req, logger)
+		if (err != nil) != (c.Decision == TOKEN_DECISION_ERROR) {
+			t.Fatalf("Unexpected result of %s: %v", c.Decision, err)
+		}
+		var record map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			var logged map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &logged); err != nil {
+				t.Fatalf("Log line is not JSON: %s", line)
+			}
+			if logged["msg"] == "Served install token" {
+				record = logged
+			}
+		}
+		if record == nil {
+			t.Fatalf("No decision logged for %s:\n%s", c.Decision, buf.String())
+		}
+		if record["decision"] != c.Decision || record["level"] != "debug" || record["app"] != float64(c.App) || record["install"] != float64(installId) {
+			t.Errorf("Expected decision %s but logged %v", c.Decision, record)
+		}
+		remaining, found := record["remaining"]
+		if c.Decision == TOKEN_DECISION_ERROR {
+			if found {
+				t.Errorf("Logged remaining validity of failed request: %v", record)
+			}
+		} else if remaining != float64(3600) {
+			t.Errorf("Expected 3600 seconds remaining for %s but logged %v", c.Decision, remaining)
+		}
+	}
+}
+
+func TestGetInstallTokenWithKey(t *testing.T) {
+	const appId = 1
+	const installId = 2
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	keyService, rsaKey := seedKeyService(t, appId, &logger)
+	fingerprint, err := keyutils.SignerFingerprint(rsaKey)
+	if err != nil {
+		t.Fatalf("Failed to derive fingerprint: %s", err)
+	}
+	provider := StubProviders{
+		InstallToken:      GenInstallToken(),
+		InstallExpiration: time.Now().Add(time.Hour),
+	}
+	service := InstallTokenService{
+		TokenMessageStore:    NewMemTokenStore(),
+		SigningService:       keyService,
+		InstallTokenProvider: provider.InstallTokenProvider,
+	}
+	req := tokenpb.GetInstallTokenRequest{
+		App:     appId,
+		Install: installId,
+	}
+	for _, attempt := range []string{"mint", "cache hit"} {
+		resp, key, err := service.GetInstallTokenWithKey(&req, &logger)
+		if err != nil {
+			t.Fatalf("Failed to get token on %s: %s", attempt, err)
+		}
+		if resp.Token.Token != provider.InstallToken {
+			t.Fatalf("Got token %s on %s instead of %s", resp.Token.Token, attempt, provider.InstallToken)
+		}
+		if key != fingerprint {
+			t.Errorf("Got key fingerprint %q on %s instead of %s", key, attempt, fingerprint)
+		}
+	}
+	if provider.InstallTokenCalls != 1 {
+		t.Fatalf("Install token provider called %d times instead of once", provider.InstallTokenCalls)
+	}
+	_, meta, err := service.TokenMessageStore.GetInstallToken(appId, installId)
+	if err != nil {
+		t.Fatalf("Failed to get cached token: %s", err)
+	}
+	if persisted := InstallTokenKeyFromMeta(meta); persisted != fingerprint {
+		t.Errorf("Persisted key fingerprint %q instead of %s", persisted, fingerprint)
+	}
+
+	// A token which could not be put still has the fingerprint it was minted with
+	tokenStore := NewMemTokenStore()
+	installName, err := tokenStore.InstallTokenName(appId, installId)
+	if err != nil {
+		t.Fatalf("Failed to name install token: %s", err)
+	}
+	tokenStore.MessageStore = &failingPutStore{
+		MessageStore: tokenStore.MessageStore,
+		Name:         installName,
+		Err:          errors.New("store unavailable"),
+	}
+	service.TokenMessageStore = tokenStore
+	_, key, err := service.GetInstallTokenWithKey(&req, &logger)
+	if err != nil {
+		t.Fatalf("Failed to get unpersisted token: %s", err)
+	}
+	if key != fingerprint {
+		t.Errorf("Got key fingerprint %q of unpersisted token instead of %s", key, fingerprint)
+	}
+}
+
+func TestScopedInstallTokenRecordsKey(t *testing.T) {
+	const appId = 1
+	const installId = 2
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	keyService, rsaKey := seedKeyService(t, appId, &logger)
+	fingerprint, err := keyutils.SignerFingerprint(rsaKey)
+	if err != nil {
+		t.Fatalf("Failed to derive fingerprint: %s", err)
+	}
+	store := NewMemTokenStore()
+	service := InstallTokenService{
+		TokenMessageStore: store,
+		SigningService:    keyService,
+		ScopedInstallTokenProvider: func(install uint64, appToken string, scope *InstallTokenScope) (string, time.Time, error) {
+			return GenInstallToken(), time.Now().Add(time.Hour), nil
+		},
+	}
+	scope := &InstallTokenScope{
+		Permissions: map[string]string{
+			"contents": "read",
+		},
+	}
+	token, err := service.GetScopedInstallToken(context.Background(), appId, installId, scope, &logger)
+	if err != nil {
+		t.Fatalf("Failed to get scoped token: %s", err)
+	}
+	cached, meta, err := store.GetScopedInstallToken(appId, installId, scope)
+	if err != nil || cached.Token != token.Token {
+		t.Fatalf("Cached scoped token as %v, %v instead of %s", cached, err, token.Token)
+	}
+	if persisted := InstallTokenKeyFromMeta(meta); persisted != fingerprint {
+		t.Errorf("Persisted key fingerprint %q of scoped token instead of %s", persisted, fingerprint)
+	}
+	if scopeBack, err := InstallTokenScopeFromMeta(meta); err != nil || scopeBack.String() != scope.String() {
+		t.Errorf("Persisted scope %v, %v instead of %s", scopeBack, err, scope)
+	}
+}
+
+func TestGetInstallTokenRateLimit(t *testing.T) {
+	const appId = 1
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	reset := now.Add(10 * time.Minute)
+	provider := StubProviders{
+		AppJwt: GenJwtToken(appId),
+	}
+	store := NewMemTokenStore()
+	// Expired by the ClockSkew, but still accepted by GitHub
+	pbexp, err := ptypes.TimestampProto(now.Add(30 * time.Second))
+	if err != nil {
+		t.Fatalf("Failed to convert expiration: %s", err)
+	}
+	cachedToken := tokenpb.InstallToken{
+		App:        appId,
+		Install:    2,
+		Token:      GenInstallToken(),
+		Expiration: pbexp,
+	}
+	if _, err = store.PutInstallToken(&cachedToken); err != nil {
+		t.Fatalf("Failed to put install token: %s", err)
+	}
+	calls := 0
+	service := InstallTokenService{
+		TokenMessageStore: store,
+		SigningService:    &provider,
+		InstallTokenProvider: func(install uint64, appToken string) (string, time.Time, error) {
+			calls++
+			return "", time.Time{}, &RateLimitError{Reset: reset}
+		},
+		Clock:     timeutils.FixedClock(now).Now,
+		ClockSkew: time.Minute,
+	}
+	resp, err := service.GetInstallToken(&tokenpb.GetInstallTokenRequest{App: appId, Install: 2}, &logger)
+	if err != nil {
+		t.Fatalf("Rate limited refresh did not fall back to cached token: %s", err)
+	}
+	if resp.Token.Token != cachedToken.Token {
+		t.Fatalf("Got token %s instead of cached token %s", resp.Token.Token, cachedToken.Token)
+	}
+	_, err = service.GetInstallToken(&tokenpb.GetInstallTokenRequest{App: appId, Install: 3}, &logger)
+	rateLimit, ok := err.(*RateLimitError)
+	if !ok {
+		t.Fatalf("Expected RateLimitError without a cached token but got %v", err)
+	}
+	if retry := rateLimit.RetryAfter(now); retry != 10*time.Minute {
+		t.Fatalf("Retry after %s instead of %s", retry, 10*time.Minute)
+	}
+	if calls != 1 {
+		t.Fatalf("Provider was called %d times before the rate limit reset", calls)
+	}
+	service.Clock = timeutils.FixedClock(reset).Now
+	service.GetInstallToken(&tokenpb.GetInstallTokenRequest{App: appId, Install: 3}, &logger)
+	if calls != 2 {
+		t.Fatalf("Provider was not called after the rate limit reset")
+	}
+}
+
+func TestGetInstallTokenRateLimitPerApp(t *testing.T) {
+	const limitedApp = 1
+	const otherApp = 2
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	provider := StubProviders{
+		AppJwt:            GenJwtToken(limitedApp),
+		InstallToken:      GenInstallToken(),
+		InstallExpiration: now.Add(time.Hour),
+	}
+	// Install 2 is of the rate limited app, and install 3 of the other app
+	calls := make(map[uint64]int)
+	service := InstallTokenService{
+		TokenMessageStore: NewMemTokenStore(),
+		SigningService:    &provider,
+		InstallTokenProvider: func(install uint64, appToken string) (string, time.Time, error) {
+			calls[install]++
+			if install == 2 {
+				return "", time.Time{}, &RateLimitError{Reset: now.Add(10 * time.Minute)}
+			}
+			return provider.InstallToken, provider.InstallExpiration, nil
+		},
+		Clock: timeutils.FixedClock(now).Now,
+	}
+	req := tokenpb.GetInstallTokenRequest{App: limitedApp, Install: 2}
+	if _, err := service.GetInstallToken(&req, &logger); err == nil {
+		t.Fatalf("Got token of rate limited app")
+	}
+	if _, err := service.GetInstallToken(&req, &logger); err == nil {
+		t.Fatalf("Got token of rate limited app")
+	}
+	if calls[2] != 1 {
+		t.Fatalf("Provider was called %d times for the rate limited app", calls[2])
+	}
+	resp, err := service.GetInstallToken(&tokenpb.GetInstallTokenRequest{App: otherApp, Install: 3}, &logger)
+	if err != nil {
+		t.Fatalf("Other app was held back by the rate limit of app %d: %s", limitedApp, err)
+	}
+	if resp.Token.Token != provider.InstallToken {
+		t.Fatalf("Got token %s instead of %s", resp.Token.Token, provider.InstallToken)
+	}
+}
+
+func TestV3InstallTokenRateLimit(t *testing.T) {
+	reset := time.Now().Add(time.Hour).Truncate(time.Second)
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", fmt.Sprintf("%d", reset.Unix()))
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"message": "API rate limit exceeded"}`)
+	}))
+	defer github.Close()
+	client := V3InstallTokenClient{
+		BaseUrl: github.URL,
+		Client:  github.Client(),
+	}
+	_, _, err := client.InstallTokenProvider(1, "app-token")
+	rateLimit, ok := err.(*RateLimitError)
+	if !ok {
+		t.Fatalf("Expected RateLimitError but got %v", err)
+	}
+	if !rateLimit.Reset.Equal(reset) {
+		t.Fatalf("Rate limit resets at %s instead of %s", rateLimit.Reset, reset)
+	}
+}
+
+func TestVerifyCachedToken(t *testing.T) {
+	const appId = 1
+	const installId = 2
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	provider := StubProviders{
+		AppJwt:            GenJwtToken(appId),
+		InstallToken:      GenInstallToken(),
+		InstallExpiration: time.Now().Add(time.Hour),
+	}
+	store := NewMemTokenStore()
+	pbexp, err := ptypes.TimestampProto(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to convert expiration: %s", err)
+	}
+	cachedToken := tokenpb.InstallToken{
+		App:        appId,
+		Install:    installId,
+		Token:      GenInstallToken(),
+		Expiration: pbexp,
+	}
+	if _, err = store.PutInstallToken(&cachedToken); err != nil {
+		t.Fatalf("Failed to put install token: %s", err)
+	}
+	accept := true
+	verified := 0
+	service := InstallTokenService{
+		TokenMessageStore:    store,
+		SigningService:       &provider,
+		InstallTokenProvider: provider.InstallTokenProvider,
+		VerifyCachedToken: func(token *tokenpb.InstallToken, meta *messagestore.CacheMeta, logger kslog.KsLogger) bool {
+			verified++
+			return accept
+		},
+	}
+	req := tokenpb.GetInstallTokenRequest{
+		App:     appId,
+		Install: installId,
+	}
+	resp, err := service.GetInstallToken(&req, &logger)
+	if err != nil {
+		t.Fatalf("Failed to get install token: %s", err)
+	}
+	if resp.Token.Token != cachedToken.Token || provider.InstallTokenCalls != 0 {
+		t.Fatalf("Accepted cached token was not served")
+	}
+	accept = false
+	resp, err = service.GetInstallToken(&req, &logger)
+	if err != nil {
+		t.Fatalf("Failed to get install token: %s", err)
+	}
+	if resp.Token.Token != provider.InstallToken || provider.InstallTokenCalls != 1 {
+		t.Fatalf("Rejected cached token was served instead of a new one")
+	}
+	if verified != 2 {
+		t.Fatalf("Verified %d cached tokens instead of 2", verified)
+	}
+	stored, _, err := store.GetInstallToken(appId, installId)
+	if err != nil || stored.Token != provider.InstallToken {
+		t.Fatalf("New token was not cached: %v", err)
+	}
+}
+
+func TestPruneExpiredTokens(t *testing.T) {
+	const appId = 1
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewMemTokenStore()
+	tokens := []struct {
+		App        uint64
+		Install    uint64
+		Expiration time.Time
+	}{
+		{appId, 1, now.Add(-time.Minute)},
+		{appId, 2, now.Add(time.Minute)},
+		{appId, 3, now.Add(-time.Hour)},
+		{2, 1, now.Add(-time.Hour)},
+	}
+	for _, token := range tokens {
+		pbexp, err := ptypes.TimestampProto(token.Expiration)
+		if err != nil {
+			t.Fatalf("Failed to convert expiration: %s", err)
+		}
+		_, err = store.PutInstallToken(&tokenpb.InstallToken{
+			App:        token.App,
+			Install:    token.Install,
+			Token:      GenInstallToken(),
+			Expiration: pbexp,
+		})
+		if err != nil {
+			t.Fatalf("Failed to put install token: %s", err)
+		}
+	}
+	recordName, err := store.IdempotentInstallTokenName(appId, 2, "request-1")
+	if err != nil {
+		t.Fatalf("Failed to name idempotency record: %s", err)
+	}
+	record := IdempotencyRecord{
+		App:         appId,
+		Install:     2,
+		TokenSha256: tokenSha256(GenInstallToken()),
+	}
+	if _, err = store.PutMessage(recordName, &record); err != nil {
+		t.Fatalf("Failed to put idempotency record: %s", err)
+	}
+	// Neither a token without a value nor one of another install is pruned
+	emptyName, _ := store.InstallTokenName(appId, 4)
+	if _, err = store.PutMessage(emptyName, &tokenpb.InstallToken{App: appId, Install: 4}); err != nil {
+		t.Fatalf("Failed to put empty token: %s", err)
+	}
+	misnamedName, _ := store.InstallTokenName(appId, 5)
+	if _, err = store.PutMessage(misnamedName, &tokenpb.InstallToken{App: appId, Install: 6, Token: GenInstallToken()}); err != nil {
+		t.Fatalf("Failed to put misnamed token: %s", err)
+	}
+	service := InstallTokenService{
+		TokenMessageStore: store,
+		Clock:             timeutils.FixedClock(now).Now,
+		ClockSkew:         time.Hour,
+	}
+	pruned, err := service.PruneExpiredTokens(appId, &logger)
+	if err != nil {
+		t.Fatalf("Failed to prune tokens: %s", err)
+	}
+	if pruned != 2 {
+		t.Fatalf("Pruned %d tokens instead of 2", pruned)
+	}
+	for _, token := range tokens {
+		_, _, err := store.GetInstallToken(token.App, token.Install)
+		kept := token.App != appId || token.Expiration.After(now)
+		if kept && err != nil {
+			t.Errorf("Token of app %d install %d was pruned: %s", token.App, token.Install, err)
+		} else if !kept && !messagestore.IsNotFound(err) {
+			t.Errorf("Expired token of app %d install %d was not pruned: %v", token.App, token.Install, err)
+		}
+	}
+	if _, err = store.GetMessage(recordName, &record); err != nil {
+		t.Errorf("Idempotency record was pruned: %s", err)
+	}
+	for _, name := range []string{emptyName, misnamedName} {
+		if _, err = store.GetMessage(name, &tokenpb.InstallToken{}); err != nil {
+			t.Errorf("Document %s which is not a token of its name was pruned: %s", name, err)
+		}
+	}
+}
+
+func TestPutInstallTokenExpires(t *testing.T) {
+	store := NewMemTokenStore()
+	expiration := time.Date(2020, 1, 1, 1, 0, 0, 0, time.UTC)
+	pbexp, err := ptypes.TimestampProto(expiration)
+	if err != nil {
+		t.Fatalf("Failed to convert expiration: %s", err)
+	}
+	token := tokenpb.InstallToken{
+		App:        1,
+		Install:    2,
+		Token:      GenInstallToken(),
+		Expiration: pbexp,
+	}
+	if _, err = store.PutInstallTokenWithKey(&token, "00:11"); err != nil {
+		t.Fatalf("Failed to put install token: %s", err)
+	}
+	_, meta, err := store.GetInstallToken(1, 2)
+	if err != nil {
+		t.Fatalf("Failed to get install token: %s", err)
+	}
+	if expires := meta.Metadata[messagestore.EXPIRES_META]; expires != "2020-01-01T01:00:00Z" {
+		t.Errorf("Token put with expiry metadata %q", expires)
+	}
+	if InstallTokenKeyFromMeta(meta) != "00:11" {
+		t.Errorf("Token put without its key fingerprint")
+	}
+}
+
+func TestGetInstallTokenIdempotent(t *testing.T) {
+	const appId = 1
+	const installId = 2
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	provider := StubProviders{
+		AppJwt:            GenJwtToken(appId),
+		InstallExpiration: now.Add(time.Hour),
+	}
+	minted := 0
+	store := NewMemTokenStore()
+	service := InstallTokenService{
+		TokenMessageStore: store,
+		SigningService:    &provider,
+		InstallTokenProvider: func(install uint64, appToken string) (string, time.Time, error) {
+			minted++
+			return GenInstallToken(), provider.InstallExpiration, nil
+		},
+		Clock: func() time.Time { return now },
+		// Every cached token is refreshed, so only idempotency avoids minting
+		RefreshThreshold:  2 * time.Hour,
+		IdempotencyWindow: time.Minute,
+	}
+	req := tokenpb.GetInstallTokenRequest{
+		App:     appId,
+		Install: installId,
+	}
+	first, err := service.GetInstallTokenIdempotent(&req, "request-1", &logger)
+	if err != nil {
+		t.Fatalf("Failed to get token: %s", err)
+	}
+	retried, err := service.GetInstallTokenIdempotent(&req, "request-1", &logger)
+	if err != nil {
+		t.Fatalf("Failed to get token again: %s", err)
+	}
+	if minted != 1 || retried.Token.Token != first.Token.Token {
+		t.Fatalf("Minted %d tokens serving the same idempotency key twice", minted)
+	}
+	name, err := store.IdempotentInstallTokenName(appId, installId, "request-1")
+	if err != nil {
+		t.Fatalf("Failed to name idempotency record: %s", err)
+	}
+	var recorded IdempotencyRecord
+	meta, err := store.GetMessage(name, &recorded)
+	if err != nil {
+		t.Fatalf("Failed to get idempotency record: %s", err)
+	}
+	if recorded.TokenSha256 != tokenSha256(first.Token.Token) {
+		t.Errorf("Idempotency record does not reference the served token")
+	}
+	if expires := meta.Metadata[messagestore.EXPIRES_META]; expires != now.Add(time.Minute).Format(time.RFC3339) {
+		t.Errorf("Idempotency record expires at %s instead of the end of the window", expires)
+	}
+	other, err := service.GetInstallTokenIdempotent(&req, "request-2", &logger)
+	if err != nil {
+		t.Fatalf("Failed to get token for another key: %s", err)
+	}
+	if minted != 2 || other.Token.Token == first.Token.Token {
+		t.Fatalf("Another idempotency key was served the token of the first")
+	}
+	if err = service.InvalidateInstallToken(appId, installId, &logger); err != nil {
+		t.Fatalf("Failed to invalidate token: %s", err)
+	}
+	if _, err = service.GetInstallTokenIdempotent(&req, "request-2", &logger); err != nil {
+		t.Fatalf("Failed to get token after invalidating it: %s", err)
+	}
+	if minted != 3 {
+		t.Fatalf("Idempotency key was served its token after it was invalidated")
+	}
+	now = now.Add(2 * time.Minute)
+	if _, err = service.GetInstallTokenIdempotent(&req, "request-2", &logger); err != nil {
+		t.Fatalf("Failed to get token after the window: %s", err)
+	}
+	if minted != 4 {
+		t.Fatalf("Idempotency key was served its token after the window")
+	}
+}
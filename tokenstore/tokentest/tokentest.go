@@ -0,0 +1,171 @@
+// Fake app and install token providers for testing services which get
+// tokens, without contacting GitHub.  The providers count their calls and
+// can be programmed to fail.
+package tokentest
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aefalcon/github-keystore-protobuf/go/appkeypb"
+	"github.com/aefalcon/go-github-keystore/keyservice"
+	"github.com/aefalcon/go-github-keystore/kslog"
+)
+
+// DEFAULT_APP_TOKEN_LIFETIME is the lifetime of app tokens signed by a Signer
+// unless configured otherwise, the longest GitHub accepts
+const DEFAULT_APP_TOKEN_LIFETIME = 10 * time.Minute
+
+// DEFAULT_INSTALL_TOKEN_LIFETIME is the lifetime of install tokens given by
+// InstallTokens unless configured otherwise, as GitHub issues them
+const DEFAULT_INSTALL_TOKEN_LIFETIME = time.Hour
+
+// calls counts the calls of a fake provider and chooses their errors
+type calls struct {
+	mu    sync.Mutex
+	count int
+}
+
+// next counts a call, getting the error it fails with: the entry of errs for
+// the call if there is one, otherwise err
+func (c *calls) next(errs []error, err error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.count++
+	if c.count <= len(errs) {
+		return errs[c.count-1]
+	}
+	return err
+}
+
+func (c *calls) get() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.count
+}
+
+func now(clock func() time.Time) time.Time {
+	if clock == nil {
+		return time.Now()
+	}
+	return clock()
+}
+
+// randomToken generates a random opaque token
+func randomToken() string {
+	var token [32]byte
+	if _, err := rand.Read(token[:]); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(token[:])
+}
+
+// AppJwt creates an unsigned app JWT for an app with an `exp` claim, which
+// GitHub would reject but token services can parse
+func AppJwt(app uint64, expiration time.Time) string {
+	header, err := json.Marshal(map[string]string{
+		"typ": "JWT",
+		"alg": "RS256",
+	})
+	if err != nil {
+		panic(err)
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss": fmt.Sprintf("%d", app),
+		"exp": expiration.Unix(),
+	})
+	if err != nil {
+		panic(err)
+	}
+	return strings.Join([]string{
+		base64.RawURLEncoding.EncodeToString(header),
+		base64.RawURLEncoding.EncodeToString(claims),
+		randomToken(),
+	}, ".")
+}
+
+// Signer is a keyservice.SigningService signing fake app JWTs with AppJwt.
+// It is safe for concurrent use.
+type Signer struct {
+	Lifetime time.Duration    // Lifetime of signed tokens; defaults to DEFAULT_APP_TOKEN_LIFETIME
+	Clock    func() time.Time // Time tokens are signed at, such as a timeutils.Clock's Now; defaults to time.Now
+	Errs     []error          // Errors of successive calls; nil entries succeed
+	Err      error            // Error of calls beyond Errs, if set
+	calls    calls
+}
+
+var _ keyservice.SigningService = &Signer{}
+
+func (s *Signer) SignJwt(req *appkeypb.SignJwtRequest, logger kslog.KsLogger) (*appkeypb.SignJwtResponse, error) {
+	if err := s.calls.next(s.Errs, s.Err); err != nil {
+		return nil, err
+	}
+	lifetime := s.Lifetime
+	if lifetime == 0 {
+		lifetime = DEFAULT_APP_TOKEN_LIFETIME
+	}
+	return &appkeypb.SignJwtResponse{
+		Jwt: AppJwt(req.App, now(s.Clock).Add(lifetime)),
+	}, nil
+}
+
+// Calls gets the number of times SignJwt was called, including failures
+func (s *Signer) Calls() int {
+	return s.calls.get()
+}
+
+// InstallTokens provides fake install tokens.  Its Provide method may be used
+// as a tokenstore.InstallTokenProvider.  It is safe for concurrent use.
+type InstallTokens struct {
+	Token      string           // Token provided; a random token for each call if empty
+	Expiration time.Time        // Expiration of provided tokens; Lifetime after the call if zero
+	Lifetime   time.Duration    // Lifetime of provided tokens; defaults to DEFAULT_INSTALL_TOKEN_LIFETIME
+	Clock      func() time.Time // Time tokens are provided at, such as a timeutils.Clock's Now; defaults to time.Now
+	Errs       []error          // Errors of successive calls; nil entries succeed
+	Err        error            // Error of calls beyond Errs, if set
+	calls      calls
+	mu         sync.Mutex
+	install    uint64
+	appToken   string
+}
+
+// Provide gives an install token for an installation
+func (p *InstallTokens) Provide(install uint64, appToken string) (string, time.Time, error) {
+	p.mu.Lock()
+	p.install = install
+	p.appToken = appToken
+	p.mu.Unlock()
+	if err := p.calls.next(p.Errs, p.Err); err != nil {
+		return "", time.Time{}, err
+	}
+	token := p.Token
+	if token == "" {
+		token = randomToken()
+	}
+	expiration := p.Expiration
+	if expiration.IsZero() {
+		lifetime := p.Lifetime
+		if lifetime == 0 {
+			lifetime = DEFAULT_INSTALL_TOKEN_LIFETIME
+		}
+		expiration = now(p.Clock).Add(lifetime)
+	}
+	return token, expiration, nil
+}
+
+// Calls gets the number of times Provide was called, including failures
+func (p *InstallTokens) Calls() int {
+	return p.calls.get()
+}
+
+// LastCall gets the installation and app token of the latest call of Provide
+func (p *InstallTokens) LastCall() (uint64, string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.install, p.appToken
+}
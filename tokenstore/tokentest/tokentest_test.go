@@ -0,0 +1,92 @@
+package tokentest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aefalcon/github-keystore-protobuf/go/appkeypb"
+	"github.com/aefalcon/go-github-keystore/kslog"
+	"github.com/aefalcon/go-github-keystore/timeutils"
+)
+
+func TestSigner(t *testing.T) {
+	logger := kslog.KsTestLogger{
+		TestLogger: t,
+	}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	failure := fmt.Errorf("signing failed")
+	signer := Signer{
+		Clock: timeutils.FixedClock(now).Now,
+		Errs:  []error{nil, failure},
+	}
+	resp, err := signer.SignJwt(&appkeypb.SignJwtRequest{App: 1}, &logger)
+	if err != nil {
+		t.Fatalf("Failed to sign: %s", err)
+	}
+	parts := strings.Split(resp.Jwt, ".")
+	if len(parts) != 3 {
+		t.Fatalf("JWT has %d parts", len(parts))
+	}
+	claimsJson, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatalf("Failed to decode claims: %s", err)
+	}
+	var claims struct {
+		Iss string
+		Exp int64
+	}
+	if err = json.Unmarshal(claimsJson, &claims); err != nil {
+		t.Fatalf("Failed to parse claims: %s", err)
+	}
+	if claims.Iss != "1" || claims.Exp != now.Add(DEFAULT_APP_TOKEN_LIFETIME).Unix() {
+		t.Errorf("JWT has claims %+v", claims)
+	}
+	if _, err = signer.SignJwt(&appkeypb.SignJwtRequest{App: 1}, &logger); err != failure {
+		t.Errorf("Expected programmed error but got %v", err)
+	}
+	if _, err = signer.SignJwt(&appkeypb.SignJwtRequest{App: 1}, &logger); err != nil {
+		t.Errorf("Call after programmed errors failed: %s", err)
+	}
+	if signer.Calls() != 3 {
+		t.Errorf("Signer counted %d calls instead of 3", signer.Calls())
+	}
+}
+
+func TestInstallTokens(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	failure := fmt.Errorf("provider failed")
+	provider := InstallTokens{
+		Clock: timeutils.FixedClock(now).Now,
+		Err:   failure,
+		Errs:  []error{nil},
+	}
+	token, expiration, err := provider.Provide(2, "app-token")
+	if err != nil {
+		t.Fatalf("Failed to provide token: %s", err)
+	}
+	if token == "" || !expiration.Equal(now.Add(DEFAULT_INSTALL_TOKEN_LIFETIME)) {
+		t.Errorf("Provided token %q expiring %s", token, expiration)
+	}
+	other, _, err := provider.Provide(3, "other-app-token")
+	if err != failure || other != "" {
+		t.Errorf("Expected programmed error but got %q, %v", other, err)
+	}
+	if install, appToken := provider.LastCall(); install != 3 || appToken != "other-app-token" {
+		t.Errorf("Last call was for install %d with app token %s", install, appToken)
+	}
+	if provider.Calls() != 2 {
+		t.Errorf("Provider counted %d calls instead of 2", provider.Calls())
+	}
+	fixed := InstallTokens{
+		Token:      "fixed",
+		Expiration: now,
+	}
+	token, expiration, err = fixed.Provide(2, "app-token")
+	if err != nil || token != "fixed" || !expiration.Equal(now) {
+		t.Errorf("Fixed provider gave %q expiring %s, %v", token, expiration, err)
+	}
+}